@@ -0,0 +1,134 @@
+// Package address validates postal addresses against per-country rules.
+package address
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Elimists/go-app/models"
+)
+
+// ValidationError names the first field that failed validation.
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// Rule describes what a country's addresses must contain.
+type Rule struct {
+	PostalCode         *regexp.Regexp // nil when the country has no postal codes or they are free-form.
+	PostalCodeRequired bool
+	StateRequired      bool
+	StateLabel         string // What the country calls its subdivisions, for error messages.
+	// Format rewrites a valid postal code into its canonical form.
+	Format func(string) string
+}
+
+// Rules by ISO 3166-1 alpha-2 country code. Countries not listed only need a street, city and country.
+var Rules = map[string]Rule{
+	"US": {PostalCode: regexp.MustCompile(`^\d{5}(-\d{4})?$`), PostalCodeRequired: true, StateRequired: true, StateLabel: "state"},
+	"CA": {PostalCode: regexp.MustCompile(`^[ABCEGHJ-NPRSTVXY]\d[ABCEGHJ-NPRSTV-Z] ?\d[ABCEGHJ-NPRSTV-Z]\d$`), PostalCodeRequired: true, StateRequired: true, StateLabel: "province", Format: spaceAt(3)},
+	"GB": {PostalCode: regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`), PostalCodeRequired: true, Format: spaceBeforeLast(3)},
+	"IE": {PostalCode: regexp.MustCompile(`^([AC-FHKNPRTV-Y]\d{2}|D6W) ?[0-9AC-FHKNPRTV-Y]{4}$`), Format: spaceAt(3)},
+	"AU": {PostalCode: regexp.MustCompile(`^\d{4}$`), PostalCodeRequired: true, StateRequired: true, StateLabel: "state"},
+	"NZ": {PostalCode: regexp.MustCompile(`^\d{4}$`), PostalCodeRequired: true},
+	"DE": {PostalCode: regexp.MustCompile(`^\d{5}$`), PostalCodeRequired: true},
+	"FR": {PostalCode: regexp.MustCompile(`^\d{5}$`), PostalCodeRequired: true},
+	"ES": {PostalCode: regexp.MustCompile(`^\d{5}$`), PostalCodeRequired: true},
+	"IT": {PostalCode: regexp.MustCompile(`^\d{5}$`), PostalCodeRequired: true},
+	"NL": {PostalCode: regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`), PostalCodeRequired: true, Format: spaceAt(4)},
+	"IN": {PostalCode: regexp.MustCompile(`^[1-9]\d{5}$`), PostalCodeRequired: true, StateRequired: true, StateLabel: "state"},
+	"JP": {PostalCode: regexp.MustCompile(`^\d{3}-?\d{4}$`), PostalCodeRequired: true, StateRequired: true, StateLabel: "prefecture", Format: dashAt(3)},
+	"BR": {PostalCode: regexp.MustCompile(`^\d{5}-?\d{3}$`), PostalCodeRequired: true, StateRequired: true, StateLabel: "state", Format: dashAt(5)},
+	"MX": {PostalCode: regexp.MustCompile(`^\d{5}$`), PostalCodeRequired: true, StateRequired: true, StateLabel: "state"},
+}
+
+// Used for countries without a rule, so obvious junk is still rejected.
+var genericPostalCode = regexp.MustCompile(`^[A-Z0-9][A-Z0-9 \-]{1,9}$`)
+
+var countryCode = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// Normalize trims every field, upper cases the country and postal code and puts known postal codes in their canonical form.
+func Normalize(a *models.UserAddress) {
+	a.StreetAddress = strings.TrimSpace(a.StreetAddress)
+	a.City = strings.TrimSpace(a.City)
+	a.State = strings.TrimSpace(a.State)
+	a.Country = strings.ToUpper(strings.TrimSpace(a.Country))
+	a.ZipCode = strings.Join(strings.Fields(strings.ToUpper(a.ZipCode)), " ")
+
+	if rule, ok := Rules[a.Country]; ok && rule.Format != nil && rule.PostalCode != nil && rule.PostalCode.MatchString(a.ZipCode) {
+		a.ZipCode = rule.Format(a.ZipCode)
+	}
+}
+
+// Validate checks a normalized address and returns a *ValidationError for the first problem found.
+func Validate(a *models.UserAddress) error {
+	if !countryCode.MatchString(a.Country) {
+		return &ValidationError{Field: "country", Message: "must be a two letter ISO country code"}
+	}
+	if a.StreetAddress == "" {
+		return &ValidationError{Field: "streetAddress", Message: "is required"}
+	}
+	if a.City == "" {
+		return &ValidationError{Field: "city", Message: "is required"}
+	}
+
+	rule, known := Rules[a.Country]
+	if rule.StateRequired && a.State == "" {
+		return &ValidationError{Field: "state", Message: fmt.Sprintf("%s is required in %s", rule.StateLabel, a.Country)}
+	}
+
+	if a.ZipCode == "" {
+		if rule.PostalCodeRequired {
+			return &ValidationError{Field: "zipCode", Message: fmt.Sprintf("is required in %s", a.Country)}
+		}
+		return nil
+	}
+
+	pattern := genericPostalCode
+	if known && rule.PostalCode != nil {
+		pattern = rule.PostalCode
+	}
+	if !pattern.MatchString(a.ZipCode) {
+		return &ValidationError{Field: "zipCode", Message: fmt.Sprintf("is not a valid postal code for %s", a.Country)}
+	}
+	return nil
+}
+
+// Insert a space n characters from the start, e.g. K1A0B1 to K1A 0B1.
+func spaceAt(n int) func(string) string {
+	return func(s string) string {
+		s = strings.ReplaceAll(s, " ", "")
+		if len(s) <= n {
+			return s
+		}
+		return s[:n] + " " + s[n:]
+	}
+}
+
+// Insert a space n characters from the end, e.g. SW1A1AA to SW1A 1AA.
+func spaceBeforeLast(n int) func(string) string {
+	return func(s string) string {
+		s = strings.ReplaceAll(s, " ", "")
+		if len(s) <= n {
+			return s
+		}
+		return s[:len(s)-n] + " " + s[len(s)-n:]
+	}
+}
+
+// Insert a dash n characters from the start, e.g. 1000001 to 100-0001.
+func dashAt(n int) func(string) string {
+	return func(s string) string {
+		s = strings.ReplaceAll(s, "-", "")
+		if len(s) <= n {
+			return s
+		}
+		return s[:n] + "-" + s[n:]
+	}
+}
@@ -0,0 +1,77 @@
+package address
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Elimists/go-app/models"
+)
+
+func TestNormalizeAndValidate(t *testing.T) {
+	for _, tc := range []struct {
+		country, state, zip string
+		wantZip             string // After normalizing.
+		field               string // The field Validate should reject, or "" for valid.
+	}{
+		{"us", "NY", "10001", "10001", ""},
+		{"US", "NY", "10001-1234", "10001-1234", ""},
+		{"US", "NY", "1000", "1000", "zipCode"},
+		{"US", "", "10001", "10001", "state"},
+		{"US", "NY", "", "", "zipCode"},
+		{"CA", "ON", "k1a0b1", "K1A 0B1", ""},
+		{"CA", "ON", "K1A 0B1", "K1A 0B1", ""},
+		{"CA", "ON", "D1A 0B1", "D1A 0B1", "zipCode"}, // D is never used.
+		{"CA", "", "K1A 0B1", "K1A 0B1", "state"},
+		{"GB", "", "sw1a1aa", "SW1A 1AA", ""},
+		{"GB", "", "M1 1AE", "M1 1AE", ""},
+		{"GB", "", "SW1A", "SW1A", "zipCode"},
+		{"IE", "", "", "", ""}, // Eircodes are optional.
+		{"IE", "", "d02x285", "D02 X285", ""},
+		{"IE", "", "B02 X285", "B02 X285", "zipCode"},
+		{"AU", "NSW", "2000", "2000", ""},
+		{"AU", "", "2000", "2000", "state"},
+		{"NZ", "", "6011", "6011", ""},
+		{"DE", "", "10115", "10115", ""},
+		{"DE", "", "1011", "1011", "zipCode"},
+		{"NL", "", "1012ab", "1012 AB", ""},
+		{"NL", "", "1012 A", "1012 A", "zipCode"},
+		{"IN", "MH", "400001", "400001", ""},
+		{"IN", "MH", "040001", "040001", "zipCode"},
+		{"JP", "Tokyo", "1000001", "100-0001", ""},
+		{"JP", "", "100-0001", "100-0001", "state"},
+		{"BR", "SP", "01310100", "01310-100", ""},
+		{"MX", "CDMX", "06600", "06600", ""},
+		{"MX", "", "06600", "06600", "state"},
+		{"SE", "", "", "", ""}, // No rule: only the generic check, and only when a code is given.
+		{"SE", "", "114 55", "114 55", ""},
+		{"SE", "", "!!", "!!", "zipCode"},
+		{"USA", "NY", "10001", "10001", "country"},
+	} {
+		a := models.UserAddress{StreetAddress: " 1 Main St ", City: " Springfield ", State: tc.state, Country: tc.country, ZipCode: tc.zip}
+		Normalize(&a)
+		if a.ZipCode != tc.wantZip || a.StreetAddress != "1 Main St" || a.City != "Springfield" {
+			t.Errorf("%s %q: normalized to %+v, want postal code %q", tc.country, tc.zip, a, tc.wantZip)
+		}
+
+		err := Validate(&a)
+		var invalid *ValidationError
+		switch {
+		case tc.field == "" && err != nil:
+			t.Errorf("%s %q %q: %v, want valid", tc.country, tc.state, tc.zip, err)
+		case tc.field != "" && (!errors.As(err, &invalid) || invalid.Field != tc.field):
+			t.Errorf("%s %q %q: %v, want a %s error", tc.country, tc.state, tc.zip, err, tc.field)
+		}
+	}
+}
+
+func TestValidateRequiresStreetAndCity(t *testing.T) {
+	for field, a := range map[string]models.UserAddress{
+		"streetAddress": {City: "Berlin", Country: "DE", ZipCode: "10115"},
+		"city":          {StreetAddress: "Unter den Linden 1", Country: "DE", ZipCode: "10115"},
+	} {
+		var invalid *ValidationError
+		if err := Validate(&a); !errors.As(err, &invalid) || invalid.Field != field {
+			t.Errorf("missing %s: %v", field, err)
+		}
+	}
+}
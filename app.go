@@ -4,11 +4,22 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/authn"
+	"github.com/Elimists/go-app/challenge"
 	"github.com/Elimists/go-app/controller"
 	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/geoip"
+	"github.com/Elimists/go-app/middleware"
 	"github.com/Elimists/go-app/routes"
+	"github.com/Elimists/go-app/scanner"
+	"github.com/Elimists/go-app/search"
+	"github.com/Elimists/go-app/sso"
+	"github.com/Elimists/go-app/storage"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/csrf"
@@ -30,8 +41,128 @@ func init() {
 
 func main() {
 	database.Connect()
+
+	audit.Register(audit.NewDBSink(database.DB))
+	if path := os.Getenv("AUDIT_LOG_FILE"); path != "" {
+		fileSink, err := audit.NewFileSink(path)
+		if err != nil {
+			log.Fatalf("Error opening audit log file: %s", err.Error())
+		}
+		defer fileSink.Close()
+		audit.Register(fileSink)
+	}
+
+	if path := os.Getenv("GEOIP_DB_PATH"); path != "" {
+		locator, err := geoip.OpenMaxMind(path)
+		if err != nil {
+			log.Fatalf("Error opening GeoIP database: %s", err.Error())
+		}
+		defer locator.Close()
+		geoip.Default = locator
+	}
+
+	if backends := os.Getenv("AUTH_BACKENDS"); backends != "" {
+		var chain authn.Chain
+		for _, backend := range strings.Split(backends, ",") {
+			switch strings.TrimSpace(backend) {
+			case authn.ProviderLocal:
+				chain = append(chain, authn.Database{})
+			case authn.ProviderLDAP:
+				chain = append(chain, authn.NewLDAP(authn.LDAPConfigFromEnv()))
+			default:
+				log.Fatalf("Unknown auth backend: %s", backend)
+			}
+		}
+		authn.Default = chain
+	}
+
+	if os.Getenv("SAML_IDP_METADATA") != "" {
+		samlConfig, err := sso.SAMLConfigFromEnv()
+		if err != nil {
+			log.Fatalf("Error configuring SAML: %s", err.Error())
+		}
+		if sso.Default, err = sso.NewSAML(samlConfig); err != nil {
+			log.Fatalf("Error configuring SAML: %s", err.Error())
+		}
+	}
+
+	switch os.Getenv("STORAGE_BACKEND") {
+	case "", "local":
+		root := os.Getenv("STORAGE_LOCAL_PATH")
+		if root == "" {
+			root = "./uploads"
+		}
+		storage.Default = storage.NewLocal(root, os.Getenv("API_URL"), []byte(os.Getenv("SECRET_KEY")))
+	case "s3":
+		store, err := storage.NewS3(storage.S3ConfigFromEnv())
+		if err != nil {
+			log.Fatalf("Error configuring S3 storage: %s", err.Error())
+		}
+		storage.Default = store
+	default:
+		log.Fatalf("Unknown storage backend: %s", os.Getenv("STORAGE_BACKEND"))
+	}
+
+	switch os.Getenv("SEARCH_BACKEND") {
+	case "", "memory":
+		// The in-memory index starts empty every time.
+		go func() {
+			if err := controller.ReindexDevices(); err != nil {
+				log.Printf("Error building search index: %s", err.Error())
+			}
+		}()
+	case "mysql":
+		index := search.NewMySQL(database.DB)
+		if err := index.Migrate(); err != nil {
+			log.Fatalf("Error migrating search index: %s", err.Error())
+		}
+		search.Default = index
+		if os.Getenv("SEARCH_REINDEX") == "true" {
+			go func() {
+				if err := controller.ReindexDevices(); err != nil {
+					log.Printf("Error rebuilding search index: %s", err.Error())
+				}
+			}()
+		}
+	default:
+		log.Fatalf("Unknown search backend: %s", os.Getenv("SEARCH_BACKEND"))
+	}
+
+	switch os.Getenv("CHALLENGE_PROVIDER") {
+	case "hcaptcha":
+		challenge.Default = challenge.NewHCaptcha(os.Getenv("CHALLENGE_SITE_KEY"), os.Getenv("CHALLENGE_SECRET"))
+	case "turnstile":
+		challenge.Default = challenge.NewTurnstile(os.Getenv("CHALLENGE_SITE_KEY"), os.Getenv("CHALLENGE_SECRET"))
+	case "pow":
+		bits, err := strconv.Atoi(os.Getenv("CHALLENGE_POW_BITS"))
+		if err != nil {
+			bits = 20
+		}
+		challenge.Default = challenge.NewHashcash([]byte(os.Getenv("SECRET_KEY")), bits, 5*time.Minute)
+	}
+
+	switch os.Getenv("SCANNER_BACKEND") {
+	case "":
+		// Uploads would be published after a check that finds nothing real, so production has to choose.
+		if os.Getenv("ENVIRONMENT") == "production" {
+			log.Fatalf("SCANNER_BACKEND must be set in production: clamd, or eicar to only check for the EICAR test file.")
+		}
+	case "eicar":
+		if os.Getenv("ENVIRONMENT") == "production" {
+			log.Printf("No malware scanner is configured. Uploaded files are only checked for the EICAR test file.")
+		}
+	case "clamd":
+		scanner.Default = scanner.ClamdFromEnv()
+	default:
+		log.Fatalf("Unknown scanner backend: %s", os.Getenv("SCANNER_BACKEND"))
+	}
+
 	go controller.EmailVerificationWorker()
-	app := fiber.New()
+	go controller.FileScanWorker()
+	// Bodies over fiber's limit are streamed so device file uploads never sit in memory. BodyLimit keeps every other
+	// route at the default limit.
+	app := fiber.New(fiber.Config{StreamRequestBody: true, DisablePreParseMultipartForm: true})
+	app.Use(middleware.BodyLimit(fiber.DefaultBodyLimit, controller.StreamsRequestBody))
 
 	app.Static("/", "./public")
 
@@ -44,6 +175,15 @@ func main() {
 	)
 
 	app.Use(csrf.New(csrf.Config{
+		// Requests posted by other servers or non-browser clients carry no CSRF token.
+		Next: func(c *fiber.Ctx) bool {
+			switch c.Path() {
+			case "/saml/acs", "/oauth/device_authorization", "/oauth/token":
+				return true
+			}
+			// The "this wasn't me" form is posted from a page without the CSRF header. Its token is the secret.
+			return strings.HasPrefix(c.Path(), "/scim/") || strings.HasPrefix(c.Path(), "/security/notme/")
+		},
 		KeyLookup:      fmt.Sprintf("header:X-%s-CSRF-Token", os.Getenv("API_NAME")),
 		CookieName:     fmt.Sprintf("%s_csrf", os.Getenv("API_NAME")),
 		CookieSameSite: "Lax",
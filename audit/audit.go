@@ -0,0 +1,125 @@
+// Package audit records security relevant events to one or more append-only sinks.
+package audit
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	LoginSucceeded       EventType = "login_succeeded"
+	LoginFailed          EventType = "login_failed"
+	PasswordChanged      EventType = "password_changed"
+	PasswordChangeFailed EventType = "password_change_failed"
+	PrivilegeChanged     EventType = "privilege_changed"
+	EmailVerified        EventType = "email_verified"
+	UsersListed          EventType = "users_listed"
+	SessionsRevoked      EventType = "sessions_revoked"
+
+	ImpersonationStarted EventType = "impersonation_started"
+	ImpersonationStopped EventType = "impersonation_stopped"
+	ImpersonatedRequest  EventType = "impersonated_request"
+
+	RegistrationSettingsChanged EventType = "registration_settings_changed"
+	InviteCreated               EventType = "invite_created"
+	InviteRevoked               EventType = "invite_revoked"
+
+	UserProvisioned  EventType = "user_provisioned"
+	UserUpdated      EventType = "user_updated"
+	UserDeactivated  EventType = "user_deactivated"
+	UserReactivated  EventType = "user_reactivated"
+	UserDeleted      EventType = "user_deleted"
+	SCIMTokenCreated EventType = "scim_token_created"
+	SCIMTokenRevoked EventType = "scim_token_revoked"
+
+	DeviceAuthorizationApproved EventType = "device_authorization_approved"
+	DeviceAuthorizationDenied   EventType = "device_authorization_denied"
+
+	DeviceCreated        EventType = "device_created"
+	DeviceUpdated        EventType = "device_updated"
+	DeviceDeleted        EventType = "device_deleted"
+	DeviceStageChanged   EventType = "device_stage_changed"
+	DeviceRolledBack     EventType = "device_rolled_back"
+	DeviceFileUploaded   EventType = "device_file_uploaded"
+	DeviceFileDeleted    EventType = "device_file_deleted"
+	DeviceImagesUploaded EventType = "device_images_uploaded"
+	DeviceImageDeleted   EventType = "device_image_deleted"
+	// Recorded by the scanner for files that were infected or could not be scanned.
+	DeviceFileQuarantined EventType = "device_file_quarantined"
+
+	ReviewCreated  EventType = "review_created"
+	ReviewUpdated  EventType = "review_updated"
+	ReviewDeleted  EventType = "review_deleted"
+	CommentDeleted EventType = "comment_deleted"
+
+	ContentReported           EventType = "content_reported"
+	ContentHidden             EventType = "content_hidden"
+	ContentUnhidden           EventType = "content_unhidden"
+	UserWarned                EventType = "user_warned"
+	UserSuspended             EventType = "user_suspended"
+	ModerationCaseClaimed     EventType = "moderation_case_claimed"
+	ModerationCaseResolved    EventType = "moderation_case_resolved"
+	ModerationCaseDismissed   EventType = "moderation_case_dismissed"
+	ModerationSettingsChanged EventType = "moderation_settings_changed"
+
+	VocabularyTermCreated EventType = "vocabulary_term_created"
+	VocabularyTermUpdated EventType = "vocabulary_term_updated"
+	VocabularyTermDeleted EventType = "vocabulary_term_deleted"
+	VocabularyTermsMerged EventType = "vocabulary_terms_merged"
+
+	AccountStatusChanged EventType = "account_status_changed"
+	AppealSubmitted      EventType = "appeal_submitted"
+	AppealDecided        EventType = "appeal_decided"
+)
+
+// Event describes something that happened, who did it and who it happened to.
+type Event struct {
+	Type        EventType         `json:"type"`
+	ActorID     uint              `json:"actorID,omitempty"`
+	ActorEmail  string            `json:"actorEmail,omitempty"`
+	TargetID    uint              `json:"targetID,omitempty"`
+	TargetEmail string            `json:"targetEmail,omitempty"`
+	IP          string            `json:"ip,omitempty"`
+	UserAgent   string            `json:"userAgent,omitempty"`
+	Details     map[string]string `json:"details,omitempty"`
+	OccurredAt  time.Time         `json:"occurredAt"`
+}
+
+// A Sink persists events. Sinks must never modify or drop events they have already written.
+type Sink interface {
+	Write(e Event) error
+}
+
+var (
+	mu    sync.RWMutex
+	sinks []Sink
+)
+
+// Register adds a sink that every recorded event is written to.
+func Register(s Sink) {
+	mu.Lock()
+	defer mu.Unlock()
+	sinks = append(sinks, s)
+}
+
+// Record writes the event to every registered sink.
+//
+// A failing sink is logged and does not stop the event from reaching the others.
+func Record(e Event) {
+	if e.OccurredAt.IsZero() {
+		e.OccurredAt = time.Now()
+	}
+	// Most of our storage keeps millisecond precision. Truncate so hashes survive a round trip.
+	e.OccurredAt = e.OccurredAt.UTC().Truncate(time.Millisecond)
+
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, s := range sinks {
+		if err := s.Write(e); err != nil {
+			log.Printf("Error writing audit event %s: %s", e.Type, err.Error())
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/Elimists/go-app/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrChainBroken = errors.New("audit hash chain is broken")
+
+// DBSink stores events as hash-chained rows in the audit_entries table.
+type DBSink struct {
+	db *gorm.DB
+	mu sync.Mutex
+}
+
+func NewDBSink(db *gorm.DB) *DBSink {
+	return &DBSink{db: db}
+}
+
+func (s *DBSink) Write(e Event) error {
+	details, err := json.Marshal(e.Details)
+	if err != nil {
+		return err
+	}
+
+	entry := models.AuditEntry{
+		Type:        string(e.Type),
+		ActorID:     e.ActorID,
+		ActorEmail:  e.ActorEmail,
+		TargetID:    e.TargetID,
+		TargetEmail: e.TargetEmail,
+		IP:          e.IP,
+		UserAgent:   e.UserAgent,
+		Details:     string(details),
+		OccurredAt:  e.OccurredAt,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		// Lock the current head of the chain so other instances append after us, not beside us.
+		var head models.AuditEntry
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Order("id desc").Limit(1).Find(&head).Error; err != nil {
+			return err
+		}
+		entry.PrevHash = head.Hash
+		entry.Hash = hashEntry(&entry)
+		return tx.Create(&entry).Error
+	})
+}
+
+// VerifyChain walks the whole audit table and checks every row against its predecessor.
+//
+// Returns the ID of the first row that does not match together with ErrChainBroken.
+func VerifyChain(db *gorm.DB) (uint, error) {
+	var (
+		prevHash string
+		brokenAt uint
+	)
+
+	var batch []models.AuditEntry
+	result := db.FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			if batch[i].PrevHash != prevHash || batch[i].Hash != hashEntry(&batch[i]) {
+				brokenAt = batch[i].ID
+				return ErrChainBroken
+			}
+			prevHash = batch[i].Hash
+		}
+		return nil
+	})
+
+	return brokenAt, result.Error
+}
+
+func hashEntry(e *models.AuditEntry) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%d\n%s\n%d\n%s\n%s\n%s\n%s\n%d",
+		e.PrevHash, e.Type,
+		e.ActorID, e.ActorEmail,
+		e.TargetID, e.TargetEmail,
+		e.IP, e.UserAgent, e.Details,
+		e.OccurredAt.UnixMilli(),
+	)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,82 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Elimists/go-app/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Appends five events to a fresh table and returns the sink's database.
+func testChain(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.AuditEntry{}); err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ := db.DB()
+	t.Cleanup(func() { sqlDB.Close() })
+
+	sink := NewDBSink(db)
+	occurredAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 1; i <= 5; i++ {
+		event := Event{Type: PrivilegeChanged, ActorID: 1, ActorEmail: "admin@example.org", TargetID: uint(i),
+			Details: map[string]string{"to": fmt.Sprint(i)}, OccurredAt: occurredAt.Add(time.Duration(i) * time.Minute)}
+		if err := sink.Write(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestVerifyChain(t *testing.T) {
+	db := testChain(t)
+
+	var entries []models.AuditEntry
+	db.Order("id").Find(&entries)
+	if len(entries) != 5 || entries[0].PrevHash != "" {
+		t.Fatalf("entries = %+v", entries)
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].PrevHash != entries[i-1].Hash {
+			t.Errorf("entry %d does not link to its predecessor", entries[i].ID)
+		}
+	}
+	if id, err := VerifyChain(db); err != nil {
+		t.Errorf("VerifyChain() = %d, %v", id, err)
+	}
+}
+
+func TestVerifyChainEditedRow(t *testing.T) {
+	db := testChain(t)
+	// The model refuses updates, so tamper the way someone with database access would.
+	if err := db.Exec("UPDATE audit_entries SET details = ? WHERE id = 3", `{"to":"1"}`).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if id, err := VerifyChain(db); !errors.Is(err, ErrChainBroken) || id != 3 {
+		t.Errorf("VerifyChain() = %d, %v, want 3 and ErrChainBroken", id, err)
+	}
+}
+
+func TestVerifyChainDeletedRow(t *testing.T) {
+	db := testChain(t)
+	if err := db.Exec("DELETE FROM audit_entries WHERE id = 3").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// The gap shows up at the row that pointed at the deleted one.
+	if id, err := VerifyChain(db); !errors.Is(err, ErrChainBroken) || id != 4 {
+		t.Errorf("VerifyChain() = %d, %v, want 4 and ErrChainBroken", id, err)
+	}
+}
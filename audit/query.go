@@ -0,0 +1,47 @@
+package audit
+
+import (
+	"time"
+
+	"github.com/Elimists/go-app/models"
+	"gorm.io/gorm"
+)
+
+// Filter narrows down an audit query. Zero values are ignored.
+type Filter struct {
+	ActorID     uint
+	ActorEmail  string
+	TargetID    uint
+	TargetEmail string
+	Types       []EventType
+	From        time.Time
+	To          time.Time
+}
+
+// Query narrows db to the matching audit entries. Callers order and page the result.
+func Query(db *gorm.DB, f Filter) *gorm.DB {
+	q := db.Model(&models.AuditEntry{})
+
+	if f.ActorID != 0 {
+		q = q.Where("actor_id = ?", f.ActorID)
+	}
+	if f.ActorEmail != "" {
+		q = q.Where("actor_email = ?", f.ActorEmail)
+	}
+	if f.TargetID != 0 {
+		q = q.Where("target_id = ?", f.TargetID)
+	}
+	if f.TargetEmail != "" {
+		q = q.Where("target_email = ?", f.TargetEmail)
+	}
+	if len(f.Types) > 0 {
+		q = q.Where("type IN ?", f.Types)
+	}
+	if !f.From.IsZero() {
+		q = q.Where("occurred_at >= ?", f.From)
+	}
+	if !f.To.IsZero() {
+		q = q.Where("occurred_at <= ?", f.To)
+	}
+	return q
+}
@@ -0,0 +1,45 @@
+// Package authn checks a user's credentials against one or more backends.
+package authn
+
+import (
+	"errors"
+
+	"github.com/Elimists/go-app/models"
+)
+
+var (
+	ErrUserNotFound       = errors.New("user not found")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Auth providers, stored on models.User.AuthProvider.
+const (
+	ProviderLocal = "local"
+	ProviderLDAP  = "ldap"
+	ProviderSAML  = "saml"
+)
+
+// An Authenticator checks an email and password and returns the matching local user.
+//
+// It returns ErrUserNotFound when it does not know the user, so the next backend in a Chain can try,
+// and ErrInvalidCredentials when it knows the user but the password is wrong.
+type Authenticator interface {
+	Authenticate(email string, password string) (*models.User, error)
+}
+
+// Chain tries each authenticator in turn until one of them knows the user.
+type Chain []Authenticator
+
+func (ch Chain) Authenticate(email string, password string) (*models.User, error) {
+	for _, a := range ch {
+		user, err := a.Authenticate(email, password)
+		if errors.Is(err, ErrUserNotFound) {
+			continue
+		}
+		return user, err
+	}
+	return nil, ErrUserNotFound
+}
+
+// Default is the authenticator used by Login. Swap it out at startup.
+var Default Authenticator = Database{}
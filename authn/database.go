@@ -0,0 +1,35 @@
+package authn
+
+import (
+	"errors"
+
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Database checks the password against the bcrypt hash stored on the user.
+type Database struct{}
+
+func (Database) Authenticate(email string, password string) (*models.User, error) {
+	var user models.User
+
+	if err := database.DB.Where("email = ?", email).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	// Directory users have no local password.
+	if user.AuthProvider != "" && user.AuthProvider != ProviderLocal {
+		return nil, ErrUserNotFound
+	}
+
+	if err := bcrypt.CompareHashAndPassword(user.Password, []byte(password)); err != nil {
+		return &user, ErrInvalidCredentials
+	}
+
+	return &user, nil
+}
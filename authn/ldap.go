@@ -0,0 +1,240 @@
+package authn
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/go-ldap/ldap/v3"
+	"gorm.io/gorm"
+)
+
+// LDAPConfig describes how to find and check users in an LDAP or Active Directory server.
+type LDAPConfig struct {
+	URL                string // ldap://host:389 or ldaps://host:636
+	StartTLS           bool
+	InsecureSkipVerify bool
+
+	// Service account used to search for users.
+	BindDN       string
+	BindPassword string
+
+	BaseDN     string
+	UserFilter string // %s is replaced with the escaped email, e.g. "(&(objectClass=person)(mail=%s))"
+
+	FirstNameAttribute    string
+	LastNameAttribute     string
+	OrganizationAttribute string
+	GroupAttribute        string // Usually "memberOf".
+
+	// Group DN (lower case) to privilege. A user in several groups gets the most privileged one.
+	GroupPrivileges  map[string]int8
+	DefaultPrivilege int8
+
+	// Create a local user the first time a directory user signs in.
+	Provision bool
+}
+
+// LDAP binds as the user to check their password and maps their groups onto a privilege.
+type LDAP struct {
+	Config LDAPConfig
+}
+
+func NewLDAP(config LDAPConfig) *LDAP {
+	return &LDAP{Config: config}
+}
+
+// LDAPConfigFromEnv reads the LDAP_* environment variables.
+//
+// LDAP_GROUP_PRIVILEGES is a ";" separated list of "<group dn>:<privilege>" pairs.
+func LDAPConfigFromEnv() LDAPConfig {
+	config := LDAPConfig{
+		URL:                   os.Getenv("LDAP_URL"),
+		StartTLS:              os.Getenv("LDAP_START_TLS") == "true",
+		InsecureSkipVerify:    os.Getenv("LDAP_INSECURE_SKIP_VERIFY") == "true",
+		BindDN:                os.Getenv("LDAP_BIND_DN"),
+		BindPassword:          os.Getenv("LDAP_BIND_PASSWORD"),
+		BaseDN:                os.Getenv("LDAP_BASE_DN"),
+		UserFilter:            envOr("LDAP_USER_FILTER", "(&(objectClass=person)(mail=%s))"),
+		FirstNameAttribute:    envOr("LDAP_FIRST_NAME_ATTRIBUTE", "givenName"),
+		LastNameAttribute:     envOr("LDAP_LAST_NAME_ATTRIBUTE", "sn"),
+		OrganizationAttribute: envOr("LDAP_ORGANIZATION_ATTRIBUTE", "o"),
+		GroupAttribute:        envOr("LDAP_GROUP_ATTRIBUTE", "memberOf"),
+		GroupPrivileges:       map[string]int8{},
+		DefaultPrivilege:      9,
+		Provision:             os.Getenv("LDAP_PROVISION") != "false",
+	}
+
+	for _, pair := range strings.Split(os.Getenv("LDAP_GROUP_PRIVILEGES"), ";") {
+		sep := strings.LastIndex(pair, ":")
+		if sep < 0 {
+			continue
+		}
+		privilege, err := strconv.Atoi(strings.TrimSpace(pair[sep+1:]))
+		if err != nil {
+			continue
+		}
+		config.GroupPrivileges[strings.ToLower(strings.TrimSpace(pair[:sep]))] = int8(privilege)
+	}
+
+	return config
+}
+
+func (l *LDAP) Authenticate(email string, password string) (*models.User, error) {
+	entry, err := l.lookup(email, password)
+	if err != nil {
+		return nil, err
+	}
+	return l.syncUser(email, entry)
+}
+
+// Find the directory entry for an email and check the password by binding as it.
+func (l *LDAP) lookup(email string, password string) (*ldap.Entry, error) {
+	// An empty password would turn the user bind into an anonymous bind, which most servers accept.
+	if password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := l.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.Bind(l.Config.BindDN, l.Config.BindPassword); err != nil {
+		return nil, fmt.Errorf("ldap service bind: %w", err)
+	}
+
+	attributes := []string{l.Config.FirstNameAttribute, l.Config.LastNameAttribute, l.Config.OrganizationAttribute, l.Config.GroupAttribute}
+	search := ldap.NewSearchRequest(
+		l.Config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(l.Config.UserFilter, ldap.EscapeFilter(email)),
+		attributes,
+		nil,
+	)
+
+	// Two entries are enough to know the email is ambiguous. Servers report any more as a size limit error.
+	result, err := conn.Search(search)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ldap search: %w", err)
+	}
+	if len(result.Entries) == 0 {
+		return nil, ErrUserNotFound
+	}
+	// Guessing which entry is meant could sign someone in as another person, and falling through to the next
+	// backend could let a local account shadow the directory.
+	if len(result.Entries) > 1 {
+		return nil, ErrInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("ldap user bind: %w", err)
+	}
+	return entry, nil
+}
+
+func (l *LDAP) dial() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: l.Config.InsecureSkipVerify}
+
+	conn, err := ldap.DialURL(l.Config.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	if l.Config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Find or provision the local user for a directory entry and bring their privilege in line with their groups.
+func (l *LDAP) syncUser(email string, entry *ldap.Entry) (*models.User, error) {
+	privilege := l.privilegeFor(entry.GetAttributeValues(l.Config.GroupAttribute))
+
+	var user models.User
+	err := database.DB.Where("email = ?", email).First(&user).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if !l.Config.Provision {
+			return nil, ErrUserNotFound
+		}
+
+		user = models.User{
+			Email:        email,
+			Privilege:    privilege,
+			Verified:     true, // The directory vouches for the address.
+			AuthProvider: ProviderLDAP,
+			UserDetails: models.UserDetails{
+				FirstName:    entry.GetAttributeValue(l.Config.FirstNameAttribute),
+				LastName:     entry.GetAttributeValue(l.Config.LastNameAttribute),
+				Organization: entry.GetAttributeValue(l.Config.OrganizationAttribute),
+			},
+		}
+		if err := database.DB.Create(&user).Error; err != nil {
+			return nil, err
+		}
+		return &user, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Never let the directory take over an account that has its own password.
+	if user.AuthProvider != ProviderLDAP {
+		return nil, ErrUserNotFound
+	}
+
+	if user.Privilege != privilege {
+		oldPrivilege := user.Privilege
+		if err := database.DB.Model(&user).Update("privilege", privilege).Error; err != nil {
+			return nil, err
+		}
+
+		audit.Record(audit.Event{
+			Type:        audit.PrivilegeChanged,
+			TargetID:    user.ID,
+			TargetEmail: user.Email,
+			Details: map[string]string{
+				"from":   strconv.Itoa(int(oldPrivilege)),
+				"to":     strconv.Itoa(int(privilege)),
+				"source": ProviderLDAP,
+			},
+		})
+	}
+
+	return &user, nil
+}
+
+func (l *LDAP) privilegeFor(groups []string) int8 {
+	privilege := l.Config.DefaultPrivilege
+	for _, group := range groups {
+		if p, ok := l.Config.GroupPrivileges[strings.ToLower(group)]; ok && p < privilege {
+			privilege = p
+		}
+	}
+	return privilege
+}
+
+func envOr(key string, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,225 @@
+package authn
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+type directoryEntry struct {
+	dn         string
+	mail       string
+	password   string
+	attributes map[string][]string
+}
+
+// A tiny LDAP server that understands simple binds and searches on (mail=...).
+type fakeDirectory struct {
+	bindDN       string
+	bindPassword string
+	entries      []directoryEntry
+}
+
+func (d *fakeDirectory) start(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	return "ldap://" + listener.Addr().String()
+}
+
+func (d *fakeDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			if dn == d.bindDN && password == d.bindPassword {
+				code = ldap.LDAPResultSuccess
+			}
+			for _, e := range d.entries {
+				if dn == e.dn && password == e.password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			conn.Write(ldapResult(id, ldap.ApplicationBindResponse, code))
+
+		case ldap.ApplicationSearchRequest:
+			sizeLimit := int(op.Children[3].Value.(int64))
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			sent := 0
+			code := uint16(ldap.LDAPResultSuccess)
+			for _, e := range d.entries {
+				if !strings.Contains(filter, "(mail="+e.mail+")") {
+					continue
+				}
+				if sizeLimit > 0 && sent == sizeLimit {
+					code = ldap.LDAPResultSizeLimitExceeded
+					break
+				}
+				conn.Write(searchEntry(id, e))
+				sent++
+			}
+			conn.Write(ldapResult(id, ldap.ApplicationSearchResultDone, code))
+
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+func envelope(id int64, op *ber.Packet) []byte {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+	packet.AppendChild(op)
+	return packet.Bytes()
+}
+
+func ldapResult(id int64, tag ber.Tag, code uint16) []byte {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return envelope(id, op)
+}
+
+func searchEntry(id int64, e directoryEntry) []byte {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "DN"))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for name, values := range e.attributes {
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+		}
+		attribute.AppendChild(set)
+		attributes.AppendChild(attribute)
+	}
+	op.AppendChild(attributes)
+	return envelope(id, op)
+}
+
+func newTestLDAP(t *testing.T, entries ...directoryEntry) *LDAP {
+	t.Helper()
+	directory := &fakeDirectory{bindDN: "cn=service,dc=example,dc=org", bindPassword: "service-secret", entries: entries}
+
+	t.Setenv("LDAP_URL", directory.start(t))
+	t.Setenv("LDAP_BIND_DN", directory.bindDN)
+	t.Setenv("LDAP_BIND_PASSWORD", directory.bindPassword)
+	t.Setenv("LDAP_BASE_DN", "dc=example,dc=org")
+	t.Setenv("LDAP_GROUP_PRIVILEGES", "cn=Admins,ou=groups,dc=example,dc=org:1;cn=staff,ou=groups,dc=example,dc=org:5")
+	return NewLDAP(LDAPConfigFromEnv())
+}
+
+var ada = directoryEntry{
+	dn:       "uid=ada,ou=people,dc=example,dc=org",
+	mail:     "ada@example.org",
+	password: "analytical",
+	attributes: map[string][]string{
+		"givenName": {"Ada"},
+		"sn":        {"Lovelace"},
+		"memberOf":  {"cn=staff,ou=groups,dc=example,dc=org", "CN=Admins,OU=Groups,DC=example,DC=org"},
+	},
+}
+
+func TestLDAPLookup(t *testing.T) {
+	l := newTestLDAP(t, ada)
+
+	entry, err := l.lookup("ada@example.org", "analytical")
+	if err != nil {
+		t.Fatalf("valid credentials: %v", err)
+	}
+	if entry.DN != ada.dn || entry.GetAttributeValue("givenName") != "Ada" {
+		t.Errorf("entry = %s %v", entry.DN, entry.Attributes)
+	}
+	if got := l.privilegeFor(entry.GetAttributeValues("memberOf")); got != 1 {
+		t.Errorf("privilege = %d, want 1", got)
+	}
+
+	if _, err := l.lookup("ada@example.org", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong password: got %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := l.lookup("ada@example.org", ""); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("empty password: got %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := l.lookup("nobody@example.org", "analytical"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("unknown user: got %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestLDAPAmbiguousEmail(t *testing.T) {
+	clone := func(uid string) directoryEntry {
+		e := ada
+		e.dn = "uid=" + uid + ",ou=people,dc=example,dc=org"
+		return e
+	}
+
+	// Two matches fit inside the size limit, three make the server give up on the search.
+	for _, count := range []int{2, 3} {
+		entries := []directoryEntry{ada}
+		for i := 1; i < count; i++ {
+			entries = append(entries, clone("ada"+strings.Repeat("x", i)))
+		}
+		l := newTestLDAP(t, entries...)
+
+		if _, err := l.lookup("ada@example.org", "analytical"); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%d matches: got %v, want ErrInvalidCredentials", count, err)
+		}
+	}
+}
+
+func TestLDAPServiceBindFails(t *testing.T) {
+	l := newTestLDAP(t, ada)
+	l.Config.BindPassword = "wrong"
+
+	_, err := l.lookup("ada@example.org", "analytical")
+	if err == nil || errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrUserNotFound) {
+		t.Errorf("got %v, want a service bind error", err)
+	}
+}
+
+func TestLDAPPrivilegeFor(t *testing.T) {
+	l := newTestLDAP(t)
+
+	tests := []struct {
+		groups []string
+		want   int8
+	}{
+		{nil, 9},
+		{[]string{"cn=unknown,dc=example,dc=org"}, 9},
+		{[]string{"CN=Staff,OU=Groups,DC=Example,DC=Org"}, 5},
+		{[]string{"cn=staff,ou=groups,dc=example,dc=org", "cn=admins,ou=groups,dc=example,dc=org"}, 1},
+	}
+	for _, tt := range tests {
+		if got := l.privilegeFor(tt.groups); got != tt.want {
+			t.Errorf("privilegeFor(%v) = %d, want %d", tt.groups, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Package challenge makes clients prove they are human, or at least willing to spend some CPU, before hitting sensitive endpoints.
+package challenge
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrMissingResponse = errors.New("challenge response is missing")
+	ErrFailed          = errors.New("challenge was not solved")
+	ErrExpired         = errors.New("challenge has expired")
+	ErrReplayed        = errors.New("challenge has already been used")
+)
+
+// Challenge is what a client needs to know to solve a challenge.
+type Challenge struct {
+	Kind       string `json:"kind"`                 // "hcaptcha", "turnstile" or "pow".
+	SiteKey    string `json:"siteKey,omitempty"`    // CAPTCHA widgets only.
+	Token      string `json:"token,omitempty"`      // Proof-of-work only. Find a counter so that SHA-256(token + ":" + counter) has Difficulty leading zero bits.
+	Difficulty int    `json:"difficulty,omitempty"` // Proof-of-work only.
+}
+
+// A Verifier hands out challenges and checks the answers.
+type Verifier interface {
+	Issue() (Challenge, error)
+	Verify(ctx context.Context, response string, remoteIP string) error
+}
+
+// Disabled lets everything through. Used when no challenge provider is configured.
+type Disabled struct{}
+
+func (Disabled) Issue() (Challenge, error) {
+	return Challenge{Kind: "none"}, nil
+}
+
+func (Disabled) Verify(ctx context.Context, response string, remoteIP string) error {
+	return nil
+}
+
+// Default is the verifier used by the challenge middleware. Swap it out at startup.
+var Default Verifier = Disabled{}
@@ -0,0 +1,138 @@
+package challenge
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Brute forces a counter for the token, the same way a client would.
+func solve(t *testing.T, token string, difficulty int) string {
+	t.Helper()
+	for counter := 0; counter < 1<<24; counter++ {
+		response := token + ":" + strconv.Itoa(counter)
+		sum := sha256.Sum256([]byte(response))
+		if leadingZeroBits(sum[:]) >= difficulty {
+			return response
+		}
+	}
+	t.Fatal("no solution found")
+	return ""
+}
+
+// Finds a counter that does not meet the difficulty.
+func miss(t *testing.T, token string, difficulty int) string {
+	t.Helper()
+	for counter := 0; ; counter++ {
+		response := token + ":" + strconv.Itoa(counter)
+		sum := sha256.Sum256([]byte(response))
+		if leadingZeroBits(sum[:]) < difficulty {
+			return response
+		}
+	}
+}
+
+func TestHashcashValid(t *testing.T) {
+	h := NewHashcash([]byte("secret"), 8, time.Minute)
+	issued, err := h.Issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued.Kind != "pow" || issued.Difficulty != 8 {
+		t.Errorf("Issue() = %+v", issued)
+	}
+
+	if err := h.Verify(context.Background(), solve(t, issued.Token, 8), ""); err != nil {
+		t.Errorf("valid stamp: %v", err)
+	}
+}
+
+func TestHashcashWrongBits(t *testing.T) {
+	h := NewHashcash([]byte("secret"), 8, time.Minute)
+	issued, err := h.Issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Verify(context.Background(), miss(t, issued.Token, 8), ""); !errors.Is(err, ErrFailed) {
+		t.Errorf("unsolved stamp: got %v, want ErrFailed", err)
+	}
+
+	// A token issued at a lower difficulty must not be accepted, even with the same secret.
+	easy := NewHashcash([]byte("secret"), 1, time.Minute)
+	issued, err = easy.Issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Verify(context.Background(), solve(t, issued.Token, 1), ""); !errors.Is(err, ErrFailed) {
+		t.Errorf("easier token: got %v, want ErrFailed", err)
+	}
+
+	// Nor may the client lower the difficulty in the token itself.
+	issued, err = h.Issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := "1" + strings.TrimPrefix(issued.Token, "8")
+	if err := h.Verify(context.Background(), solve(t, forged, 1), ""); !errors.Is(err, ErrFailed) {
+		t.Errorf("forged difficulty: got %v, want ErrFailed", err)
+	}
+}
+
+func TestHashcashExpired(t *testing.T) {
+	h := NewHashcash([]byte("secret"), 8, -time.Minute)
+	issued, err := h.Issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Verify(context.Background(), solve(t, issued.Token, 8), ""); !errors.Is(err, ErrExpired) {
+		t.Errorf("expired stamp: got %v, want ErrExpired", err)
+	}
+}
+
+func TestHashcashReplayed(t *testing.T) {
+	h := NewHashcash([]byte("secret"), 8, time.Minute)
+	issued, err := h.Issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := solve(t, issued.Token, 8)
+
+	if err := h.Verify(context.Background(), response, ""); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := h.Verify(context.Background(), response, ""); !errors.Is(err, ErrReplayed) {
+		t.Errorf("second use: got %v, want ErrReplayed", err)
+	}
+
+	// A different counter for the same token is still a replay.
+	first := response[strings.LastIndex(response, ":")+1:]
+	start, _ := strconv.Atoi(first)
+	for counter := start + 1; ; counter++ {
+		other := issued.Token + ":" + strconv.Itoa(counter)
+		sum := sha256.Sum256([]byte(other))
+		if leadingZeroBits(sum[:]) >= 8 {
+			if err := h.Verify(context.Background(), other, ""); !errors.Is(err, ErrReplayed) {
+				t.Errorf("second counter: got %v, want ErrReplayed", err)
+			}
+			break
+		}
+	}
+}
+
+func TestHashcashWrongSecret(t *testing.T) {
+	issued, err := NewHashcash([]byte("secret"), 8, time.Minute).Issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHashcash([]byte("other"), 8, time.Minute)
+	if err := h.Verify(context.Background(), solve(t, issued.Token, 8), ""); !errors.Is(err, ErrFailed) {
+		t.Errorf("foreign token: got %v, want ErrFailed", err)
+	}
+}
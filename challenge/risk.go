@@ -0,0 +1,70 @@
+package challenge
+
+import (
+	"sync"
+	"time"
+)
+
+// RiskTracker counts recent failures per key (usually an IP address).
+type RiskTracker struct {
+	window time.Duration
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+}
+
+func NewRiskTracker(window time.Duration) *RiskTracker {
+	return &RiskTracker{window: window, failures: map[string][]time.Time{}}
+}
+
+// DefaultTracker is the tracker used by the challenge middleware.
+var DefaultTracker = NewRiskTracker(15 * time.Minute)
+
+// Past this many keys, stale entries are swept out on the next failure.
+const maxTrackedKeys = 10000
+
+func (r *RiskTracker) RecordFailure(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.failures) > maxTrackedKeys {
+		for k := range r.failures {
+			if len(r.recent(k)) == 0 {
+				delete(r.failures, k)
+			}
+		}
+	}
+	r.failures[key] = append(r.recent(key), time.Now())
+}
+
+// Reset forgets the failures for a key.
+func (r *RiskTracker) Reset(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.failures, key)
+}
+
+// Failures returns how many failures the key has had inside the window.
+func (r *RiskTracker) Failures(key string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	recent := r.recent(key)
+	if len(recent) == 0 {
+		delete(r.failures, key)
+	} else {
+		r.failures[key] = recent
+	}
+	return len(recent)
+}
+
+// Must be called with mu held.
+func (r *RiskTracker) recent(key string) []time.Time {
+	cutoff := time.Now().Add(-r.window)
+	list := r.failures[key]
+	i := 0
+	for i < len(list) && list[i].Before(cutoff) {
+		i++
+	}
+	return list[i:]
+}
@@ -0,0 +1,87 @@
+package challenge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	HCaptchaVerifyURL  = "https://api.hcaptcha.com/siteverify"
+	TurnstileVerifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+)
+
+// SiteVerify checks CAPTCHA tokens against a provider speaking the hCaptcha/Turnstile "siteverify" protocol.
+type SiteVerify struct {
+	Kind    string
+	URL     string
+	SiteKey string
+	Secret  string
+	Client  *http.Client
+}
+
+func NewHCaptcha(siteKey string, secret string) *SiteVerify {
+	return &SiteVerify{Kind: "hcaptcha", URL: HCaptchaVerifyURL, SiteKey: siteKey, Secret: secret}
+}
+
+func NewTurnstile(siteKey string, secret string) *SiteVerify {
+	return &SiteVerify{Kind: "turnstile", URL: TurnstileVerifyURL, SiteKey: siteKey, Secret: secret}
+}
+
+type siteVerifyResponse struct {
+	Success    bool     `json:"success"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+func (s *SiteVerify) Issue() (Challenge, error) {
+	return Challenge{Kind: s.Kind, SiteKey: s.SiteKey}, nil
+}
+
+func (s *SiteVerify) Verify(ctx context.Context, response string, remoteIP string) error {
+	if response == "" {
+		return ErrMissingResponse
+	}
+
+	form := url.Values{
+		"secret":   {s.Secret},
+		"response": {response},
+		"sitekey":  {s.SiteKey},
+	}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s siteverify returned %d", s.Kind, res.StatusCode)
+	}
+
+	var result siteVerifyResponse
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return err
+	}
+	if !result.Success {
+		return fmt.Errorf("%w: %s", ErrFailed, strings.Join(result.ErrorCodes, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package challenge
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Stands in for the provider. Accepts "good-token" from the given secret and site key.
+func newSiteVerifyServer(t *testing.T, secret string, siteKey string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("method = %s, want POST", r.Method)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/x-www-form-urlencoded" {
+			t.Errorf("content type = %q", ct)
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		if r.PostForm.Get("remoteip") != "203.0.113.7" {
+			t.Errorf("remoteip = %q", r.PostForm.Get("remoteip"))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.PostForm.Get("secret") != secret:
+			w.Write([]byte(`{"success":false,"error-codes":["invalid-input-secret"]}`))
+		case r.PostForm.Get("sitekey") != siteKey:
+			w.Write([]byte(`{"success":false,"error-codes":["sitekey-secret-mismatch"]}`))
+		case r.PostForm.Get("response") == "good-token":
+			w.Write([]byte(`{"success":true}`))
+		case r.PostForm.Get("response") == "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte(`{"success":false,"error-codes":["invalid-input-response"]}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSiteVerify(t *testing.T) {
+	providers := map[string]func(string, string) *SiteVerify{
+		"hcaptcha":  NewHCaptcha,
+		"turnstile": NewTurnstile,
+	}
+
+	for kind, newProvider := range providers {
+		t.Run(kind, func(t *testing.T) {
+			server := newSiteVerifyServer(t, "shh", "site-key")
+			provider := newProvider("site-key", "shh")
+			provider.URL = server.URL
+			provider.Client = server.Client()
+
+			issued, err := provider.Issue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if issued.Kind != kind || issued.SiteKey != "site-key" {
+				t.Errorf("Issue() = %+v", issued)
+			}
+
+			ctx := context.Background()
+			if err := provider.Verify(ctx, "good-token", "203.0.113.7"); err != nil {
+				t.Errorf("good token: %v", err)
+			}
+			if err := provider.Verify(ctx, "bad-token", "203.0.113.7"); !errors.Is(err, ErrFailed) {
+				t.Errorf("bad token: got %v, want ErrFailed", err)
+			}
+			if err := provider.Verify(ctx, "", "203.0.113.7"); !errors.Is(err, ErrMissingResponse) {
+				t.Errorf("empty response: got %v, want ErrMissingResponse", err)
+			}
+			if err := provider.Verify(ctx, "broken", "203.0.113.7"); err == nil || errors.Is(err, ErrFailed) {
+				t.Errorf("provider error: got %v, want a non-ErrFailed error", err)
+			}
+
+			provider.Secret = "wrong"
+			if err := provider.Verify(ctx, "good-token", "203.0.113.7"); !errors.Is(err, ErrFailed) {
+				t.Errorf("wrong secret: got %v, want ErrFailed", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,431 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/middleware"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/pagination"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	maxStatusReason   = 2000
+	maxAppealMessage  = 5000
+	maxSuspensionSpan = 10 * 365 * 24 * time.Hour
+)
+
+var (
+	errAppealInvalid   = errors.New("appeal link is invalid")
+	errNothingToAppeal = errors.New("account is active")
+	errAppealPending   = errors.New("an appeal is already pending")
+	errAppealNotFound  = errors.New("appeal not found")
+	errAppealDecided   = errors.New("appeal has already been decided")
+)
+
+var appealSorts = map[string]pagination.Sort{
+	"oldest": {Column: "created_at", Time: true},
+	"newest": {Column: "created_at", Desc: true, Time: true},
+}
+
+// Refuse to issue tokens to accounts that are deactivated, suspended or banned. Every sign-in path calls this.
+//
+// Returns a response packet describing the refusal, or nil when the account may sign in.
+func accountRefusal(user *models.User) *models.ResponsePacket {
+	if user.DeactivatedAt != nil {
+		return &models.ResponsePacket{Error: true, Code: "account_deactivated", Message: "This account has been deactivated."}
+	}
+	switch user.AccountStatus() {
+	case models.AccountSuspended:
+		return &models.ResponsePacket{Error: true, Code: "account_suspended", Message: "This account is suspended until " + user.SuspendedUntil.UTC().Format(time.RFC1123) + "."}
+	case models.AccountBanned:
+		return &models.ResponsePacket{Error: true, Code: "account_banned", Message: "This account has been banned."}
+	}
+	return nil
+}
+
+// Change a user's account status inside a transaction. Suspending or banning ends the user's sessions and returns a
+// new appeal token to email them. Reinstating closes their pending appeals. Call middleware.InvalidateSession after
+// the transaction commits.
+func setAccountStatus(tx *gorm.DB, user *models.User, status string, until *time.Time, reason string, actorID uint) (string, error) {
+	now := time.Now()
+	if status == models.AccountActive {
+		until, reason = nil, ""
+	}
+	updates := map[string]interface{}{
+		"status":               status,
+		"suspended_until":      until,
+		"status_reason":        reason,
+		"status_changed_by_id": actorID,
+		"status_changed_at":    now,
+		"appeal_token_hash":    "",
+	}
+
+	var token string
+	if status == models.AccountActive {
+		if err := tx.Model(&models.Appeal{}).Where("user_id = ? AND status = ?", user.ID, models.AppealPending).Updates(map[string]interface{}{
+			"status":        models.AppealOverturned,
+			"response":      "Your account has been reinstated.",
+			"decided_by_id": actorID,
+			"decided_at":    now,
+		}).Error; err != nil {
+			return "", err
+		}
+	} else {
+		var hash string
+		var err error
+		if token, hash, err = generateSecureToken(); err != nil {
+			return "", err
+		}
+		updates["appeal_token_hash"] = hash
+		updates["sessions_valid_after"] = now.Unix()
+	}
+
+	if err := tx.Model(&models.User{}).Where("id = ?", user.ID).Updates(updates).Error; err != nil {
+		return "", err
+	}
+	user.Status, user.SuspendedUntil, user.StatusReason, user.StatusChangedByID, user.StatusChangedAt = status, until, reason, &actorID, &now
+	return token, nil
+}
+
+// Suspend, ban or reinstate a user. Staff can only change the status of users with a lower privilege than their own.
+//
+// Body: status (active, suspended or banned), reason, and for suspensions either days or until (RFC 3339).
+func UpdateUserStatus(c *fiber.Ctx) error {
+	var in struct {
+		Status string     `json:"status"`
+		Reason string     `json:"reason"`
+		Days   int        `json:"days"`
+		Until  *time.Time `json:"until"`
+	}
+	if err := c.BodyParser(&in); err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	in.Reason = strings.TrimSpace(in.Reason)
+
+	var until *time.Time
+	switch in.Status {
+	case models.AccountActive:
+	case models.AccountSuspended:
+		if in.Until == nil && in.Days > 0 {
+			t := time.Now().AddDate(0, 0, in.Days)
+			in.Until = &t
+		}
+		if in.Until == nil || !in.Until.After(time.Now()) || time.Until(*in.Until) > maxSuspensionSpan {
+			rp := models.ResponsePacket{Error: true, Code: "invalid_until", Message: "Suspensions need days or an until time in the next ten years."}
+			return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+		}
+		until = in.Until
+	case models.AccountBanned:
+	default:
+		rp := models.ResponsePacket{Error: true, Code: "invalid_status", Message: "Status must be one of active, suspended or banned."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	if in.Status != models.AccountActive && in.Reason == "" {
+		rp := models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Please give a reason. It is shown to the user."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	if len(in.Reason) > maxStatusReason {
+		in.Reason = in.Reason[:maxStatusReason]
+	}
+
+	actorID, privilege := actorFromClaims(c)
+	var user models.User
+	var previous, token string
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", c.Params("id")).First(&user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errTargetNotFound
+			}
+			return err
+		}
+		if user.ID == actorID || user.Privilege <= privilege {
+			return errUserProtected
+		}
+		previous = user.AccountStatus()
+		var err error
+		token, err = setAccountStatus(tx, &user, in.Status, until, in.Reason, actorID)
+		return err
+	})
+	if err != nil {
+		return accountStatusError(c, err)
+	}
+	middleware.InvalidateSession(user.ID)
+	go notifyAccountStatus(user, token)
+
+	event := newAuditEvent(c, audit.AccountStatusChanged)
+	event.TargetID, event.TargetEmail = user.ID, user.Email
+	event.Details["from"] = previous
+	event.Details["to"] = in.Status
+	if until != nil {
+		event.Details["until"] = until.UTC().Format(time.RFC3339)
+	}
+	if in.Reason != "" {
+		event.Details["reason"] = in.Reason
+	}
+	audit.Record(event)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"userID":         user.ID,
+		"status":         user.Status,
+		"suspendedUntil": user.SuspendedUntil,
+		"statusReason":   user.StatusReason,
+	})
+}
+
+// Show a suspended or banned user why, and their latest appeal. The token comes from the email they were sent.
+func GetAppealStatus(c *fiber.Ctx) error {
+	var user models.User
+	if err := database.DB.Where("appeal_token_hash = ?", hashToken(c.Params("token"))).First(&user).Error; err != nil || c.Params("token") == "" {
+		return accountStatusError(c, errAppealInvalid)
+	}
+
+	var appeal models.Appeal
+	var latest *models.Appeal
+	if err := database.DB.Where("user_id = ?", user.ID).Order("id DESC").Limit(1).Find(&appeal).Error; err == nil && appeal.ID != 0 {
+		latest = &appeal
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"status":         user.AccountStatus(),
+		"suspendedUntil": user.SuspendedUntil,
+		"statusReason":   user.StatusReason,
+		"appeal":         latest,
+	})
+}
+
+// Appeal a suspension or ban. Works without signing in, using the token from the email the user was sent.
+//
+// Body: message.
+func SubmitAppeal(c *fiber.Ctx) error {
+	var data map[string]string
+	if err := c.BodyParser(&data); err != nil || strings.TrimSpace(data["message"]) == "" {
+		rp := models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Please explain why the decision should be reconsidered."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	message := strings.TrimSpace(data["message"])
+	if len(message) > maxAppealMessage {
+		message = message[:maxAppealMessage]
+	}
+
+	var user models.User
+	var appeal models.Appeal
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("appeal_token_hash = ?", hashToken(c.Params("token"))).First(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) || c.Params("token") == "" {
+			return errAppealInvalid
+		}
+		if err != nil {
+			return err
+		}
+		if user.AccountStatus() == models.AccountActive {
+			return errNothingToAppeal
+		}
+		var pending int64
+		if err := tx.Model(&models.Appeal{}).Where("user_id = ? AND status = ?", user.ID, models.AppealPending).Count(&pending).Error; err != nil {
+			return err
+		}
+		if pending > 0 {
+			return errAppealPending
+		}
+
+		appeal = models.Appeal{UserID: user.ID, AccountStatus: user.Status, StatusReason: user.StatusReason, Message: message, Status: models.AppealPending}
+		return tx.Create(&appeal).Error
+	})
+	if err != nil {
+		return accountStatusError(c, err)
+	}
+
+	event := newAuditEvent(c, audit.AppealSubmitted)
+	event.ActorID, event.ActorEmail = user.ID, user.Email
+	event.TargetID, event.TargetEmail = user.ID, user.Email
+	event.Details["appealID"] = strconv.FormatUint(uint64(appeal.ID), 10)
+	audit.Record(event)
+
+	return c.Status(fiber.StatusCreated).JSON(&appeal)
+}
+
+// List appeals, oldest first by default.
+//
+// Query: status (pending, upheld or overturned; defaults to pending), sort (oldest or newest), limit and cursor.
+func GetAppeals(c *fiber.Ctx) error {
+	p, err := pagination.Parse(c, pagination.Limits{Default: 20, Max: 100}, appealSorts, "oldest")
+	if err != nil {
+		return paginationError(c, err)
+	}
+
+	base := database.DB.Model(&models.Appeal{}).Where("status = ?", c.Query("status", models.AppealPending))
+	total, err := pagination.Count(base)
+	if err != nil {
+		return paginationError(c, err)
+	}
+	var appeals []models.Appeal
+	if err := p.Query(base, "id").Find(&appeals).Error; err != nil {
+		return paginationError(c, err)
+	}
+	page := pagination.NewPage(c, p, appeals, func(a *models.Appeal) pagination.Key {
+		return pagination.Key{Value: a.CreatedAt, ID: a.ID}
+	}, total)
+	return c.Status(fiber.StatusOK).JSON(&page)
+}
+
+// Decide an appeal. Overturning it makes the account active again. The user is emailed the decision.
+//
+// Body: decision (upheld or overturned) and response, which is shown to the user.
+func DecideAppeal(c *fiber.Ctx) error {
+	var data map[string]string
+	if err := c.BodyParser(&data); err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	decision, response := data["decision"], strings.TrimSpace(data["response"])
+	if decision != models.AppealUpheld && decision != models.AppealOverturned {
+		rp := models.ResponsePacket{Error: true, Code: "invalid_decision", Message: "Decision must be upheld or overturned."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	if response == "" {
+		rp := models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Please write a response to the user."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	actorID, privilege := actorFromClaims(c)
+	var appeal models.Appeal
+	var user models.User
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", c.Params("id")).First(&appeal).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errAppealNotFound
+			}
+			return err
+		}
+		if appeal.Status != models.AppealPending {
+			return errAppealDecided
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", appeal.UserID).First(&user).Error; err != nil {
+			return err
+		}
+		if user.ID == actorID || user.Privilege <= privilege {
+			return errUserProtected
+		}
+
+		now := time.Now()
+		appeal.Status, appeal.Response, appeal.DecidedByID, appeal.DecidedAt = decision, response, &actorID, &now
+		if err := tx.Select("status", "response", "decided_by_id", "decided_at").Save(&appeal).Error; err != nil {
+			return err
+		}
+		if decision == models.AppealOverturned {
+			_, err := setAccountStatus(tx, &user, models.AccountActive, nil, "", actorID)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return accountStatusError(c, err)
+	}
+	if decision == models.AppealOverturned {
+		middleware.InvalidateSession(user.ID)
+	}
+	go notifyAppealDecision(user, appeal)
+
+	event := newAuditEvent(c, audit.AppealDecided)
+	event.TargetID, event.TargetEmail = user.ID, user.Email
+	event.Details["appealID"] = strconv.FormatUint(uint64(appeal.ID), 10)
+	event.Details["decision"] = decision
+	audit.Record(event)
+
+	return c.Status(fiber.StatusOK).JSON(&appeal)
+}
+
+func notifyAccountStatus(user models.User, appealToken string) {
+	var subject, message string
+	switch user.Status {
+	case models.AccountSuspended:
+		subject = "Your account has been suspended"
+		message = fmt.Sprintf("<p>Your account has been suspended until %s.</p>", user.SuspendedUntil.UTC().Format(time.RFC1123))
+	case models.AccountBanned:
+		subject = "Your account has been banned"
+		message = "<p>Your account has been banned.</p>"
+	default:
+		subject = "Your account has been reinstated"
+		message = "<p>Your account is active again. You can sign in as usual.</p>"
+	}
+	if user.StatusReason != "" {
+		message += fmt.Sprintf("<p>Reason:<br>%s</p>", html.EscapeString(user.StatusReason))
+	}
+	if appealToken != "" {
+		message += fmt.Sprintf(`<p>If you think this is a mistake, you can <a href="%s/appeals/%s">appeal the decision</a>.</p>`, os.Getenv("API_URL"), appealToken)
+	}
+
+	body := fmt.Sprintf(`
+		<html>
+			<div  style="font-size:20px; font-family: Arial, serif;">
+				<p>Hi there,</p>
+				%s
+			</div>
+		</html>
+		`, message)
+
+	if err := sendHTMLEmail(user.Email, subject, body); err != nil {
+		log.Printf("Error sending account status notice: %s", err.Error())
+	}
+}
+
+func notifyAppealDecision(user models.User, appeal models.Appeal) {
+	outcome := "Your appeal was reviewed and the decision stands."
+	if appeal.Status == models.AppealOverturned {
+		outcome = "Your appeal was successful and your account is active again."
+	}
+
+	body := fmt.Sprintf(`
+		<html>
+			<div  style="font-size:20px; font-family: Arial, serif;">
+				<p>Hi there,</p>
+				<p>%s</p>
+				<p>%s</p>
+			</div>
+		</html>
+		`, outcome, html.EscapeString(appeal.Response))
+
+	if err := sendHTMLEmail(user.Email, "Your appeal has been decided", body); err != nil {
+		log.Printf("Error sending appeal decision: %s", err.Error())
+	}
+}
+
+func accountStatusError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errTargetNotFound):
+		rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "User not found!"}
+		return c.Status(fiber.StatusNotFound).JSON(rp)
+	case errors.Is(err, errUserProtected):
+		rp := models.ResponsePacket{Error: true, Code: "forbidden", Message: "You can only change the status of users with a lower privilege than yours."}
+		return c.Status(fiber.StatusForbidden).JSON(rp)
+	case errors.Is(err, errAppealInvalid):
+		rp := models.ResponsePacket{Error: true, Code: "invalid_token", Message: "This appeal link is invalid or no longer applies."}
+		return c.Status(fiber.StatusNotFound).JSON(rp)
+	case errors.Is(err, errNothingToAppeal):
+		rp := models.ResponsePacket{Error: true, Code: "account_active", Message: "Your account is active. There is nothing to appeal."}
+		return c.Status(fiber.StatusConflict).JSON(rp)
+	case errors.Is(err, errAppealPending):
+		rp := models.ResponsePacket{Error: true, Code: "appeal_pending", Message: "You already have an appeal waiting for a decision."}
+		return c.Status(fiber.StatusConflict).JSON(rp)
+	case errors.Is(err, errAppealNotFound):
+		rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "Appeal not found!"}
+		return c.Status(fiber.StatusNotFound).JSON(rp)
+	case errors.Is(err, errAppealDecided):
+		rp := models.ResponsePacket{Error: true, Code: "appeal_decided", Message: "This appeal has already been decided."}
+		return c.Status(fiber.StatusConflict).JSON(rp)
+	}
+	rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+	return c.Status(fiber.StatusInternalServerError).JSON(rp)
+}
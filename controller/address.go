@@ -0,0 +1,263 @@
+package controller
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/Elimists/go-app/address"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var errAddressNotFound = errors.New("address not found")
+
+// Fields a client may send when adding or updating an address. Nil fields are left unchanged on update.
+type addressInput struct {
+	StreetAddress *string `json:"streetAddress"`
+	City          *string `json:"city"`
+	State         *string `json:"state"`
+	ZipCode       *string `json:"zipCode"`
+	Country       *string `json:"country"`
+	IsActive      *bool   `json:"isActive"`
+}
+
+func (in *addressInput) applyTo(a *models.UserAddress) {
+	if in.StreetAddress != nil {
+		a.StreetAddress = *in.StreetAddress
+	}
+	if in.City != nil {
+		a.City = *in.City
+	}
+	if in.State != nil {
+		a.State = *in.State
+	}
+	if in.ZipCode != nil {
+		a.ZipCode = *in.ZipCode
+	}
+	if in.Country != nil {
+		a.Country = *in.Country
+	}
+	if in.IsActive != nil {
+		a.IsActive = *in.IsActive
+	}
+}
+
+// List the user's addresses, default address first.
+func GetAddress(c *fiber.Ctx) error {
+	details, rp := addressOwner(c)
+	if rp != nil {
+		return c.Status(rpStatus(rp)).JSON(rp)
+	}
+
+	var addresses []models.UserAddress
+	if err := database.DB.Where("user_details_id = ?", details.ID).Order("is_active desc, id").Find(&addresses).Error; err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&addresses)
+}
+
+// Add an address. The first address a user adds becomes their default.
+func AddAddress(c *fiber.Ctx) error {
+	var in addressInput
+	if err := c.BodyParser(&in); err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	details, rp := addressOwner(c)
+	if rp != nil {
+		return c.Status(rpStatus(rp)).JSON(rp)
+	}
+
+	addr := models.UserAddress{UserDetailsID: details.ID}
+	in.applyTo(&addr)
+	if rp := validateAddress(&addr); rp != nil {
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockAddressBook(tx, details.ID); err != nil {
+			return err
+		}
+
+		var count int64
+		if err := tx.Model(&models.UserAddress{}).Where("user_details_id = ?", details.ID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			addr.IsActive = true
+		}
+		if addr.IsActive {
+			if err := clearDefaultAddress(tx, details.ID); err != nil {
+				return err
+			}
+		}
+		return tx.Create(&addr).Error
+	})
+	if err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not add address."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(&addr)
+}
+
+// Update some or all fields of an address. Setting isActive makes it the default.
+func UpdateAddress(c *fiber.Ctx) error {
+	var in addressInput
+	if err := c.BodyParser(&in); err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	details, rp := addressOwner(c)
+	if rp != nil {
+		return c.Status(rpStatus(rp)).JSON(rp)
+	}
+
+	var addr models.UserAddress
+	var invalid *models.ResponsePacket
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockAddressBook(tx, details.ID); err != nil {
+			return err
+		}
+		if err := findAddress(tx, details.ID, c.Params("addressID"), &addr); err != nil {
+			return err
+		}
+
+		wasActive := addr.IsActive
+		in.applyTo(&addr)
+		if invalid = validateAddress(&addr); invalid != nil {
+			return gorm.ErrInvalidData
+		}
+
+		// The default can only move to another address, never be unset outright.
+		if wasActive && !addr.IsActive {
+			addr.IsActive = true
+		}
+		if addr.IsActive && !wasActive {
+			if err := clearDefaultAddress(tx, details.ID); err != nil {
+				return err
+			}
+		}
+		return tx.Save(&addr).Error
+	})
+	if invalid != nil {
+		return c.Status(fiber.StatusNotAcceptable).JSON(invalid)
+	}
+	if errors.Is(err, errAddressNotFound) {
+		rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "Address not found."}
+		return c.Status(fiber.StatusNotFound).JSON(rp)
+	}
+	if err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not update address."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&addr)
+}
+
+// Delete an address. If it was the default, the most recently added remaining address takes over.
+func DeleteAddress(c *fiber.Ctx) error {
+	details, rp := addressOwner(c)
+	if rp != nil {
+		return c.Status(rpStatus(rp)).JSON(rp)
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockAddressBook(tx, details.ID); err != nil {
+			return err
+		}
+
+		var addr models.UserAddress
+		if err := findAddress(tx, details.ID, c.Params("addressID"), &addr); err != nil {
+			return err
+		}
+		if err := tx.Delete(&addr).Error; err != nil {
+			return err
+		}
+		if !addr.IsActive {
+			return nil
+		}
+
+		var next models.UserAddress
+		err := tx.Where("user_details_id = ?", details.ID).Order("id desc").First(&next).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Model(&next).Update("is_active", true).Error
+	})
+	if errors.Is(err, errAddressNotFound) {
+		rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "Address not found."}
+		return c.Status(fiber.StatusNotFound).JSON(rp)
+	}
+	if err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not delete address."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	rp = &models.ResponsePacket{Error: false, Code: "address_deleted", Message: "Address deleted successfully."}
+	return c.Status(fiber.StatusOK).JSON(rp)
+}
+
+// Check that :id is the caller's own user ID and load their details.
+func addressOwner(c *fiber.Ctx) (*models.UserDetails, *models.ResponsePacket) {
+	claims := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	userID, ok := claims["id"].(float64)
+	if !ok || strconv.FormatUint(uint64(userID), 10) != c.Params("id") {
+		return nil, &models.ResponsePacket{Error: true, Code: "forbidden", Message: "You can only manage your own addresses."}
+	}
+
+	var details models.UserDetails
+	if err := database.DB.Where("user_id = ?", uint(userID)).First(&details).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &models.ResponsePacket{Error: true, Code: "not_found", Message: "User details not found."}
+		}
+		return nil, &models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+	}
+	return &details, nil
+}
+
+func rpStatus(rp *models.ResponsePacket) int {
+	switch rp.Code {
+	case "forbidden":
+		return fiber.StatusForbidden
+	case "not_found":
+		return fiber.StatusNotFound
+	}
+	return fiber.StatusInternalServerError
+}
+
+func validateAddress(addr *models.UserAddress) *models.ResponsePacket {
+	address.Normalize(addr)
+	if err := address.Validate(addr); err != nil {
+		return &models.ResponsePacket{Error: true, Code: "invalid_address", Message: err.Error()}
+	}
+	return nil
+}
+
+// Lock the user's details row so concurrent address writes for the same user run one at a time.
+func lockAddressBook(tx *gorm.DB, detailsID uint) error {
+	return tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").Where("id = ?", detailsID).First(&models.UserDetails{}).Error
+}
+
+func clearDefaultAddress(tx *gorm.DB, detailsID uint) error {
+	return tx.Model(&models.UserAddress{}).Where("user_details_id = ? AND is_active = ?", detailsID, true).Update("is_active", false).Error
+}
+
+func findAddress(tx *gorm.DB, detailsID uint, id string, addr *models.UserAddress) error {
+	err := tx.Where("id = ? AND user_details_id = ?", id, detailsID).First(addr).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errAddressNotFound
+	}
+	return err
+}
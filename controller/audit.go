@@ -0,0 +1,123 @@
+package controller
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/pagination"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var auditSorts = map[string]pagination.Sort{
+	"newest": {Column: "id", Desc: true},
+}
+
+// Query the security audit log, newest first.
+//
+// Supports ?actor=, ?target= (user ID or email), ?type= (comma separated), ?from= and ?to= (RFC3339), ?limit= and ?cursor=.
+func GetAuditLog(c *fiber.Ctx) error {
+	p, err := pagination.Parse(c, pagination.Limits{Default: 50, Max: 200}, auditSorts, "newest")
+	if err != nil {
+		return paginationError(c, err)
+	}
+
+	var filter audit.Filter
+
+	if actor := c.Query("actor"); actor != "" {
+		if id, err := strconv.ParseUint(actor, 10, 64); err == nil {
+			filter.ActorID = uint(id)
+		} else {
+			filter.ActorEmail = actor
+		}
+	}
+
+	if target := c.Query("target"); target != "" {
+		if id, err := strconv.ParseUint(target, 10, 64); err == nil {
+			filter.TargetID = uint(id)
+		} else {
+			filter.TargetEmail = target
+		}
+	}
+
+	if types := c.Query("type"); types != "" {
+		for _, t := range strings.Split(types, ",") {
+			filter.Types = append(filter.Types, audit.EventType(strings.TrimSpace(t)))
+		}
+	}
+
+	if from := c.Query("from"); from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, from); err != nil {
+			rp := models.ResponsePacket{Error: true, Code: "invalid_time", Message: "'from' must be an RFC3339 timestamp."}
+			return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+		}
+	}
+	if to := c.Query("to"); to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, to); err != nil {
+			rp := models.ResponsePacket{Error: true, Code: "invalid_time", Message: "'to' must be an RFC3339 timestamp."}
+			return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+		}
+	}
+
+	base := audit.Query(database.DB, filter)
+	total, err := pagination.Count(base)
+	if err != nil {
+		return paginationError(c, err)
+	}
+	var entries []models.AuditEntry
+	if err := p.Query(base, "id").Find(&entries).Error; err != nil {
+		return paginationError(c, err)
+	}
+
+	page := pagination.NewPage(c, p, entries, func(e *models.AuditEntry) pagination.Key {
+		return pagination.Key{Value: e.ID, ID: e.ID}
+	}, total)
+	return c.Status(fiber.StatusOK).JSON(&page)
+}
+
+// Check the audit log hash chain for tampering.
+func VerifyAuditLog(c *fiber.Ctx) error {
+	brokenAt, err := audit.VerifyChain(database.DB)
+	if err != nil {
+		if errors.Is(err, audit.ErrChainBroken) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": true, "code": "chain_broken", "brokenAt": brokenAt})
+		}
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	rp := models.ResponsePacket{Error: false, Code: "chain_intact", Message: "Audit log is intact."}
+	return c.Status(fiber.StatusOK).JSON(rp)
+}
+
+// Build an audit event for the current request. The actor is taken from the JWT when there is one.
+func newAuditEvent(c *fiber.Ctx, t audit.EventType) audit.Event {
+	e := audit.Event{
+		Type:      t,
+		IP:        c.IP(),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+		Details:   map[string]string{},
+	}
+
+	if token, ok := c.Locals("user").(*jwt.Token); ok {
+		claims := token.Claims.(jwt.MapClaims)
+		e.ActorEmail, _ = claims["email"].(string)
+		if id, ok := claims["id"].(float64); ok {
+			e.ActorID = uint(id)
+		}
+
+		// Credit the staff member, not the user they are impersonating.
+		if imp := impersonationFromClaims(claims); imp != nil {
+			e.Details["impersonatedID"] = strconv.FormatUint(uint64(e.ActorID), 10)
+			e.Details["impersonationSessionID"] = strconv.FormatUint(uint64(imp.SessionID), 10)
+			e.ActorID, e.ActorEmail = imp.ActorID, imp.ActorEmail
+		}
+	}
+
+	return e
+}
@@ -1,7 +1,10 @@
 package controller
 
 import (
+	crand "crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,7 +18,10 @@ import (
 	"time"
 	"unicode"
 
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/authn"
 	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/middleware"
 	"github.com/Elimists/go-app/models"
 	"github.com/eapache/channels"
 	"github.com/gofiber/fiber/v2"
@@ -64,6 +70,11 @@ func Register(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
 	}
 
+	inviteCode := strings.TrimSpace(data["invite"])
+	if rp := checkRegistrationAllowed(string(decodedEmail), inviteCode); rp != nil {
+		return c.Status(fiber.StatusForbidden).JSON(rp)
+	}
+
 	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(data["password"]), 12)
 	verificationCode := generateVerificationCode()
 	auth := models.User{
@@ -81,9 +92,22 @@ func Register(c *fiber.Ctx) error {
 		},
 	}
 
-	userErr := database.DB.Create(&auth).Error
+	userErr := database.DB.Transaction(func(tx *gorm.DB) error {
+		if inviteCode != "" {
+			invite, err := consumeInvite(tx, inviteCode)
+			if err != nil {
+				return err
+			}
+			auth.Privilege = invite.Privilege
+		}
+		return tx.Create(&auth).Error
+	})
 
 	if userErr != nil {
+		if errors.Is(userErr, errInviteInvalid) {
+			rp := models.ResponsePacket{Error: true, Code: "invalid_invite", Message: "Invite code is invalid or has expired."}
+			return c.Status(fiber.StatusForbidden).JSON(rp)
+		}
 		if strings.Contains(userErr.Error(), "Duplicate entry") {
 			rp := models.ResponsePacket{Error: true, Code: "duplicate_email", Message: "Email already exists!"}
 			return c.Status(fiber.StatusNotAcceptable).JSON(rp)
@@ -134,16 +158,42 @@ func Login(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
 	}
 
-	var auth models.User
+	event := newAuditEvent(c, audit.LoginFailed)
+	event.TargetEmail = data["email"]
 
-	if err := database.DB.Where("email = ?", data["email"]).First(&auth).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
+	user, err := authn.Default.Authenticate(data["email"], data["password"])
+	if user != nil {
+		event.TargetID = user.ID
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, authn.ErrUserNotFound):
+			event.Details["reason"] = "account_not_found"
+			audit.Record(event)
 			rp := models.ResponsePacket{Error: true, Code: "account_not_found", Message: "Account not found!"}
 			return c.Status(fiber.StatusNotFound).JSON(rp)
+		case errors.Is(err, authn.ErrInvalidCredentials):
+			event.Details["reason"] = "incorrect_password"
+			audit.Record(event)
+			rp := models.ResponsePacket{Error: true, Code: "incorrect_password", Message: "Password is not correct"}
+			return c.Status(fiber.StatusBadRequest).JSON(rp)
+		default:
+			log.Printf("Error authenticating user: %s", err.Error())
+			rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not log in."}
+			return c.Status(fiber.StatusInternalServerError).JSON(rp)
 		}
 	}
+	auth := *user
+
+	if rp := accountRefusal(&auth); rp != nil {
+		event.Details["reason"] = rp.Code
+		audit.Record(event)
+		return c.Status(fiber.StatusForbidden).JSON(rp)
+	}
 
 	if !auth.Verified {
+		event.Details["reason"] = "email_unverified"
+		audit.Record(event)
 		rp := models.ResponsePacket{Error: true, Code: "email_unverified", Message: "User is not verfied."}
 		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
 	}
@@ -155,20 +205,14 @@ func Login(c *fiber.Ctx) error {
 		expiry = jwt.NewNumericDate(time.Now().Add(240 * time.Hour))
 	}
 
-	if err := bcrypt.CompareHashAndPassword(auth.Password, []byte(data["password"])); err != nil {
-		rp := models.ResponsePacket{Error: true, Code: "incorrect_password", Message: "Password is not correct"}
-		return c.Status(fiber.StatusBadRequest).JSON(rp)
+	if auth.PasswordResetRequired {
+		event.Details["reason"] = "password_reset_required"
+		audit.Record(event)
+		rp := models.ResponsePacket{Error: true, Code: "password_reset_required", Message: "Your password must be reset before you can log in. Check your email for a reset link."}
+		return c.Status(fiber.StatusForbidden).JSON(rp)
 	}
 
-	claims := jwt.MapClaims{
-		"email":     auth.Email,
-		"id":        auth.ID,
-		"verified":  auth.Verified,
-		"privilege": auth.Privilege,
-		"exp":       expiry,
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString([]byte(os.Getenv("SECRET_KEY")))
+	signedToken, err := signToken(newUserClaims(&auth, expiry))
 
 	if err != nil {
 		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Could not sign token."}
@@ -177,6 +221,12 @@ func Login(c *fiber.Ctx) error {
 
 	database.DB.Model(&auth).Where("email = ?", data["email"]).Update("updated_at", time.Now()) // update the last logged in datetime
 
+	event.Type = audit.LoginSucceeded
+	event.ActorID, event.ActorEmail = auth.ID, auth.Email
+	audit.Record(event)
+
+	recordSignIn(c, &auth)
+
 	c.Append(fmt.Sprintf("X-%s-JWT-Token", os.Getenv("API_NAME")), signedToken)
 
 	c.Cookie(&fiber.Cookie{
@@ -267,6 +317,11 @@ func VerifyEmail(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(rp)
 	}
 
+	event := newAuditEvent(c, audit.EmailVerified)
+	event.ActorID, event.ActorEmail = user.ID, user.Email
+	event.TargetID, event.TargetEmail = user.ID, user.Email
+	audit.Record(event)
+
 	rp := models.ResponsePacket{Error: false, Code: "verified", Message: "Verification successfull."}
 	return c.Status(fiber.StatusAccepted).JSON(rp)
 }
@@ -280,13 +335,8 @@ func UpdatePassword(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
 	}
 
-	if data["email"] == "" {
-		rp := models.ResponsePacket{Error: true, Code: "missing_data", Message: "Email field is empty."}
-		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
-	}
-
-	decodedOldPassword, err := base64.StdEncoding.DecodeString(data["oldpassword"])
-	decodedNewPassword, err := base64.StdEncoding.DecodeString(data["newpassword"])
+	decodedOldPassword, _ := base64.StdEncoding.DecodeString(data["oldpassword"])
+	decodedNewPassword, _ := base64.StdEncoding.DecodeString(data["newpassword"])
 	if len(string(decodedOldPassword)) <= 0 || len(string(decodedNewPassword)) <= 0 {
 		rp := models.ResponsePacket{Error: true, Code: "missing_data", Message: "Password field(s) are empty."}
 		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
@@ -302,17 +352,10 @@ func UpdatePassword(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
 	}
 
-	decodedEmail, err := base64.StdEncoding.DecodeString(data["email"])
-	if err != nil {
-		rp := models.ResponsePacket{Error: true, Code: "invalid_email", Message: "Invalid email."}
-		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
-	}
-
-	updatedNewHashedPassword, _ := bcrypt.GenerateFromPassword([]byte(decodedNewPassword), 12)
-
-	var auth models.User
-
-	if err := database.DB.Model(&auth).Where("email = ?", decodedEmail).Updates(map[string]interface{}{"password": string(updatedNewHashedPassword)}).Error; err != nil {
+	// The account is always the signed in one. An email in the body is ignored.
+	userID, _ := actorFromClaims(c)
+	var user models.User
+	if err := database.DB.Where("id = ?", userID).First(&user).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "Unable to update password for user. User not found."}
 			return c.Status(fiber.StatusNotFound).JSON(rp)
@@ -320,8 +363,35 @@ func UpdatePassword(c *fiber.Ctx) error {
 		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not update password"}
 		return c.Status(fiber.StatusInternalServerError).JSON(rp)
 	}
+	if user.AuthProvider != "" && user.AuthProvider != authn.ProviderLocal {
+		rp := models.ResponsePacket{Error: true, Code: "directory_account", Message: "This account signs in through your organization's directory. Please change your password there."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	if err := bcrypt.CompareHashAndPassword(user.Password, decodedOldPassword); err != nil {
+		event := newAuditEvent(c, audit.PasswordChangeFailed)
+		event.TargetID, event.TargetEmail = user.ID, user.Email
+		audit.Record(event)
+		rp := models.ResponsePacket{Error: true, Code: "invalid_credentials", Message: "Current password is incorrect."}
+		return c.Status(fiber.StatusUnauthorized).JSON(rp)
+	}
+
+	updatedNewHashedPassword, _ := bcrypt.GenerateFromPassword(decodedNewPassword, 12)
+	if err := database.DB.Model(&user).Updates(map[string]interface{}{
+		"password":             updatedNewHashedPassword,
+		"sessions_valid_after": time.Now().Unix(),
+	}).Error; err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not update password"}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+	middleware.InvalidateSession(user.ID)
+
+	event := newAuditEvent(c, audit.PasswordChanged)
+	event.TargetID, event.TargetEmail = user.ID, user.Email
+	event.Details["method"] = "update"
+	audit.Record(event)
 
-	return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthroized"})
+	rp := models.ResponsePacket{Error: false, Code: "password_updated", Message: "Password has been updated. Please log in again."}
+	return c.Status(fiber.StatusOK).JSON(rp)
 }
 
 /*Password Reset*/
@@ -353,8 +423,12 @@ func ResetPassword(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(rp)
 	}
 
-	err := SendPasswordResetEmail(user.Email)
-	if err != nil {
+	if user.AuthProvider != "" && user.AuthProvider != authn.ProviderLocal {
+		rp := models.ResponsePacket{Error: true, Code: "directory_account", Message: "This account signs in through your organization's directory. Please reset your password there."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	if err := issuePasswordReset(&user); err != nil {
 		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Could not send email."}
 		return c.Status(fiber.StatusInternalServerError).JSON(rp)
 	}
@@ -362,31 +436,137 @@ func ResetPassword(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"message": "Email sent!"})
 }
 
+// Set a new password using the token from a password reset email.
+//
+// Signs the user out everywhere and lifts any forced reset on the account.
+func ConfirmPasswordReset(c *fiber.Ctx) error {
+	var data map[string]string
+
+	if err := c.BodyParser(&data); err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	if data["password"] != data["password2"] {
+		rp := models.ResponsePacket{Error: true, Code: "password_mismatch", Message: "Passwords do not match."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	if !passwordIsValid(data["password"]) {
+		rp := models.ResponsePacket{Error: true, Code: "invalid_password", Message: "Password is not strong enough."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	var reset models.PasswordReset
+	if err := database.DB.Where("token_hash = ? AND expires_at > ?", hashToken(c.Params("token")), time.Now()).First(&reset).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			rp := models.ResponsePacket{Error: true, Code: "invalid_token", Message: "Reset link is invalid or has expired."}
+			return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+		}
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(data["password"]), 12)
+
+	var user models.User
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("id = ?", reset.UserID).First(&user).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&user).Updates(map[string]interface{}{
+			"password":                hashedPassword,
+			"password_reset_required": false,
+			"sessions_valid_after":    time.Now().Unix(),
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", reset.UserID).Delete(&models.PasswordReset{}).Error
+	})
+	if err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not update password"}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+	middleware.InvalidateSession(user.ID)
+
+	event := newAuditEvent(c, audit.PasswordChanged)
+	event.ActorID, event.ActorEmail = user.ID, user.Email
+	event.TargetID, event.TargetEmail = user.ID, user.Email
+	event.Details["method"] = "reset_link"
+	audit.Record(event)
+
+	rp := models.ResponsePacket{Error: false, Code: "password_reset", Message: "Password has been reset. Please log in again."}
+	return c.Status(fiber.StatusOK).JSON(rp)
+}
+
 /*
  * HELPER FUNCTIONS
  */
-func SendPasswordResetEmail(email string) error {
-
-	auth := smtp.PlainAuth("", "231c63d58c7571", "15065dc065bf4c", "sandbox.smtp.mailtrap.io")
-
-	to := []string{email}
-	subject := "Subject: Password Reset\n"
-	from := "maker@example.com"
-	mime := "MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\n\n"
+func SendPasswordResetEmail(email string, resetLink string) error {
 	body := fmt.Sprintf(`
 		<html>
 			<div  style="font-size:20px; font-family: Arial, serif;">
 				<p>Hi there,</p>
 				<p>It looks like you requested a password reset. If this was you, please click the link below to reset your password.</p>
 				<p>If you did not request a password reset, please ignore this email.</p>
-				<p>Reset your password here: <code style="font-weight: bold;"><button>Reset Password</button></p>
+				<p>Reset your password here: <a href="%s">Reset Password</a></p>
 			</div>
 		</html>
-		`)
-	msg := []byte(subject + mime + body)
+		`, resetLink)
 
-	err := smtp.SendMail("sandbox.smtp.mailtrap.io:2525", auth, from, to, msg)
-	return err
+	return sendHTMLEmail(email, "Password Reset", body)
+}
+
+// Create a single-use reset token for the user and email them the link.
+func issuePasswordReset(user *models.User) error {
+	token, tokenHash, err := generateSecureToken()
+	if err != nil {
+		return err
+	}
+
+	reset := models.PasswordReset{
+		UserID:    user.ID,
+		TokenHash: tokenHash,
+		ExpiresAt: time.Now().Add(time.Minute * 30),
+	}
+	if err := database.DB.Create(&reset).Error; err != nil {
+		return err
+	}
+
+	resetLink := fmt.Sprintf("%s/resetpassword/%s", os.Getenv("API_URL"), token)
+	return SendPasswordResetEmail(user.Email, resetLink)
+}
+
+// The claims every user token carries.
+func newUserClaims(user *models.User, expiry *jwt.NumericDate) jwt.MapClaims {
+	return jwt.MapClaims{
+		"email":     user.Email,
+		"id":        user.ID,
+		"verified":  user.Verified,
+		"privilege": user.Privilege,
+		"iat":       jwt.NewNumericDate(time.Now()),
+		"exp":       expiry,
+	}
+}
+
+func signToken(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(os.Getenv("SECRET_KEY")))
+}
+
+// Returns a random URL safe token and its SHA-256 hash. Only the hash should be stored.
+func generateSecureToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := crand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
 func emailIsValid(s string) bool {
@@ -429,13 +609,6 @@ func generateVerificationCode() string {
 
 // Send the verification code to the user.
 func SendVerificationEmail(email string, verificationLink string) error {
-	// Set up authentication information.
-	auth := smtp.PlainAuth("", "231c63d58c7571", "15065dc065bf4c", "sandbox.smtp.mailtrap.io")
-
-	to := []string{email}
-	subject := "Subject: Makers Verification Code\n"
-	from := "maker@example.com"
-	mime := "MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\n\n"
 	body := fmt.Sprintf(`
 		<html>
 			<div  style="font-size:20px; font-family: Arial, serif;">
@@ -444,8 +617,18 @@ func SendVerificationEmail(email string, verificationLink string) error {
 			</div>
 		</html>
 		`, verificationLink)
-	msg := []byte(subject + mime + body)
 
-	err := smtp.SendMail("sandbox.smtp.mailtrap.io:2525", auth, from, to, msg)
-	return err
+	return sendHTMLEmail(email, "Makers Verification Code", body)
+}
+
+func sendHTMLEmail(email string, subject string, body string) error {
+	// Set up authentication information.
+	auth := smtp.PlainAuth("", "231c63d58c7571", "15065dc065bf4c", "sandbox.smtp.mailtrap.io")
+
+	to := []string{email}
+	from := "maker@example.com"
+	mime := "MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\n\n"
+	msg := []byte("Subject: " + subject + "\n" + mime + body)
+
+	return smtp.SendMail("sandbox.smtp.mailtrap.io:2525", auth, from, to, msg)
 }
@@ -0,0 +1,187 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"os"
+	"regexp"
+
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/media"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/storage"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+const maxAvatarBytes = 4 << 20 // Matches fiber's default body limit.
+
+var (
+	avatarSizes    = []int{512, 256, 64}
+	avatarFileName = regexp.MustCompile(`^(64|256|512)\.(jpg|png)$`)
+	avatarHash     = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// Upload a new profile picture.
+//
+// Multipart form: avatar (the image file) and an optional altText.
+func UploadAvatar(c *fiber.Ctx) error {
+	fileHeader, err := c.FormFile("avatar")
+	if err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Missing avatar file."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	if fileHeader.Size > maxAvatarBytes {
+		rp := models.ResponsePacket{Error: true, Code: "file_too_large", Message: "Profile pictures must be 4 MB or smaller."}
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(rp)
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Could not read upload."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+	data, err := io.ReadAll(io.LimitReader(file, maxAvatarBytes+1))
+	file.Close()
+	if err != nil || len(data) > maxAvatarBytes {
+		rp := models.ResponsePacket{Error: true, Code: "file_too_large", Message: "Profile pictures must be 4 MB or smaller."}
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(rp)
+	}
+
+	img, _, orientation, err := media.Decode(data)
+	switch {
+	case errors.Is(err, media.ErrUnsupportedType):
+		rp := models.ResponsePacket{Error: true, Code: "unsupported_type", Message: "Profile pictures must be JPEG, PNG or WebP images."}
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(rp)
+	case errors.Is(err, media.ErrTooManyPixels):
+		rp := models.ResponsePacket{Error: true, Code: "image_too_large", Message: "Image dimensions are too large."}
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(rp)
+	case err != nil:
+		rp := models.ResponsePacket{Error: true, Code: "invalid_image", Message: "Image could not be read."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	claims := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	var details models.UserDetails
+	if err := database.DB.Where("user_id = ?", uint(claims["id"].(float64))).First(&details).Error; err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "User details not found."}
+		return c.Status(fiber.StatusNotFound).JSON(rp)
+	}
+
+	sum := sha256.Sum256(data)
+	name := hex.EncodeToString(sum[:])
+
+	// Re-encoding from decoded pixels is what strips EXIF and anything else hiding in the file.
+	contentType, ext := media.Format(img)
+	if err := storeAvatarVariants(c.Context(), name, media.Orient(media.Square(img, avatarSizes[0]), orientation), contentType, ext); err != nil {
+		log.Printf("Error storing avatar: %s", err.Error())
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not save profile picture."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	var picture models.UserProfilePicture
+	var oldPicture models.UserProfilePicture
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_details_id = ?", details.ID).First(&picture).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		oldPicture = picture
+
+		picture.UserDetailsID = details.ID
+		picture.UrlSafeName = name
+		picture.Extension = ext
+		picture.ImageAltText = c.FormValue("altText")
+		return tx.Save(&picture).Error
+	})
+	if err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not save profile picture."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	if oldPicture.UrlSafeName != "" && oldPicture.UrlSafeName != name {
+		deleteUnusedAvatar(c.Context(), oldPicture)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"profilePicture": picture, "urls": avatarURLs(&picture)})
+}
+
+// Serve a stored avatar variant. Names are content hashes, so responses can be cached forever.
+func GetAvatar(c *fiber.Ctx) error {
+	name, file := c.Params("name"), c.Params("file")
+	if !avatarHash.MatchString(name) || !avatarFileName.MatchString(file) {
+		rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "Image not found."}
+		return c.Status(fiber.StatusNotFound).JSON(rp)
+	}
+
+	etag := fmt.Sprintf(`"%s-%s"`, name, file)
+	c.Set(fiber.HeaderCacheControl, "public, max-age=31536000, immutable")
+	c.Set(fiber.HeaderETag, etag)
+	if c.Get(fiber.HeaderIfNoneMatch) == etag {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	reader, info, err := storage.Default.Get(c.Context(), "avatars/"+name+"/"+file)
+	if err != nil {
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		if errors.Is(err, storage.ErrNotFound) {
+			rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "Image not found."}
+			return c.Status(fiber.StatusNotFound).JSON(rp)
+		}
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	c.Set(fiber.HeaderContentType, info.ContentType)
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	return c.SendStream(reader, int(info.Size))
+}
+
+// Encode and store every size in the format media.Format picked for the uploaded image.
+func storeAvatarVariants(ctx context.Context, name string, largest image.Image, contentType string, ext string) error {
+	for _, size := range avatarSizes {
+		variant := largest
+		if size != avatarSizes[0] {
+			variant = media.Square(largest, size)
+		}
+
+		var buf bytes.Buffer
+		if err := media.Encode(&buf, variant, ext); err != nil {
+			return err
+		}
+		key := fmt.Sprintf("avatars/%s/%d.%s", name, size, ext)
+		if err := storage.Default.Put(ctx, key, &buf, int64(buf.Len()), contentType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove an old avatar's files unless someone else uploaded the same image.
+func deleteUnusedAvatar(ctx context.Context, old models.UserProfilePicture) {
+	var count int64
+	if err := database.DB.Model(&models.UserProfilePicture{}).Where("url_safe_name = ?", old.UrlSafeName).Count(&count).Error; err != nil || count > 0 {
+		return
+	}
+	for _, size := range avatarSizes {
+		if err := storage.Default.Delete(ctx, fmt.Sprintf("avatars/%s/%d.%s", old.UrlSafeName, size, old.Extension)); err != nil {
+			log.Printf("Error deleting old avatar: %s", err.Error())
+		}
+	}
+}
+
+func avatarURLs(picture *models.UserProfilePicture) map[string]string {
+	urls := map[string]string{}
+	for _, size := range avatarSizes {
+		urls[fmt.Sprint(size)] = fmt.Sprintf("%s/avatars/%s/%d.%s", os.Getenv("API_URL"), picture.UrlSafeName, size, picture.Extension)
+	}
+	return urls
+}
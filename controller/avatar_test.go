@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Elimists/go-app/storage"
+	"github.com/gofiber/fiber/v2"
+)
+
+// A photo with an EXIF block carrying something the uploader would not want published.
+func exifPhoto(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 800, 600))
+	for y := 0; y < 600; y++ {
+		for x := 0; x < 800; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 90, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	segment := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x00GPS 51.5007N 0.1246W")
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+	data := buf.Bytes()
+	out := append(append(append([]byte{}, data[:2]...), app1...), segment...)
+	return append(out, data[2:]...)
+}
+
+// Lists the markers of a JPEG's header segments, up to the start of the image data.
+func jpegMarkers(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var markers []byte
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; i += 2 + int(binary.BigEndian.Uint16(data[i+2:])) {
+		markers = append(markers, data[i+1])
+		if data[i+1] == 0xDA {
+			break
+		}
+	}
+	return markers
+}
+
+func uploadAvatar(t *testing.T, app *fiber.App, data []byte) (int, map[string]string) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("avatar", "me.jpg")
+	part.Write(data)
+	form.Close()
+
+	req := httptest.NewRequest(fiber.MethodPut, "/users/me/avatar", &body)
+	req.Header.Set(fiber.HeaderContentType, form.FormDataContentType())
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var out struct {
+		URLs map[string]string `json:"urls"`
+	}
+	json.NewDecoder(res.Body).Decode(&out)
+	return res.StatusCode, out.URLs
+}
+
+func TestUploadAvatarRejectsOtherTypes(t *testing.T) {
+	useTestDB(t)
+	storage.Default = storage.NewLocal(t.TempDir(), "", nil)
+	user := createTestUser(t, "member@example.org", 9)
+
+	app := fiber.New()
+	app.Put("/users/me/avatar", signedInAs(user), UploadAvatar)
+	for name, data := range map[string][]byte{
+		"text": []byte("<svg xmlns='http://www.w3.org/2000/svg'></svg>"),
+		"gif":  []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;"),
+	} {
+		if status, _ := uploadAvatar(t, app, data); status != fiber.StatusUnsupportedMediaType {
+			t.Errorf("%s: status = %d, want 415", name, status)
+		}
+	}
+}
+
+func TestUploadAvatarStripsEXIF(t *testing.T) {
+	useTestDB(t)
+	t.Setenv("API_URL", "")
+	storage.Default = storage.NewLocal(t.TempDir(), "", nil)
+	user := createTestUser(t, "member@example.org", 9)
+
+	app := fiber.New()
+	app.Put("/users/me/avatar", signedInAs(user), UploadAvatar)
+	app.Get("/avatars/:name/:file", GetAvatar)
+
+	photo := exifPhoto(t)
+	if markers := jpegMarkers(t, photo); bytes.IndexByte(markers, 0xE1) < 0 {
+		t.Fatalf("test photo has no APP1 segment: %x", markers)
+	}
+	status, urls := uploadAvatar(t, app, photo)
+	if status != fiber.StatusOK || len(urls) != len(avatarSizes) {
+		t.Fatalf("status = %d, urls = %v", status, urls)
+	}
+
+	for _, size := range avatarSizes {
+		url := urls[uintString(uint(size))]
+		res, err := app.Test(httptest.NewRequest(fiber.MethodGet, url, nil), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != fiber.StatusOK {
+			t.Fatalf("%s: status = %d", url, res.StatusCode)
+		}
+
+		config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+		if err != nil || config.Width != size || config.Height != size {
+			t.Errorf("%s: %dx%d, %v, want %dx%d", url, config.Width, config.Height, err, size, size)
+		}
+		if markers := jpegMarkers(t, data); bytes.IndexByte(markers, 0xE1) >= 0 || bytes.Contains(data, []byte("GPS")) {
+			t.Errorf("%s still carries EXIF: markers %x", url, markers)
+		}
+		if got := res.Header.Get(fiber.HeaderCacheControl); got != "public, max-age=31536000, immutable" {
+			t.Errorf("%s: Cache-Control = %q", url, got)
+		}
+		if got := res.Header.Get(fiber.HeaderContentType); got != "image/jpeg" {
+			t.Errorf("%s: Content-Type = %q", url, got)
+		}
+
+		// The ETag lets browsers revalidate without downloading again.
+		req := httptest.NewRequest(fiber.MethodGet, url, nil)
+		req.Header.Set(fiber.HeaderIfNoneMatch, res.Header.Get(fiber.HeaderETag))
+		if res, err := app.Test(req, -1); err != nil || res.StatusCode != fiber.StatusNotModified {
+			t.Errorf("%s: revalidation = %v, %v, want 304", url, res.StatusCode, err)
+		}
+	}
+}
+
+func TestGetAvatarMissing(t *testing.T) {
+	storage.Default = storage.NewLocal(t.TempDir(), "", nil)
+	app := fiber.New()
+	app.Get("/avatars/:name/:file", GetAvatar)
+
+	name := "0000000000000000000000000000000000000000000000000000000000000000"
+	for target, want := range map[string]int{
+		"/avatars/" + name + "/256.jpg": fiber.StatusNotFound,
+		"/avatars/" + name + "/100.jpg": fiber.StatusNotFound,
+		"/avatars/not-a-hash/256.jpg":   fiber.StatusNotFound,
+	} {
+		res, err := app.Test(httptest.NewRequest(fiber.MethodGet, target, nil), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A missing file must not be cached forever, or it would stay missing once uploaded.
+		if res.StatusCode != want || res.Header.Get(fiber.HeaderCacheControl) == "public, max-age=31536000, immutable" {
+			t.Errorf("%s: status = %d, Cache-Control = %q", target, res.StatusCode, res.Header.Get(fiber.HeaderCacheControl))
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package controller
+
+import (
+	"github.com/Elimists/go-app/challenge"
+	"github.com/Elimists/go-app/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Hand out a fresh challenge so clients can solve it before they are asked to.
+func GetChallenge(c *fiber.Ctx) error {
+	issued, err := challenge.Default.Issue()
+	if err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Could not issue challenge."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+	return c.Status(fiber.StatusOK).JSON(&issued)
+}
@@ -0,0 +1,536 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/markup"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/pagination"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	maxCommentLength = 10000
+	maxCommentDepth  = 6
+	deletedComment   = "[deleted]"
+	hiddenComment    = "[hidden by a moderator]"
+)
+
+var (
+	errCommentNotFound  = errors.New("comment not found")
+	errCommentForbidden = errors.New("not allowed to change this comment")
+	errCommentDeleted   = errors.New("comment was deleted")
+	errCommentTooDeep   = errors.New("thread is nested too deeply")
+	errNotAQuestion     = errors.New("comment is not a question")
+	errInvalidAnswer    = errors.New("answer is not a reply in the thread")
+)
+
+var commentSorts = map[string]pagination.Sort{
+	"newest": {Column: "created_at", Desc: true, Time: true},
+	"oldest": {Column: "created_at", Time: true},
+}
+
+var replySorts = map[string]pagination.Sort{
+	"oldest": {Column: "id"},
+}
+
+// Threads in a listing carry at most this many replies. The rest are paged through GetCommentReplies.
+const threadReplyLimit = 20
+
+// List a device's discussion threads a page at a time. Each top level comment carries its first replies, oldest first,
+// to be nested by parentID, and how many replies it has in total. Comments hidden by moderators keep their place, but
+// only moderators see what they said.
+//
+// Query: sort (newest or oldest), filter (questions or unanswered), limit and cursor.
+func GetDeviceComments(c *fiber.Ctx) error {
+	device, err := loadVisibleDevice(c)
+	if err != nil {
+		return deviceWriteError(c, err)
+	}
+	p, err := pagination.Parse(c, pagination.Limits{Default: 8, Max: 50}, commentSorts, "newest")
+	if err != nil {
+		return paginationError(c, err)
+	}
+
+	base := database.DB.Model(&models.Comment{}).Where("device_id = ? AND parent_id IS NULL", device.ID)
+	switch c.Query("filter") {
+	case "questions":
+		base = base.Where("is_question = ?", true)
+	case "unanswered":
+		base = base.Where("is_question = ? AND answered = ?", true, false)
+	}
+
+	total, err := pagination.Count(base)
+	if err != nil {
+		return paginationError(c, err)
+	}
+	var threads []models.Comment
+	if err := p.Query(base, "id").Find(&threads).Error; err != nil {
+		return paginationError(c, err)
+	}
+	page := pagination.NewPage(c, p, threads, func(comment *models.Comment) pagination.Key {
+		return pagination.Key{Value: comment.CreatedAt, ID: comment.ID}
+	}, total)
+
+	if len(page.Data) > 0 {
+		ids := make([]uint, len(page.Data))
+		position := map[uint]int{}
+		for i, thread := range page.Data {
+			ids[i] = thread.ID
+			position[thread.ID] = i
+		}
+		var counts []struct {
+			ThreadID uint
+			Count    int
+		}
+		if err := database.DB.Model(&models.Comment{}).Select("thread_id, COUNT(*) AS count").
+			Where("thread_id IN ? AND parent_id IS NOT NULL", ids).Group("thread_id").Scan(&counts).Error; err != nil {
+			return paginationError(c, err)
+		}
+		for _, count := range counts {
+			i := position[count.ThreadID]
+			page.Data[i].ReplyCount = count.Count
+			var replies []models.Comment
+			if err := database.DB.Where("thread_id = ? AND parent_id IS NOT NULL", count.ThreadID).Order("id").Limit(threadReplyLimit).Find(&replies).Error; err != nil {
+				return paginationError(c, err)
+			}
+			page.Data[i].Replies = replies
+		}
+	}
+
+	if !isModerator(c) {
+		for i := range page.Data {
+			maskHiddenComment(&page.Data[i])
+			for j := range page.Data[i].Replies {
+				maskHiddenComment(&page.Data[i].Replies[j])
+			}
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&page)
+}
+
+// List the replies in one of a device's threads a page at a time, oldest first, to be nested by parentID.
+//
+// Query: limit and cursor.
+func GetCommentReplies(c *fiber.Ctx) error {
+	device, err := loadVisibleDevice(c)
+	if err != nil {
+		return deviceWriteError(c, err)
+	}
+	p, err := pagination.Parse(c, pagination.Limits{Default: threadReplyLimit, Max: 100}, replySorts, "oldest")
+	if err != nil {
+		return paginationError(c, err)
+	}
+
+	var thread models.Comment
+	if err := database.DB.Select("id").Where("id = ? AND device_id = ? AND parent_id IS NULL", c.Params("thread"), device.ID).First(&thread).Error; err != nil {
+		return commentError(c, errCommentNotFound)
+	}
+
+	base := database.DB.Model(&models.Comment{}).Where("thread_id = ? AND parent_id IS NOT NULL", thread.ID)
+	total, err := pagination.Count(base)
+	if err != nil {
+		return paginationError(c, err)
+	}
+	var replies []models.Comment
+	if err := p.Query(base, "id").Find(&replies).Error; err != nil {
+		return paginationError(c, err)
+	}
+	page := pagination.NewPage(c, p, replies, func(comment *models.Comment) pagination.Key {
+		return pagination.Key{Value: comment.ID, ID: comment.ID}
+	}, total)
+
+	if !isModerator(c) {
+		for i := range page.Data {
+			maskHiddenComment(&page.Data[i])
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&page)
+}
+
+// Start a thread or reply to a comment. Mentioned users are emailed.
+//
+// Body: body (markdown), parentID to reply, and isQuestion for a new thread asking the author something.
+func AddComment(c *fiber.Ctx) error {
+	var in struct {
+		Body       string `json:"body"`
+		ParentID   *uint  `json:"parentID"`
+		IsQuestion bool   `json:"isQuestion"`
+	}
+	if err := c.BodyParser(&in); err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	if rp := validateCommentBody(&in.Body); rp != nil {
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	device, err := loadVisibleDevice(c)
+	if err != nil {
+		return deviceWriteError(c, err)
+	}
+
+	userID, _ := actorFromClaims(c)
+	names := mentionNames(&device, markup.Mentions(in.Body))
+	comment := models.Comment{DeviceID: device.ID, UserID: userID, Body: in.Body}
+	if comment.BodyHTML, err = markup.Render(markup.ReplaceMentions(in.Body, names)); err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "invalid_body", Message: "Comment could not be read."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if in.ParentID != nil {
+			var parent models.Comment
+			err := tx.Where("id = ? AND device_id = ?", *in.ParentID, device.ID).First(&parent).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errCommentNotFound
+			}
+			if err != nil {
+				return err
+			}
+			if parent.DeletedAt != nil {
+				return errCommentDeleted
+			}
+			if parent.Depth+1 > maxCommentDepth {
+				return errCommentTooDeep
+			}
+			comment.ParentID, comment.ThreadID, comment.Depth = &parent.ID, parent.ThreadID, parent.Depth+1
+		} else {
+			comment.IsQuestion = in.IsQuestion
+		}
+
+		if err := tx.Create(&comment).Error; err != nil {
+			return err
+		}
+		if comment.ParentID == nil {
+			comment.ThreadID = comment.ID
+			if err := tx.Model(&comment).UpdateColumn("thread_id", comment.ID).Error; err != nil {
+				return err
+			}
+		}
+		return saveMentions(tx, comment.ID, names)
+	})
+	if err != nil {
+		return commentError(c, err)
+	}
+
+	go notifyMentions(comment, newMentions(names, nil, userID))
+
+	return c.Status(fiber.StatusCreated).JSON(&comment)
+}
+
+// Edit your own comment. The comment is marked as edited, and only users who were not mentioned before are emailed.
+//
+// Body: body (markdown).
+func UpdateComment(c *fiber.Ctx) error {
+	var data map[string]string
+	if err := c.BodyParser(&data); err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	body := data["body"]
+	if rp := validateCommentBody(&body); rp != nil {
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	var device models.Device
+	err := database.DB.Unscoped().Model(&models.Device{}).Select("devices.id", "devices.user_posts_id", "devices.stage", "devices.hidden_at").
+		Joins("JOIN comments ON comments.device_id = devices.id").Where("comments.id = ?", c.Params("id")).First(&device).Error
+	if err != nil {
+		return commentError(c, errCommentNotFound)
+	}
+
+	userID, _ := actorFromClaims(c)
+	names := mentionNames(&device, markup.Mentions(body))
+	rendered, err := markup.Render(markup.ReplaceMentions(body, names))
+	if err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "invalid_body", Message: "Comment could not be read."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	var comment models.Comment
+	var added map[uint]string
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := loadCommentForUpdate(tx, c.Params("id"), &comment); err != nil {
+			return err
+		}
+		if comment.UserID != userID {
+			return errCommentForbidden
+		}
+		if comment.DeletedAt != nil {
+			return errCommentDeleted
+		}
+
+		var before []models.CommentMention
+		if err := tx.Where("comment_id = ?", comment.ID).Find(&before).Error; err != nil {
+			return err
+		}
+		added = newMentions(names, before, userID)
+
+		now := time.Now()
+		comment.Body, comment.BodyHTML, comment.EditedAt = body, rendered, &now
+		if err := tx.Select("body", "body_html", "edited_at").Save(&comment).Error; err != nil {
+			return err
+		}
+		return saveMentions(tx, comment.ID, added)
+	})
+	if err != nil {
+		return commentError(c, err)
+	}
+
+	go notifyMentions(comment, added)
+
+	return c.Status(fiber.StatusOK).JSON(&comment)
+}
+
+// Delete a comment. Authors can delete their own and moderators can delete any. The comment stays as a "[deleted]"
+// placeholder so replies keep their place.
+func DeleteComment(c *fiber.Ctx) error {
+	userID, privilege := actorFromClaims(c)
+	var comment models.Comment
+	override := false
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := loadCommentForUpdate(tx, c.Params("id"), &comment); err != nil {
+			return err
+		}
+		if comment.DeletedAt != nil {
+			return errCommentDeleted
+		}
+		if comment.UserID != userID {
+			if privilege > moderatorPrivilege {
+				return errCommentForbidden
+			}
+			override = true
+		}
+
+		now := time.Now()
+		comment.Body, comment.BodyHTML = deletedComment, "<p>"+deletedComment+"</p>"
+		comment.DeletedAt, comment.DeletedByID = &now, &userID
+		if err := tx.Select("body", "body_html", "deleted_at", "deleted_by_id").Save(&comment).Error; err != nil {
+			return err
+		}
+		// A deleted reply can no longer be the accepted answer.
+		return tx.Model(&models.Comment{}).Where("answer_id = ?", comment.ID).UpdateColumn("answer_id", nil).Error
+	})
+	if err != nil {
+		return commentError(c, err)
+	}
+
+	event := newAuditEvent(c, audit.CommentDeleted)
+	event.TargetID = comment.UserID
+	event.Details["commentID"] = strconv.FormatUint(uint64(comment.ID), 10)
+	event.Details["deviceID"] = strconv.FormatUint(uint64(comment.DeviceID), 10)
+	if override {
+		event.Details["override"] = "true"
+	}
+	audit.Record(event)
+
+	rp := models.ResponsePacket{Error: false, Code: "delete_success", Message: "Comment deleted successfully."}
+	return c.Status(fiber.StatusOK).JSON(rp)
+}
+
+// Mark a question as answered or open it again. Allowed for the device's author, whoever asked, and moderators.
+//
+// Body: answered (bool) and an optional answerID naming the reply that answered it.
+func MarkCommentAnswered(c *fiber.Ctx) error {
+	var in struct {
+		Answered bool  `json:"answered"`
+		AnswerID *uint `json:"answerID"`
+	}
+	if err := c.BodyParser(&in); err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	userID, privilege := actorFromClaims(c)
+	var question models.Comment
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := loadCommentForUpdate(tx, c.Params("id"), &question); err != nil {
+			return err
+		}
+		if !question.IsQuestion || question.ParentID != nil {
+			return errNotAQuestion
+		}
+
+		var device models.Device
+		if err := tx.Select("id", "user_posts_id").Where("id = ?", question.DeviceID).First(&device).Error; err != nil {
+			return err
+		}
+		if device.UserPostsID != userID && question.UserID != userID && privilege > moderatorPrivilege {
+			return errCommentForbidden
+		}
+
+		question.Answered, question.AnswerID = in.Answered, nil
+		if in.Answered && in.AnswerID != nil {
+			var count int64
+			err := tx.Model(&models.Comment{}).
+				Where("id = ? AND thread_id = ? AND parent_id IS NOT NULL AND deleted_at IS NULL", *in.AnswerID, question.ID).
+				Count(&count).Error
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				return errInvalidAnswer
+			}
+			question.AnswerID = in.AnswerID
+		}
+		return tx.Select("answered", "answer_id").Save(&question).Error
+	})
+	if err != nil {
+		return commentError(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&question)
+}
+
+func maskHiddenComment(comment *models.Comment) {
+	if comment.HiddenAt != nil {
+		comment.Body, comment.BodyHTML = hiddenComment, "<p>"+hiddenComment+"</p>"
+	}
+}
+
+func loadCommentForUpdate(tx *gorm.DB, id string, comment *models.Comment) error {
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", id).First(comment).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errCommentNotFound
+	}
+	return err
+}
+
+func validateCommentBody(body *string) *models.ResponsePacket {
+	*body = strings.TrimSpace(*body)
+	switch {
+	case *body == "":
+		return &models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Comment cannot be empty."}
+	case len(*body) > maxCommentLength:
+		return &models.ResponsePacket{Error: true, Code: "invalid_body", Message: fmt.Sprintf("Comments must be %d characters or fewer.", maxCommentLength)}
+	}
+	return nil
+}
+
+// Display names of the mentioned users who can be mentioned on the device: verified, in good standing and able to see
+// it. Anyone else is left out, so their name is never shown and they are not emailed.
+func mentionNames(device *models.Device, ids []uint) map[uint]string {
+	names := map[uint]string{}
+	if len(ids) == 0 {
+		return names
+	}
+
+	var users []models.User
+	if err := database.DB.Preload("UserDetails").Where("id IN ? AND verified = ? AND deactivated_at IS NULL", ids, true).Find(&users).Error; err != nil {
+		log.Printf("Error looking up mentioned users: %s", err.Error())
+		return names
+	}
+	for _, user := range users {
+		if user.AccountStatus() != models.AccountActive || !userCanSeeDevice(&user, device) {
+			continue
+		}
+		name := strings.TrimSpace(user.UserDetails.FirstName + " " + user.UserDetails.LastName)
+		if name == "" {
+			name = "user" + strconv.FormatUint(uint64(user.ID), 10)
+		}
+		names[user.ID] = name
+	}
+	return names
+}
+
+// The mentioned users that were not mentioned before, leaving out the comment's author.
+func newMentions(names map[uint]string, before []models.CommentMention, authorID uint) map[uint]string {
+	known := map[uint]bool{authorID: true}
+	for _, mention := range before {
+		known[mention.UserID] = true
+	}
+	added := map[uint]string{}
+	for id, name := range names {
+		if !known[id] {
+			added[id] = name
+		}
+	}
+	return added
+}
+
+func saveMentions(tx *gorm.DB, commentID uint, names map[uint]string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	mentions := make([]models.CommentMention, 0, len(names))
+	for id := range names {
+		mentions = append(mentions, models.CommentMention{CommentID: commentID, UserID: id})
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&mentions).Error
+}
+
+func notifyMentions(comment models.Comment, mentioned map[uint]string) {
+	if len(mentioned) == 0 {
+		return
+	}
+	ids := make([]uint, 0, len(mentioned))
+	for id := range mentioned {
+		ids = append(ids, id)
+	}
+
+	var device models.Device
+	if err := database.DB.Select("id", "name").Where("id = ?", comment.DeviceID).First(&device).Error; err != nil {
+		return
+	}
+	var users []models.User
+	if err := database.DB.Select("id", "email").Where("id IN ?", ids).Find(&users).Error; err != nil {
+		log.Printf("Error finding mentioned users: %s", err.Error())
+		return
+	}
+
+	body := fmt.Sprintf(`
+		<html>
+			<div  style="font-size:20px; font-family: Arial, serif;">
+				<p>Hi there,</p>
+				<p>You were mentioned in a comment on <b>%s</b>:</p>
+				<blockquote>%s</blockquote>
+				<p><a href="%s/getdevice/%d">View the device</a></p>
+			</div>
+		</html>
+		`, html.EscapeString(device.Name), comment.BodyHTML, os.Getenv("API_URL"), device.ID)
+
+	for _, user := range users {
+		if err := sendHTMLEmail(user.Email, "You were mentioned in a comment", body); err != nil {
+			log.Printf("Error sending mention notification: %s", err.Error())
+		}
+	}
+}
+
+func commentError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errCommentNotFound):
+		rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "Comment not found!"}
+		return c.Status(fiber.StatusNotFound).JSON(rp)
+	case errors.Is(err, errCommentForbidden):
+		rp := models.ResponsePacket{Error: true, Code: "forbidden", Message: "You are not allowed to change this comment."}
+		return c.Status(fiber.StatusForbidden).JSON(rp)
+	case errors.Is(err, errCommentDeleted):
+		rp := models.ResponsePacket{Error: true, Code: "comment_deleted", Message: "That comment has been deleted."}
+		return c.Status(fiber.StatusGone).JSON(rp)
+	case errors.Is(err, errCommentTooDeep):
+		rp := models.ResponsePacket{Error: true, Code: "thread_too_deep", Message: "Replies cannot be nested any deeper. Reply further up the thread."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	case errors.Is(err, errNotAQuestion):
+		rp := models.ResponsePacket{Error: true, Code: "not_a_question", Message: "Only questions can be marked as answered."}
+		return c.Status(fiber.StatusConflict).JSON(rp)
+	case errors.Is(err, errInvalidAnswer):
+		rp := models.ResponsePacket{Error: true, Code: "invalid_answer", Message: "The answer must be a reply in the same thread."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+	return c.Status(fiber.StatusInternalServerError).JSON(rp)
+}
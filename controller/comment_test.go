@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/markup"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/pagination"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestThreadRepliesAreLimited(t *testing.T) {
+	useTestDB(t)
+	author := createTestUser(t, "author@example.org", 9)
+	device := createTestDevice(t, "Switch mount", author, models.StagePublic)
+
+	thread := models.Comment{DeviceID: device.ID, UserID: author.ID, Body: "Thread"}
+	database.DB.Create(&thread)
+	database.DB.Model(&thread).Update("thread_id", thread.ID)
+	const replyCount = threadReplyLimit + 5
+	for i := 0; i < replyCount; i++ {
+		reply := models.Comment{DeviceID: device.ID, ThreadID: thread.ID, ParentID: &thread.ID, Depth: 1, UserID: author.ID, Body: "Reply"}
+		if err := database.DB.Create(&reply).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := fiber.New()
+	app.Get("/getdevice/:id/comments", GetDeviceComments)
+	app.Get("/getdevice/:id/comments/:thread/replies", GetCommentReplies)
+
+	var threads pagination.Page[models.Comment]
+	if status := sendRequest(t, app, fiber.MethodGet, "/getdevice/"+uintString(device.ID)+"/comments", "", &threads); status != fiber.StatusOK {
+		t.Fatalf("status = %d", status)
+	}
+	if len(threads.Data) != 1 || len(threads.Data[0].Replies) != threadReplyLimit || threads.Data[0].ReplyCount != replyCount {
+		t.Fatalf("threads = %d, replies = %d of %d", len(threads.Data), len(threads.Data[0].Replies), threads.Data[0].ReplyCount)
+	}
+
+	seen := map[uint]bool{}
+	target := "/getdevice/" + uintString(device.ID) + "/comments/" + uintString(thread.ID) + "/replies?limit=10"
+	for pages := 0; target != ""; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		var page pagination.Page[models.Comment]
+		if status := sendRequest(t, app, fiber.MethodGet, target, "", &page); status != fiber.StatusOK {
+			t.Fatalf("%s: status = %d", target, status)
+		}
+		for _, reply := range page.Data {
+			if seen[reply.ID] || reply.ThreadID != thread.ID {
+				t.Errorf("unexpected reply %+v", reply)
+			}
+			seen[reply.ID] = true
+		}
+		target = ""
+		if page.Links.Next != nil {
+			target = (*page.Links.Next)[strings.Index(*page.Links.Next, "/getdevice/"):]
+		}
+	}
+	if len(seen) != replyCount {
+		t.Errorf("paged through %d replies, want %d", len(seen), replyCount)
+	}
+
+	other := createTestDevice(t, "Page turner", author, models.StagePublic)
+	if status := sendRequest(t, app, fiber.MethodGet, "/getdevice/"+uintString(other.ID)+"/comments/"+uintString(thread.ID)+"/replies", "", nil); status != fiber.StatusNotFound {
+		t.Errorf("thread on another device: status = %d", status)
+	}
+}
+
+func TestMentionNames(t *testing.T) {
+	useTestDB(t)
+	author := createTestUser(t, "author@example.org", 9)
+	member := createTestUser(t, "member@example.org", 9)
+	moderator := createTestUser(t, "moderator@example.org", moderatorPrivilege)
+	unverified := createTestUser(t, "unverified@example.org", 9)
+	database.DB.Model(&unverified).Update("verified", false)
+	deactivated := createTestUser(t, "deactivated@example.org", 9)
+	database.DB.Model(&deactivated).Update("deactivated_at", time.Now())
+	banned := createTestUser(t, "banned@example.org", 9)
+	database.DB.Model(&banned).Update("status", models.AccountBanned)
+	for _, user := range []models.User{author, member, moderator} {
+		database.DB.Model(&models.UserDetails{}).Where("user_id = ?", user.ID).Update("first_name", strings.Split(user.Email, "@")[0])
+	}
+
+	everyone := []uint{author.ID, member.ID, moderator.ID, unverified.ID, deactivated.ID, banned.ID, 9999}
+	tests := []struct {
+		stage string
+		want  map[uint]string
+	}{
+		{models.StagePublic, map[uint]string{author.ID: "author", member.ID: "member", moderator.ID: "moderator"}},
+		{models.StageReview, map[uint]string{author.ID: "author", moderator.ID: "moderator"}},
+	}
+	for _, tt := range tests {
+		device := createTestDevice(t, "Switch mount "+tt.stage, author, tt.stage)
+		if got := mentionNames(&device, everyone); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: names = %v, want %v", tt.stage, got, tt.want)
+		}
+		rendered := markup.ReplaceMentions("<@"+uintString(member.ID)+"> <@"+uintString(banned.ID)+">", mentionNames(&device, everyone))
+		want := "**@member** @unknown"
+		if tt.stage != models.StagePublic {
+			want = "@unknown @unknown"
+		}
+		if rendered != want {
+			t.Errorf("%s: rendered = %q, want %q", tt.stage, rendered, want)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/storage"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/valyala/fasthttp"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	deviceFileMaxKey     = "devices.file_max_mb"
+	defaultDeviceFileMax = 100
+	maxDeviceFiles       = 20
+	maxFileNameLength    = 200
+)
+
+// File bundles are recognised by their first bytes, never by the name they were uploaded with.
+var bundleTypes = []struct {
+	magic       []byte
+	ext         string
+	contentType string
+}{
+	{[]byte("PK\x03\x04"), "zip", "application/zip"},
+	{[]byte("Rar!\x1a\x07\x00"), "rar", "application/vnd.rar"},     // RAR 4
+	{[]byte("Rar!\x1a\x07\x01\x00"), "rar", "application/vnd.rar"}, // RAR 5
+}
+
+var (
+	deviceFileUpload   = regexp.MustCompile(`^/devices/[0-9]+/files/?$`)
+	unsafeNameChars    = regexp.MustCompile(`[\x00-\x1f\x7f"\\/:*?<>|]+`)
+	errFileNotFound    = errors.New("file not found")
+	errDuplicateFile   = errors.New("file already uploaded")
+	errTooManyFiles    = errors.New("device has too many files")
+	errUploadTooShort  = errors.New("upload ended early")
+	errFileQuarantined = errors.New("file is quarantined")
+)
+
+// StreamsRequestBody reports whether a route reads its request body as a stream or sets its own body limit. Every
+// other route has its body buffered and capped by middleware.BodyLimit.
+func StreamsRequestBody(c *fiber.Ctx) bool {
+	return c.Method() == fiber.MethodPost && (deviceFileUpload.MatchString(c.Path()) || deviceImageUpload.MatchString(c.Path()))
+}
+
+// Upload a file bundle to a device you posted. The request body is the file itself and is streamed to storage as it
+// arrives. Only zip and rar archives are accepted. The file is quarantined until the malware scanner passes it.
+//
+// Query: name (the file's name) and description.
+func UploadDeviceFile(c *fiber.Ctx) error {
+	size := c.Request().Header.ContentLength()
+	limit := deviceFileMaxBytes()
+	switch {
+	case size < 0:
+		c.Context().SetConnectionClose()
+		rp := models.ResponsePacket{Error: true, Code: "length_required", Message: "Uploads need a Content-Length header."}
+		return c.Status(fiber.StatusLengthRequired).JSON(rp)
+	case size == 0:
+		rp := models.ResponsePacket{Error: true, Code: "no_attachment", Message: "The request body should be the file."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	case int64(size) > limit:
+		c.Context().SetConnectionClose()
+		rp := models.ResponsePacket{Error: true, Code: "file_too_large", Message: fmt.Sprintf("Files must be %d MB or smaller.", limit>>20)}
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(rp)
+	}
+	name := cleanFileName(c.Query("name"))
+	if name == "" {
+		rp := models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Please give the file a name."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	// Check the device before reading the body, so refused uploads cost nothing.
+	var device models.Device
+	var count int64
+	_, err := loadOwnedDevice(c, database.DB, &device)
+	if err == nil {
+		err = database.DB.Model(&models.DeviceFile{}).Where("device_id = ?", device.ID).Count(&count).Error
+	}
+	if err == nil && count >= maxDeviceFiles {
+		err = errTooManyFiles
+	}
+	if err != nil {
+		c.Context().SetConnectionClose()
+		return deviceFileError(c, err)
+	}
+
+	body := c.Context().RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+	reader := bufio.NewReader(body)
+	header, _ := reader.Peek(8)
+	ext, contentType := detectBundle(header)
+	if ext == "" {
+		c.Context().SetConnectionClose()
+		rp := models.ResponsePacket{Error: true, Code: "unsupported_type", Message: "Unsupported file type. Make sure all files are packaged as zip or rar."}
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(rp)
+	}
+	if !strings.EqualFold(path.Ext(name), "."+ext) {
+		name += "." + ext
+	}
+
+	random := make([]byte, 16)
+	if _, err := crand.Read(random); err != nil {
+		return deviceFileError(c, err)
+	}
+	key := fmt.Sprintf("devices/%d/files/%s.%s", device.ID, hex.EncodeToString(random), ext)
+
+	hash := sha256.New()
+	var counter byteCounter
+	upload := io.TeeReader(io.LimitReader(reader, int64(size)), io.MultiWriter(hash, &counter))
+	err = storage.Default.Put(c.Context(), key, upload, int64(size), contentType)
+	if err == nil && counter != byteCounter(size) {
+		err = errUploadTooShort
+	}
+	if err != nil {
+		log.Printf("Error storing device file: %s", err.Error())
+		deleteStoredFile(key)
+		return deviceFileError(c, err)
+	}
+
+	userID, _ := actorFromClaims(c)
+	file := models.DeviceFile{
+		Name:             name,
+		Description:      strings.TrimSpace(c.Query("description")),
+		DiscLocationName: key,
+		FileSize:         uint(size),
+		ContentType:      contentType,
+		Checksum:         hex.EncodeToString(hash.Sum(nil)),
+		UploadedByID:     userID,
+		DeviceID:         device.ID,
+		ScanStatus:       models.ScanPending,
+	}
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		// Lock the device so two uploads of the same file cannot both pass the duplicate check.
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").Where("id = ?", device.ID).First(&models.Device{}).Error; err != nil {
+			return err
+		}
+		var duplicates int64
+		if err := tx.Model(&models.DeviceFile{}).Where("device_id = ? AND checksum = ?", device.ID, file.Checksum).Count(&duplicates).Error; err != nil {
+			return err
+		}
+		if duplicates > 0 {
+			return errDuplicateFile
+		}
+		return tx.Create(&file).Error
+	})
+	if err != nil {
+		deleteStoredFile(key)
+		return deviceFileError(c, err)
+	}
+
+	event := newAuditEvent(c, audit.DeviceFileUploaded)
+	event.Details["deviceID"] = strconv.FormatUint(uint64(device.ID), 10)
+	event.Details["fileID"] = strconv.FormatUint(uint64(file.ID), 10)
+	event.Details["sha256"] = file.Checksum
+	audit.Record(event)
+	queueFileScan(file.ID)
+
+	return c.Status(fiber.StatusCreated).JSON(&file)
+}
+
+// List a device's files with their checksums and download counts. Only the author and moderators see files that have
+// not passed the malware scan.
+func GetDeviceFiles(c *fiber.Ctx) error {
+	device, err := loadVisibleDevice(c)
+	if err != nil {
+		return deviceWriteError(c, err)
+	}
+	query := database.DB.Where("device_id = ?", device.ID)
+	if !canManageDeviceFiles(c, &device) {
+		query = query.Where("scan_status = ?", models.ScanClean)
+	}
+	files := []models.DeviceFile{}
+	if err := query.Order("id").Find(&files).Error; err != nil {
+		return deviceFileError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(&files)
+}
+
+// Download a device file. Anyone can download files of public devices; other files need the author's or a moderator's
+// JWT. Single byte ranges are supported so interrupted downloads can resume.
+func DownloadDeviceFile(c *fiber.Ctx) error {
+	device, err := loadVisibleDevice(c)
+	if err != nil {
+		return deviceWriteError(c, err)
+	}
+	var file models.DeviceFile
+	if err := database.DB.Where("id = ? AND device_id = ?", c.Params("fileID"), device.ID).First(&file).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return deviceFileError(c, errFileNotFound)
+		}
+		return deviceFileError(c, err)
+	}
+	if file.ScanStatus != models.ScanClean {
+		if !canManageDeviceFiles(c, &device) {
+			return deviceFileError(c, errFileNotFound)
+		}
+		return deviceFileError(c, errFileQuarantined)
+	}
+
+	size := int64(file.FileSize)
+	etag := `"` + file.Checksum + `"`
+	start, end := int64(0), size-1
+	partial := false
+	// Multiple ranges are not supported and fall back to the whole file, which the RFC allows.
+	if byteRange := c.Get(fiber.HeaderRange); byteRange != "" && !strings.Contains(byteRange, ",") {
+		if ifRange := c.Get(fiber.HeaderIfRange); ifRange == "" || ifRange == etag {
+			first, last, err := fasthttp.ParseByteRange([]byte(byteRange), int(size))
+			if err != nil {
+				c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", size))
+				return c.SendStatus(fiber.StatusRequestedRangeNotSatisfiable)
+			}
+			start, end, partial = int64(first), int64(last), true
+		}
+	}
+
+	reader, _, err := storage.Default.GetRange(c.Context(), file.DiscLocationName, start, end-start+1)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return deviceFileError(c, errFileNotFound)
+		}
+		return deviceFileError(c, err)
+	}
+
+	// Resumed downloads ask for a later range, so only count requests that start at the beginning.
+	if start == 0 && c.Method() == fiber.MethodGet {
+		if err := database.DB.Model(&models.DeviceFile{}).Where("id = ?", file.ID).UpdateColumn("download_count", gorm.Expr("download_count + 1")).Error; err != nil {
+			log.Printf("Error counting download of file %d: %s", file.ID, err.Error())
+		}
+	}
+
+	c.Attachment(file.Name)
+	c.Set(fiber.HeaderContentType, file.ContentType)
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderCacheControl, "private, no-transform")
+	if partial {
+		c.Status(fiber.StatusPartialContent)
+		c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	}
+	return c.SendStream(reader, int(end-start+1))
+}
+
+// Delete a file from a device you posted. Moderators can delete any device's files.
+func DeleteDeviceFile(c *fiber.Ctx) error {
+	var device models.Device
+	var file models.DeviceFile
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := loadOwnedDevice(c, tx, &device); err != nil {
+			return err
+		}
+		err := tx.Where("id = ? AND device_id = ?", c.Params("fileID"), device.ID).First(&file).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errFileNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&file).Error
+	})
+	if err != nil {
+		return deviceFileError(c, err)
+	}
+	deleteStoredFile(file.DiscLocationName)
+
+	event := newAuditEvent(c, audit.DeviceFileDeleted)
+	event.Details["deviceID"] = strconv.FormatUint(uint64(device.ID), 10)
+	event.Details["fileID"] = strconv.FormatUint(uint64(file.ID), 10)
+	if userID, _ := actorFromClaims(c); userID != device.UserPostsID {
+		event.TargetID = device.UserPostsID
+		event.Details["override"] = "true"
+	}
+	audit.Record(event)
+
+	rp := models.ResponsePacket{Error: false, Code: "delete_success", Message: "File deleted successfully."}
+	return c.Status(fiber.StatusOK).JSON(rp)
+}
+
+// The largest file a device can carry, in bytes. Admins can change it in the settings table.
+func deviceFileMaxBytes() int64 {
+	fallback := os.Getenv("DEVICE_FILE_MAX_MB")
+	if fallback == "" {
+		fallback = strconv.Itoa(defaultDeviceFileMax)
+	}
+	mb, err := strconv.Atoi(getSetting(deviceFileMaxKey, fallback))
+	if err != nil || mb <= 0 {
+		mb = defaultDeviceFileMax
+	}
+	return int64(mb) << 20
+}
+
+// Returns the extension and content type for a bundle's first bytes, or empty strings when the type is not allowed.
+func detectBundle(header []byte) (string, string) {
+	for _, t := range bundleTypes {
+		if bytes.HasPrefix(header, t.magic) {
+			return t.ext, t.contentType
+		}
+	}
+	return "", ""
+}
+
+// Keep the last path element, drop characters that are unsafe in file names or headers and cap the length.
+func cleanFileName(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Trim(unsafeNameChars.ReplaceAllString(name, "_"), " .")
+	if len(name) > maxFileNameLength {
+		name = name[len(name)-maxFileNameLength:]
+	}
+	return name
+}
+
+// The author and moderators can see quarantined files, but nobody can download them.
+func canManageDeviceFiles(c *fiber.Ctx, device *models.Device) bool {
+	if _, ok := c.Locals("user").(*jwt.Token); !ok {
+		return false
+	}
+	userID, privilege := actorFromClaims(c)
+	return device.UserPostsID == userID || privilege <= moderatorPrivilege
+}
+
+func deleteStoredFile(key string) {
+	if err := storage.Default.Delete(context.Background(), key); err != nil {
+		log.Printf("Error deleting stored file %s: %s", key, err.Error())
+	}
+}
+
+type byteCounter int
+
+func (b *byteCounter) Write(p []byte) (int, error) {
+	*b += byteCounter(len(p))
+	return len(p), nil
+}
+
+func deviceFileError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errDeviceNotFound), errors.Is(err, errDeviceForbidden):
+		return deviceWriteError(c, err)
+	case errors.Is(err, errFileNotFound):
+		rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "File not found."}
+		return c.Status(fiber.StatusNotFound).JSON(rp)
+	case errors.Is(err, errDuplicateFile):
+		rp := models.ResponsePacket{Error: true, Code: "duplicate_file", Message: "This file has already been uploaded to the device."}
+		return c.Status(fiber.StatusConflict).JSON(rp)
+	case errors.Is(err, errTooManyFiles):
+		rp := models.ResponsePacket{Error: true, Code: "quantity_exceeded", Message: fmt.Sprintf("A device can have at most %d files.", maxDeviceFiles)}
+		return c.Status(fiber.StatusConflict).JSON(rp)
+	case errors.Is(err, errFileQuarantined):
+		rp := models.ResponsePacket{Error: true, Code: "file_quarantined", Message: "This file has not passed the malware scan and cannot be downloaded."}
+		return c.Status(fiber.StatusConflict).JSON(rp)
+	case errors.Is(err, errUploadTooShort):
+		rp := models.ResponsePacket{Error: true, Code: "incomplete_upload", Message: "The upload ended before the whole file arrived."}
+		return c.Status(fiber.StatusBadRequest).JSON(rp)
+	}
+	rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+	return c.Status(fiber.StatusInternalServerError).JSON(rp)
+}
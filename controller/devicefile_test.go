@@ -0,0 +1,136 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/storage"
+	"github.com/gofiber/fiber/v2"
+)
+
+// The zip magic bytes followed by enough content to ask for ranges of.
+var testZip = append([]byte("PK\x03\x04"), []byte("0123456789abcdefghijklmnopqrstuvwxyz")...)
+
+func uploadFile(t *testing.T, app *fiber.App, deviceID uint, data []byte) (int, models.DeviceFile) {
+	t.Helper()
+	req := httptest.NewRequest(fiber.MethodPost, "/devices/"+uintString(deviceID)+"/files?name=Switch%20mount.zip", bytes.NewReader(data))
+	req.Header.Set(fiber.HeaderContentType, "application/octet-stream")
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var file models.DeviceFile
+	json.NewDecoder(res.Body).Decode(&file)
+	return res.StatusCode, file
+}
+
+func TestUploadDeviceFile(t *testing.T) {
+	useTestDB(t)
+	storage.Default = storage.NewLocal(t.TempDir(), "", nil)
+	author := createTestUser(t, "author@example.org", 9)
+	device := createTestDevice(t, "Switch mount", author, models.StagePublic)
+
+	app := fiber.New()
+	app.Post("/devices/:id/files", signedInAs(author), UploadDeviceFile)
+
+	// The name says zip, but the first bytes decide.
+	if status, _ := uploadFile(t, app, device.ID, []byte("MZ\x90\x00 not an archive at all")); status != fiber.StatusUnsupportedMediaType {
+		t.Errorf("executable = %d, want 415", status)
+	}
+
+	status, file := uploadFile(t, app, device.ID, testZip)
+	if status != fiber.StatusCreated {
+		t.Fatalf("zip = %d", status)
+	}
+	sum := sha256.Sum256(testZip)
+	if file.Checksum != hex.EncodeToString(sum[:]) || file.FileSize != uint(len(testZip)) || file.ScanStatus != models.ScanPending {
+		t.Errorf("file = %+v", file)
+	}
+	var stored models.DeviceFile
+	database.DB.First(&stored, file.ID)
+	reader, _, err := storage.Default.Get(context.Background(), stored.DiscLocationName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(reader)
+	reader.Close()
+	if !bytes.Equal(data, testZip) {
+		t.Errorf("stored %d bytes that differ from the upload", len(data))
+	}
+
+	if status, _ := uploadFile(t, app, device.ID, testZip); status != fiber.StatusConflict {
+		t.Errorf("duplicate = %d, want 409", status)
+	}
+}
+
+func TestDownloadDeviceFileRanges(t *testing.T) {
+	useTestDB(t)
+	storage.Default = storage.NewLocal(t.TempDir(), "", nil)
+	author := createTestUser(t, "author@example.org", 9)
+	device := createTestDevice(t, "Switch mount", author, models.StagePublic)
+
+	app := fiber.New()
+	app.Post("/devices/:id/files", signedInAs(author), UploadDeviceFile)
+	app.Get("/getdevice/:id/files/:fileID", DownloadDeviceFile)
+	_, file := uploadFile(t, app, device.ID, testZip)
+	database.DB.Model(&models.DeviceFile{}).Where("id = ?", file.ID).Update("scan_status", models.ScanClean)
+
+	target := "/getdevice/" + uintString(device.ID) + "/files/" + uintString(file.ID)
+	download := func(byteRange string) (int, string, []byte) {
+		req := httptest.NewRequest(fiber.MethodGet, target, nil)
+		if byteRange != "" {
+			req.Header.Set(fiber.HeaderRange, byteRange)
+		}
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, res.Header.Get(fiber.HeaderContentRange), body
+	}
+	downloads := func() uint {
+		var saved models.DeviceFile
+		database.DB.First(&saved, file.ID)
+		return saved.DownloadCount
+	}
+
+	if status, _, body := download(""); status != fiber.StatusOK || !bytes.Equal(body, testZip) {
+		t.Errorf("whole file = %d, %q", status, body)
+	}
+	if n := downloads(); n != 1 {
+		t.Errorf("downloads after the whole file = %d, want 1", n)
+	}
+
+	status, contentRange, body := download("bytes=5-9")
+	if status != fiber.StatusPartialContent || contentRange != "bytes 5-9/40" || !bytes.Equal(body, testZip[5:10]) {
+		t.Errorf("bytes=5-9 = %d, %q, %q", status, contentRange, body)
+	}
+	if n := downloads(); n != 1 {
+		t.Errorf("a resumed download was counted: %d", n)
+	}
+
+	status, contentRange, body = download("bytes=0-3")
+	if status != fiber.StatusPartialContent || contentRange != "bytes 0-3/40" || string(body) != "PK\x03\x04" {
+		t.Errorf("bytes=0-3 = %d, %q, %q", status, contentRange, body)
+	}
+	if n := downloads(); n != 2 {
+		t.Errorf("downloads after a range from the start = %d, want 2", n)
+	}
+
+	if status, contentRange, _ := download("bytes=100-200"); status != fiber.StatusRequestedRangeNotSatisfiable || contentRange != "bytes */40" {
+		t.Errorf("unsatisfiable range = %d, %q", status, contentRange)
+	}
+	if n := downloads(); n != 2 {
+		t.Errorf("a refused range was counted: %d", n)
+	}
+}
@@ -0,0 +1,526 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/media"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/storage"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	maxDeviceImageBytes = 4 << 20
+	maxImagesPerUpload  = 5
+	maxDeviceImages     = 12
+	maxAltTextLength    = 250
+	maxImageTitleLength = 120
+	deviceThumbnailSize = 400
+)
+
+// MaxDeviceImageUpload caps the body of an image upload: five full size images plus room for the multipart framing.
+const MaxDeviceImageUpload = maxImagesPerUpload*maxDeviceImageBytes + 1<<20
+
+var (
+	// Longest side in pixels, largest first.
+	deviceImageSizes    = []int{1600, 800, deviceThumbnailSize}
+	deviceImageUpload   = regexp.MustCompile(`^/devices/[0-9]+/images/?$`)
+	deviceImageFileName = regexp.MustCompile(`^(400|800|1600)\.(jpg|png)$`)
+	errImageNotFound    = errors.New("image not found")
+	errDuplicateImage   = errors.New("image already uploaded")
+	errTooManyImages    = errors.New("device has too many images")
+	errImageOrder       = errors.New("image order does not list every image once")
+)
+
+// Upload up to five images to a device you posted. The first image a device gets becomes its cover.
+//
+// Multipart form: images (the files) and, in the same order, altText for every image and an optional title.
+func UploadDeviceImages(c *fiber.Ctx) error {
+	form, err := c.MultipartForm()
+	if err != nil || len(form.File["images"]) == 0 {
+		rp := models.ResponsePacket{Error: true, Code: "no_attachment", Message: "No images attached."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	files := form.File["images"]
+	if len(files) > maxImagesPerUpload {
+		rp := models.ResponsePacket{Error: true, Code: "quantity_exceeded", Message: fmt.Sprintf("You can upload at most %d images at a time.", maxImagesPerUpload)}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	altTexts, titles := form.Value["altText"], form.Value["title"]
+	if len(altTexts) != len(files) || (len(titles) != 0 && len(titles) != len(files)) {
+		rp := models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Every image needs alt text."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	var device models.Device
+	if _, err := loadOwnedDevice(c, database.DB, &device); err != nil {
+		return deviceImageError(c, err)
+	}
+
+	// Variants are stored under the image's hash, so storing a duplicate would overwrite, and cleaning up after it delete,
+	// the files of the image already there.
+	var existingHashes []string
+	if err := database.DB.Model(&models.DeviceImage{}).Where("device_id = ?", device.ID).Pluck("hash", &existingHashes).Error; err != nil {
+		return deviceImageError(c, err)
+	}
+
+	images := make([]models.DeviceImage, 0, len(files))
+	stored := []models.DeviceImage{}
+	cleanup := func() {
+		for _, image := range stored {
+			deleteUnusedImageVariants(image)
+		}
+	}
+	for i, fileHeader := range files {
+		image := models.DeviceImage{AltText: strings.TrimSpace(altTexts[i]), DeviceID: device.ID}
+		if len(titles) != 0 {
+			image.Title = strings.TrimSpace(titles[i])
+		}
+		if rp := validateImageText(&image); rp != nil {
+			cleanup()
+			return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+		}
+		if fileHeader.Size > maxDeviceImageBytes {
+			cleanup()
+			rp := models.ResponsePacket{Error: true, Code: "file_too_large", Message: "Images must be 4 MB or smaller."}
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(rp)
+		}
+		file, err := fileHeader.Open()
+		if err != nil {
+			cleanup()
+			return deviceImageError(c, err)
+		}
+		data, err := io.ReadAll(io.LimitReader(file, maxDeviceImageBytes+1))
+		file.Close()
+		if err != nil || len(data) > maxDeviceImageBytes {
+			cleanup()
+			rp := models.ResponsePacket{Error: true, Code: "file_too_large", Message: "Images must be 4 MB or smaller."}
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(rp)
+		}
+
+		img, _, orientation, err := media.Decode(data)
+		switch {
+		case errors.Is(err, media.ErrUnsupportedType):
+			cleanup()
+			rp := models.ResponsePacket{Error: true, Code: "unsupported_type", Message: "Images must be JPEG, PNG or WebP."}
+			return c.Status(fiber.StatusUnsupportedMediaType).JSON(rp)
+		case errors.Is(err, media.ErrTooManyPixels):
+			cleanup()
+			rp := models.ResponsePacket{Error: true, Code: "image_too_large", Message: "Image dimensions are too large."}
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(rp)
+		case err != nil:
+			cleanup()
+			rp := models.ResponsePacket{Error: true, Code: "invalid_image", Message: "Image could not be read."}
+			return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+		}
+
+		sum := sha256.Sum256(data)
+		image.Hash = hex.EncodeToString(sum[:])
+		for _, other := range images {
+			if other.Hash == image.Hash {
+				cleanup()
+				return deviceImageError(c, errDuplicateImage)
+			}
+		}
+		for _, hash := range existingHashes {
+			if hash == image.Hash {
+				cleanup()
+				return deviceImageError(c, errDuplicateImage)
+			}
+		}
+		// Re-encoding from decoded pixels strips EXIF, location data included.
+		if err := storeImageVariants(c.Context(), &image, media.Orient(img, orientation)); err != nil {
+			log.Printf("Error storing device image: %s", err.Error())
+			cleanup()
+			return deviceImageError(c, err)
+		}
+		stored = append(stored, image)
+		images = append(images, image)
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		// Lock the device so concurrent uploads agree on positions and the limit.
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").Where("id = ?", device.ID).First(&models.Device{}).Error; err != nil {
+			return err
+		}
+		var existing []models.DeviceImage
+		if err := tx.Select("id", "hash", "position", "is_cover").Where("device_id = ?", device.ID).Find(&existing).Error; err != nil {
+			return err
+		}
+		if len(existing)+len(images) > maxDeviceImages {
+			return errTooManyImages
+		}
+		next, hasCover := 0, false
+		for _, e := range existing {
+			for _, image := range images {
+				if e.Hash == image.Hash {
+					return errDuplicateImage
+				}
+			}
+			if e.Position >= next {
+				next = e.Position + 1
+			}
+			hasCover = hasCover || e.IsCover
+		}
+		for i := range images {
+			images[i].Position = next + i
+		}
+		images[0].IsCover = !hasCover
+		return tx.Create(&images).Error
+	})
+	if err != nil {
+		cleanup()
+		return deviceImageError(c, err)
+	}
+
+	event := newAuditEvent(c, audit.DeviceImagesUploaded)
+	event.Details["deviceID"] = strconv.FormatUint(uint64(device.ID), 10)
+	event.Details["count"] = strconv.Itoa(len(images))
+	audit.Record(event)
+
+	fillImageURLs(images)
+	return c.Status(fiber.StatusCreated).JSON(&images)
+}
+
+// List a device's gallery in order.
+func GetDeviceImages(c *fiber.Ctx) error {
+	device, err := loadVisibleDevice(c)
+	if err != nil {
+		return deviceWriteError(c, err)
+	}
+	images := []models.DeviceImage{}
+	if err := database.DB.Where("device_id = ?", device.ID).Order("position, id").Find(&images).Error; err != nil {
+		return deviceImageError(c, err)
+	}
+	fillImageURLs(images)
+	return c.Status(fiber.StatusOK).JSON(&images)
+}
+
+// Serve one size of a device image. Names are content hashes, but a device can still be hidden or deleted, so public
+// caches only keep them for a day.
+func GetDeviceImageFile(c *fiber.Ctx) error {
+	name, file := c.Params("name"), c.Params("file")
+	if !avatarHash.MatchString(name) || !deviceImageFileName.MatchString(file) {
+		return deviceImageError(c, errImageNotFound)
+	}
+	device, err := loadVisibleDevice(c)
+	if err != nil {
+		return deviceImageError(c, errImageNotFound)
+	}
+
+	etag := fmt.Sprintf(`"%s-%s"`, name, file)
+	if device.Stage == models.StagePublic && device.HiddenAt == nil {
+		c.Set(fiber.HeaderCacheControl, "public, max-age=86400")
+	} else {
+		c.Set(fiber.HeaderCacheControl, "private, no-cache")
+	}
+	c.Set(fiber.HeaderETag, etag)
+	if c.Get(fiber.HeaderIfNoneMatch) == etag {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	reader, info, err := storage.Default.Get(c.Context(), fmt.Sprintf("devices/%d/images/%s/%s", device.ID, name, file))
+	if err != nil {
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		if errors.Is(err, storage.ErrNotFound) {
+			return deviceImageError(c, errImageNotFound)
+		}
+		return deviceImageError(c, err)
+	}
+
+	c.Set(fiber.HeaderContentType, info.ContentType)
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	return c.SendStream(reader, int(info.Size))
+}
+
+// Change an image's caption, description or alt text, or make it the device's cover. Fields left out keep their value.
+func UpdateDeviceImage(c *fiber.Ctx) error {
+	var data struct {
+		Title       *string `json:"title"`
+		Description *string `json:"description"`
+		AltText     *string `json:"altText"`
+		IsCover     bool    `json:"isCover"`
+	}
+	if err := c.BodyParser(&data); err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	var device models.Device
+	var image models.DeviceImage
+	var invalid *models.ResponsePacket
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := loadOwnedDevice(c, tx, &device); err != nil {
+			return err
+		}
+		if err := loadDeviceImage(c, tx, device.ID, &image); err != nil {
+			return err
+		}
+		if data.Title != nil {
+			image.Title = strings.TrimSpace(*data.Title)
+		}
+		if data.Description != nil {
+			image.Description = strings.TrimSpace(*data.Description)
+		}
+		if data.AltText != nil {
+			image.AltText = strings.TrimSpace(*data.AltText)
+		}
+		if invalid = validateImageText(&image); invalid != nil {
+			return gorm.ErrInvalidData
+		}
+		if data.IsCover && !image.IsCover {
+			if err := tx.Model(&models.DeviceImage{}).Where("device_id = ? AND is_cover = ?", device.ID, true).Update("is_cover", false).Error; err != nil {
+				return err
+			}
+			image.IsCover = true
+		}
+		return tx.Save(&image).Error
+	})
+	if invalid != nil {
+		return c.Status(fiber.StatusNotAcceptable).JSON(invalid)
+	}
+	if err != nil {
+		return deviceImageError(c, err)
+	}
+
+	images := []models.DeviceImage{image}
+	fillImageURLs(images)
+	return c.Status(fiber.StatusOK).JSON(&images[0])
+}
+
+// Reorder a device's gallery. The body lists every image ID of the device in the new order.
+func ReorderDeviceImages(c *fiber.Ctx) error {
+	var data struct {
+		ImageIDs []uint `json:"imageIDs"`
+	}
+	if err := c.BodyParser(&data); err != nil || len(data.ImageIDs) == 0 {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	var device models.Device
+	images := []models.DeviceImage{}
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := loadOwnedDevice(c, tx, &device); err != nil {
+			return err
+		}
+		if err := tx.Where("device_id = ?", device.ID).Find(&images).Error; err != nil {
+			return err
+		}
+		positions := make(map[uint]int, len(data.ImageIDs))
+		for i, id := range data.ImageIDs {
+			positions[id] = i
+		}
+		if len(positions) != len(data.ImageIDs) || len(positions) != len(images) {
+			return errImageOrder
+		}
+		for i := range images {
+			position, ok := positions[images[i].ID]
+			if !ok {
+				return errImageOrder
+			}
+			if images[i].Position == position {
+				continue
+			}
+			images[i].Position = position
+			if err := tx.Model(&images[i]).Update("position", position).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return deviceImageError(c, err)
+	}
+
+	ordered := make([]models.DeviceImage, len(images))
+	for _, image := range images {
+		ordered[image.Position] = image
+	}
+	fillImageURLs(ordered)
+	return c.Status(fiber.StatusOK).JSON(&ordered)
+}
+
+// Delete an image from a device you posted. When the cover goes, the next image in the gallery takes its place.
+func DeleteDeviceImage(c *fiber.Ctx) error {
+	var device models.Device
+	var image models.DeviceImage
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := loadOwnedDevice(c, tx, &device); err != nil {
+			return err
+		}
+		if err := loadDeviceImage(c, tx, device.ID, &image); err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Delete(&image).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.DeviceImage{}).Where("device_id = ? AND position > ?", device.ID, image.Position).
+			UpdateColumn("position", gorm.Expr("position - 1")).Error; err != nil {
+			return err
+		}
+		if !image.IsCover {
+			return nil
+		}
+		var next models.DeviceImage
+		err := tx.Where("device_id = ?", device.ID).Order("position, id").First(&next).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Model(&next).Update("is_cover", true).Error
+	})
+	if err != nil {
+		return deviceImageError(c, err)
+	}
+	deleteImageVariants(image)
+
+	event := newAuditEvent(c, audit.DeviceImageDeleted)
+	event.Details["deviceID"] = strconv.FormatUint(uint64(device.ID), 10)
+	event.Details["imageID"] = strconv.FormatUint(uint64(image.ID), 10)
+	if userID, _ := actorFromClaims(c); userID != device.UserPostsID {
+		event.TargetID = device.UserPostsID
+		event.Details["override"] = "true"
+	}
+	audit.Record(event)
+
+	rp := models.ResponsePacket{Error: false, Code: "delete_success", Message: "Image deleted successfully."}
+	return c.Status(fiber.StatusOK).JSON(rp)
+}
+
+// Set CoverThumbnail on each device that has a cover image.
+func fillCoverThumbnails(devices []models.Device) error {
+	if len(devices) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(devices))
+	for i, d := range devices {
+		ids[i] = d.ID
+	}
+	var covers []models.DeviceImage
+	if err := database.DB.Select("device_id", "hash", "extension").Where("device_id IN ? AND is_cover = ?", ids, true).Find(&covers).Error; err != nil {
+		return err
+	}
+	thumbnails := make(map[uint]string, len(covers))
+	for _, cover := range covers {
+		thumbnails[cover.DeviceID] = deviceImageURL(cover, deviceThumbnailSize)
+	}
+	for i := range devices {
+		devices[i].CoverThumbnail = thumbnails[devices[i].ID]
+	}
+	return nil
+}
+
+func fillImageURLs(images []models.DeviceImage) {
+	for i := range images {
+		images[i].URLs = map[string]string{}
+		for _, size := range deviceImageSizes {
+			images[i].URLs[strconv.Itoa(size)] = deviceImageURL(images[i], size)
+		}
+	}
+}
+
+func deviceImageURL(image models.DeviceImage, size int) string {
+	return fmt.Sprintf("%s/getdevice/%d/images/%s/%d.%s", os.Getenv("API_URL"), image.DeviceID, image.Hash, size, image.Extension)
+}
+
+func deviceImageKey(image models.DeviceImage, size int) string {
+	return fmt.Sprintf("devices/%d/images/%s/%d.%s", image.DeviceID, image.Hash, size, image.Extension)
+}
+
+// Encode and store every size, setting the record's extension and dimensions. The format is picked once, from the
+// full size image.
+func storeImageVariants(ctx context.Context, record *models.DeviceImage, img image.Image) error {
+	contentType, ext := media.Format(img)
+	record.Extension = ext
+	for i, size := range deviceImageSizes {
+		variant := media.Fit(img, size)
+		var buf bytes.Buffer
+		if err := media.Encode(&buf, variant, ext); err != nil {
+			return err
+		}
+		if i == 0 {
+			record.Width, record.Height = variant.Bounds().Dx(), variant.Bounds().Dy()
+		}
+		if err := storage.Default.Put(ctx, deviceImageKey(*record, size), &buf, int64(buf.Len()), contentType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteImageVariants(image models.DeviceImage) {
+	for _, size := range deviceImageSizes {
+		deleteStoredFile(deviceImageKey(image, size))
+	}
+}
+
+// Remove the variants of an upload that was not saved, unless the device has a saved image with the same hash. A
+// concurrent upload of the same image may have got there first.
+func deleteUnusedImageVariants(image models.DeviceImage) {
+	var count int64
+	if err := database.DB.Model(&models.DeviceImage{}).Where("device_id = ? AND hash = ?", image.DeviceID, image.Hash).Count(&count).Error; err != nil || count > 0 {
+		return
+	}
+	deleteImageVariants(image)
+}
+
+func loadDeviceImage(c *fiber.Ctx, tx *gorm.DB, deviceID uint, image *models.DeviceImage) error {
+	err := tx.Where("id = ? AND device_id = ?", c.Params("imageID"), deviceID).First(image).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errImageNotFound
+	}
+	return err
+}
+
+func validateImageText(image *models.DeviceImage) *models.ResponsePacket {
+	if image.AltText == "" {
+		return &models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Every image needs alt text."}
+	}
+	if len(image.AltText) > maxAltTextLength {
+		return &models.ResponsePacket{Error: true, Code: "invalid_alt_text", Message: fmt.Sprintf("Alt text must be %d characters or fewer.", maxAltTextLength)}
+	}
+	if len(image.Title) > maxImageTitleLength {
+		return &models.ResponsePacket{Error: true, Code: "invalid_title", Message: fmt.Sprintf("Captions must be %d characters or fewer.", maxImageTitleLength)}
+	}
+	return nil
+}
+
+func deviceImageError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errDeviceNotFound), errors.Is(err, errDeviceForbidden):
+		return deviceWriteError(c, err)
+	case errors.Is(err, errImageNotFound):
+		rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "Image not found."}
+		return c.Status(fiber.StatusNotFound).JSON(rp)
+	case errors.Is(err, errDuplicateImage):
+		rp := models.ResponsePacket{Error: true, Code: "duplicate_image", Message: "This image has already been uploaded to the device."}
+		return c.Status(fiber.StatusConflict).JSON(rp)
+	case errors.Is(err, errTooManyImages):
+		rp := models.ResponsePacket{Error: true, Code: "quantity_exceeded", Message: fmt.Sprintf("A device can have at most %d images.", maxDeviceImages)}
+		return c.Status(fiber.StatusConflict).JSON(rp)
+	case errors.Is(err, errImageOrder):
+		rp := models.ResponsePacket{Error: true, Code: "invalid_order", Message: "List every image of the device exactly once."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+	return c.Status(fiber.StatusInternalServerError).JSON(rp)
+}
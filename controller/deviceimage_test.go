@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/storage"
+	"github.com/gofiber/fiber/v2"
+)
+
+// An opaque PNG large enough to be scaled for every size.
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 2000, 1200))
+	for y := 0; y < 1200; y++ {
+		for x := 0; x < 2000; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: uint8(x ^ y), A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func uploadImage(t *testing.T, app *fiber.App, deviceID uint, data []byte) (int, []models.DeviceImage) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("images", "photo.png")
+	part.Write(data)
+	form.WriteField("altText", "A switch mounted on a wheelchair tray.")
+	form.Close()
+
+	req := httptest.NewRequest(fiber.MethodPost, "/devices/"+uintString(deviceID)+"/images", &body)
+	req.Header.Set(fiber.HeaderContentType, form.FormDataContentType())
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var images []models.DeviceImage
+	if res.StatusCode == fiber.StatusCreated {
+		if err := json.NewDecoder(res.Body).Decode(&images); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res.StatusCode, images
+}
+
+func TestUploadDuplicateImageKeepsVariants(t *testing.T) {
+	useTestDB(t)
+	storage.Default = storage.NewLocal(t.TempDir(), "", nil)
+	author := createTestUser(t, "author@example.org", 9)
+	device := createTestDevice(t, "Switch mount", author, models.StageDraft)
+
+	app := fiber.New()
+	app.Post("/devices/:id/images", signedInAs(author), UploadDeviceImages)
+
+	data := testPNG(t)
+	status, images := uploadImage(t, app, device.ID, data)
+	if status != fiber.StatusCreated || len(images) != 1 {
+		t.Fatalf("upload: status = %d, images = %v", status, images)
+	}
+	var image models.DeviceImage
+	database.DB.First(&image, images[0].ID)
+	if image.Extension != "jpg" || image.Width != 1600 || image.Height != 960 {
+		t.Errorf("image = %s %dx%d, want an opaque jpg at 1600x960", image.Extension, image.Width, image.Height)
+	}
+
+	if status, _ := uploadImage(t, app, device.ID, data); status != fiber.StatusConflict {
+		t.Fatalf("duplicate upload: status = %d", status)
+	}
+
+	// Every size is stored in the same format, and the duplicate did not remove any of them.
+	for _, size := range deviceImageSizes {
+		reader, _, err := storage.Default.Get(context.Background(), deviceImageKey(image, size))
+		if err != nil {
+			t.Errorf("size %s: %v", strconv.Itoa(size), err)
+			continue
+		}
+		reader.Close()
+	}
+	var count int64
+	database.DB.Model(&models.DeviceImage{}).Where("device_id = ?", device.ID).Count(&count)
+	if count != 1 {
+		t.Errorf("device has %d images, want 1", count)
+	}
+}
@@ -0,0 +1,308 @@
+package controller
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/pagination"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+var (
+	errRevisionNotFound = errors.New("revision not found")
+	errNothingToRestore = errors.New("device already matches the revision")
+)
+
+// One field that differs between two revisions. From is null when the entry was added and To is null when it was removed.
+type fieldChange struct {
+	Field string  `json:"field"`
+	From  *string `json:"from"`
+	To    *string `json:"to"`
+}
+
+// List every saved version of a device, newest first.
+func GetDeviceRevisions(c *fiber.Ctx) error {
+	device, err := loadVisibleDevice(c)
+	if err != nil {
+		return deviceWriteError(c, err)
+	}
+
+	p, err := pagination.Parse(c, pagination.Limits{Default: 20, Max: 100}, map[string]pagination.Sort{
+		"newest": {Column: "number", Desc: true},
+	}, "newest")
+	if err != nil {
+		return paginationError(c, err)
+	}
+
+	base := database.DB.Model(&models.DeviceRevision{}).Where("device_id = ?", device.ID)
+	total, err := pagination.Count(base)
+	if err != nil {
+		return paginationError(c, err)
+	}
+	var revisions []models.DeviceRevision
+	if err := p.Query(base, "id").Find(&revisions).Error; err != nil {
+		return paginationError(c, err)
+	}
+
+	page := pagination.NewPage(c, p, revisions, func(r *models.DeviceRevision) pagination.Key {
+		return pagination.Key{Value: r.Number, ID: r.ID}
+	}, total)
+	return c.Status(fiber.StatusOK).JSON(&page)
+}
+
+func GetDeviceRevision(c *fiber.Ctx) error {
+	device, err := loadVisibleDevice(c)
+	if err != nil {
+		return deviceWriteError(c, err)
+	}
+
+	revision, err := findRevision(database.DB, device.ID, c.Params("number"))
+	if err != nil {
+		return revisionError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(&revision)
+}
+
+// Compare two revisions field by field.
+//
+// Query: from and to are revision numbers. To defaults to the latest revision.
+func DiffDeviceRevisions(c *fiber.Ctx) error {
+	device, err := loadVisibleDevice(c)
+	if err != nil {
+		return deviceWriteError(c, err)
+	}
+	if c.Query("from") == "" {
+		rp := models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Missing revision to compare from."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	from, err := findRevision(database.DB, device.ID, c.Query("from"))
+	if err != nil {
+		return revisionError(c, err)
+	}
+	to, err := findRevision(database.DB, device.ID, c.Query("to", "latest"))
+	if err != nil {
+		return revisionError(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"from":    from.Number,
+		"to":      to.Number,
+		"changes": diffSnapshots(from.Snapshot, to.Snapshot),
+	})
+}
+
+// Restore a device to an earlier revision. The restore is saved as a new revision, so it can be undone the same way.
+// Public devices restored by their author go back to review.
+//
+// Body: reason (required).
+func RollbackDevice(c *fiber.Ctx) error {
+	var data map[string]string
+	if err := c.BodyParser(&data); err != nil || strings.TrimSpace(data["reason"]) == "" {
+		rp := models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Please give a reason for the rollback."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	reason := strings.TrimSpace(data["reason"])
+
+	userID, privilege := actorFromClaims(c)
+	var device models.Device
+	var target, revision models.DeviceRevision
+	var override, resubmitted bool
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if override, err = loadOwnedDevice(c, tx, &device); err != nil {
+			return err
+		}
+		if target, err = findRevision(tx, device.ID, c.Params("number")); err != nil {
+			return err
+		}
+		if _, err := recordDeviceRevision(tx, &device, device.UserPostsID, baselineRevisionReason, nil); err != nil {
+			return err
+		}
+
+		current := device
+		target.Snapshot.Apply(&device)
+		if reflect.DeepEqual(models.NewDeviceSnapshot(&current), target.Snapshot) {
+			return errNothingToRestore
+		}
+		if err := checkDeviceNameFree(tx, &device); err != nil {
+			return err
+		}
+		if resubmitted, err = resubmitChangedDevice(tx, &device, userID, privilege); err != nil {
+			return err
+		}
+		if err := tx.Omit("Capabilities", "Disabilities", "Usages", "Images", "Reviews").Save(&device).Error; err != nil {
+			return err
+		}
+		if err := mapDeviceTerms(tx, &device); err != nil {
+			return err
+		}
+		if err := replaceDeviceChildren(tx, &device, &device); err != nil {
+			return err
+		}
+
+		saved, err := recordDeviceRevision(tx, &device, userID, reason, &target.Number)
+		if saved != nil {
+			revision = *saved
+		}
+		return err
+	})
+	if err != nil {
+		return revisionError(c, err)
+	}
+
+	event := newAuditEvent(c, audit.DeviceRolledBack)
+	event.Details["deviceID"] = strconv.FormatUint(uint64(device.ID), 10)
+	event.Details["restoredFrom"] = strconv.FormatUint(uint64(target.Number), 10)
+	event.Details["revision"] = strconv.FormatUint(uint64(revision.Number), 10)
+	event.Details["reason"] = reason
+	if override {
+		event.TargetID = device.UserPostsID
+		event.Details["override"] = "true"
+	}
+	audit.Record(event)
+	if resubmitted {
+		announceResubmission(c, device)
+	}
+	indexDevice(device.ID)
+
+	return c.Status(fiber.StatusOK).JSON(&revision)
+}
+
+// Reason given to the revision that records a device's content before its first tracked change. Credited to the author.
+const baselineRevisionReason = "Recorded before the first tracked edit."
+
+// Save the device's current content as a new revision. Nothing is saved, and nil is returned, when the content is the same as the latest revision.
+func recordDeviceRevision(tx *gorm.DB, device *models.Device, actorID uint, reason string, restoredFrom *uint) (*models.DeviceRevision, error) {
+	snapshot := models.NewDeviceSnapshot(device)
+
+	var latest models.DeviceRevision
+	err := tx.Where("device_id = ?", device.ID).Order("number desc").First(&latest).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if err == nil && reflect.DeepEqual(latest.Snapshot, snapshot) {
+		return nil, nil
+	}
+
+	revision := models.DeviceRevision{
+		DeviceID:     device.ID,
+		Number:       latest.Number + 1,
+		ActorID:      actorID,
+		Reason:       reason,
+		RestoredFrom: restoredFrom,
+		Snapshot:     snapshot,
+	}
+	if err := tx.Create(&revision).Error; err != nil {
+		return nil, err
+	}
+	return &revision, nil
+}
+
+// Look up a revision by number, or the newest one for "latest".
+func findRevision(db *gorm.DB, deviceID uint, number string) (models.DeviceRevision, error) {
+	var revision models.DeviceRevision
+	query := db.Where("device_id = ?", deviceID)
+	if number == "latest" {
+		query = query.Order("number desc")
+	} else {
+		n, err := strconv.ParseUint(number, 10, 32)
+		if err != nil {
+			return revision, errRevisionNotFound
+		}
+		query = query.Where("number = ?", n)
+	}
+
+	err := query.First(&revision).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return revision, errRevisionNotFound
+	}
+	return revision, err
+}
+
+// Load the device named by :id if the caller may see it.
+func loadVisibleDevice(c *fiber.Ctx) (models.Device, error) {
+	var device models.Device
+	if err := database.DB.Select("id", "user_posts_id", "stage", "hidden_at").Where("id = ?", c.Params("id")).First(&device).Error; err != nil {
+		return device, errDeviceNotFound
+	}
+	if !canSeeDevice(c, &device) {
+		return device, errDeviceNotFound
+	}
+	return device, nil
+}
+
+func diffSnapshots(a, b models.DeviceSnapshot) []fieldChange {
+	changes := []fieldChange{}
+	scalar := func(field, from, to string) {
+		if from != to {
+			changes = append(changes, fieldChange{Field: field, From: &from, To: &to})
+		}
+	}
+	scalar("name", a.Name, b.Name)
+	scalar("difficulty", a.Difficulty, b.Difficulty)
+	scalar("timeToComplete", a.TimeToComplete, b.TimeToComplete)
+	scalar("materialCost", a.MaterialCost, b.MaterialCost)
+	scalar("license", a.License, b.License)
+
+	changes = append(changes, diffItems("capabilities", a.Capabilities, b.Capabilities)...)
+	changes = append(changes, diffItems("disabilities", a.Disabilities, b.Disabilities)...)
+	changes = append(changes, diffItems("usages", a.Usages, b.Usages)...)
+	return changes
+}
+
+// Child entries are matched by name, and the description is what changes.
+func diffItems(field string, a, b []models.SnapshotItem) []fieldChange {
+	before := map[string]string{}
+	for _, item := range a {
+		before[item.Name] = item.Description
+	}
+	after := map[string]string{}
+	for _, item := range b {
+		after[item.Name] = item.Description
+	}
+
+	var changes []fieldChange
+	seen := map[string]bool{} // Report duplicate names once.
+	for _, item := range a {
+		if seen[item.Name] {
+			continue
+		}
+		seen[item.Name] = true
+		from := before[item.Name]
+		to, kept := after[item.Name]
+		switch {
+		case !kept:
+			changes = append(changes, fieldChange{Field: field + "." + item.Name, From: &from})
+		case from != to:
+			changes = append(changes, fieldChange{Field: field + "." + item.Name, From: &from, To: &to})
+		}
+	}
+	for _, item := range b {
+		if seen[item.Name] {
+			continue
+		}
+		seen[item.Name] = true
+		to := after[item.Name]
+		changes = append(changes, fieldChange{Field: field + "." + item.Name, To: &to})
+	}
+	return changes
+}
+
+func revisionError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errRevisionNotFound):
+		rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "Revision not found!"}
+		return c.Status(fiber.StatusNotFound).JSON(rp)
+	case errors.Is(err, errNothingToRestore):
+		rp := models.ResponsePacket{Error: true, Code: "no_changes", Message: "The device already matches that revision."}
+		return c.Status(fiber.StatusConflict).JSON(rp)
+	}
+	return deviceWriteError(c, err)
+}
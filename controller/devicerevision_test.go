@@ -0,0 +1,140 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/search"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	a := models.DeviceSnapshot{
+		Name: "Switch mount", Difficulty: "easy", License: "MIT",
+		Capabilities: []models.SnapshotItem{{Name: "Grip", Description: "Light"}, {Name: "Reach"}},
+		Usages:       []models.SnapshotItem{{Name: "Gaming"}},
+	}
+	b := models.DeviceSnapshot{
+		Name: "Switch mount", Difficulty: "hard", License: "MIT",
+		Capabilities: []models.SnapshotItem{{Name: "Grip", Description: "Firm"}, {Name: "Pinch", Description: "Two fingers"}},
+		Usages:       []models.SnapshotItem{{Name: "Gaming"}},
+	}
+
+	type change struct{ field, from, to string } // "-" stands for a missing side.
+	var got []change
+	for _, c := range diffSnapshots(a, b) {
+		from, to := "-", "-"
+		if c.From != nil {
+			from = *c.From
+		}
+		if c.To != nil {
+			to = *c.To
+		}
+		got = append(got, change{c.Field, from, to})
+	}
+	want := []change{
+		{"difficulty", "easy", "hard"},
+		{"capabilities.Grip", "Light", "Firm"},
+		{"capabilities.Reach", "", "-"},
+		{"capabilities.Pinch", "-", "Two fingers"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diff = %v, want %v", got, want)
+	}
+	if changes := diffSnapshots(a, a); len(changes) != 0 {
+		t.Errorf("diff with itself = %v", changes)
+	}
+}
+
+type revisionTest struct {
+	t      *testing.T
+	device models.Device
+	app    *fiber.App
+}
+
+func newRevisionTest(t *testing.T, author models.User, editor models.User, stage string) *revisionTest {
+	t.Helper()
+	search.Default = search.NewMemory()
+	r := &revisionTest{t: t, device: createTestDevice(t, "Switch mount", author, stage), app: fiber.New()}
+	r.app.Patch("/devices/:id", signedInAs(editor), UpdateDevice)
+	r.app.Post("/author/devices/:id/revisions/:number/rollback", signedInAs(author), RollbackDevice)
+	r.app.Post("/devices/:id/revisions/:number/rollback", signedInAs(editor), RollbackDevice)
+	return r
+}
+
+func (r *revisionTest) edit(body string) {
+	r.t.Helper()
+	if status := sendRequest(r.t, r.app, fiber.MethodPatch, "/devices/"+uintString(r.device.ID), body, nil); status != fiber.StatusOK {
+		r.t.Fatalf("edit = %d", status)
+	}
+}
+
+func (r *revisionTest) rollback(prefix string, number string) (int, models.DeviceRevision) {
+	r.t.Helper()
+	var revision models.DeviceRevision
+	target := prefix + "/devices/" + uintString(r.device.ID) + "/revisions/" + number + "/rollback"
+	status := sendRequest(r.t, r.app, fiber.MethodPost, target, `{"reason":"Undo the change."}`, &revision)
+	return status, revision
+}
+
+func TestRollbackDevice(t *testing.T) {
+	useTestDB(t)
+	author := createTestUser(t, "author@example.org", 9)
+	r := newRevisionTest(t, author, author, models.StageDraft)
+
+	// The first edit records the original content as revision 1 and the edit as 2.
+	r.edit(`{"Difficulty":"hard","Capabilities":[{"Name":"Grip"}]}`)
+	status, revision := r.rollback("", "1")
+	if status != fiber.StatusOK {
+		t.Fatalf("rollback = %d", status)
+	}
+	if revision.Number != 3 || revision.RestoredFrom == nil || *revision.RestoredFrom != 1 || revision.ActorID != author.ID {
+		t.Errorf("revision = %+v, want 3 restored from 1", revision)
+	}
+
+	var saved models.Device
+	database.DB.Preload("Capabilities").First(&saved, r.device.ID)
+	if saved.Difficulty != "easy" || len(saved.Capabilities) != 0 {
+		t.Errorf("restored device = %s with %d capabilities", saved.Difficulty, len(saved.Capabilities))
+	}
+
+	// Restoring what the device already holds changes nothing, so it is refused rather than saved again.
+	if status, _ := r.rollback("", "1"); status != fiber.StatusConflict {
+		t.Errorf("no-op rollback = %d, want 409", status)
+	}
+	var count int64
+	database.DB.Model(&models.DeviceRevision{}).Where("device_id = ?", r.device.ID).Count(&count)
+	if count != 3 {
+		t.Errorf("revisions = %d, want 3", count)
+	}
+
+	if status, _ := r.rollback("", "9"); status != fiber.StatusNotFound {
+		t.Errorf("unknown revision = %d, want 404", status)
+	}
+}
+
+func TestRollbackPublicDeviceByAuthor(t *testing.T) {
+	useTestDB(t)
+	author := createTestUser(t, "author@example.org", 9)
+	moderator := createTestUser(t, "moderator@example.org", moderatorPrivilege)
+	r := newRevisionTest(t, author, moderator, models.StagePublic)
+
+	// A moderator's edit keeps the device public. The author undoing it has to go through review again.
+	r.edit(`{"Difficulty":"hard"}`)
+	if status, _ := r.rollback("/author", "1"); status != fiber.StatusOK {
+		t.Fatalf("rollback = %d", status)
+	}
+
+	var saved models.Device
+	database.DB.First(&saved, r.device.ID)
+	if saved.Stage != models.StageReview || saved.Difficulty != "easy" {
+		t.Errorf("device = %s, %s, want review and easy", saved.Stage, saved.Difficulty)
+	}
+	var history []models.DeviceStageHistory
+	database.DB.Where("device_id = ?", r.device.ID).Find(&history)
+	if len(history) != 1 || history[0].FromStage != models.StagePublic || history[0].ToStage != models.StageReview || history[0].ActorID != author.ID {
+		t.Errorf("stage history = %+v", history)
+	}
+}
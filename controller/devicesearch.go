@@ -0,0 +1,154 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/pagination"
+	"github.com/Elimists/go-app/search"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+// Search results are ranked by the index, so their cursors hold an offset.
+var searchSorts = map[string]pagination.Sort{"relevance": {Ranked: true}}
+
+// A page of search results and the facet counts over all of them.
+type searchPage struct {
+	pagination.Page[models.Device]
+	Facets map[string][]search.FacetCount `json:"facets"`
+}
+
+// Search devices by text with optional filters.
+//
+// Query: q, difficulty, license, stage, capability and disability (comma separated values), limit and cursor. Only
+// moderators can search outside public devices. Capabilities and disabilities are looked up in their vocabularies, so a
+// synonym or a broader term finds the devices tagged with the canonical terms.
+func SearchDevices(c *fiber.Ctx) error {
+	p, err := pagination.Parse(c, pagination.Limits{Default: 12, Max: 50}, searchSorts, "relevance")
+	if err != nil {
+		return paginationError(c, err)
+	}
+
+	query := search.Query{
+		Text:         c.Query("q"),
+		Difficulty:   splitQuery(c.Query("difficulty")),
+		License:      splitQuery(c.Query("license")),
+		Stage:        []string{models.StagePublic},
+		Capabilities: canonicalFilter(models.VocabularyCapability, splitQuery(c.Query("capability"))),
+		Disabilities: canonicalFilter(models.VocabularyDisability, splitQuery(c.Query("disability"))),
+		Offset:       p.Offset(),
+		Limit:        p.Limit,
+	}
+	moderator := isModerator(c)
+	if moderator {
+		query.Stage = splitQuery(c.Query("stage"))
+	}
+
+	result, err := search.Default.Search(c.Context(), query)
+	if err != nil {
+		log.Printf("Error searching devices: %s", err.Error())
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+	if !moderator {
+		delete(result.Facets, search.FacetStage) // Would count devices the caller cannot see.
+	}
+
+	devices := []models.Device{}
+	if len(result.IDs) > 0 {
+		var found []models.Device
+		err := database.DB.Select("id", "name", "difficulty", "license", "stage", "time_to_complete", "material_cost", "rating_average", "rating_count", "created_at", "updated_at", "user_posts_id").
+			Where("id IN ?", result.IDs).Find(&found).Error
+		if err != nil {
+			rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+			return c.Status(fiber.StatusInternalServerError).JSON(rp)
+		}
+		// Keep the index's ranking. Devices deleted since they were indexed are skipped.
+		byID := map[uint]models.Device{}
+		for _, device := range found {
+			byID[device.ID] = device
+		}
+		for _, id := range result.IDs {
+			if device, ok := byID[id]; ok {
+				devices = append(devices, device)
+			}
+		}
+	}
+
+	page := searchPage{Page: pagination.NewRankedPage(c, p, devices, result.Total), Facets: result.Facets}
+	return c.Status(fiber.StatusOK).JSON(&page)
+}
+
+// Rebuild the search index from the database. Needed at startup for the in-memory index.
+func ReindexDevices() error {
+	var devices []models.Device
+	return database.DB.Preload("Capabilities").Preload("Disabilities").Preload("Usages").Where("hidden_at IS NULL").
+		FindInBatches(&devices, 200, func(tx *gorm.DB, batch int) error {
+			for i := range devices {
+				if err := search.Default.Index(context.Background(), searchDocument(&devices[i])); err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+}
+
+// Bring the search index up to date with a device after it was saved, hidden or deleted. Failures are logged and the index
+// catches up on the next save or reindex.
+func indexDevice(id uint) {
+	var device models.Device
+	err := database.DB.Preload("Capabilities").Preload("Disabilities").Preload("Usages").Where("id = ?", id).First(&device).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && device.HiddenAt != nil) {
+		err = search.Default.Remove(context.Background(), id)
+	} else if err == nil {
+		err = search.Default.Index(context.Background(), searchDocument(&device))
+	}
+	if err != nil {
+		log.Printf("Error indexing device %d: %s", id, err.Error())
+	}
+}
+
+func searchDocument(device *models.Device) search.Document {
+	doc := search.Document{
+		ID:         device.ID,
+		Name:       device.Name,
+		Difficulty: device.Difficulty,
+		License:    device.License,
+		Stage:      device.Stage,
+	}
+	for _, capability := range device.Capabilities {
+		doc.Capabilities = append(doc.Capabilities, search.SubDocument{Name: capability.Name, Description: capability.Description})
+	}
+	for _, disability := range device.Disabilities {
+		doc.Disabilities = append(doc.Disabilities, search.SubDocument{Name: disability.Name, Description: disability.Description})
+	}
+	for _, usage := range device.Usages {
+		doc.Usages = append(doc.Usages, search.SubDocument{Name: usage.Name, Description: usage.Description})
+	}
+	return doc
+}
+
+// Whether the request carries a valid JWT with moderator privilege. Works on routes where the JWT is optional.
+func isModerator(c *fiber.Ctx) bool {
+	if _, ok := c.Locals("user").(*jwt.Token); !ok {
+		return false
+	}
+	_, privilege := actorFromClaims(c)
+	return privilege <= moderatorPrivilege
+}
+
+func splitQuery(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
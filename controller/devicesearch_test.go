@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/search"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestSearchDevicesPages(t *testing.T) {
+	useTestDB(t)
+	search.Default = search.NewMemory()
+	author := createTestUser(t, "author@example.org", 9)
+	for _, name := range []string{"Switch mount", "Joystick switch", "Big switch", "Page turner"} {
+		device := createTestDevice(t, name, author, models.StagePublic)
+		if err := search.Default.Index(context.Background(), searchDocument(&device)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := fiber.New()
+	app.Get("/devices/search", SearchDevices)
+
+	var names []string
+	target := "/devices/search?q=switch&limit=2"
+	for pages := 0; target != ""; pages++ {
+		if pages > 2 {
+			t.Fatal("too many pages")
+		}
+		var page searchPage
+		if status := sendRequest(t, app, fiber.MethodGet, target, "", &page); status != fiber.StatusOK {
+			t.Fatalf("%s: status = %d", target, status)
+		}
+		if page.Total.Count != 3 || !page.Total.Exact || page.Sort != "relevance" || page.Limit != 2 {
+			t.Errorf("%s: total = %+v, sort = %s, limit = %d", target, page.Total, page.Sort, page.Limit)
+		}
+		if _, ok := page.Facets[search.FacetDifficulty]; !ok {
+			t.Errorf("%s: no difficulty facet in %v", target, page.Facets)
+		}
+		if _, ok := page.Facets[search.FacetStage]; ok {
+			t.Errorf("%s: stage facet shown to a visitor", target)
+		}
+		if pages == 0 && page.Links.Prev != nil {
+			t.Errorf("first page links back to %s", *page.Links.Prev)
+		}
+		if pages == 1 && (page.Links.Prev == nil || page.Links.Next != nil) {
+			t.Errorf("last page links = %+v", page.Links)
+		}
+		for _, device := range page.Data {
+			names = append(names, device.Name)
+		}
+
+		target = ""
+		if page.Links.Next != nil {
+			target = (*page.Links.Next)[strings.Index(*page.Links.Next, "/devices/search"):]
+		}
+	}
+
+	if strings.Join(names, ",") != "Big switch,Joystick switch,Switch mount" {
+		t.Errorf("results = %v", names)
+	}
+
+	if status := sendRequest(t, app, fiber.MethodGet, "/devices/search?q=switch&cursor=bogus", "", nil); status != fiber.StatusBadRequest {
+		t.Errorf("bad cursor: status = %d", status)
+	}
+}
@@ -0,0 +1,295 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/pagination"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Who may move a device from one stage to another.
+type stageTransition struct {
+	from, to       string
+	author         bool // The user who posted the device.
+	moderator      bool // Privilege 4 or better.
+	commentNeeded  bool
+	otherReviewer  bool // A moderator who posted the device cannot take this one themselves, unless they are an admin.
+	notifyModerate bool // Tell moderators there is something to review.
+	notifyAuthor   bool // Tell the author a moderator made a decision.
+}
+
+var stageTransitions = []stageTransition{
+	{from: models.StageDraft, to: models.StageReview, author: true, moderator: true, notifyModerate: true},
+	{from: models.StageReview, to: models.StageDraft, author: true},                                              // Author withdraws.
+	{from: models.StageReview, to: models.StageDraft, moderator: true, commentNeeded: true, notifyAuthor: true},  // Moderator rejects.
+	{from: models.StageReview, to: models.StagePublic, moderator: true, otherReviewer: true, notifyAuthor: true}, // Moderator approves.
+	{from: models.StagePublic, to: models.StageArchived, author: true, moderator: true},
+	{from: models.StageArchived, to: models.StageDraft, author: true, moderator: true},
+	{from: models.StageArchived, to: models.StagePublic, moderator: true},
+}
+
+var (
+	errInvalidTransition = errors.New("invalid stage transition")
+	errCommentRequired   = errors.New("a comment is required")
+	errSelfApproval      = errors.New("authors cannot approve their own device")
+)
+
+// Move a device to another stage.
+//
+// Body: stage (draft, review, public or archived) and comment. Moderators must explain rejections.
+func SetDeviceStage(c *fiber.Ctx) error {
+	var data map[string]string
+	if err := c.BodyParser(&data); err != nil || data["stage"] == "" {
+		rp := models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Missing required fields."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	to, comment := data["stage"], strings.TrimSpace(data["comment"])
+
+	userID, privilege := actorFromClaims(c)
+	var device models.Device
+	var transition stageTransition
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", c.Params("id")).First(&device).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errDeviceNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		isAuthor := device.UserPostsID == userID
+		isModerator := privilege <= moderatorPrivilege
+		if !isAuthor && !isModerator {
+			return errDeviceForbidden
+		}
+
+		found := false
+		for _, t := range stageTransitions {
+			if t.from != device.Stage || t.to != to {
+				continue
+			}
+			// Prefer the author's version of a transition so withdrawing your own submission never needs a comment.
+			if (t.author && isAuthor) || (t.moderator && isModerator) {
+				transition, found = t, true
+				if t.author && isAuthor {
+					break
+				}
+			}
+		}
+		if !found {
+			return errInvalidTransition
+		}
+		if transition.otherReviewer && isAuthor && privilege != 1 {
+			return errSelfApproval
+		}
+		if transition.commentNeeded && comment == "" {
+			return errCommentRequired
+		}
+
+		history := models.DeviceStageHistory{DeviceID: device.ID, FromStage: device.Stage, ToStage: to, ActorID: userID, Comment: comment}
+		if err := tx.Model(&device).Update("stage", to).Error; err != nil {
+			return err
+		}
+		return tx.Create(&history).Error
+	})
+
+	switch {
+	case errors.Is(err, errInvalidTransition):
+		rp := models.ResponsePacket{Error: true, Code: "invalid_transition", Message: fmt.Sprintf("You cannot move this device from %s to %s.", device.Stage, to)}
+		return c.Status(fiber.StatusConflict).JSON(rp)
+	case errors.Is(err, errSelfApproval):
+		rp := models.ResponsePacket{Error: true, Code: "self_approval", Message: "Another moderator has to approve a device you posted."}
+		return c.Status(fiber.StatusForbidden).JSON(rp)
+	case errors.Is(err, errCommentRequired):
+		rp := models.ResponsePacket{Error: true, Code: "comment_required", Message: "Please explain why the device was rejected."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	case err != nil:
+		return deviceWriteError(c, err)
+	}
+
+	from := transition.from
+	event := newAuditEvent(c, audit.DeviceStageChanged)
+	event.TargetID = device.UserPostsID
+	event.Details["deviceID"] = strconv.FormatUint(uint64(device.ID), 10)
+	event.Details["from"] = from
+	event.Details["to"] = to
+	audit.Record(event)
+	indexDevice(device.ID)
+
+	claims := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	actorEmail, _ := claims["email"].(string)
+	if transition.notifyModerate {
+		go notifyModerators(device, actorEmail)
+	}
+	if transition.notifyAuthor {
+		go notifyDeviceAuthor(device, to, comment)
+	}
+
+	rp := models.ResponsePacket{Error: false, Code: "stage_changed", Message: fmt.Sprintf("Device moved to %s.", to)}
+	return c.Status(fiber.StatusOK).JSON(rp)
+}
+
+// List a device's stage changes, newest first. Visible to the author and moderators.
+func GetDeviceStageHistory(c *fiber.Ctx) error {
+	var device models.Device
+	if err := database.DB.Select("id", "user_posts_id").Where("id = ?", c.Params("id")).First(&device).Error; err != nil {
+		return deviceWriteError(c, errDeviceNotFound)
+	}
+	userID, privilege := actorFromClaims(c)
+	if device.UserPostsID != userID && privilege > moderatorPrivilege {
+		return deviceWriteError(c, errDeviceForbidden)
+	}
+
+	var history []models.DeviceStageHistory
+	if err := database.DB.Where("device_id = ?", device.ID).Order("id desc").Find(&history).Error; err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+	return c.Status(fiber.StatusOK).JSON(&history)
+}
+
+// List devices waiting for review, oldest first by default.
+func GetDevicesForReview(c *fiber.Ctx) error {
+	sorts := map[string]pagination.Sort{"oldest": {Column: "updated_at", Time: true}}
+	for name, sort := range deviceSorts {
+		sorts[name] = sort
+	}
+	p, err := pagination.Parse(c, deviceLimits, sorts, "oldest")
+	if err != nil {
+		return paginationError(c, err)
+	}
+
+	page, err := devicePage(c, p, database.DB.Model(&models.Device{}).Where("stage = ?", models.StageReview))
+	if err != nil {
+		return paginationError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(&page)
+}
+
+// List the caller's own devices in every stage, most recently updated first by default.
+func GetMyDevices(c *fiber.Ctx) error {
+	p, err := pagination.Parse(c, deviceLimits, deviceSorts, "updated")
+	if err != nil {
+		return paginationError(c, err)
+	}
+
+	userID, _ := actorFromClaims(c)
+	page, err := devicePage(c, p, database.DB.Model(&models.Device{}).Where("user_posts_id = ?", userID))
+	if err != nil {
+		return paginationError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(&page)
+}
+
+// Whether the caller may see a device that is not public or has been hidden by a moderator. Works on routes where the
+// JWT is optional.
+func canSeeDevice(c *fiber.Ctx, device *models.Device) bool {
+	if device.Stage == models.StagePublic && device.HiddenAt == nil {
+		return true
+	}
+	if _, ok := c.Locals("user").(*jwt.Token); !ok {
+		return false
+	}
+	userID, privilege := actorFromClaims(c)
+	return device.UserPostsID == userID || privilege <= moderatorPrivilege
+}
+
+// Whether the user could open the device. The same rule as canSeeDevice, for someone other than the caller.
+func userCanSeeDevice(user *models.User, device *models.Device) bool {
+	if device.Stage == models.StagePublic && device.HiddenAt == nil {
+		return true
+	}
+	return device.UserPostsID == user.ID || user.Privilege <= moderatorPrivilege
+}
+
+// Sends a public device back to review when someone who cannot publish changes it, so moderators see the change before
+// the public does. Call before saving the device.
+func resubmitChangedDevice(tx *gorm.DB, device *models.Device, actorID uint, privilege int8) (bool, error) {
+	if device.Stage != models.StagePublic || privilege <= moderatorPrivilege {
+		return false, nil
+	}
+	history := models.DeviceStageHistory{DeviceID: device.ID, FromStage: device.Stage, ToStage: models.StageReview, ActorID: actorID, Comment: "Changed after publishing."}
+	device.Stage = models.StageReview
+	return true, tx.Create(&history).Error
+}
+
+// Record and announce a resubmission once its transaction has committed.
+func announceResubmission(c *fiber.Ctx, device models.Device) {
+	event := newAuditEvent(c, audit.DeviceStageChanged)
+	event.TargetID = device.UserPostsID
+	event.Details["deviceID"] = strconv.FormatUint(uint64(device.ID), 10)
+	event.Details["from"] = models.StagePublic
+	event.Details["to"] = models.StageReview
+	event.Details["reason"] = "changed_after_publishing"
+	audit.Record(event)
+
+	claims := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	actorEmail, _ := claims["email"].(string)
+	go notifyModerators(device, actorEmail)
+}
+
+func notifyModerators(device models.Device, submittedBy string) {
+	var moderators []models.User
+	if err := database.DB.Select("email").Where("privilege <= ? AND verified = ? AND deactivated_at IS NULL", moderatorPrivilege, true).Find(&moderators).Error; err != nil {
+		log.Printf("Error finding moderators: %s", err.Error())
+		return
+	}
+
+	body := fmt.Sprintf(`
+		<html>
+			<div  style="font-size:20px; font-family: Arial, serif;">
+				<p>Hi there,</p>
+				<p>%s submitted <b>%s</b> for review.</p>
+				<p><a href="%s/getdevice/%d">Review the device</a></p>
+			</div>
+		</html>
+		`, html.EscapeString(submittedBy), html.EscapeString(device.Name), os.Getenv("API_URL"), device.ID)
+
+	for _, moderator := range moderators {
+		if err := sendHTMLEmail(moderator.Email, "A device is waiting for review", body); err != nil {
+			log.Printf("Error sending review notification: %s", err.Error())
+		}
+	}
+}
+
+func notifyDeviceAuthor(device models.Device, to string, comment string) {
+	var author models.User
+	if err := database.DB.Select("email").Where("id = ?", device.UserPostsID).First(&author).Error; err != nil {
+		return
+	}
+
+	outcome := "was approved and is now public"
+	if to == models.StageDraft {
+		outcome = "was sent back to draft"
+	}
+	note := ""
+	if comment != "" {
+		note = fmt.Sprintf("<p>Moderator's comment:<br>%s</p>", html.EscapeString(comment))
+	}
+
+	body := fmt.Sprintf(`
+		<html>
+			<div  style="font-size:20px; font-family: Arial, serif;">
+				<p>Hi there,</p>
+				<p>Your device <b>%s</b> %s.</p>
+				%s
+			</div>
+		</html>
+		`, html.EscapeString(device.Name), outcome, note)
+
+	if err := sendHTMLEmail(author.Email, "Your device has been reviewed", body); err != nil {
+		log.Printf("Error sending review outcome: %s", err.Error())
+	}
+}
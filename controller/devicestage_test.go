@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/search"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestApprovingOwnDevice(t *testing.T) {
+	useTestDB(t)
+	search.Default = search.NewMemory()
+	admin := createTestUser(t, "admin@example.org", 1)
+	moderator := createTestUser(t, "moderator@example.org", moderatorPrivilege)
+	other := createTestUser(t, "other@example.org", moderatorPrivilege)
+
+	tests := []struct {
+		name       string
+		author     models.User
+		actor      models.User
+		wantStatus int
+	}{
+		{"moderator approves their own device", moderator, moderator, fiber.StatusForbidden},
+		{"another moderator approves it", moderator, other, fiber.StatusOK},
+		{"admin approves their own device", admin, admin, fiber.StatusOK},
+	}
+	for i, tt := range tests {
+		device := createTestDevice(t, "Switch adapter "+string(rune('A'+i)), tt.author, models.StageReview)
+
+		app := fiber.New()
+		app.Put("/devices/:id/stage", signedInAs(tt.actor), SetDeviceStage)
+		var rp models.ResponsePacket
+		if status := sendRequest(t, app, fiber.MethodPut, "/devices/"+uintString(device.ID)+"/stage", `{"stage":"public"}`, &rp); status != tt.wantStatus {
+			t.Errorf("%s: status = %d (%s), want %d", tt.name, status, rp.Code, tt.wantStatus)
+		}
+
+		wantStage := models.StagePublic
+		if tt.wantStatus != fiber.StatusOK {
+			wantStage = models.StageReview
+		}
+		var saved models.Device
+		database.DB.First(&saved, device.ID)
+		if saved.Stage != wantStage {
+			t.Errorf("%s: stage = %s, want %s", tt.name, saved.Stage, wantStage)
+		}
+	}
+
+	// Authors can still withdraw their own submission.
+	device := createTestDevice(t, "Page turner", moderator, models.StageReview)
+	app := fiber.New()
+	app.Put("/devices/:id/stage", signedInAs(moderator), SetDeviceStage)
+	if status := sendRequest(t, app, fiber.MethodPut, "/devices/"+uintString(device.ID)+"/stage", `{"stage":"draft"}`, nil); status != fiber.StatusOK {
+		t.Errorf("withdrawing = %d", status)
+	}
+}
@@ -0,0 +1,377 @@
+package controller
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Moderators and above may edit or delete devices they did not post.
+const moderatorPrivilege int8 = 4
+
+var (
+	errDeviceNameTaken = errors.New("a device with that name already exists")
+	errDeviceNotFound  = errors.New("device not found")
+	errDeviceForbidden = errors.New("not allowed to change this device")
+	nonURLSafe         = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// Create a device from the full aggregate: fields plus capabilities, disabilities and usages.
+func AddDevice(c *fiber.Ctx) error {
+	var device models.Device
+	if err := c.BodyParser(&device); err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	userID, _ := actorFromClaims(c)
+	// The body binds the whole model, so reset anything only the server sets. A client-supplied DeletedAt or HiddenAt
+	// would otherwise create an invisible device that still holds its name.
+	device.Model = gorm.Model{}
+	device.HiddenAt = nil
+	device.UserPostsID = userID
+	device.Images, device.Reviews = nil, nil
+	device.RatingAverage, device.RatingCount = 0, 0
+	device.Stage = models.StageDraft // Publishing goes through the review workflow.
+	clearDeviceChildIDs(&device)
+
+	if rp := validateDevice(&device); rp != nil {
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkDeviceNameFree(tx, &device); err != nil {
+			return err
+		}
+		if err := mapDeviceTerms(tx, &device); err != nil {
+			return err
+		}
+		if err := tx.Create(&device).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&models.DeviceStageHistory{DeviceID: device.ID, ToStage: device.Stage, ActorID: userID}).Error; err != nil {
+			return err
+		}
+		_, err := recordDeviceRevision(tx, &device, userID, "Created.", nil)
+		return err
+	})
+	if err != nil {
+		return deviceWriteError(c, err)
+	}
+
+	event := newAuditEvent(c, audit.DeviceCreated)
+	event.Details["deviceID"] = strconv.FormatUint(uint64(device.ID), 10)
+	audit.Record(event)
+	indexDevice(device.ID)
+
+	return c.Status(fiber.StatusCreated).JSON(&device)
+}
+
+// Update a device. Fields left empty keep their value and the stage can only change through SetDeviceStage. Child lists that are sent replace the existing ones, omitted lists are kept.
+//
+// An optional reason is stored with the revision the update creates. Public devices changed by their author go back to
+// review.
+func UpdateDevice(c *fiber.Ctx) error {
+	var body struct {
+		models.Device
+		Reason string `json:"reason"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	in := body.Device
+	clearDeviceChildIDs(&in)
+
+	userID, privilege := actorFromClaims(c)
+	var device models.Device
+	var override, resubmitted bool
+	var invalid *models.ResponsePacket
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if override, err = loadOwnedDevice(c, tx, &device); err != nil {
+			return err
+		}
+		// Devices saved before revisions existed get their current content recorded first, so the edit can be rolled back.
+		if _, err := recordDeviceRevision(tx, &device, device.UserPostsID, baselineRevisionReason, nil); err != nil {
+			return err
+		}
+
+		if err := mapDeviceTerms(tx, &in); err != nil {
+			return err
+		}
+		if in.Name != "" {
+			device.Name = in.Name
+		}
+		if in.Difficulty != "" {
+			device.Difficulty = in.Difficulty
+		}
+		if in.TimeToComplete != "" {
+			device.TimeToComplete = in.TimeToComplete
+		}
+		if in.MaterialCost != "" {
+			device.MaterialCost = in.MaterialCost
+		}
+		if in.License != "" {
+			device.License = in.License
+		}
+		if in.Capabilities != nil {
+			device.Capabilities = in.Capabilities
+		}
+		if in.Disabilities != nil {
+			device.Disabilities = in.Disabilities
+		}
+		if in.Usages != nil {
+			device.Usages = in.Usages
+		}
+
+		if invalid = validateDevice(&device); invalid != nil {
+			return gorm.ErrInvalidData
+		}
+		if err := checkDeviceNameFree(tx, &device); err != nil {
+			return err
+		}
+		if resubmitted, err = resubmitChangedDevice(tx, &device, userID, privilege); err != nil {
+			return err
+		}
+
+		if err := tx.Omit("Capabilities", "Disabilities", "Usages", "Images", "Reviews").Save(&device).Error; err != nil {
+			return err
+		}
+		if err := replaceDeviceChildren(tx, &device, &in); err != nil {
+			return err
+		}
+		_, err = recordDeviceRevision(tx, &device, userID, strings.TrimSpace(body.Reason), nil)
+		return err
+	})
+	if invalid != nil {
+		return c.Status(fiber.StatusNotAcceptable).JSON(invalid)
+	}
+	if err != nil {
+		return deviceWriteError(c, err)
+	}
+
+	event := newAuditEvent(c, audit.DeviceUpdated)
+	event.Details["deviceID"] = strconv.FormatUint(uint64(device.ID), 10)
+	if override {
+		event.TargetID = device.UserPostsID
+		event.Details["override"] = "true"
+	}
+	audit.Record(event)
+	if resubmitted {
+		announceResubmission(c, device)
+	}
+	indexDevice(device.ID)
+
+	return c.Status(fiber.StatusOK).JSON(&device)
+}
+
+// Delete a device along with its capabilities, disabilities, usages, images and files.
+func DeleteDevice(c *fiber.Ctx) error {
+	var device models.Device
+	var override bool
+	var fileKeys []string
+	var images []models.DeviceImage
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if override, err = loadOwnedDevice(c, tx, &device); err != nil {
+			return err
+		}
+		if err := tx.Model(&models.DeviceFile{}).Where("device_id = ?", device.ID).Pluck("disc_location_name", &fileKeys).Error; err != nil {
+			return err
+		}
+		if err := tx.Select("device_id", "hash", "extension").Where("device_id = ?", device.ID).Find(&images).Error; err != nil {
+			return err
+		}
+		// Hard delete, so the name is free again and the cascade constraints apply.
+		for _, child := range []interface{}{&models.DeviceCapability{}, &models.DeviceDisability{}, &models.DeviceUsage{}, &models.DeviceImage{}, &models.DeviceFile{}} {
+			if err := tx.Unscoped().Where("device_id = ?", device.ID).Delete(child).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Unscoped().Delete(&device).Error
+	})
+	if err != nil {
+		return deviceWriteError(c, err)
+	}
+	for _, key := range fileKeys {
+		deleteStoredFile(key)
+	}
+	for _, image := range images {
+		deleteImageVariants(image)
+	}
+
+	event := newAuditEvent(c, audit.DeviceDeleted)
+	event.Details["deviceID"] = strconv.FormatUint(uint64(device.ID), 10)
+	event.Details["name"] = device.Name
+	if override {
+		event.TargetID = device.UserPostsID
+		event.Details["override"] = "true"
+	}
+	audit.Record(event)
+	indexDevice(device.ID)
+
+	rp := models.ResponsePacket{Error: false, Code: "delete_success", Message: "Device deleted successfully."}
+	return c.Status(fiber.StatusOK).JSON(rp)
+}
+
+// Load the device named by :id with its children and lock it for the rest of the transaction.
+//
+// Only the user who posted it or a moderator may continue. Reports whether a moderator is acting on someone else's device.
+func loadOwnedDevice(c *fiber.Ctx, tx *gorm.DB, device *models.Device) (bool, error) {
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Preload("Capabilities").Preload("Disabilities").Preload("Usages").
+		Where("id = ?", c.Params("id")).First(device).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, errDeviceNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+
+	userID, privilege := actorFromClaims(c)
+	if device.UserPostsID == userID {
+		return false, nil
+	}
+	if privilege <= moderatorPrivilege {
+		return true, nil
+	}
+	return false, errDeviceForbidden
+}
+
+// Swap out the child lists that were sent in the request.
+func replaceDeviceChildren(tx *gorm.DB, device *models.Device, in *models.Device) error {
+	if in.Capabilities != nil {
+		if err := tx.Unscoped().Where("device_id = ?", device.ID).Delete(&models.DeviceCapability{}).Error; err != nil {
+			return err
+		}
+		if len(device.Capabilities) > 0 {
+			if err := tx.Model(device).Association("Capabilities").Append(device.Capabilities); err != nil {
+				return err
+			}
+		}
+	}
+	if in.Disabilities != nil {
+		if err := tx.Unscoped().Where("device_id = ?", device.ID).Delete(&models.DeviceDisability{}).Error; err != nil {
+			return err
+		}
+		if len(device.Disabilities) > 0 {
+			if err := tx.Model(device).Association("Disabilities").Append(device.Disabilities); err != nil {
+				return err
+			}
+		}
+	}
+	if in.Usages != nil {
+		if err := tx.Unscoped().Where("device_id = ?", device.ID).Delete(&models.DeviceUsage{}).Error; err != nil {
+			return err
+		}
+		if len(device.Usages) > 0 {
+			if err := tx.Model(device).Association("Usages").Append(device.Usages); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Names must stay unique across all devices, including their URL safe form.
+func checkDeviceNameFree(tx *gorm.DB, device *models.Device) error {
+	device.UrlSafeName = urlSafeName(device.Name)
+
+	var count int64
+	err := tx.Unscoped().Model(&models.Device{}).
+		Where("(name = ? OR url_safe_name = ?) AND id <> ?", device.Name, device.UrlSafeName, device.ID).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errDeviceNameTaken
+	}
+	return nil
+}
+
+func validateDevice(device *models.Device) *models.ResponsePacket {
+	device.Name = strings.TrimSpace(device.Name)
+	switch {
+	case device.Name == "" || urlSafeName(device.Name) == "":
+		return &models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Name is required."}
+	case len(device.Name) > 150:
+		return &models.ResponsePacket{Error: true, Code: "invalid_name", Message: "Name must be 150 characters or fewer."}
+	case device.Difficulty == "" || device.TimeToComplete == "" || device.MaterialCost == "" || device.License == "":
+		return &models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Difficulty, time to complete, material cost and license are required."}
+	}
+
+	for _, capability := range device.Capabilities {
+		if strings.TrimSpace(capability.Name) == "" {
+			return &models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Every capability needs a name."}
+		}
+	}
+	for _, disability := range device.Disabilities {
+		if strings.TrimSpace(disability.Name) == "" {
+			return &models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Every disability needs a name."}
+		}
+	}
+	for _, usage := range device.Usages {
+		if strings.TrimSpace(usage.Name) == "" {
+			return &models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Every usage needs a name."}
+		}
+	}
+	return nil
+}
+
+// Children are always inserted fresh, so IDs from the client are ignored.
+func clearDeviceChildIDs(device *models.Device) {
+	for i := range device.Capabilities {
+		device.Capabilities[i].Model = gorm.Model{}
+		device.Capabilities[i].DeviceID = 0
+	}
+	for i := range device.Disabilities {
+		device.Disabilities[i].Model = gorm.Model{}
+		device.Disabilities[i].DeviceID = 0
+	}
+	for i := range device.Usages {
+		device.Usages[i].Model = gorm.Model{}
+		device.Usages[i].DeviceID = 0
+	}
+}
+
+func urlSafeName(name string) string {
+	return strings.Trim(nonURLSafe.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+func deviceWriteError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errDeviceNotFound):
+		rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "Device not found!"}
+		return c.Status(fiber.StatusNotFound).JSON(rp)
+	case errors.Is(err, errDeviceForbidden):
+		rp := models.ResponsePacket{Error: true, Code: "forbidden", Message: "You can only change devices you posted."}
+		return c.Status(fiber.StatusForbidden).JSON(rp)
+	case errors.Is(err, errDeviceNameTaken), err != nil && strings.Contains(err.Error(), "Duplicate entry"):
+		rp := models.ResponsePacket{Error: true, Code: "duplicate_name", Message: "Device with that name already exists. Please use another name"}
+		return c.Status(fiber.StatusConflict).JSON(rp)
+	}
+	rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Unable to save device. Internal error"}
+	return c.Status(fiber.StatusInternalServerError).JSON(rp)
+}
+
+// The user ID and privilege from the JWT.
+func actorFromClaims(c *fiber.Ctx) (uint, int8) {
+	claims := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	id, _ := claims["id"].(float64)
+	privilege, ok := claims["privilege"].(float64)
+	if !ok {
+		privilege = 9
+	}
+	return uint(id), int8(privilege)
+}
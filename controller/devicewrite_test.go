@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/search"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestUpdatePublicDeviceGoesBackToReview(t *testing.T) {
+	useTestDB(t)
+	author := createTestUser(t, "author@example.org", 9)
+	moderator := createTestUser(t, "moderator@example.org", moderatorPrivilege)
+
+	tests := []struct {
+		name      string
+		actor     models.User
+		stage     string
+		wantStage string
+	}{
+		{"author edits public device", author, models.StagePublic, models.StageReview},
+		{"author edits draft", author, models.StageDraft, models.StageDraft},
+		{"moderator edits public device", moderator, models.StagePublic, models.StagePublic},
+	}
+	for i, tt := range tests {
+		device := createTestDevice(t, "Switch adapter "+string(rune('A'+i)), author, tt.stage)
+
+		app := fiber.New()
+		app.Patch("/devices/:id", signedInAs(tt.actor), UpdateDevice)
+		body := `{"Difficulty":"hard","reason":"Harder than it looks."}`
+		var out models.Device
+		if status := sendRequest(t, app, fiber.MethodPatch, "/devices/"+uintString(device.ID), body, &out); status != fiber.StatusOK {
+			t.Fatalf("%s: status = %d", tt.name, status)
+		}
+
+		var saved models.Device
+		database.DB.First(&saved, device.ID)
+		if saved.Stage != tt.wantStage || out.Stage != tt.wantStage || saved.Difficulty != "hard" {
+			t.Errorf("%s: stage = %s (response %s), difficulty = %s, want stage %s", tt.name, saved.Stage, out.Stage, saved.Difficulty, tt.wantStage)
+		}
+
+		var history []models.DeviceStageHistory
+		database.DB.Where("device_id = ?", device.ID).Find(&history)
+		if tt.wantStage == tt.stage {
+			if len(history) != 0 {
+				t.Errorf("%s: unexpected stage history %+v", tt.name, history)
+			}
+			continue
+		}
+		if len(history) != 1 || history[0].FromStage != tt.stage || history[0].ToStage != tt.wantStage || history[0].ActorID != tt.actor.ID {
+			t.Errorf("%s: stage history = %+v", tt.name, history)
+		}
+	}
+}
+
+func TestAddDeviceIgnoresServerFields(t *testing.T) {
+	useTestDB(t)
+	search.Default = search.NewMemory()
+	author := createTestUser(t, "author@example.org", 9)
+
+	app := fiber.New()
+	app.Post("/devices", signedInAs(author), AddDevice)
+	body := `{"ID":99,"Name":"Switch mount","Difficulty":"easy","TimeToComplete":"1 hour","MaterialCost":"$10","License":"MIT",
+		"Stage":"public","CreatedAt":"2001-01-01T00:00:00Z","UpdatedAt":"2001-01-01T00:00:00Z",
+		"DeletedAt":"2001-01-01T00:00:00Z","hiddenAt":"2001-01-01T00:00:00Z","ratingCount":7,"userID":12345}`
+	var out models.Device
+	if status := sendRequest(t, app, fiber.MethodPost, "/devices", body, &out); status != fiber.StatusCreated {
+		t.Fatalf("status = %d", status)
+	}
+
+	// Queried with the default scope, so a soft-deleted row would not be found.
+	var saved models.Device
+	if err := database.DB.Where("name = ?", "Switch mount").First(&saved).Error; err != nil {
+		t.Fatalf("device is not visible: %v", err)
+	}
+	if saved.ID == 99 || saved.HiddenAt != nil || saved.CreatedAt.Year() == 2001 || saved.UpdatedAt.Year() == 2001 ||
+		saved.Stage != models.StageDraft || saved.RatingCount != 0 || saved.UserPostsID != author.ID {
+		t.Errorf("saved device = %+v", saved)
+	}
+}
@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/scanner"
+	"github.com/Elimists/go-app/storage"
+)
+
+const (
+	fileScanTimeout = 5 * time.Minute
+	fileScanSweep   = 5 * time.Minute
+)
+
+// Newly uploaded files wait here for FileScanWorker. Anything that does not fit is picked up by the next sweep.
+var fileScans = make(chan uint, 64)
+
+func queueFileScan(id uint) {
+	select {
+	case fileScans <- id:
+	default:
+	}
+}
+
+// FileScanWorker scans uploaded files one at a time. Files still pending after a restart, or after the scanner was
+// unavailable, are swept up periodically.
+func FileScanWorker() {
+	ticker := time.NewTicker(fileScanSweep)
+	defer ticker.Stop()
+	sweepPendingFiles()
+	for {
+		select {
+		case id := <-fileScans:
+			scanDeviceFile(id)
+		case <-ticker.C:
+			sweepPendingFiles()
+		}
+	}
+}
+
+func sweepPendingFiles() {
+	var ids []uint
+	if err := database.DB.Model(&models.DeviceFile{}).Where("scan_status = ?", models.ScanPending).Order("id").Pluck("id", &ids).Error; err != nil {
+		log.Printf("Error finding files to scan: %s", err.Error())
+		return
+	}
+	for _, id := range ids {
+		scanDeviceFile(id)
+	}
+}
+
+// Scan one pending file and record the verdict. Errors leave the file pending so it is tried again.
+func scanDeviceFile(id uint) {
+	var file models.DeviceFile
+	if err := database.DB.Where("id = ? AND scan_status = ?", id, models.ScanPending).First(&file).Error; err != nil {
+		return // Deleted or already scanned.
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fileScanTimeout)
+	defer cancel()
+	reader, _, err := storage.Default.Get(ctx, file.DiscLocationName)
+	if err != nil {
+		log.Printf("Error reading file %d for scanning: %s", file.ID, err.Error())
+		return
+	}
+	result, err := scanner.Default.Scan(ctx, reader)
+	reader.Close()
+
+	status := models.ScanClean
+	switch {
+	case errors.Is(err, scanner.ErrUnscannable):
+		status = models.ScanFailed
+	case err != nil:
+		log.Printf("Error scanning file %d: %s", file.ID, err.Error())
+		return
+	case result.Infected:
+		status = models.ScanInfected
+	}
+
+	now := time.Now()
+	update := database.DB.Model(&models.DeviceFile{}).Where("id = ? AND scan_status = ?", file.ID, models.ScanPending).
+		Updates(map[string]interface{}{"scan_status": status, "scan_signature": result.Signature, "scanned_at": &now})
+	if update.Error != nil {
+		log.Printf("Error saving scan result of file %d: %s", file.ID, update.Error.Error())
+		return
+	}
+	if update.RowsAffected == 0 || status == models.ScanClean {
+		return
+	}
+
+	event := audit.Event{Type: audit.DeviceFileQuarantined, TargetID: file.UploadedByID, Details: map[string]string{}}
+	event.Details["deviceID"] = strconv.FormatUint(uint64(file.DeviceID), 10)
+	event.Details["fileID"] = strconv.FormatUint(uint64(file.ID), 10)
+	event.Details["sha256"] = file.Checksum
+	event.Details["status"] = status
+	if result.Signature != "" {
+		event.Details["signature"] = result.Signature
+	}
+	audit.Record(event)
+}
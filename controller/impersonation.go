@@ -0,0 +1,137 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/middleware"
+	"github.com/Elimists/go-app/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+const impersonationDuration = time.Hour
+
+// Start viewing the app as another user.
+//
+// On success, sets X-{API_NAME}-JWT-Token to a short lived token for the target user carrying an "act" claim (RFC 8693) that names the staff member.
+func StartImpersonation(c *fiber.Ctx) error {
+	var data map[string]string
+
+	if err := c.BodyParser(&data); err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	reason := strings.TrimSpace(data["reason"])
+	if reason == "" {
+		rp := models.ResponsePacket{Error: true, Code: "missing_reason", Message: "A reason is required to impersonate a user."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	claims := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	actorID := uint(claims["id"].(float64))
+	actorEmail := claims["email"].(string)
+	actorPrivilege := int8(claims["privilege"].(float64))
+
+	var target models.User
+	if err := database.DB.Where("id = ?", c.Params("id")).First(&target).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "User not found."}
+			return c.Status(fiber.StatusNotFound).JSON(rp)
+		}
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	if target.ID == actorID || target.Privilege <= actorPrivilege {
+		rp := models.ResponsePacket{Error: true, Code: "forbidden", Message: "You can only impersonate users with less privilege than you."}
+		return c.Status(fiber.StatusForbidden).JSON(rp)
+	}
+	// Protected would refuse the token on its first use, so don't issue one.
+	if rp := accountRefusal(&target); rp != nil {
+		return c.Status(fiber.StatusForbidden).JSON(rp)
+	}
+
+	session := models.ImpersonationSession{
+		ActorID:   actorID,
+		TargetID:  target.ID,
+		Reason:    reason,
+		ExpiresAt: time.Now().Add(impersonationDuration),
+	}
+	if err := database.DB.Create(&session).Error; err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not start impersonation."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	tokenClaims := newUserClaims(&target, jwt.NewNumericDate(session.ExpiresAt))
+	tokenClaims["jti"] = strconv.FormatUint(uint64(session.ID), 10)
+	tokenClaims["act"] = map[string]interface{}{
+		"sub":   strconv.FormatUint(uint64(actorID), 10),
+		"email": actorEmail,
+	}
+	signedToken, err := signToken(tokenClaims)
+	if err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Could not sign token."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	event := newAuditEvent(c, audit.ImpersonationStarted)
+	event.TargetID, event.TargetEmail = target.ID, target.Email
+	event.Details["sessionID"] = tokenClaims["jti"].(string)
+	event.Details["reason"] = reason
+	audit.Record(event)
+
+	c.Append(fmt.Sprintf("X-%s-JWT-Token", os.Getenv("API_NAME")), signedToken)
+
+	rp := models.ResponsePacket{Error: false, Code: "impersonation_started", Message: fmt.Sprintf("Now impersonating %s.", target.Email)}
+	return c.Status(fiber.StatusOK).JSON(rp)
+}
+
+// End the impersonation session the request's token belongs to. The token stops working immediately.
+func StopImpersonation(c *fiber.Ctx) error {
+	claims := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	if !middleware.IsImpersonation(claims) {
+		rp := models.ResponsePacket{Error: true, Code: "not_impersonating", Message: "This token is not an impersonation token."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	sessionID, _ := strconv.ParseUint(claims["jti"].(string), 10, 64)
+	if err := database.DB.Model(&models.ImpersonationSession{}).Where("id = ? AND ended_at IS NULL", sessionID).Update("ended_at", time.Now()).Error; err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not stop impersonation."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+	middleware.InvalidateImpersonation(uint(sessionID))
+
+	event := newAuditEvent(c, audit.ImpersonationStopped)
+	event.Details["sessionID"] = claims["jti"].(string)
+	audit.Record(event)
+
+	rp := models.ResponsePacket{Error: false, Code: "impersonation_stopped", Message: "Impersonation ended."}
+	return c.Status(fiber.StatusOK).JSON(rp)
+}
+
+// Returns who is behind an impersonation token, or nil for a regular token.
+func impersonationFromClaims(claims jwt.MapClaims) *models.Impersonation {
+	act, ok := claims["act"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	actorID, _ := strconv.ParseUint(fmt.Sprint(act["sub"]), 10, 64)
+	sessionID, _ := strconv.ParseUint(fmt.Sprint(claims["jti"]), 10, 64)
+	actorEmail, _ := act["email"].(string)
+
+	return &models.Impersonation{
+		SessionID:  uint(sessionID),
+		ActorID:    uint(actorID),
+		ActorEmail: actorEmail,
+	}
+}
@@ -0,0 +1,30 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestImpersonationRefusesSuspendedUser(t *testing.T) {
+	useTestDB(t)
+	t.Setenv("SECRET_KEY", "test-secret")
+	admin := createTestUser(t, "admin@example.org", 1)
+	member := createTestUser(t, "member@example.org", 9)
+	database.DB.Model(&member).Updates(map[string]interface{}{"status": models.AccountSuspended, "suspended_until": time.Now().Add(time.Hour)})
+
+	app := fiber.New()
+	app.Post("/users/:id/impersonate", signedInAs(admin), StartImpersonation)
+	var rp models.ResponsePacket
+	if status := sendRequest(t, app, fiber.MethodPost, "/users/"+uintString(member.ID)+"/impersonate", `{"reason":"Support ticket."}`, &rp); status != fiber.StatusForbidden || rp.Code != "account_suspended" {
+		t.Errorf("status = %d, code = %s, want 403 account_suspended", status, rp.Code)
+	}
+	var sessions int64
+	database.DB.Model(&models.ImpersonationSession{}).Count(&sessions)
+	if sessions != 0 {
+		t.Errorf("an impersonation session was started")
+	}
+}
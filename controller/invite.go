@@ -0,0 +1,255 @@
+package controller
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+// Registration modes.
+const (
+	RegistrationOpen            = "open"
+	RegistrationInviteOnly      = "invite_only"
+	RegistrationDomainAllowlist = "domain_allowlist"
+	RegistrationClosed          = "closed"
+)
+
+const (
+	registrationModeKey    = "registration.mode"
+	registrationDomainsKey = "registration.allowed_domains"
+)
+
+var errInviteInvalid = errors.New("invite code is invalid, expired or used up")
+
+func registrationMode() string {
+	fallback := os.Getenv("REGISTRATION_MODE")
+	if fallback == "" {
+		fallback = RegistrationOpen
+	}
+	return getSetting(registrationModeKey, fallback)
+}
+
+func registrationDomainAllowed(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+
+	for _, allowed := range strings.Split(getSetting(registrationDomainsKey, ""), ",") {
+		if allowed = strings.ToLower(strings.TrimSpace(allowed)); allowed != "" && domain == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether the email may register under the current mode.
+//
+// Returns a response packet describing the refusal, or nil when registration may go ahead.
+func checkRegistrationAllowed(email string, inviteCode string) *models.ResponsePacket {
+	switch registrationMode() {
+	case RegistrationClosed:
+		return &models.ResponsePacket{Error: true, Code: "registration_closed", Message: "Registration is currently closed."}
+	case RegistrationInviteOnly:
+		if inviteCode == "" {
+			return &models.ResponsePacket{Error: true, Code: "invite_required", Message: "An invite code is required to register."}
+		}
+	case RegistrationDomainAllowlist:
+		if inviteCode == "" && !registrationDomainAllowed(email) {
+			return &models.ResponsePacket{Error: true, Code: "domain_not_allowed", Message: "Registration is restricted to approved email domains."}
+		}
+	}
+	return nil
+}
+
+// Use up one redemption of an invite inside the registration transaction.
+func consumeInvite(tx *gorm.DB, code string) (*models.Invite, error) {
+	var invite models.Invite
+	if err := tx.Where("code_hash = ?", hashToken(code)).First(&invite).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errInviteInvalid
+		}
+		return nil, err
+	}
+
+	// The guard in the WHERE clause stops two registrations racing for the last use.
+	result := tx.Model(&models.Invite{}).
+		Where("id = ? AND revoked_at IS NULL AND expires_at > ? AND uses < max_uses", invite.ID, time.Now()).
+		Update("uses", gorm.Expr("uses + 1"))
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errInviteInvalid
+	}
+
+	return &invite, nil
+}
+
+// Show the registration mode and allowed domains.
+func GetRegistrationSettings(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"mode":           registrationMode(),
+		"allowedDomains": getSetting(registrationDomainsKey, ""),
+	})
+}
+
+// Change the registration mode and/or the allowed domains (comma separated).
+func UpdateRegistrationSettings(c *fiber.Ctx) error {
+	var data map[string]string
+
+	if err := c.BodyParser(&data); err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	mode, hasMode := data["mode"]
+	domains, hasDomains := data["allowedDomains"]
+
+	if hasMode {
+		switch mode {
+		case RegistrationOpen, RegistrationInviteOnly, RegistrationDomainAllowlist, RegistrationClosed:
+		default:
+			rp := models.ResponsePacket{Error: true, Code: "invalid_mode", Message: "Mode must be one of open, invite_only, domain_allowlist or closed."}
+			return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+		}
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if hasMode {
+			if err := setSetting(tx, registrationModeKey, mode); err != nil {
+				return err
+			}
+		}
+		if hasDomains {
+			return setSetting(tx, registrationDomainsKey, domains)
+		}
+		return nil
+	})
+	if err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not update registration settings."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	event := newAuditEvent(c, audit.RegistrationSettingsChanged)
+	if hasMode {
+		event.Details["mode"] = mode
+	}
+	if hasDomains {
+		event.Details["allowedDomains"] = domains
+	}
+	audit.Record(event)
+
+	rp := models.ResponsePacket{Error: false, Code: "update_successfull", Message: "Registration settings updated."}
+	return c.Status(fiber.StatusOK).JSON(rp)
+}
+
+// Create an invite code. The code is only returned once.
+//
+// Body: privilege (default 9), maxUses (default 1), expiresInHours (default 168) and an optional note.
+func CreateInvite(c *fiber.Ctx) error {
+	var data map[string]interface{}
+
+	if err := c.BodyParser(&data); err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	privilege, maxUses, expiresInHours := 9, 1, 168
+	if v, ok := data["privilege"].(float64); ok {
+		privilege = int(v)
+	}
+	if v, ok := data["maxUses"].(float64); ok {
+		maxUses = int(v)
+	}
+	if v, ok := data["expiresInHours"].(float64); ok {
+		expiresInHours = int(v)
+	}
+	note, _ := data["note"].(string)
+
+	claims := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	actorPrivilege := int(claims["privilege"].(float64))
+
+	if privilege < 1 || privilege > 9 {
+		rp := models.ResponsePacket{Error: true, Code: "invalid_privilege", Message: "Privilege must be between 1 and 9."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	// Only admins may invite their peers; everyone else hands out privileges below their own.
+	if privilege <= actorPrivilege && actorPrivilege != 1 {
+		rp := models.ResponsePacket{Error: true, Code: "forbidden", Message: "You can only hand out privileges below your own."}
+		return c.Status(fiber.StatusForbidden).JSON(rp)
+	}
+	if maxUses < 1 || expiresInHours < 1 {
+		rp := models.ResponsePacket{Error: true, Code: "invalid_invite", Message: "maxUses and expiresInHours must be at least 1."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	token, _, err := generateSecureToken()
+	if err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not create invite."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+	code := token[:20] // 80 bits is plenty for a code people may have to type.
+
+	invite := models.Invite{
+		CodeHash:    hashToken(code),
+		CodeHint:    code[:4],
+		Note:        note,
+		Privilege:   int8(privilege),
+		MaxUses:     uint(maxUses),
+		ExpiresAt:   time.Now().Add(time.Duration(expiresInHours) * time.Hour),
+		CreatedByID: uint(claims["id"].(float64)),
+	}
+	if err := database.DB.Create(&invite).Error; err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not create invite."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	event := newAuditEvent(c, audit.InviteCreated)
+	event.Details["inviteID"] = strconv.FormatUint(uint64(invite.ID), 10)
+	event.Details["privilege"] = strconv.Itoa(privilege)
+	event.Details["maxUses"] = strconv.Itoa(maxUses)
+	audit.Record(event)
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"code": code, "invite": invite})
+}
+
+func GetInvites(c *fiber.Ctx) error {
+	var invites []models.Invite
+
+	if err := database.DB.Order("id desc").Find(&invites).Error; err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&invites)
+}
+
+func RevokeInvite(c *fiber.Ctx) error {
+	result := database.DB.Model(&models.Invite{}).Where("id = ? AND revoked_at IS NULL", c.Params("id")).Update("revoked_at", time.Now())
+	if result.Error != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not revoke invite."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+	if result.RowsAffected == 0 {
+		rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "Invite not found or already revoked."}
+		return c.Status(fiber.StatusNotFound).JSON(rp)
+	}
+
+	event := newAuditEvent(c, audit.InviteRevoked)
+	event.Details["inviteID"] = c.Params("id")
+	audit.Record(event)
+
+	rp := models.ResponsePacket{Error: false, Code: "invite_revoked", Message: "Invite revoked."}
+	return c.Status(fiber.StatusOK).JSON(rp)
+}
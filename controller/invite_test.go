@@ -0,0 +1,114 @@
+package controller
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRegistrationModes(t *testing.T) {
+	useTestDB(t)
+	t.Setenv("REGISTRATION_MODE", "")
+	if err := setSetting(database.DB, registrationDomainsKey, "example.org, Partner.ORG"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		mode, email, invite, refusal string
+	}{
+		{RegistrationOpen, "anyone@elsewhere.com", "", ""},
+		{RegistrationClosed, "anyone@example.org", "code", "registration_closed"},
+		{RegistrationInviteOnly, "anyone@example.org", "", "invite_required"},
+		{RegistrationInviteOnly, "anyone@elsewhere.com", "code", ""},
+		{RegistrationDomainAllowlist, "staff@example.org", "", ""},
+		{RegistrationDomainAllowlist, "staff@partner.org", "", ""},
+		{RegistrationDomainAllowlist, "staff@sub.example.org", "", "domain_not_allowed"},
+		{RegistrationDomainAllowlist, "anyone@elsewhere.com", "", "domain_not_allowed"},
+		{RegistrationDomainAllowlist, "anyone@elsewhere.com", "code", ""},
+	} {
+		if err := setSetting(database.DB, registrationModeKey, tc.mode); err != nil {
+			t.Fatal(err)
+		}
+		rp := checkRegistrationAllowed(tc.email, tc.invite)
+		if (rp == nil) != (tc.refusal == "") || (rp != nil && rp.Code != tc.refusal) {
+			t.Errorf("%s %s invite %q = %+v, want %q", tc.mode, tc.email, tc.invite, rp, tc.refusal)
+		}
+	}
+}
+
+func TestRegistrationModeFallsBackToEnvironment(t *testing.T) {
+	useTestDB(t)
+	t.Setenv("REGISTRATION_MODE", RegistrationClosed)
+	if mode := registrationMode(); mode != RegistrationClosed {
+		t.Errorf("mode = %s, want the environment's", mode)
+	}
+}
+
+func TestInviteSingleUse(t *testing.T) {
+	useTestDB(t)
+	admin := createTestUser(t, "admin@example.org", 1)
+
+	app := fiber.New()
+	app.Post("/invites", signedInAs(admin), CreateInvite)
+	var created struct {
+		Code   string        `json:"code"`
+		Invite models.Invite `json:"invite"`
+	}
+	if status := sendRequest(t, app, fiber.MethodPost, "/invites", `{"privilege":4}`, &created); status != fiber.StatusCreated {
+		t.Fatalf("status = %d", status)
+	}
+
+	invite, err := consumeInvite(database.DB, created.Code)
+	if err != nil || invite.Privilege != 4 {
+		t.Fatalf("first use = %+v, %v", invite, err)
+	}
+	if _, err := consumeInvite(database.DB, created.Code); !errors.Is(err, errInviteInvalid) {
+		t.Errorf("second use = %v, want errInviteInvalid", err)
+	}
+	if _, err := consumeInvite(database.DB, "not-a-code"); !errors.Is(err, errInviteInvalid) {
+		t.Errorf("unknown code = %v, want errInviteInvalid", err)
+	}
+
+	var stored models.Invite
+	database.DB.First(&stored, created.Invite.ID)
+	if stored.Uses != 1 {
+		t.Errorf("uses = %d, want 1", stored.Uses)
+	}
+
+	// Expired and revoked invites are refused even with uses left.
+	database.DB.Model(&stored).Updates(map[string]interface{}{"max_uses": 5, "expires_at": time.Now().Add(-time.Minute)})
+	if _, err := consumeInvite(database.DB, created.Code); !errors.Is(err, errInviteInvalid) {
+		t.Errorf("expired invite = %v, want errInviteInvalid", err)
+	}
+	database.DB.Model(&stored).Updates(map[string]interface{}{"expires_at": time.Now().Add(time.Hour), "revoked_at": time.Now()})
+	if _, err := consumeInvite(database.DB, created.Code); !errors.Is(err, errInviteInvalid) {
+		t.Errorf("revoked invite = %v, want errInviteInvalid", err)
+	}
+}
+
+func TestCreateInvitePrivilege(t *testing.T) {
+	useTestDB(t)
+	admin := createTestUser(t, "admin@example.org", 1)
+	manager := createTestUser(t, "manager@example.org", 2)
+
+	for _, tc := range []struct {
+		actor     models.User
+		privilege string
+		status    int
+	}{
+		{admin, "1", fiber.StatusCreated},
+		{manager, "1", fiber.StatusForbidden},
+		{manager, "2", fiber.StatusForbidden},
+		{manager, "3", fiber.StatusCreated},
+	} {
+		app := fiber.New()
+		app.Post("/invites", signedInAs(tc.actor), CreateInvite)
+		if status := sendRequest(t, app, fiber.MethodPost, "/invites", `{"privilege":`+tc.privilege+`}`, nil); status != tc.status {
+			t.Errorf("%s inviting privilege %s = %d, want %d", tc.actor.Email, tc.privilege, status, tc.status)
+		}
+	}
+}
@@ -0,0 +1,776 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/middleware"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/pagination"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	autoHideKeyPrefix      = "moderation.auto_hide."
+	defaultAutoHide        = 5
+	maxReportDetails       = 1000
+	maxSuspensionDays      = 365
+	managerPrivilege  int8 = 2 // Managers and admins can take over cases claimed by someone else.
+)
+
+// Reasons a report can give. "other" needs details.
+var reportReasons = []string{"spam", "harassment", "hate", "sexual", "violence", "misinformation", "unsafe", "copyright", "other"}
+
+// Content types that can be hidden. Profiles cannot; their owners are warned or suspended instead.
+var hideableTargets = []string{models.TargetDevice, models.TargetReview, models.TargetComment}
+
+var (
+	errTargetNotFound   = errors.New("target not found")
+	errInvalidTarget    = errors.New("invalid target type")
+	errReportOwnContent = errors.New("cannot report your own content")
+	errCaseNotFound     = errors.New("moderation case not found")
+	errCaseClosed       = errors.New("moderation case is closed")
+	errCaseClaimed      = errors.New("moderation case is claimed by another moderator")
+	errUserProtected    = errors.New("cannot act against this user")
+	errSuspendedLonger  = errors.New("user is already suspended for longer")
+)
+
+var moderationCaseSorts = map[string]pagination.Sort{
+	"oldest":  {Column: "created_at", Time: true},
+	"newest":  {Column: "created_at", Desc: true, Time: true},
+	"reports": {Column: "report_count", Desc: true},
+}
+
+type reportInput struct {
+	TargetType string `json:"targetType"`
+	TargetID   uint   `json:"targetID"`
+	ReasonCode string `json:"reasonCode"`
+	Details    string `json:"details"`
+}
+
+// Report a device, review, comment or profile to moderators. Reports about the same target are grouped into one case.
+//
+// Body: targetType, targetID, reasonCode and details.
+func CreateReport(c *fiber.Ctx) error {
+	var in reportInput
+	if err := c.BodyParser(&in); err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	return fileReport(c, in)
+}
+
+func fileReport(c *fiber.Ctx, in reportInput) error {
+	in.ReasonCode = strings.TrimSpace(in.ReasonCode)
+	in.Details = strings.TrimSpace(in.Details)
+	if !contains(reportReasons, in.ReasonCode) {
+		rp := models.ResponsePacket{Error: true, Code: "invalid_reason", Message: "Reason must be one of " + strings.Join(reportReasons, ", ") + "."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	if in.ReasonCode == "other" && in.Details == "" {
+		rp := models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Please say what is wrong."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	if len(in.Details) > maxReportDetails {
+		in.Details = in.Details[:maxReportDetails]
+	}
+
+	reporterID, _ := actorFromClaims(c)
+	var modCase models.ModerationCase
+	var ownerID uint
+	var hidden bool
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if ownerID, err = moderationTargetOwner(tx, in.TargetType, in.TargetID); err != nil {
+			return err
+		}
+		if ownerID == reporterID {
+			return errReportOwnContent
+		}
+		if err := openCase(tx, in.TargetType, in.TargetID, &modCase); err != nil {
+			return err
+		}
+
+		report := models.Report{TargetType: in.TargetType, TargetID: in.TargetID, ReporterID: reporterID, ReasonCode: in.ReasonCode, Details: in.Details, CaseID: modCase.ID}
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&report)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errAlreadyDone
+		}
+		modCase.ReportCount++
+		if err := tx.Model(&models.ModerationCase{}).Where("id = ?", modCase.ID).UpdateColumn("report_count", modCase.ReportCount).Error; err != nil {
+			return err
+		}
+
+		threshold := autoHideThreshold(in.TargetType)
+		if threshold == 0 || modCase.AutoHidden || modCase.ReportCount < uint(threshold) {
+			return nil
+		}
+		if hidden, err = setHidden(tx, in.TargetType, in.TargetID, true); err != nil || !hidden {
+			return err
+		}
+		modCase.AutoHidden = true
+		if err := tx.Model(&models.ModerationCase{}).Where("id = ?", modCase.ID).UpdateColumn("auto_hidden", true).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.ModerationAction{
+			CaseID:     &modCase.ID,
+			Action:     models.ActionAutoHide,
+			TargetType: in.TargetType,
+			TargetID:   in.TargetID,
+			UserID:     ownerID,
+			Note:       fmt.Sprintf("Hidden after %d reports.", modCase.ReportCount),
+		}).Error
+	})
+	if err != nil {
+		return moderationError(c, err)
+	}
+
+	event := newAuditEvent(c, audit.ContentReported)
+	event.TargetID = ownerID
+	event.Details["targetType"] = in.TargetType
+	event.Details["targetID"] = strconv.FormatUint(uint64(in.TargetID), 10)
+	event.Details["caseID"] = strconv.FormatUint(uint64(modCase.ID), 10)
+	event.Details["reasonCode"] = in.ReasonCode
+	audit.Record(event)
+
+	if hidden {
+		event := newAuditEvent(c, audit.ContentHidden)
+		event.TargetID = ownerID
+		event.Details["targetType"] = in.TargetType
+		event.Details["targetID"] = strconv.FormatUint(uint64(in.TargetID), 10)
+		event.Details["caseID"] = strconv.FormatUint(uint64(modCase.ID), 10)
+		event.Details["automatic"] = "true"
+		audit.Record(event)
+		if in.TargetType == models.TargetDevice {
+			indexDevice(in.TargetID)
+		}
+	}
+
+	rp := models.ResponsePacket{Error: false, Code: "report_received", Message: "Thanks, a moderator will take a look."}
+	return c.Status(fiber.StatusOK).JSON(rp)
+}
+
+// List moderation cases, oldest first by default.
+//
+// Query: status (comma separated, defaults to open,claimed), type, claimed=me, sort (oldest, newest or reports), limit
+// and cursor.
+func GetModerationCases(c *fiber.Ctx) error {
+	p, err := pagination.Parse(c, pagination.Limits{Default: 20, Max: 100}, moderationCaseSorts, "oldest")
+	if err != nil {
+		return paginationError(c, err)
+	}
+
+	statuses := splitQuery(c.Query("status"))
+	if len(statuses) == 0 {
+		statuses = []string{models.CaseOpen, models.CaseClaimed}
+	}
+	base := database.DB.Model(&models.ModerationCase{}).Where("status IN ?", statuses)
+	if targetType := c.Query("type"); targetType != "" {
+		base = base.Where("target_type = ?", targetType)
+	}
+	if c.Query("claimed") == "me" {
+		moderatorID, _ := actorFromClaims(c)
+		base = base.Where("claimed_by_id = ?", moderatorID)
+	}
+
+	total, err := pagination.Count(base)
+	if err != nil {
+		return paginationError(c, err)
+	}
+	var cases []models.ModerationCase
+	if err := p.Query(base, "id").Find(&cases).Error; err != nil {
+		return paginationError(c, err)
+	}
+	page := pagination.NewPage(c, p, cases, func(mc *models.ModerationCase) pagination.Key {
+		if p.Sort.Column == "report_count" {
+			return pagination.Key{Value: mc.ReportCount, ID: mc.ID}
+		}
+		return pagination.Key{Value: mc.CreatedAt, ID: mc.ID}
+	}, total)
+	return c.Status(fiber.StatusOK).JSON(&page)
+}
+
+// Show a case with its reports and everything moderators have done about it.
+func GetModerationCase(c *fiber.Ctx) error {
+	var modCase models.ModerationCase
+	err := database.DB.Preload("Reports", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Where("id = ?", c.Params("id")).First(&modCase).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return moderationError(c, errCaseNotFound)
+	}
+	if err != nil {
+		return moderationError(c, err)
+	}
+
+	var actions []models.ModerationAction
+	if err := database.DB.Where("case_id = ?", modCase.ID).Order("id").Find(&actions).Error; err != nil {
+		return moderationError(c, err)
+	}
+	if actions == nil {
+		actions = []models.ModerationAction{}
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"case": modCase, "actions": actions})
+}
+
+// Take a case so other moderators know it is being handled. Managers and admins can take over someone else's claim.
+func ClaimModerationCase(c *fiber.Ctx) error {
+	moderatorID, privilege := actorFromClaims(c)
+	var modCase models.ModerationCase
+	var action models.ModerationAction
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := loadCaseForUpdate(tx, c.Params("id"), &modCase); err != nil {
+			return err
+		}
+		if modCase.ClaimedByID != nil && *modCase.ClaimedByID == moderatorID {
+			return errAlreadyDone
+		}
+		if err := checkCaseClaim(&modCase, moderatorID, privilege); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		modCase.Status, modCase.ClaimedByID, modCase.ClaimedAt = models.CaseClaimed, &moderatorID, &now
+		if err := tx.Select("status", "claimed_by_id", "claimed_at").Save(&modCase).Error; err != nil {
+			return err
+		}
+		action = caseAction(tx, &modCase, moderatorID, models.ActionClaim, "")
+		return tx.Create(&action).Error
+	})
+	if err != nil {
+		return moderationError(c, err)
+	}
+
+	recordModerationAction(c, audit.ModerationCaseClaimed, action)
+	return c.Status(fiber.StatusOK).JSON(&modCase)
+}
+
+// Close a case once the content has been dealt with, for example by hiding it or warning its author.
+//
+// Body: resolution, saying what was done.
+func ResolveModerationCase(c *fiber.Ctx) error {
+	return closeCase(c, models.CaseResolved)
+}
+
+// Close a case because the reports were unfounded. Content the reports hid automatically is shown again.
+//
+// Body: note (optional).
+func DismissModerationCase(c *fiber.Ctx) error {
+	return closeCase(c, models.CaseDismissed)
+}
+
+func closeCase(c *fiber.Ctx, status string) error {
+	var data map[string]string
+	_ = c.BodyParser(&data)
+	note := strings.TrimSpace(data["note"])
+	if status == models.CaseResolved {
+		note = strings.TrimSpace(data["resolution"])
+		if note == "" {
+			rp := models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Please say how the case was resolved."}
+			return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+		}
+	}
+
+	moderatorID, privilege := actorFromClaims(c)
+	var modCase models.ModerationCase
+	var actions []models.ModerationAction
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := loadCaseForUpdate(tx, c.Params("id"), &modCase); err != nil {
+			return err
+		}
+		if err := checkCaseClaim(&modCase, moderatorID, privilege); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		modCase.Status, modCase.OpenTarget, modCase.ClosedByID, modCase.ClosedAt, modCase.Resolution = status, nil, &moderatorID, &now, note
+		if err := tx.Select("status", "open_target", "closed_by_id", "closed_at", "resolution").Save(&modCase).Error; err != nil {
+			return err
+		}
+		kind := models.ActionResolve
+		if status == models.CaseDismissed {
+			kind = models.ActionDismiss
+		}
+		actions = append(actions, caseAction(tx, &modCase, moderatorID, kind, note))
+
+		if status == models.CaseDismissed && modCase.AutoHidden {
+			shown, err := setHidden(tx, modCase.TargetType, modCase.TargetID, false)
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && !errors.Is(err, errReviewNotFound) {
+				return err
+			}
+			if shown {
+				actions = append(actions, caseAction(tx, &modCase, moderatorID, models.ActionUnhide, "Reports dismissed."))
+			}
+		}
+		return tx.Create(&actions).Error
+	})
+	if err != nil {
+		return moderationError(c, err)
+	}
+
+	for _, action := range actions {
+		switch action.Action {
+		case models.ActionResolve:
+			recordModerationAction(c, audit.ModerationCaseResolved, action)
+		case models.ActionDismiss:
+			recordModerationAction(c, audit.ModerationCaseDismissed, action)
+		case models.ActionUnhide:
+			recordModerationAction(c, audit.ContentUnhidden, action)
+			if action.TargetType == models.TargetDevice {
+				indexDevice(action.TargetID)
+			}
+		}
+	}
+	return c.Status(fiber.StatusOK).JSON(&modCase)
+}
+
+// Hide a device, review or comment from everyone but its author and moderators.
+//
+// Body: note (optional).
+func HideContent(c *fiber.Ctx) error {
+	return setContentHidden(c, true)
+}
+
+// Show hidden content again.
+//
+// Body: note (optional).
+func UnhideContent(c *fiber.Ctx) error {
+	return setContentHidden(c, false)
+}
+
+func setContentHidden(c *fiber.Ctx, hidden bool) error {
+	targetType := c.Params("type")
+	if !contains(hideableTargets, targetType) {
+		return moderationError(c, errInvalidTarget)
+	}
+	targetID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return moderationError(c, errTargetNotFound)
+	}
+	var data map[string]string
+	_ = c.BodyParser(&data)
+
+	moderatorID, _ := actorFromClaims(c)
+	action := models.ModerationAction{ModeratorID: moderatorID, Action: models.ActionUnhide, TargetType: targetType, TargetID: uint(targetID), Note: strings.TrimSpace(data["note"])}
+	if hidden {
+		action.Action = models.ActionHide
+	}
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if action.UserID, err = moderationTargetOwner(tx, targetType, action.TargetID); err != nil {
+			return err
+		}
+		changed, err := setHidden(tx, targetType, action.TargetID, hidden)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			return errAlreadyDone
+		}
+		action.CaseID = openCaseID(tx, targetType, action.TargetID)
+		return tx.Create(&action).Error
+	})
+	if err != nil {
+		return moderationError(c, err)
+	}
+
+	if targetType == models.TargetDevice {
+		indexDevice(action.TargetID)
+	}
+	if hidden {
+		recordModerationAction(c, audit.ContentHidden, action)
+		rp := models.ResponsePacket{Error: false, Code: "content_hidden", Message: "Content hidden."}
+		return c.Status(fiber.StatusOK).JSON(rp)
+	}
+	recordModerationAction(c, audit.ContentUnhidden, action)
+	rp := models.ResponsePacket{Error: false, Code: "content_unhidden", Message: "Content is visible again."}
+	return c.Status(fiber.StatusOK).JSON(rp)
+}
+
+type userSanctionInput struct {
+	Message string `json:"message"`
+	Days    int    `json:"days"`
+	CaseID  *uint  `json:"caseID"`
+}
+
+// Email a user a warning from the moderators.
+//
+// Body: message, and caseID to link the warning to a case.
+func WarnUser(c *fiber.Ctx) error {
+	var in userSanctionInput
+	if err := c.BodyParser(&in); err != nil || strings.TrimSpace(in.Message) == "" {
+		rp := models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Please write the warning."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	var user models.User
+	var action models.ModerationAction
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		user, action, err = loadSanctionTarget(c, tx, in, models.ActionWarn)
+		if err != nil {
+			return err
+		}
+		return tx.Create(&action).Error
+	})
+	if err != nil {
+		return moderationError(c, err)
+	}
+
+	go notifyModeratedUser(user.Email, "A warning from the moderators", fmt.Sprintf("<p>A moderator has warned you about your activity:</p><p>%s</p>", html.EscapeString(action.Note)))
+	recordModerationAction(c, audit.UserWarned, action)
+	rp := models.ResponsePacket{Error: false, Code: "user_warned", Message: "Warning sent."}
+	return c.Status(fiber.StatusOK).JSON(rp)
+}
+
+// Stop a user from signing in for a number of days and end their sessions. Moderators can only suspend users with a
+// lower privilege than their own. Longer suspensions and bans are for admins, through UpdateUserStatus.
+//
+// Body: days (1-365), message giving the reason, and caseID to link the suspension to a case.
+func SuspendUser(c *fiber.Ctx) error {
+	var in userSanctionInput
+	if err := c.BodyParser(&in); err != nil || strings.TrimSpace(in.Message) == "" {
+		rp := models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Please give a reason for the suspension."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	if in.Days < 1 || in.Days > maxSuspensionDays {
+		rp := models.ResponsePacket{Error: true, Code: "invalid_days", Message: fmt.Sprintf("Suspensions must last between 1 and %d days.", maxSuspensionDays)}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	until := time.Now().AddDate(0, 0, in.Days)
+	var user models.User
+	var action models.ModerationAction
+	var token string
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		user, action, err = loadSanctionTarget(c, tx, in, models.ActionSuspend)
+		if err != nil {
+			return err
+		}
+		// A suspension would cut a ban, or a longer suspension, short.
+		if user.AccountStatus() == models.AccountBanned {
+			return errAlreadyDone
+		}
+		if user.AccountStatus() == models.AccountSuspended && user.SuspendedUntil != nil && user.SuspendedUntil.After(until) {
+			return errSuspendedLonger
+		}
+		if token, err = setAccountStatus(tx, &user, models.AccountSuspended, &until, action.Note, action.ModeratorID); err != nil {
+			return err
+		}
+		return tx.Create(&action).Error
+	})
+	if err != nil {
+		return moderationError(c, err)
+	}
+	middleware.InvalidateSession(user.ID)
+	go notifyAccountStatus(user, token)
+
+	event := newAuditEvent(c, audit.UserSuspended)
+	event.TargetID, event.TargetEmail = user.ID, user.Email
+	event.Details["until"] = until.UTC().Format(time.RFC3339)
+	event.Details["note"] = action.Note
+	if action.CaseID != nil {
+		event.Details["caseID"] = strconv.FormatUint(uint64(*action.CaseID), 10)
+	}
+	audit.Record(event)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"userID": user.ID, "suspendedUntil": until})
+}
+
+// Show the number of reports that hide each kind of content automatically. Zero turns auto-hiding off.
+func GetModerationSettings(c *fiber.Ctx) error {
+	thresholds := map[string]int{}
+	for _, targetType := range hideableTargets {
+		thresholds[targetType] = autoHideThreshold(targetType)
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"autoHideThresholds": thresholds})
+}
+
+// Change the auto-hide thresholds.
+//
+// Body: autoHideThresholds, e.g. {"device": 5, "review": 3, "comment": 3}.
+func UpdateModerationSettings(c *fiber.Ctx) error {
+	var data struct {
+		AutoHideThresholds map[string]int `json:"autoHideThresholds"`
+	}
+	if err := c.BodyParser(&data); err != nil || len(data.AutoHideThresholds) == 0 {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	for targetType, threshold := range data.AutoHideThresholds {
+		if !contains(hideableTargets, targetType) || threshold < 0 || threshold > 1000 {
+			rp := models.ResponsePacket{Error: true, Code: "invalid_threshold", Message: "Thresholds must be between 0 and 1000, for device, review or comment."}
+			return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+		}
+	}
+
+	event := newAuditEvent(c, audit.ModerationSettingsChanged)
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		for targetType, threshold := range data.AutoHideThresholds {
+			if err := setSetting(tx, autoHideKeyPrefix+targetType, strconv.Itoa(threshold)); err != nil {
+				return err
+			}
+			event.Details[targetType] = strconv.Itoa(threshold)
+		}
+		return nil
+	})
+	if err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not update moderation settings."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+	audit.Record(event)
+
+	return GetModerationSettings(c)
+}
+
+// How many reports hide a kind of content automatically. Admins can change it in the settings table.
+func autoHideThreshold(targetType string) int {
+	if !contains(hideableTargets, targetType) {
+		return 0
+	}
+	fallback := os.Getenv("MODERATION_AUTO_HIDE_THRESHOLD")
+	if fallback == "" {
+		fallback = strconv.Itoa(defaultAutoHide)
+	}
+	threshold, err := strconv.Atoi(getSetting(autoHideKeyPrefix+targetType, fallback))
+	if err != nil || threshold < 0 {
+		return defaultAutoHide
+	}
+	return threshold
+}
+
+// Find who a target belongs to, checking that it exists.
+func moderationTargetOwner(tx *gorm.DB, targetType string, targetID uint) (uint, error) {
+	var ownerID uint
+	var err error
+	switch targetType {
+	case models.TargetDevice:
+		var device models.Device
+		err = tx.Select("id", "user_posts_id").Where("id = ?", targetID).First(&device).Error
+		ownerID = device.UserPostsID
+	case models.TargetReview:
+		var review models.Review
+		if err = tx.Select("id", "user_details_id").Where("id = ?", targetID).First(&review).Error; err == nil {
+			var details models.UserDetails
+			err = tx.Select("user_id").Where("id = ?", review.UserDetailsID).First(&details).Error
+			ownerID = details.UserID
+		}
+	case models.TargetComment:
+		var comment models.Comment
+		err = tx.Select("id", "user_id").Where("id = ? AND deleted_at IS NULL", targetID).First(&comment).Error
+		ownerID = comment.UserID
+	case models.TargetUser:
+		var user models.User
+		err = tx.Select("id").Where("id = ? AND deactivated_at IS NULL", targetID).First(&user).Error
+		ownerID = user.ID
+	default:
+		return 0, errInvalidTarget
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, errTargetNotFound
+	}
+	return ownerID, err
+}
+
+// Set or clear hidden_at on a target. Reports whether anything changed. Hiding a review updates its device's rating.
+func setHidden(tx *gorm.DB, targetType string, targetID uint, hidden bool) (bool, error) {
+	value, condition := gorm.Expr("NULL"), "id = ? AND hidden_at IS NOT NULL"
+	if hidden {
+		value, condition = gorm.Expr("?", time.Now()), "id = ? AND hidden_at IS NULL"
+	}
+
+	var result *gorm.DB
+	switch targetType {
+	case models.TargetDevice:
+		result = tx.Model(&models.Device{}).Where(condition, targetID).UpdateColumn("hidden_at", value)
+	case models.TargetComment:
+		result = tx.Model(&models.Comment{}).Where(condition, targetID).UpdateColumn("hidden_at", value)
+	case models.TargetReview:
+		var review models.Review
+		if err := loadReviewForUpdate(tx, strconv.FormatUint(uint64(targetID), 10), &review); err != nil {
+			return false, err
+		}
+		deviceFound, err := lockReviewedDevice(tx, review.DeviceID)
+		if err != nil {
+			return false, err
+		}
+		result = tx.Model(&models.Review{}).Where(condition, targetID).UpdateColumn("hidden_at", value)
+		if result.Error == nil && result.RowsAffected > 0 && deviceFound {
+			return true, refreshDeviceRating(tx, review.DeviceID)
+		}
+	default:
+		return false, errInvalidTarget
+	}
+	return result.RowsAffected > 0, result.Error
+}
+
+// Load the open case for a target, opening one if there is none. The case row is locked.
+func openCase(tx *gorm.DB, targetType string, targetID uint, modCase *models.ModerationCase) error {
+	key := fmt.Sprintf("%s:%d", targetType, targetID)
+	fresh := models.ModerationCase{TargetType: targetType, TargetID: targetID, OpenTarget: &key, Status: models.CaseOpen}
+	// The unique open_target column makes two first reports racing each other share a case.
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&fresh).Error; err != nil {
+		return err
+	}
+	return tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("open_target = ?", key).First(modCase).Error
+}
+
+// The ID of a target's open case, if it has one.
+func openCaseID(tx *gorm.DB, targetType string, targetID uint) *uint {
+	var modCase models.ModerationCase
+	if err := tx.Select("id").Where("open_target = ?", fmt.Sprintf("%s:%d", targetType, targetID)).Limit(1).Find(&modCase).Error; err != nil || modCase.ID == 0 {
+		return nil
+	}
+	return &modCase.ID
+}
+
+func loadCaseForUpdate(tx *gorm.DB, id string, modCase *models.ModerationCase) error {
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", id).First(modCase).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errCaseNotFound
+	}
+	return err
+}
+
+// Check the moderator may act on a case: it must be open and not claimed by someone else, unless they are a manager.
+func checkCaseClaim(modCase *models.ModerationCase, moderatorID uint, privilege int8) error {
+	if modCase.Status == models.CaseResolved || modCase.Status == models.CaseDismissed {
+		return errCaseClosed
+	}
+	if modCase.ClaimedByID != nil && *modCase.ClaimedByID != moderatorID && privilege > managerPrivilege {
+		return errCaseClaimed
+	}
+	return nil
+}
+
+// Build a log entry for an action on a case's target. The owner is left at zero when the target is gone.
+func caseAction(tx *gorm.DB, modCase *models.ModerationCase, moderatorID uint, kind string, note string) models.ModerationAction {
+	ownerID, _ := moderationTargetOwner(tx, modCase.TargetType, modCase.TargetID)
+	return models.ModerationAction{
+		CaseID:      &modCase.ID,
+		ModeratorID: moderatorID,
+		Action:      kind,
+		TargetType:  modCase.TargetType,
+		TargetID:    modCase.TargetID,
+		UserID:      ownerID,
+		Note:        note,
+	}
+}
+
+// Load and lock the user named by :id for a warning or suspension and build the log entry.
+func loadSanctionTarget(c *fiber.Ctx, tx *gorm.DB, in userSanctionInput, kind string) (models.User, models.ModerationAction, error) {
+	moderatorID, privilege := actorFromClaims(c)
+	var user models.User
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", c.Params("id")).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return user, models.ModerationAction{}, errTargetNotFound
+	}
+	if err != nil {
+		return user, models.ModerationAction{}, err
+	}
+	if user.ID == moderatorID || user.Privilege <= privilege {
+		return user, models.ModerationAction{}, errUserProtected
+	}
+	if in.CaseID != nil {
+		if err := tx.Select("id").Where("id = ?", *in.CaseID).First(&models.ModerationCase{}).Error; err != nil {
+			return user, models.ModerationAction{}, errCaseNotFound
+		}
+	}
+
+	action := models.ModerationAction{
+		CaseID:      in.CaseID,
+		ModeratorID: moderatorID,
+		Action:      kind,
+		TargetType:  models.TargetUser,
+		TargetID:    user.ID,
+		UserID:      user.ID,
+		Note:        strings.TrimSpace(in.Message),
+	}
+	return user, action, nil
+}
+
+func recordModerationAction(c *fiber.Ctx, t audit.EventType, action models.ModerationAction) {
+	event := newAuditEvent(c, t)
+	event.TargetID = action.UserID
+	event.Details["targetType"] = action.TargetType
+	event.Details["targetID"] = strconv.FormatUint(uint64(action.TargetID), 10)
+	if action.CaseID != nil {
+		event.Details["caseID"] = strconv.FormatUint(uint64(*action.CaseID), 10)
+	}
+	if action.Note != "" {
+		event.Details["note"] = action.Note
+	}
+	audit.Record(event)
+}
+
+func notifyModeratedUser(email string, subject string, message string) {
+	body := fmt.Sprintf(`
+		<html>
+			<div  style="font-size:20px; font-family: Arial, serif;">
+				<p>Hi there,</p>
+				%s
+				<p>Please read the community guidelines before posting again.</p>
+			</div>
+		</html>
+		`, message)
+
+	if err := sendHTMLEmail(email, subject, body); err != nil {
+		log.Printf("Error sending moderation notice: %s", err.Error())
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func moderationError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errInvalidTarget):
+		rp := models.ResponsePacket{Error: true, Code: "invalid_target", Message: "Target type must be device, review, comment or user."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	case errors.Is(err, errTargetNotFound), errors.Is(err, errReviewNotFound):
+		rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "Nothing to report or moderate was found."}
+		return c.Status(fiber.StatusNotFound).JSON(rp)
+	case errors.Is(err, errReportOwnContent):
+		rp := models.ResponsePacket{Error: true, Code: "own_content", Message: "You cannot report your own content."}
+		return c.Status(fiber.StatusForbidden).JSON(rp)
+	case errors.Is(err, errCaseNotFound):
+		rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "Moderation case not found!"}
+		return c.Status(fiber.StatusNotFound).JSON(rp)
+	case errors.Is(err, errCaseClosed):
+		rp := models.ResponsePacket{Error: true, Code: "case_closed", Message: "This case has already been closed."}
+		return c.Status(fiber.StatusConflict).JSON(rp)
+	case errors.Is(err, errCaseClaimed):
+		rp := models.ResponsePacket{Error: true, Code: "case_claimed", Message: "Another moderator is handling this case."}
+		return c.Status(fiber.StatusConflict).JSON(rp)
+	case errors.Is(err, errUserProtected):
+		rp := models.ResponsePacket{Error: true, Code: "forbidden", Message: "You can only act against users with a lower privilege than yours."}
+		return c.Status(fiber.StatusForbidden).JSON(rp)
+	case errors.Is(err, errAlreadyDone):
+		rp := models.ResponsePacket{Error: true, Code: "already_done", Message: "That has already been done."}
+		return c.Status(fiber.StatusConflict).JSON(rp)
+	case errors.Is(err, errSuspendedLonger):
+		rp := models.ResponsePacket{Error: true, Code: "already_suspended", Message: "The user is already suspended for longer than that."}
+		return c.Status(fiber.StatusConflict).JSON(rp)
+	}
+	rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+	return c.Status(fiber.StatusInternalServerError).JSON(rp)
+}
@@ -0,0 +1,164 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/search"
+	"github.com/gofiber/fiber/v2"
+)
+
+func report(t *testing.T, reporter models.User, device models.Device) int {
+	t.Helper()
+	app := fiber.New()
+	app.Post("/reports", signedInAs(reporter), CreateReport)
+	body := `{"targetType":"device","targetID":` + uintString(device.ID) + `,"reasonCode":"spam"}`
+	return sendRequest(t, app, fiber.MethodPost, "/reports", body, nil)
+}
+
+func deviceCase(t *testing.T, device models.Device) models.ModerationCase {
+	t.Helper()
+	var modCase models.ModerationCase
+	if err := database.DB.Where("target_type = ? AND target_id = ?", models.TargetDevice, device.ID).First(&modCase).Error; err != nil {
+		t.Fatal(err)
+	}
+	return modCase
+}
+
+func TestDuplicateReport(t *testing.T) {
+	useTestDB(t)
+	author := createTestUser(t, "author@example.org", 9)
+	reporter := createTestUser(t, "reporter@example.org", 9)
+	device := createTestDevice(t, "Switch mount", author, models.StagePublic)
+
+	if status := report(t, reporter, device); status != fiber.StatusOK {
+		t.Fatalf("first report = %d", status)
+	}
+	if status := report(t, reporter, device); status != fiber.StatusConflict {
+		t.Errorf("second report = %d, want 409", status)
+	}
+	if status := report(t, author, device); status != fiber.StatusForbidden {
+		t.Errorf("reporting own device = %d, want 403", status)
+	}
+	if modCase := deviceCase(t, device); modCase.ReportCount != 1 {
+		t.Errorf("report count = %d, want 1", modCase.ReportCount)
+	}
+}
+
+func TestAutoHideAndDismiss(t *testing.T) {
+	useTestDB(t)
+	search.Default = search.NewMemory()
+	if err := setSetting(database.DB, autoHideKeyPrefix+models.TargetDevice, "2"); err != nil {
+		t.Fatal(err)
+	}
+	author := createTestUser(t, "author@example.org", 9)
+	moderator := createTestUser(t, "moderator@example.org", moderatorPrivilege)
+	device := createTestDevice(t, "Switch mount", author, models.StagePublic)
+
+	hidden := func() bool {
+		var saved models.Device
+		database.DB.First(&saved, device.ID)
+		return saved.HiddenAt != nil
+	}
+	autoHides := func() int64 {
+		var count int64
+		database.DB.Model(&models.ModerationAction{}).Where("action = ?", models.ActionAutoHide).Count(&count)
+		return count
+	}
+
+	for i, email := range []string{"one@example.org", "two@example.org", "three@example.org"} {
+		if status := report(t, createTestUser(t, email, 9), device); status != fiber.StatusOK {
+			t.Fatalf("report %d = %d", i+1, status)
+		}
+		if wantHidden := i+1 >= 2; hidden() != wantHidden {
+			t.Errorf("after %d reports hidden = %v, want %v", i+1, hidden(), wantHidden)
+		}
+	}
+	if n := autoHides(); n != 1 {
+		t.Errorf("auto-hide actions = %d, want 1", n)
+	}
+
+	modCase := deviceCase(t, device)
+	app := fiber.New()
+	app.Post("/cases/:id/dismiss", signedInAs(moderator), DismissModerationCase)
+	if status := sendRequest(t, app, fiber.MethodPost, "/cases/"+uintString(modCase.ID)+"/dismiss", `{"note":"Not spam."}`, nil); status != fiber.StatusOK {
+		t.Fatalf("dismiss = %d", status)
+	}
+	if hidden() {
+		t.Errorf("device is still hidden after the reports were dismissed")
+	}
+	var unhides int64
+	database.DB.Model(&models.ModerationAction{}).Where("case_id = ? AND action = ?", modCase.ID, models.ActionUnhide).Count(&unhides)
+	if unhides != 1 {
+		t.Errorf("unhide actions = %d, want 1", unhides)
+	}
+}
+
+func TestClaimedCase(t *testing.T) {
+	useTestDB(t)
+	author := createTestUser(t, "author@example.org", 9)
+	first := createTestUser(t, "first@example.org", moderatorPrivilege)
+	second := createTestUser(t, "second@example.org", moderatorPrivilege)
+	manager := createTestUser(t, "manager@example.org", managerPrivilege)
+	device := createTestDevice(t, "Switch mount", author, models.StagePublic)
+	report(t, createTestUser(t, "reporter@example.org", 9), device)
+	modCase := deviceCase(t, device)
+
+	send := func(actor models.User, action string) int {
+		app := fiber.New()
+		app.Post("/cases/:id/claim", signedInAs(actor), ClaimModerationCase)
+		app.Post("/cases/:id/dismiss", signedInAs(actor), DismissModerationCase)
+		return sendRequest(t, app, fiber.MethodPost, "/cases/"+uintString(modCase.ID)+"/"+action, `{}`, nil)
+	}
+
+	if status := send(first, "claim"); status != fiber.StatusOK {
+		t.Fatalf("claim = %d", status)
+	}
+	if status := send(second, "claim"); status != fiber.StatusConflict {
+		t.Errorf("another moderator claiming = %d, want 409", status)
+	}
+	if status := send(second, "dismiss"); status != fiber.StatusConflict {
+		t.Errorf("another moderator dismissing = %d, want 409", status)
+	}
+	if status := send(manager, "claim"); status != fiber.StatusOK {
+		t.Errorf("manager taking over = %d, want 200", status)
+	}
+	if claimed := deviceCase(t, device); claimed.ClaimedByID == nil || *claimed.ClaimedByID != manager.ID {
+		t.Errorf("claimed by = %v, want the manager", claimed.ClaimedByID)
+	}
+}
+
+func TestSuspendKeepsLongerSuspension(t *testing.T) {
+	useTestDB(t)
+	moderator := createTestUser(t, "moderator@example.org", moderatorPrivilege)
+	member := createTestUser(t, "member@example.org", 9)
+
+	app := fiber.New()
+	app.Post("/users/:id/suspend", signedInAs(moderator), SuspendUser)
+	suspend := func(days string) int {
+		return sendRequest(t, app, fiber.MethodPost, "/users/"+uintString(member.ID)+"/suspend", `{"days":`+days+`,"message":"Spam."}`, nil)
+	}
+
+	if status := suspend("30"); status != fiber.StatusOK {
+		t.Fatalf("suspending = %d", status)
+	}
+	database.DB.First(&member, member.ID)
+	until := *member.SuspendedUntil
+
+	if status := suspend("5"); status != fiber.StatusConflict {
+		t.Errorf("shorter suspension = %d, want 409", status)
+	}
+	database.DB.First(&member, member.ID)
+	if !member.SuspendedUntil.Equal(until) {
+		t.Errorf("suspended until %v, want %v kept", member.SuspendedUntil, until)
+	}
+
+	if status := suspend("60"); status != fiber.StatusOK {
+		t.Errorf("longer suspension = %d, want 200", status)
+	}
+	database.DB.First(&member, member.ID)
+	if !member.SuspendedUntil.After(until) {
+		t.Errorf("suspended until %v, want later than %v", member.SuspendedUntil, until)
+	}
+}
@@ -0,0 +1,310 @@
+package controller
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	deviceCodeGrantType     = "urn:ietf:params:oauth:grant-type:device_code"
+	deviceCodeLifetime      = 10 * time.Minute
+	deviceCodePollInterval  = 5 // Seconds.
+	deviceCodeTokenLifetime = 24 * time.Hour
+
+	// No vowels or look-alike characters, so codes can't spell words and are easy to read off a screen (RFC 8628 section 6.1).
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+)
+
+// Start a device authorization grant (RFC 8628 section 3.1).
+//
+// Form body: client_id and an optional scope.
+func DeviceAuthorization(c *fiber.Ctx) error {
+	clientID := c.FormValue("client_id")
+	if !deviceClientAllowed(clientID) {
+		return oauthError(c, fiber.StatusUnauthorized, "invalid_client", "Unknown client_id.")
+	}
+
+	deviceCode, deviceCodeHash, err := generateSecureToken()
+	if err != nil {
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "Could not start device authorization.")
+	}
+
+	database.DB.Where("expires_at < ?", time.Now()).Delete(&models.DeviceAuthorization{})
+
+	authorization := models.DeviceAuthorization{
+		DeviceCodeHash: deviceCodeHash,
+		ClientID:       clientID,
+		Scope:          c.FormValue("scope"),
+		Interval:       deviceCodePollInterval,
+		ExpiresAt:      time.Now().Add(deviceCodeLifetime),
+	}
+
+	// User codes are short, so retry the rare collision with a pending request.
+	for attempt := 0; ; attempt++ {
+		if authorization.UserCode, err = generateUserCode(); err != nil {
+			return oauthError(c, fiber.StatusInternalServerError, "server_error", "Could not start device authorization.")
+		}
+		err = database.DB.Create(&authorization).Error
+		if err == nil {
+			break
+		}
+		if attempt == 2 || !strings.Contains(err.Error(), "Duplicate entry") {
+			return oauthError(c, fiber.StatusInternalServerError, "server_error", "Could not start device authorization.")
+		}
+	}
+
+	verificationURI := fmt.Sprintf("%s/device", os.Getenv("API_URL"))
+	userCode := formatUserCode(authorization.UserCode)
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"device_code":               deviceCode,
+		"user_code":                 userCode,
+		"verification_uri":          verificationURI,
+		"verification_uri_complete": verificationURI + "?user_code=" + userCode,
+		"expires_in":                int(deviceCodeLifetime.Seconds()),
+		"interval":                  authorization.Interval,
+	})
+}
+
+// Token endpoint. Only the device code grant is supported (RFC 8628 section 3.4).
+//
+// Form body: grant_type, device_code and client_id.
+func OAuthToken(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "no-store")
+
+	if c.FormValue("grant_type") != deviceCodeGrantType {
+		return oauthError(c, fiber.StatusBadRequest, "unsupported_grant_type", "Only the device_code grant is supported.")
+	}
+
+	var authorization models.DeviceAuthorization
+	if err := database.DB.Where("device_code_hash = ?", hashToken(c.FormValue("device_code"))).First(&authorization).Error; err != nil {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "Unknown device_code.")
+	}
+	if authorization.ClientID != c.FormValue("client_id") {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "device_code was issued to another client.")
+	}
+
+	now := time.Now()
+	if authorization.ConsumedAt != nil {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "device_code has already been used.")
+	}
+	if now.After(authorization.ExpiresAt) {
+		return oauthError(c, fiber.StatusBadRequest, "expired_token", "device_code has expired. Start again.")
+	}
+	if authorization.DeniedAt != nil {
+		return oauthError(c, fiber.StatusBadRequest, "access_denied", "The request was denied.")
+	}
+
+	// Polling faster than the interval earns a slow_down and a longer interval from then on.
+	polledTooSoon := authorization.LastPolledAt != nil && now.Sub(*authorization.LastPolledAt) < time.Duration(authorization.Interval)*time.Second
+	updates := map[string]interface{}{"last_polled_at": now}
+	if polledTooSoon {
+		updates["interval"] = authorization.Interval + 5
+	}
+	database.DB.Model(&authorization).Updates(updates)
+
+	if polledTooSoon {
+		return oauthError(c, fiber.StatusBadRequest, "slow_down", "Polling too fast.")
+	}
+	if authorization.ApprovedAt == nil || authorization.UserID == nil {
+		return oauthError(c, fiber.StatusBadRequest, "authorization_pending", "Waiting for the user to approve the request.")
+	}
+
+	var user models.User
+	if err := database.DB.Where("id = ?", *authorization.UserID).First(&user).Error; err != nil {
+		return oauthError(c, fiber.StatusBadRequest, "access_denied", "The approving account no longer exists.")
+	}
+	if accountRefusal(&user) != nil || user.PasswordResetRequired {
+		return oauthError(c, fiber.StatusBadRequest, "access_denied", "The approving account cannot sign in.")
+	}
+
+	// Claim the grant so two polls racing each other cannot both get a token.
+	result := database.DB.Model(&models.DeviceAuthorization{}).Where("id = ? AND consumed_at IS NULL", authorization.ID).Update("consumed_at", now)
+	if result.Error != nil || result.RowsAffected != 1 {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "device_code has already been used.")
+	}
+
+	expiry := jwt.NewNumericDate(now.Add(deviceCodeTokenLifetime))
+	signedToken, err := signToken(newUserClaims(&user, expiry))
+	if err != nil {
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "Could not sign token.")
+	}
+
+	event := newAuditEvent(c, audit.LoginSucceeded)
+	event.ActorID, event.ActorEmail = user.ID, user.Email
+	event.TargetID, event.TargetEmail = user.ID, user.Email
+	event.Details["method"] = "device_code"
+	event.Details["clientID"] = authorization.ClientID
+	audit.Record(event)
+
+	recordSignIn(c, &user)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"access_token": signedToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(deviceCodeTokenLifetime.Seconds()),
+		"scope":        authorization.Scope,
+	})
+}
+
+// Show the device verification page.
+func ShowDeviceVerification(c *fiber.Ctx) error {
+	return c.SendFile("./public/html/auth/device.html")
+}
+
+// Look up a pending request by user code so the user can check which client they are approving.
+func GetDeviceAuthorization(c *fiber.Ctx) error {
+	authorization, err := findPendingDeviceAuthorization(database.DB, c.Query("user_code"))
+	if err != nil {
+		return deviceAuthorizationLookupError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"userCode":  formatUserCode(authorization.UserCode),
+		"clientID":  authorization.ClientID,
+		"scope":     authorization.Scope,
+		"expiresAt": authorization.ExpiresAt,
+	})
+}
+
+// Approve or deny a pending request as the logged-in user.
+//
+// Body: user_code and approve (true or false).
+func VerifyDeviceAuthorization(c *fiber.Ctx) error {
+	var data struct {
+		UserCode string `json:"user_code"`
+		Approve  bool   `json:"approve"`
+	}
+	if err := c.BodyParser(&data); err != nil || data.UserCode == "" {
+		rp := models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Missing required fields."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	claims := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	userID := uint(claims["id"].(float64))
+
+	var authorization *models.DeviceAuthorization
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if authorization, err = findPendingDeviceAuthorization(tx, data.UserCode); err != nil {
+			return err
+		}
+
+		column := "denied_at"
+		if data.Approve {
+			column = "approved_at"
+		}
+		result := tx.Model(&models.DeviceAuthorization{}).
+			Where("id = ? AND approved_at IS NULL AND denied_at IS NULL", authorization.ID).
+			Updates(map[string]interface{}{column: time.Now(), "user_id": userID})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return deviceAuthorizationLookupError(c, err)
+	}
+
+	eventType := audit.DeviceAuthorizationDenied
+	if data.Approve {
+		eventType = audit.DeviceAuthorizationApproved
+	}
+	event := newAuditEvent(c, eventType)
+	event.Details["clientID"] = authorization.ClientID
+	audit.Record(event)
+
+	if !data.Approve {
+		rp := models.ResponsePacket{Error: false, Code: "device_denied", Message: "The device was not signed in."}
+		return c.Status(fiber.StatusOK).JSON(rp)
+	}
+	rp := models.ResponsePacket{Error: false, Code: "device_approved", Message: "The device is now signed in. You can return to it."}
+	return c.Status(fiber.StatusOK).JSON(rp)
+}
+
+func findPendingDeviceAuthorization(tx *gorm.DB, userCode string) (*models.DeviceAuthorization, error) {
+	var authorization models.DeviceAuthorization
+	err := tx.Where("user_code = ? AND expires_at > ? AND approved_at IS NULL AND denied_at IS NULL", normalizeUserCode(userCode), time.Now()).
+		First(&authorization).Error
+	if err != nil {
+		return nil, err
+	}
+	return &authorization, nil
+}
+
+func deviceAuthorizationLookupError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		rp := models.ResponsePacket{Error: true, Code: "invalid_user_code", Message: "That code is invalid or has expired."}
+		return c.Status(fiber.StatusNotFound).JSON(rp)
+	}
+	rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+	return c.Status(fiber.StatusInternalServerError).JSON(rp)
+}
+
+// OAUTH_DEVICE_CLIENTS lists the allowed client IDs, comma separated. When unset any client ID is accepted.
+func deviceClientAllowed(clientID string) bool {
+	if clientID == "" {
+		return false
+	}
+	allowed := os.Getenv("OAUTH_DEVICE_CLIENTS")
+	if allowed == "" {
+		return true
+	}
+	for _, id := range strings.Split(allowed, ",") {
+		if strings.TrimSpace(id) == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+func generateUserCode() (string, error) {
+	code := make([]byte, userCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// Upper case and drop anything outside the alphabet, so "bcdf-ghjk" and "BCDF GHJK" both match.
+func normalizeUserCode(code string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(code) {
+		if strings.ContainsRune(userCodeAlphabet, r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func formatUserCode(code string) string {
+	if len(code) != userCodeLength {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+// Error response in the RFC 6749 section 5.2 format.
+func oauthError(c *fiber.Ctx, status int, code string, description string) error {
+	return c.Status(status).JSON(fiber.Map{"error": code, "error_description": description})
+}
@@ -0,0 +1,152 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+type deviceGrantTest struct {
+	t          *testing.T
+	app        *fiber.App
+	deviceCode string
+	userCode   string
+}
+
+// Starts a device authorization for the test client with the approving user signed in on /oauth/device.
+func newDeviceGrantTest(t *testing.T, user models.User) *deviceGrantTest {
+	t.Helper()
+	t.Setenv("SECRET_KEY", "test-secret")
+	t.Setenv("OAUTH_DEVICE_CLIENTS", "")
+
+	app := fiber.New()
+	app.Post("/oauth/device_authorization", DeviceAuthorization)
+	app.Post("/oauth/token", OAuthToken)
+	app.Post("/oauth/device", signedInAs(user), VerifyDeviceAuthorization)
+	d := &deviceGrantTest{t: t, app: app}
+
+	var started struct {
+		DeviceCode string `json:"device_code"`
+		UserCode   string `json:"user_code"`
+		Interval   int    `json:"interval"`
+	}
+	if status := d.postForm("/oauth/device_authorization", url.Values{"client_id": {"tv"}}, &started); status != fiber.StatusOK {
+		t.Fatalf("device authorization = %d", status)
+	}
+	if started.DeviceCode == "" || len(started.UserCode) != userCodeLength+1 || started.Interval != deviceCodePollInterval {
+		t.Fatalf("device authorization = %+v", started)
+	}
+	d.deviceCode, d.userCode = started.DeviceCode, started.UserCode
+	return d
+}
+
+func (d *deviceGrantTest) postForm(target string, form url.Values, out interface{}) int {
+	d.t.Helper()
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+	res, err := d.app.Test(req, -1)
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	json.NewDecoder(res.Body).Decode(out)
+	return res.StatusCode
+}
+
+// Polls the token endpoint and returns the OAuth error code, or "" with the access token on success.
+func (d *deviceGrantTest) poll() (string, string) {
+	d.t.Helper()
+	var out struct {
+		Error       string `json:"error"`
+		AccessToken string `json:"access_token"`
+	}
+	d.postForm("/oauth/token", url.Values{"grant_type": {deviceCodeGrantType}, "device_code": {d.deviceCode}, "client_id": {"tv"}}, &out)
+	return out.Error, out.AccessToken
+}
+
+// Moves the last poll back past the interval, as if the client had waited.
+func (d *deviceGrantTest) wait() {
+	d.t.Helper()
+	database.DB.Model(&models.DeviceAuthorization{}).Where("device_code_hash = ?", hashToken(d.deviceCode)).
+		Update("last_polled_at", time.Now().Add(-time.Hour))
+}
+
+func (d *deviceGrantTest) answer(approve bool) {
+	d.t.Helper()
+	body := `{"user_code":"` + d.userCode + `","approve":` + strconv.FormatBool(approve) + `}`
+	if status := sendRequest(d.t, d.app, fiber.MethodPost, "/oauth/device", body, nil); status != fiber.StatusOK {
+		d.t.Fatalf("answering = %d", status)
+	}
+}
+
+func TestDeviceGrantApproved(t *testing.T) {
+	useTestDB(t)
+	d := newDeviceGrantTest(t, createTestUser(t, "member@example.org", 9))
+
+	if code, _ := d.poll(); code != "authorization_pending" {
+		t.Errorf("before approval = %q, want authorization_pending", code)
+	}
+	d.answer(true)
+	d.wait()
+	code, token := d.poll()
+	if code != "" || token == "" {
+		t.Fatalf("after approval = %q, token %q", code, token)
+	}
+
+	// The device code is good for one token only.
+	d.wait()
+	if code, _ := d.poll(); code != "invalid_grant" {
+		t.Errorf("second token = %q, want invalid_grant", code)
+	}
+}
+
+func TestDeviceGrantSlowDown(t *testing.T) {
+	useTestDB(t)
+	d := newDeviceGrantTest(t, createTestUser(t, "member@example.org", 9))
+
+	d.poll()
+	if code, _ := d.poll(); code != "slow_down" {
+		t.Fatalf("polling again at once = %q, want slow_down", code)
+	}
+	var authorization models.DeviceAuthorization
+	database.DB.Where("device_code_hash = ?", hashToken(d.deviceCode)).First(&authorization)
+	if authorization.Interval != deviceCodePollInterval+5 {
+		t.Errorf("interval = %d, want %d", authorization.Interval, deviceCodePollInterval+5)
+	}
+
+	d.wait()
+	if code, _ := d.poll(); code != "authorization_pending" {
+		t.Errorf("after waiting = %q, want authorization_pending", code)
+	}
+}
+
+func TestDeviceGrantDenied(t *testing.T) {
+	useTestDB(t)
+	d := newDeviceGrantTest(t, createTestUser(t, "member@example.org", 9))
+
+	d.answer(false)
+	if code, token := d.poll(); code != "access_denied" || token != "" {
+		t.Errorf("after denial = %q, token %q, want access_denied", code, token)
+	}
+}
+
+func TestDeviceGrantExpired(t *testing.T) {
+	useTestDB(t)
+	d := newDeviceGrantTest(t, createTestUser(t, "member@example.org", 9))
+
+	d.answer(true)
+	database.DB.Model(&models.DeviceAuthorization{}).Where("device_code_hash = ?", hashToken(d.deviceCode)).
+		Update("expires_at", time.Now().Add(-time.Second))
+	if code, token := d.poll(); code != "expired_token" || token != "" {
+		t.Errorf("after expiry = %q, token %q, want expired_token", code, token)
+	}
+}
@@ -0,0 +1,22 @@
+package controller
+
+import (
+	"errors"
+
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/pagination"
+	"github.com/gofiber/fiber/v2"
+)
+
+func paginationError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, pagination.ErrInvalidCursor):
+		rp := models.ResponsePacket{Error: true, Code: "invalid_cursor", Message: "The page cursor is invalid. Start again from the first page."}
+		return c.Status(fiber.StatusBadRequest).JSON(rp)
+	case errors.Is(err, pagination.ErrInvalidSort):
+		rp := models.ResponsePacket{Error: true, Code: "invalid_sort", Message: "Unknown sort order."}
+		return c.Status(fiber.StatusBadRequest).JSON(rp)
+	}
+	rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+	return c.Status(fiber.StatusInternalServerError).JSON(rp)
+}
@@ -0,0 +1,413 @@
+package controller
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/pagination"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const reviewEditWindowKey = "reviews.edit_window_hours"
+
+var (
+	errReviewNotFound   = errors.New("review not found")
+	errReviewForbidden  = errors.New("not allowed to change this review")
+	errReviewDuplicate  = errors.New("already reviewed this device")
+	errReviewOwnDevice  = errors.New("cannot review your own device")
+	errEditWindowClosed = errors.New("edit window has closed")
+	errAlreadyDone      = errors.New("already done")
+)
+
+var reviewSorts = map[string]pagination.Sort{
+	"helpful": {Column: "helpful_count", Desc: true},
+	"newest":  {Column: "created_at", Desc: true, Time: true},
+	"highest": {Column: "rating", Desc: true},
+	"lowest":  {Column: "rating"},
+}
+
+// List a public device's reviews, most helpful first by default.
+//
+// Query: sort (helpful, newest, highest or lowest), limit and cursor.
+func GetDeviceReviews(c *fiber.Ctx) error {
+	p, err := pagination.Parse(c, pagination.Limits{Default: 10, Max: 50}, reviewSorts, "helpful")
+	if err != nil {
+		return paginationError(c, err)
+	}
+
+	var device models.Device
+	if err := database.DB.Select("id").Where("id = ? AND stage = ? AND hidden_at IS NULL", c.Params("id"), models.StagePublic).First(&device).Error; err != nil {
+		return reviewError(c, errDeviceNotFound)
+	}
+
+	base := database.DB.Model(&models.Review{}).Where("device_id = ? AND hidden_at IS NULL", device.ID)
+	total, err := pagination.Count(base)
+	if err != nil {
+		return paginationError(c, err)
+	}
+	var reviews []models.Review
+	if err := p.Query(base, "id").Find(&reviews).Error; err != nil {
+		return paginationError(c, err)
+	}
+
+	page := pagination.NewPage(c, p, reviews, func(r *models.Review) pagination.Key {
+		switch p.Sort.Column {
+		case "helpful_count":
+			return pagination.Key{Value: r.HelpfulCount, ID: r.ID}
+		case "rating":
+			return pagination.Key{Value: r.Rating, ID: r.ID}
+		}
+		return pagination.Key{Value: r.CreatedAt, ID: r.ID}
+	}, total)
+	return c.Status(fiber.StatusOK).JSON(&page)
+}
+
+// Review a public device. Each user can review a device once and not their own.
+//
+// Body: rating (1-5), title and review.
+func AddReview(c *fiber.Ctx) error {
+	var in models.Review
+	if err := c.BodyParser(&in); err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	if rp := validateReview(&in); rp != nil {
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	userID, _ := actorFromClaims(c)
+	review := models.Review{Title: in.Title, Review: in.Review, Rating: in.Rating}
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var device models.Device
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "user_posts_id").
+			Where("id = ? AND stage = ? AND hidden_at IS NULL", c.Params("id"), models.StagePublic).First(&device).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errDeviceNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if device.UserPostsID == userID {
+			return errReviewOwnDevice
+		}
+
+		var details models.UserDetails
+		if err := tx.Select("id").Where("user_id = ?", userID).First(&details).Error; err != nil {
+			return err
+		}
+		var count int64
+		if err := tx.Unscoped().Model(&models.Review{}).Where("user_details_id = ? AND device_id = ?", details.ID, device.ID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return errReviewDuplicate
+		}
+
+		review.UserDetailsID, review.DeviceID = details.ID, device.ID
+		if err := tx.Create(&review).Error; err != nil {
+			return err
+		}
+		return refreshDeviceRating(tx, device.ID)
+	})
+	if err != nil {
+		return reviewError(c, err)
+	}
+
+	event := newAuditEvent(c, audit.ReviewCreated)
+	event.Details["reviewID"] = strconv.FormatUint(uint64(review.ID), 10)
+	event.Details["deviceID"] = strconv.FormatUint(uint64(review.DeviceID), 10)
+	audit.Record(event)
+
+	return c.Status(fiber.StatusCreated).JSON(&review)
+}
+
+// Edit your own review while the edit window is open. Fields left empty keep their value.
+func UpdateReview(c *fiber.Ctx) error {
+	var in models.Review
+	if err := c.BodyParser(&in); err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	userID, _ := actorFromClaims(c)
+	var review models.Review
+	var invalid *models.ResponsePacket
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := loadReviewForUpdate(tx, c.Params("id"), &review); err != nil {
+			return err
+		}
+		if owner, err := reviewOwnedBy(tx, &review, userID); err != nil || !owner {
+			return errReviewForbidden
+		}
+		if time.Since(review.CreatedAt) > reviewEditWindow() {
+			return errEditWindowClosed
+		}
+		deviceFound, err := lockReviewedDevice(tx, review.DeviceID)
+		if err != nil {
+			return err
+		}
+
+		if in.Title != "" {
+			review.Title = in.Title
+		}
+		if in.Review != "" {
+			review.Review = in.Review
+		}
+		if in.Rating != 0 {
+			review.Rating = in.Rating
+		}
+		if invalid = validateReview(&review); invalid != nil {
+			return gorm.ErrInvalidData
+		}
+
+		now := time.Now()
+		review.EditedAt = &now
+		if err := tx.Select("title", "review", "rating", "edited_at").Save(&review).Error; err != nil {
+			return err
+		}
+		if !deviceFound {
+			return nil
+		}
+		return refreshDeviceRating(tx, review.DeviceID)
+	})
+	if invalid != nil {
+		return c.Status(fiber.StatusNotAcceptable).JSON(invalid)
+	}
+	if err != nil {
+		return reviewError(c, err)
+	}
+
+	event := newAuditEvent(c, audit.ReviewUpdated)
+	event.Details["reviewID"] = strconv.FormatUint(uint64(review.ID), 10)
+	audit.Record(event)
+
+	return c.Status(fiber.StatusOK).JSON(&review)
+}
+
+// Delete a review. Authors can delete their own at any time and moderators can delete any.
+func DeleteReview(c *fiber.Ctx) error {
+	userID, privilege := actorFromClaims(c)
+	var review models.Review
+	var override bool
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := loadReviewForUpdate(tx, c.Params("id"), &review); err != nil {
+			return err
+		}
+		owner, err := reviewOwnedBy(tx, &review, userID)
+		if err != nil {
+			return err
+		}
+		if !owner {
+			if privilege > moderatorPrivilege {
+				return errReviewForbidden
+			}
+			override = true
+		}
+		deviceFound, err := lockReviewedDevice(tx, review.DeviceID)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Where("review_id = ?", review.ID).Delete(&models.ReviewVote{}).Error; err != nil {
+			return err
+		}
+		// Hard delete, so the author can review the device again.
+		if err := tx.Unscoped().Delete(&review).Error; err != nil {
+			return err
+		}
+		if !deviceFound {
+			return nil
+		}
+		return refreshDeviceRating(tx, review.DeviceID)
+	})
+	if err != nil {
+		return reviewError(c, err)
+	}
+
+	event := newAuditEvent(c, audit.ReviewDeleted)
+	event.Details["reviewID"] = strconv.FormatUint(uint64(review.ID), 10)
+	event.Details["deviceID"] = strconv.FormatUint(uint64(review.DeviceID), 10)
+	if override {
+		event.Details["override"] = "true"
+	}
+	audit.Record(event)
+
+	rp := models.ResponsePacket{Error: false, Code: "delete_success", Message: "Review deleted successfully."}
+	return c.Status(fiber.StatusOK).JSON(rp)
+}
+
+// Mark a review as helpful. Authors cannot vote for their own reviews.
+func VoteReviewHelpful(c *fiber.Ctx) error {
+	userID, _ := actorFromClaims(c)
+	var review models.Review
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := loadReviewForUpdate(tx, c.Params("id"), &review); err != nil {
+			return err
+		}
+		if owner, err := reviewOwnedBy(tx, &review, userID); err != nil || owner {
+			return errReviewForbidden
+		}
+
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.ReviewVote{ReviewID: review.ID, UserID: userID})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errAlreadyDone
+		}
+		return tx.Model(&review).UpdateColumn("helpful_count", gorm.Expr("helpful_count + 1")).Error
+	})
+	if err != nil {
+		return reviewError(c, err)
+	}
+
+	rp := models.ResponsePacket{Error: false, Code: "vote_recorded", Message: "Thanks for your feedback."}
+	return c.Status(fiber.StatusOK).JSON(rp)
+}
+
+// Take back a helpful vote.
+func UnvoteReviewHelpful(c *fiber.Ctx) error {
+	userID, _ := actorFromClaims(c)
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var review models.Review
+		if err := loadReviewForUpdate(tx, c.Params("id"), &review); err != nil {
+			return err
+		}
+
+		result := tx.Where("review_id = ? AND user_id = ?", review.ID, userID).Delete(&models.ReviewVote{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errAlreadyDone
+		}
+		return tx.Model(&review).UpdateColumn("helpful_count", gorm.Expr("helpful_count - 1")).Error
+	})
+	if err != nil {
+		return reviewError(c, err)
+	}
+
+	rp := models.ResponsePacket{Error: false, Code: "vote_removed", Message: "Vote removed."}
+	return c.Status(fiber.StatusOK).JSON(rp)
+}
+
+// Report a review to moderators. Same as POST /reports with targetType review.
+//
+// Body: reasonCode and details.
+func ReportReview(c *fiber.Ctx) error {
+	in := reportInput{TargetType: models.TargetReview}
+	if err := c.BodyParser(&in); err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return reviewError(c, errReviewNotFound)
+	}
+	in.TargetType, in.TargetID = models.TargetReview, uint(id)
+	return fileReport(c, in)
+}
+
+// Lock the device a review belongs to before its rating is refreshed. Deleted devices are locked too, so their reviews
+// can still be edited and removed. Reports false when the device row no longer exists at all.
+func lockReviewedDevice(tx *gorm.DB, deviceID uint) (bool, error) {
+	err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").Where("id = ?", deviceID).First(&models.Device{}).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Recalculate a device's average rating and review count from its visible reviews. The device row must already be
+// locked. Deleted devices keep an up to date rating in case they are restored.
+func refreshDeviceRating(tx *gorm.DB, deviceID uint) error {
+	var stats struct {
+		Average float64
+		Count   uint
+	}
+	if err := tx.Model(&models.Review{}).Select("COALESCE(AVG(rating), 0) AS average, COUNT(*) AS count").
+		Where("device_id = ? AND hidden_at IS NULL", deviceID).Scan(&stats).Error; err != nil {
+		return err
+	}
+	return tx.Unscoped().Model(&models.Device{}).Where("id = ?", deviceID).
+		UpdateColumns(map[string]interface{}{"rating_average": stats.Average, "rating_count": stats.Count}).Error
+}
+
+func loadReviewForUpdate(tx *gorm.DB, id string, review *models.Review) error {
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", id).First(review).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errReviewNotFound
+	}
+	return err
+}
+
+func reviewOwnedBy(tx *gorm.DB, review *models.Review, userID uint) (bool, error) {
+	var details models.UserDetails
+	if err := tx.Select("id").Where("user_id = ?", userID).First(&details).Error; err != nil {
+		return false, err
+	}
+	return details.ID == review.UserDetailsID, nil
+}
+
+// How long after posting a review can be edited. Admins can change it in the settings table.
+func reviewEditWindow() time.Duration {
+	fallback := os.Getenv("REVIEW_EDIT_WINDOW_HOURS")
+	if fallback == "" {
+		fallback = "48"
+	}
+	hours, err := strconv.Atoi(getSetting(reviewEditWindowKey, fallback))
+	if err != nil || hours < 0 {
+		hours = 48
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+func validateReview(review *models.Review) *models.ResponsePacket {
+	review.Title = strings.TrimSpace(review.Title)
+	review.Review = strings.TrimSpace(review.Review)
+	switch {
+	case review.Rating < 1 || review.Rating > 5:
+		return &models.ResponsePacket{Error: true, Code: "invalid_rating", Message: "Rating must be between 1 and 5."}
+	case len(review.Title) > 150:
+		return &models.ResponsePacket{Error: true, Code: "invalid_title", Message: "Title must be 150 characters or fewer."}
+	case len(review.Review) > 5000:
+		return &models.ResponsePacket{Error: true, Code: "invalid_review", Message: "Reviews must be 5000 characters or fewer."}
+	}
+	return nil
+}
+
+func reviewError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errDeviceNotFound):
+		rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "Device not found!"}
+		return c.Status(fiber.StatusNotFound).JSON(rp)
+	case errors.Is(err, errReviewNotFound):
+		rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "Review not found!"}
+		return c.Status(fiber.StatusNotFound).JSON(rp)
+	case errors.Is(err, errReviewForbidden):
+		rp := models.ResponsePacket{Error: true, Code: "forbidden", Message: "You are not allowed to do that with this review."}
+		return c.Status(fiber.StatusForbidden).JSON(rp)
+	case errors.Is(err, errReviewOwnDevice):
+		rp := models.ResponsePacket{Error: true, Code: "own_device", Message: "You cannot review a device you posted."}
+		return c.Status(fiber.StatusForbidden).JSON(rp)
+	case errors.Is(err, errReviewDuplicate), err != nil && strings.Contains(err.Error(), "Duplicate entry"):
+		rp := models.ResponsePacket{Error: true, Code: "duplicate_review", Message: "You have already reviewed this device. Edit your review instead."}
+		return c.Status(fiber.StatusConflict).JSON(rp)
+	case errors.Is(err, errEditWindowClosed):
+		rp := models.ResponsePacket{Error: true, Code: "edit_window_closed", Message: "Reviews can no longer be edited this long after posting."}
+		return c.Status(fiber.StatusForbidden).JSON(rp)
+	case errors.Is(err, errAlreadyDone):
+		rp := models.ResponsePacket{Error: true, Code: "already_done", Message: "You have already done that."}
+		return c.Status(fiber.StatusConflict).JSON(rp)
+	}
+	rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+	return c.Status(fiber.StatusInternalServerError).JSON(rp)
+}
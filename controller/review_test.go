@@ -0,0 +1,48 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestReviewOnDeletedDevice(t *testing.T) {
+	useTestDB(t)
+	author := createTestUser(t, "author@example.org", 9)
+	reviewer := createTestUser(t, "reviewer@example.org", 9)
+	device := createTestDevice(t, "Switch mount", author, models.StagePublic)
+
+	var details models.UserDetails
+	database.DB.Where("user_id = ?", reviewer.ID).First(&details)
+	review := models.Review{Title: "Works", Review: "Works well for me.", Rating: 4, UserDetailsID: details.ID, DeviceID: device.ID}
+	if err := database.DB.Create(&review).Error; err != nil {
+		t.Fatal(err)
+	}
+	database.DB.Delete(&device)
+
+	app := fiber.New()
+	app.Patch("/reviews/:id", signedInAs(reviewer), UpdateReview)
+	app.Delete("/reviews/:id", signedInAs(reviewer), DeleteReview)
+
+	if status := sendRequest(t, app, fiber.MethodPatch, "/reviews/"+uintString(review.ID), `{"rating":2}`, nil); status != fiber.StatusOK {
+		t.Errorf("update: status = %d", status)
+	}
+	var saved models.Device
+	database.DB.Unscoped().First(&saved, device.ID)
+	if saved.RatingCount != 1 || saved.RatingAverage != 2 {
+		t.Errorf("rating = %v from %d reviews, want 2 from 1", saved.RatingAverage, saved.RatingCount)
+	}
+
+	// The device row is gone for good, so there is no rating left to refresh.
+	database.DB.Unscoped().Delete(&saved)
+	if status := sendRequest(t, app, fiber.MethodDelete, "/reviews/"+uintString(review.ID), "", nil); status != fiber.StatusOK {
+		t.Errorf("delete: status = %d", status)
+	}
+	var count int64
+	database.DB.Unscoped().Model(&models.Review{}).Where("id = ?", review.ID).Count(&count)
+	if count != 0 {
+		t.Errorf("review was not deleted")
+	}
+}
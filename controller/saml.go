@@ -0,0 +1,252 @@
+package controller
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/authn"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/sso"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+const samlRequestLifetime = 10 * time.Minute
+
+// Holds the RelayState of the login this browser started, so a response can't be posted into someone else's browser.
+const samlRelayCookie = "saml_relay_state"
+
+var errSSOAccountConflict = errors.New("a local account already uses this email")
+
+// Serve this service provider's SAML metadata.
+func SAMLMetadata(c *fiber.Ctx) error {
+	if sso.Default == nil {
+		return samlDisabled(c)
+	}
+
+	metadata, err := sso.Default.Metadata()
+	if err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Could not build SAML metadata."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	c.Set(fiber.HeaderContentType, "application/samlmetadata+xml")
+	return c.Send(metadata)
+}
+
+// Start an SP-initiated login by redirecting the browser to the identity provider. The RelayState is also set in a
+// cookie, and the ACS only accepts the response in the browser holding it.
+//
+// Takes an optional ?redirect= path to return to after signing in.
+func SAMLLogin(c *fiber.Ctx) error {
+	if sso.Default == nil {
+		return samlDisabled(c)
+	}
+
+	relayState, _, err := generateSecureToken()
+	if err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Could not start SAML login."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	redirectURL, requestID, err := sso.Default.AuthnRequestURL(relayState)
+	if err != nil {
+		log.Printf("Error building SAML AuthnRequest: %s", err.Error())
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Could not start SAML login."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	request := models.SAMLRequest{
+		ID:         requestID,
+		RelayState: relayState,
+		RedirectTo: safeRedirect(c.Query("redirect")),
+		ExpiresAt:  time.Now().Add(samlRequestLifetime),
+	}
+	if err := database.DB.Create(&request).Error; err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Could not start SAML login."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	// The identity provider posts back cross-site, which a Lax cookie would not survive.
+	c.Cookie(&fiber.Cookie{
+		Name:     samlRelayCookie,
+		Value:    relayState,
+		Path:     "/",
+		Expires:  request.ExpiresAt,
+		Secure:   true,
+		HTTPOnly: true,
+		SameSite: "None",
+	})
+
+	return c.Redirect(redirectURL, fiber.StatusFound)
+}
+
+// Assertion Consumer Service. Handles both SP-initiated and IdP-initiated logins.
+//
+// On success, redirects to the requested page with the token in the URL fragment (#token=...).
+func SAMLACS(c *fiber.Ctx) error {
+	if sso.Default == nil {
+		return samlDisabled(c)
+	}
+
+	event := newAuditEvent(c, audit.LoginFailed)
+	event.Details["method"] = "saml"
+
+	identity, err := sso.Default.ParseResponse(c.FormValue("SAMLResponse"))
+	if err != nil {
+		log.Printf("Rejected SAML response: %s", err.Error())
+		event.Details["reason"] = "invalid_assertion"
+		audit.Record(event)
+		rp := models.ResponsePacket{Error: true, Code: "invalid_assertion", Message: "SAML assertion could not be validated."}
+		return c.Status(fiber.StatusUnauthorized).JSON(rp)
+	}
+	event.TargetEmail = identity.Email
+
+	now := time.Now()
+	database.DB.Where("expires_at < ?", now).Delete(&models.SAMLRequest{})
+	database.DB.Where("expires_at < ?", now).Delete(&models.SAMLAssertion{})
+
+	redirect := "/"
+	if identity.InResponseTo != "" {
+		var request models.SAMLRequest
+		if err := database.DB.Where("id = ? AND expires_at > ?", identity.InResponseTo, now).First(&request).Error; err != nil {
+			event.Details["reason"] = "unknown_request"
+			audit.Record(event)
+			rp := models.ResponsePacket{Error: true, Code: "unknown_request", Message: "SAML response does not match a login we started. Please try again."}
+			return c.Status(fiber.StatusUnauthorized).JSON(rp)
+		}
+		relayState := c.FormValue("RelayState")
+		if relayState != request.RelayState || c.Cookies(samlRelayCookie) != relayState {
+			event.Details["reason"] = "relay_state_mismatch"
+			audit.Record(event)
+			rp := models.ResponsePacket{Error: true, Code: "relay_state_mismatch", Message: "SAML response was not started from this browser. Please try again."}
+			return c.Status(fiber.StatusUnauthorized).JSON(rp)
+		}
+		c.ClearCookie(samlRelayCookie)
+		// Deleting is what claims the request, so two responses racing for it cannot both win.
+		if result := database.DB.Delete(&request); result.Error != nil || result.RowsAffected != 1 {
+			event.Details["reason"] = "unknown_request"
+			audit.Record(event)
+			rp := models.ResponsePacket{Error: true, Code: "unknown_request", Message: "SAML response does not match a login we started. Please try again."}
+			return c.Status(fiber.StatusUnauthorized).JSON(rp)
+		}
+		redirect = request.RedirectTo
+	} else {
+		if !sso.Default.AllowIDPInitiated() {
+			event.Details["reason"] = "idp_initiated_disabled"
+			audit.Record(event)
+			rp := models.ResponsePacket{Error: true, Code: "idp_initiated_disabled", Message: "Logins must be started from this site."}
+			return c.Status(fiber.StatusUnauthorized).JSON(rp)
+		}
+		redirect = safeRedirect(c.FormValue("RelayState"))
+	}
+
+	// Remember the assertion until well after it stops being valid, clock skew included.
+	seen := models.SAMLAssertion{ID: identity.AssertionID, ExpiresAt: identity.NotOnOrAfter.Add(10 * time.Minute)}
+	if identity.AssertionID == "" || database.DB.Create(&seen).Error != nil {
+		event.Details["reason"] = "assertion_replayed"
+		audit.Record(event)
+		rp := models.ResponsePacket{Error: true, Code: "assertion_replayed", Message: "SAML assertion has already been used."}
+		return c.Status(fiber.StatusUnauthorized).JSON(rp)
+	}
+
+	user, err := findOrProvisionSAMLUser(identity)
+	if err != nil {
+		if errors.Is(err, errSSOAccountConflict) {
+			event.Details["reason"] = "account_conflict"
+			audit.Record(event)
+			rp := models.ResponsePacket{Error: true, Code: "account_conflict", Message: "An account with this email already exists. Please log in with your password."}
+			return c.Status(fiber.StatusConflict).JSON(rp)
+		}
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not sign in."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+	event.TargetID = user.ID
+
+	if rp := accountRefusal(user); rp != nil {
+		event.Details["reason"] = rp.Code
+		audit.Record(event)
+		return c.Status(fiber.StatusForbidden).JSON(rp)
+	}
+
+	signedToken, err := signToken(newUserClaims(user, jwt.NewNumericDate(time.Now().Add(24*time.Hour))))
+	if err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Could not sign token."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	event.Type = audit.LoginSucceeded
+	event.ActorID, event.ActorEmail = user.ID, user.Email
+	audit.Record(event)
+
+	recordSignIn(c, user)
+
+	return c.Redirect(redirect+"#token="+signedToken, fiber.StatusSeeOther)
+}
+
+// Find the local user for a SAML identity, creating one on first sign-in and keeping their details in sync after that.
+func findOrProvisionSAMLUser(identity *sso.Identity) (*models.User, error) {
+	var user models.User
+	err := database.DB.Where("email = ?", identity.Email).Preload("UserDetails").First(&user).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		user = models.User{
+			Email:        identity.Email,
+			Privilege:    9, // General user.
+			Verified:     true,
+			AuthProvider: authn.ProviderSAML,
+			UserDetails: models.UserDetails{
+				FirstName:    identity.FirstName,
+				LastName:     identity.LastName,
+				Organization: identity.Organization,
+			},
+		}
+		if err := database.DB.Create(&user).Error; err != nil {
+			return nil, err
+		}
+		return &user, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if user.AuthProvider != authn.ProviderSAML {
+		return nil, errSSOAccountConflict
+	}
+
+	details := map[string]interface{}{}
+	if identity.FirstName != "" {
+		details["first_name"] = identity.FirstName
+	}
+	if identity.LastName != "" {
+		details["last_name"] = identity.LastName
+	}
+	if identity.Organization != "" {
+		details["organization"] = identity.Organization
+	}
+	if len(details) > 0 && user.UserDetails.ID != 0 {
+		if err := database.DB.Model(&user.UserDetails).Updates(details).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// Only allow redirects to paths on this site.
+func safeRedirect(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+	return path
+}
+
+func samlDisabled(c *fiber.Ctx) error {
+	rp := models.ResponsePacket{Error: true, Code: "saml_disabled", Message: "SAML login is not configured."}
+	return c.Status(fiber.StatusNotFound).JSON(rp)
+}
@@ -0,0 +1,229 @@
+package controller
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Elimists/go-app/authn"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/sso"
+	"github.com/Elimists/go-app/sso/samltest"
+	"github.com/crewjam/saml"
+	"github.com/gofiber/fiber/v2"
+)
+
+type samlTest struct {
+	t        *testing.T
+	app      *fiber.App
+	idp      *samltest.IdP
+	metadata *saml.EntityDescriptor
+	cookie   string // The RelayState cookie the browser holds, if any.
+}
+
+func newSAMLTest(t *testing.T, allowIDPInitiated bool) *samlTest {
+	t.Helper()
+	useTestDB(t)
+	t.Setenv("SECRET_KEY", "test-secret")
+
+	idp := samltest.NewIdP(t)
+	key, cert := samltest.NewKeyPair(t, "api.example.org")
+	sp, err := sso.NewSAML(sso.SAMLConfig{
+		RootURL:           "https://api.example.org",
+		Key:               key,
+		Certificate:       cert,
+		IDPMetadata:       idp.Metadata(),
+		AllowIDPInitiated: allowIDPInitiated,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := sso.Default
+	sso.Default = sp
+	t.Cleanup(func() { sso.Default = previous })
+
+	raw, err := sp.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata saml.EntityDescriptor
+	if err := xml.Unmarshal(raw, &metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Post("/saml/acs", SAMLACS)
+	return &samlTest{t: t, app: app, idp: idp, metadata: &metadata}
+}
+
+// Starts an SP-initiated login the way SAMLLogin would.
+func (s *samlTest) expectRequest(id string, redirect string) {
+	s.t.Helper()
+	request := models.SAMLRequest{ID: id, RelayState: "relay", RedirectTo: redirect, ExpiresAt: time.Now().Add(samlRequestLifetime)}
+	if err := database.DB.Create(&request).Error; err != nil {
+		s.t.Fatal(err)
+	}
+	s.cookie = request.RelayState
+}
+
+// Posts a response to the ACS and returns the status, the Location header and the error code, if any.
+func (s *samlTest) post(response string, relayState string) (int, string, string) {
+	s.t.Helper()
+	form := url.Values{"SAMLResponse": {response}, "RelayState": {relayState}}
+	req := httptest.NewRequest(http.MethodPost, "/saml/acs", strings.NewReader(form.Encode()))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+	if s.cookie != "" {
+		req.AddCookie(&http.Cookie{Name: samlRelayCookie, Value: s.cookie})
+	}
+
+	res, err := s.app.Test(req, -1)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	var rp models.ResponsePacket
+	json.NewDecoder(res.Body).Decode(&rp)
+	return res.StatusCode, res.Header.Get(fiber.HeaderLocation), rp.Code
+}
+
+func TestSAMLACSValidAssertion(t *testing.T) {
+	s := newSAMLTest(t, false)
+	s.expectRequest("id-login", "/devices")
+
+	response := s.idp.Response(t, s.metadata, samltest.Login{InResponseTo: "id-login", Email: "ada@example.org", FirstName: "Ada", LastName: "Lovelace"})
+	status, location, code := s.post(response, "relay")
+	if status != fiber.StatusSeeOther || !strings.HasPrefix(location, "/devices#token=") {
+		t.Fatalf("status = %d, location = %q, code = %q", status, location, code)
+	}
+
+	var user models.User
+	if err := database.DB.Preload("UserDetails").Where("email = ?", "ada@example.org").First(&user).Error; err != nil {
+		t.Fatalf("user was not provisioned: %v", err)
+	}
+	if user.ID == 0 || user.AuthProvider != authn.ProviderSAML || !user.Verified || user.UserDetails.FirstName != "Ada" {
+		t.Errorf("provisioned user = %+v", user)
+	}
+
+	var pending int64
+	database.DB.Model(&models.SAMLRequest{}).Count(&pending)
+	if pending != 0 {
+		t.Errorf("the login request was not claimed")
+	}
+}
+
+func TestSAMLACSBadSignature(t *testing.T) {
+	s := newSAMLTest(t, false)
+	s.expectRequest("id-login", "/")
+
+	impostor := samltest.NewIdP(t)
+	response := impostor.Response(t, s.metadata, samltest.Login{InResponseTo: "id-login", Email: "ada@example.org"})
+	if status, _, code := s.post(response, ""); status != fiber.StatusUnauthorized || code != "invalid_assertion" {
+		t.Errorf("status = %d, code = %q, want 401 invalid_assertion", status, code)
+	}
+
+	var users int64
+	database.DB.Model(&models.User{}).Count(&users)
+	if users != 0 {
+		t.Errorf("a user was provisioned from a forged assertion")
+	}
+}
+
+func TestSAMLACSReplayedAssertion(t *testing.T) {
+	s := newSAMLTest(t, true)
+
+	response := s.idp.Response(t, s.metadata, samltest.Login{Email: "ada@example.org"})
+	if status, _, code := s.post(response, "/"); status != fiber.StatusSeeOther {
+		t.Fatalf("first use: status = %d, code = %q", status, code)
+	}
+	if status, _, code := s.post(response, "/"); status != fiber.StatusUnauthorized || code != "assertion_replayed" {
+		t.Errorf("replay: status = %d, code = %q, want 401 assertion_replayed", status, code)
+	}
+}
+
+func TestSAMLACSUnknownInResponseTo(t *testing.T) {
+	s := newSAMLTest(t, true)
+	s.expectRequest("id-login", "/")
+
+	response := s.idp.Response(t, s.metadata, samltest.Login{InResponseTo: "id-someone-else", Email: "ada@example.org"})
+	if status, _, code := s.post(response, ""); status != fiber.StatusUnauthorized || code != "unknown_request" {
+		t.Errorf("status = %d, code = %q, want 401 unknown_request", status, code)
+	}
+
+	// Expired requests are as good as unknown.
+	if err := database.DB.Model(&models.SAMLRequest{}).Where("id = ?", "id-login").Update("expires_at", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+	response = s.idp.Response(t, s.metadata, samltest.Login{InResponseTo: "id-login", Email: "ada@example.org"})
+	if status, _, code := s.post(response, ""); status != fiber.StatusUnauthorized || code != "unknown_request" {
+		t.Errorf("expired request: status = %d, code = %q, want 401 unknown_request", status, code)
+	}
+}
+
+func TestSAMLACSIdPInitiatedDisabled(t *testing.T) {
+	s := newSAMLTest(t, false)
+
+	response := s.idp.Response(t, s.metadata, samltest.Login{Email: "ada@example.org"})
+	if status, _, code := s.post(response, "/"); status != fiber.StatusUnauthorized || code != "idp_initiated_disabled" {
+		t.Errorf("status = %d, code = %q, want 401 idp_initiated_disabled", status, code)
+	}
+}
+
+func TestSAMLACSIdPInitiatedRedirect(t *testing.T) {
+	s := newSAMLTest(t, true)
+
+	response := s.idp.Response(t, s.metadata, samltest.Login{Email: "ada@example.org"})
+	status, location, code := s.post(response, "//evil.example.com")
+	if status != fiber.StatusSeeOther || !strings.HasPrefix(location, "/#token=") {
+		t.Errorf("status = %d, location = %q, code = %q", status, location, code)
+	}
+}
+
+func TestSAMLLoginSetsRelayCookie(t *testing.T) {
+	s := newSAMLTest(t, false)
+	s.app.Get("/saml/login", SAMLLogin)
+
+	res, err := s.app.Test(httptest.NewRequest(http.MethodGet, "/saml/login?redirect=/devices", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var request models.SAMLRequest
+	if err := database.DB.First(&request).Error; err != nil {
+		t.Fatal(err)
+	}
+	var cookie *http.Cookie
+	for _, c := range res.Cookies() {
+		if c.Name == samlRelayCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value != request.RelayState || !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteNoneMode {
+		t.Errorf("relay cookie = %+v, want %s", cookie, request.RelayState)
+	}
+}
+
+func TestSAMLACSRelayStateMismatch(t *testing.T) {
+	s := newSAMLTest(t, false)
+	s.expectRequest("id-login", "/devices")
+	response := s.idp.Response(t, s.metadata, samltest.Login{InResponseTo: "id-login", Email: "ada@example.org"})
+
+	// Someone else's response posted into a browser that never started a login.
+	s.cookie = ""
+	if status, _, code := s.post(response, "relay"); status != fiber.StatusUnauthorized || code != "relay_state_mismatch" {
+		t.Errorf("no cookie: status = %d, code = %q, want 401 relay_state_mismatch", status, code)
+	}
+	s.cookie = "other"
+	if status, _, code := s.post(response, "relay"); status != fiber.StatusUnauthorized || code != "relay_state_mismatch" {
+		t.Errorf("other cookie: status = %d, code = %q, want 401 relay_state_mismatch", status, code)
+	}
+
+	// The request survives the refusals, so the browser that started it can still finish.
+	s.cookie = "relay"
+	if status, _, code := s.post(response, "relay"); status != fiber.StatusSeeOther {
+		t.Errorf("matching cookie: status = %d, code = %q", status, code)
+	}
+}
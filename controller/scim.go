@@ -0,0 +1,1013 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/authn"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/middleware"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/scim"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Groups are the fixed privilege levels. Group IDs are the privilege numbers.
+var scimGroups = []struct {
+	Privilege int8
+	Name      string
+}{
+	{1, "Admin"},
+	{2, "Manager"},
+	{3, "Coordinator"},
+	{4, "Moderator"},
+	{9, "General"},
+}
+
+// Attributes that may be used in a Users filter, lower cased.
+var scimUserColumns = map[string]scim.Column{
+	"id":                      {Expr: "users.id", Kind: scim.NumberColumn},
+	"externalid":              {Expr: "users.external_id", Kind: scim.StringColumn},
+	"username":                {Expr: "users.email", Kind: scim.StringColumn},
+	"emails":                  {Expr: "users.email", Kind: scim.StringColumn},
+	"emails.value":            {Expr: "users.email", Kind: scim.StringColumn},
+	"emails.type":             {Expr: "'work'", Kind: scim.StringColumn}, // The one email we keep is always the primary work address.
+	"emails.primary":          {Expr: "(1 = 1)", Kind: scim.BoolColumn},
+	"active":                  {Expr: "(users.deactivated_at IS NULL)", Kind: scim.BoolColumn},
+	"name.givenname":          {Expr: "user_details.first_name", Kind: scim.StringColumn},
+	"name.familyname":         {Expr: "user_details.last_name", Kind: scim.StringColumn},
+	"groups":                  {Expr: "users.privilege", Kind: scim.NumberColumn},
+	"groups.value":            {Expr: "users.privilege", Kind: scim.NumberColumn},
+	"enterprise.organization": {Expr: "user_details.organization", Kind: scim.StringColumn},
+	"meta.created":            {Expr: "users.created_at", Kind: scim.TimeColumn},
+	"meta.lastmodified":       {Expr: "users.updated_at", Kind: scim.TimeColumn},
+}
+
+var (
+	errSCIMUniqueness = errors.New("userName is already taken")
+	errSCIMNotFound   = errors.New("resource not found")
+	errSCIMProtected  = errors.New("this user cannot be managed through SCIM")
+	scimValueFilter   = regexp.MustCompile(`\[[^\]]*\]`)
+)
+
+// The most privileged group SCIM may hand out. Defaults to Manager so a leaked token cannot mint admins.
+func scimMinPrivilege() int8 {
+	level, err := strconv.Atoi(os.Getenv("SCIM_MIN_PRIVILEGE"))
+	if err != nil || level < 1 || level > 9 {
+		return 2
+	}
+	return int8(level)
+}
+
+/*
+ * USERS
+ */
+
+// List users. Supports filter, startIndex and count.
+func SCIMGetUsers(c *fiber.Ctx) error {
+	startIndex, count := scimPage(c)
+
+	query := database.DB.Model(&models.User{}).Scopes(scimManaged).Joins("LEFT JOIN user_details ON user_details.user_id = users.id")
+	if expr := c.Query("filter"); expr != "" {
+		filter, err := scim.ParseFilter(expr)
+		if err != nil {
+			return scimError(c, fiber.StatusBadRequest, scim.ErrInvalidFilter, err.Error())
+		}
+		where, args, err := filter.SQL(scimUserColumns)
+		if err != nil {
+			return scimError(c, fiber.StatusBadRequest, scim.ErrInvalidFilter, err.Error())
+		}
+		query = query.Where(where, args...)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "", "Could not list users.")
+	}
+
+	var users []models.User
+	if count > 0 {
+		if err := query.Preload("UserDetails").Order("users.id").Offset(startIndex - 1).Limit(count).Find(&users).Error; err != nil {
+			return scimError(c, fiber.StatusInternalServerError, "", "Could not list users.")
+		}
+	}
+
+	resources := make([]scim.User, 0, len(users))
+	for i := range users {
+		resources = append(resources, toSCIMUser(&users[i]))
+	}
+	return scimJSON(c, fiber.StatusOK, scim.NewListResponse(resources, total, startIndex, len(resources)))
+}
+
+func SCIMGetUser(c *fiber.Ctx) error {
+	user, err := findSCIMUser(database.DB, c.Params("id"))
+	if err != nil {
+		return scimLookupError(c, err)
+	}
+	return scimJSON(c, fiber.StatusOK, toSCIMUser(user))
+}
+
+// Provision a new user. Users created this way are already verified and sign in through the identity provider.
+func SCIMCreateUser(c *fiber.Ctx) error {
+	var in scim.User
+	if err := json.Unmarshal(c.Body(), &in); err != nil {
+		return scimError(c, fiber.StatusBadRequest, scim.ErrInvalidSyntax, "Body is not a valid SCIM User.")
+	}
+
+	// Provisioned users sign in through a directory. Local accounts would be out of SCIM's reach once created.
+	provider := os.Getenv("SCIM_AUTH_PROVIDER")
+	if provider == "" || provider == authn.ProviderLocal {
+		provider = authn.ProviderSAML
+	}
+	user := models.User{
+		Privilege:    9, // General user.
+		Verified:     true,
+		AuthProvider: provider,
+	}
+	if err := applySCIMUser(&user, &in); err != nil {
+		return scimError(c, fiber.StatusBadRequest, scim.ErrInvalidValue, err.Error())
+	}
+	if in.Password != "" {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(in.Password), 12)
+		if err != nil {
+			return scimError(c, fiber.StatusBadRequest, scim.ErrInvalidValue, "Password could not be hashed.")
+		}
+		user.Password = hashedPassword
+	}
+
+	// No verification row: the identity provider has already vouched for the email.
+	if err := database.DB.Omit("UserVerification").Create(&user).Error; err != nil {
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			return scimError(c, fiber.StatusConflict, scim.ErrUniqueness, errSCIMUniqueness.Error())
+		}
+		return scimError(c, fiber.StatusInternalServerError, "", "Could not create user.")
+	}
+
+	event := newSCIMAuditEvent(c, audit.UserProvisioned, &user)
+	event.Details["authProvider"] = provider
+	audit.Record(event)
+
+	c.Set(fiber.HeaderLocation, scimLocation("Users", user.ID))
+	return scimJSON(c, fiber.StatusCreated, toSCIMUser(&user))
+}
+
+// Replace a user's attributes.
+func SCIMReplaceUser(c *fiber.Ctx) error {
+	var in scim.User
+	if err := json.Unmarshal(c.Body(), &in); err != nil {
+		return scimError(c, fiber.StatusBadRequest, scim.ErrInvalidSyntax, "Body is not a valid SCIM User.")
+	}
+	return saveSCIMUser(c, func(current *scim.User) error {
+		// PUT replaces everything the client sends and clears what it leaves out, except active which defaults to true.
+		if in.Active == nil {
+			active := true
+			in.Active = &active
+		}
+		*current = in
+		return nil
+	})
+}
+
+// Apply add, replace and remove operations to a user.
+func SCIMPatchUser(c *fiber.Ctx) error {
+	var patch scim.PatchOp
+	if err := json.Unmarshal(c.Body(), &patch); err != nil || len(patch.Operations) == 0 {
+		return scimError(c, fiber.StatusBadRequest, scim.ErrInvalidSyntax, "Body is not a valid SCIM PatchOp.")
+	}
+	return saveSCIMUser(c, func(current *scim.User) error {
+		for _, op := range patch.Operations {
+			if err := patchSCIMUser(current, op); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Permanently delete a user.
+func SCIMDeleteUser(c *fiber.Ctx) error {
+	user, err := findSCIMUser(database.DB, c.Params("id"))
+	if err != nil {
+		return scimLookupError(c, err)
+	}
+	if user.Privilege < scimMinPrivilege() {
+		return scimLookupError(c, errSCIMProtected)
+	}
+
+	if err := database.DB.Select("UserDetails", "UserVerification").Delete(user).Error; err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "", "Could not delete user.")
+	}
+	middleware.InvalidateSession(user.ID)
+
+	audit.Record(newSCIMAuditEvent(c, audit.UserDeleted, user))
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Load the user, let edit change its SCIM representation and write the result back.
+func saveSCIMUser(c *fiber.Ctx, edit func(current *scim.User) error) error {
+	var saved *models.User
+	var events []audit.EventType
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		user, err := findSCIMUser(tx, c.Params("id"))
+		if err != nil {
+			return err
+		}
+		if user.Privilege < scimMinPrivilege() {
+			return errSCIMProtected
+		}
+		wasActive := user.DeactivatedAt == nil
+
+		current := toSCIMUser(user)
+		if err := edit(&current); err != nil {
+			return err
+		}
+		if err := applySCIMUser(user, &current); err != nil {
+			return err
+		}
+
+		events = append(events, audit.UserUpdated)
+		switch {
+		case wasActive && user.DeactivatedAt != nil:
+			// End every session the user has open.
+			user.SessionsValidAfter = time.Now().Unix()
+			events = append(events, audit.UserDeactivated)
+		case !wasActive && user.DeactivatedAt == nil:
+			events = append(events, audit.UserReactivated)
+		}
+
+		if err := tx.Omit(clause.Associations).Save(user).Error; err != nil {
+			if strings.Contains(err.Error(), "Duplicate entry") {
+				return errSCIMUniqueness
+			}
+			return err
+		}
+		user.UserDetails.UserID = user.ID
+		if err := tx.Save(&user.UserDetails).Error; err != nil {
+			return err
+		}
+		saved = user
+		return nil
+	})
+
+	if err != nil {
+		var invalid *scimInvalidError
+		switch {
+		case errors.As(err, &invalid):
+			return scimError(c, fiber.StatusBadRequest, invalid.scimType, invalid.Error())
+		case errors.Is(err, errSCIMUniqueness):
+			return scimError(c, fiber.StatusConflict, scim.ErrUniqueness, err.Error())
+		case errors.Is(err, errSCIMNotFound), errors.Is(err, errSCIMProtected):
+			return scimLookupError(c, err)
+		}
+		return scimError(c, fiber.StatusInternalServerError, "", "Could not update user.")
+	}
+
+	middleware.InvalidateSession(saved.ID)
+	for _, t := range events {
+		audit.Record(newSCIMAuditEvent(c, t, saved))
+	}
+
+	return scimJSON(c, fiber.StatusOK, toSCIMUser(saved))
+}
+
+type scimInvalidError struct {
+	scimType string
+	detail   string
+}
+
+func (e *scimInvalidError) Error() string {
+	return e.detail
+}
+
+func invalidSCIMValue(format string, a ...interface{}) error {
+	return &scimInvalidError{scimType: scim.ErrInvalidValue, detail: fmt.Sprintf(format, a...)}
+}
+
+func invalidSCIMPath(path string) error {
+	return &scimInvalidError{scimType: scim.ErrInvalidPath, detail: fmt.Sprintf("Unsupported attribute path %q.", path)}
+}
+
+// Apply a single PATCH operation to the SCIM representation of a user.
+func patchSCIMUser(u *scim.User, op scim.PatchOperation) error {
+	kind := strings.ToLower(op.Op)
+	if kind != "add" && kind != "replace" && kind != "remove" {
+		return invalidSCIMValue("Unsupported patch op %q.", op.Op)
+	}
+
+	// Without a path the value is an object of attributes to set.
+	if op.Path == "" {
+		if kind == "remove" {
+			return &scimInvalidError{scimType: scim.ErrNoTarget, detail: "Remove operations need a path."}
+		}
+		values, ok := op.Value.(map[string]interface{})
+		if !ok {
+			return invalidSCIMValue("Patch value must be an object when no path is given.")
+		}
+		for path, value := range values {
+			if err := setSCIMUserAttribute(u, path, value, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return setSCIMUserAttribute(u, op.Path, op.Value, kind == "remove")
+}
+
+func setSCIMUserAttribute(u *scim.User, path string, value interface{}, remove bool) error {
+	attr := strings.ToLower(path)
+	attr = strings.TrimPrefix(attr, strings.ToLower(scim.UserSchema)+":")
+	if strings.HasPrefix(attr, strings.ToLower(scim.EnterpriseUserSchema)) {
+		attr = "enterprise" + strings.TrimPrefix(attr, strings.ToLower(scim.EnterpriseUserSchema))
+		attr = strings.Replace(attr, ":", ".", 1)
+	}
+	// We only keep one email, so emails[type eq "work"].value means the same as emails.value.
+	attr = scimValueFilter.ReplaceAllString(attr, "")
+
+	str := func() (string, error) {
+		if remove || value == nil {
+			return "", nil
+		}
+		s, ok := value.(string)
+		if !ok {
+			return "", invalidSCIMValue("%s must be a string.", path)
+		}
+		return s, nil
+	}
+	name := func() *scim.Name {
+		if u.Name == nil {
+			u.Name = &scim.Name{}
+		}
+		return u.Name
+	}
+
+	var err error
+	switch attr {
+	case "username":
+		if remove {
+			return &scimInvalidError{scimType: scim.ErrMutability, detail: "userName is required."}
+		}
+		u.UserName, err = str()
+	case "externalid":
+		u.ExternalID, err = str()
+	case "active":
+		active := !remove
+		switch v := value.(type) {
+		case bool:
+			active = v
+		case string:
+			// Some identity providers send "True" and "False".
+			active, err = strconv.ParseBool(v)
+		}
+		if err != nil {
+			return invalidSCIMValue("active must be a boolean.")
+		}
+		u.Active = &active
+	case "name":
+		if remove {
+			u.Name = nil
+			return nil
+		}
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return invalidSCIMValue("name must be an object.")
+		}
+		for key, v := range fields {
+			if err := setSCIMUserAttribute(u, "name."+key, v, false); err != nil {
+				return err
+			}
+		}
+	case "name.givenname":
+		name().GivenName, err = str()
+	case "name.familyname":
+		name().FamilyName, err = str()
+	case "name.formatted":
+		name().Formatted, err = str()
+	case "emails.value":
+		if remove {
+			return &scimInvalidError{scimType: scim.ErrMutability, detail: "The primary email cannot be removed."}
+		}
+		var email string
+		if email, err = str(); err == nil {
+			u.Emails = []scim.MultiValue{{Value: email, Type: "work", Primary: true}}
+		}
+	case "emails":
+		if remove {
+			return &scimInvalidError{scimType: scim.ErrMutability, detail: "The primary email cannot be removed."}
+		}
+		raw, _ := json.Marshal(value)
+		var emails []scim.MultiValue
+		if json.Unmarshal(raw, &emails) != nil || len(emails) == 0 {
+			return invalidSCIMValue("emails must be a list of email objects.")
+		}
+		u.Emails = emails
+	case "enterprise":
+		fields, ok := value.(map[string]interface{})
+		if remove || !ok {
+			u.Enterprise = nil
+			return nil
+		}
+		for key, v := range fields {
+			if err := setSCIMUserAttribute(u, scim.EnterpriseUserSchema+":"+key, v, false); err != nil {
+				return err
+			}
+		}
+	case "enterprise.organization":
+		if u.Enterprise == nil {
+			u.Enterprise = &scim.EnterpriseUser{}
+		}
+		u.Enterprise.Organization, err = str()
+	case "groups":
+		return &scimInvalidError{scimType: scim.ErrMutability, detail: "Change group membership through /Groups."}
+	default:
+		return invalidSCIMPath(path)
+	}
+	return err
+}
+
+// Copy a SCIM user onto the model.
+func applySCIMUser(user *models.User, in *scim.User) error {
+	email := in.UserName
+	for _, e := range in.Emails {
+		if email == "" || e.Primary {
+			email = e.Value
+		}
+	}
+	// userName is what identity providers match on, so it wins when it looks like an email.
+	if emailIsValid(strings.ToLower(strings.TrimSpace(in.UserName))) {
+		email = in.UserName
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !emailIsValid(email) {
+		return invalidSCIMValue("userName or a primary email must be a valid email address.")
+	}
+
+	// Users without one would drop out of SCIM's reach, see scimManaged.
+	if strings.TrimSpace(in.ExternalID) == "" {
+		return invalidSCIMValue("externalId is required.")
+	}
+
+	user.Email = email
+	user.ExternalID = in.ExternalID
+	user.UserDetails.UserEmail = email
+	user.UserDetails.FirstName, user.UserDetails.LastName = "", ""
+	if in.Name != nil {
+		user.UserDetails.FirstName = in.Name.GivenName
+		user.UserDetails.LastName = in.Name.FamilyName
+	}
+	user.UserDetails.Organization = ""
+	if in.Enterprise != nil {
+		user.UserDetails.Organization = in.Enterprise.Organization
+	}
+
+	active := in.Active == nil || *in.Active
+	if !active && user.DeactivatedAt == nil {
+		now := time.Now()
+		user.DeactivatedAt = &now
+	} else if active {
+		user.DeactivatedAt = nil
+	}
+	return nil
+}
+
+func toSCIMUser(user *models.User) scim.User {
+	active := user.DeactivatedAt == nil
+	created, modified := user.CreatedAt, user.UpdatedAt
+
+	u := scim.User{
+		Schemas:    []string{scim.UserSchema, scim.EnterpriseUserSchema},
+		ID:         strconv.FormatUint(uint64(user.ID), 10),
+		ExternalID: user.ExternalID,
+		UserName:   user.Email,
+		Name: &scim.Name{
+			Formatted:  strings.TrimSpace(user.UserDetails.FirstName + " " + user.UserDetails.LastName),
+			GivenName:  user.UserDetails.FirstName,
+			FamilyName: user.UserDetails.LastName,
+		},
+		Emails: []scim.MultiValue{{Value: user.Email, Type: "work", Primary: true}},
+		Active: &active,
+		Meta: &scim.Meta{
+			ResourceType: "User",
+			Created:      &created,
+			LastModified: &modified,
+			Location:     scimLocation("Users", user.ID),
+		},
+	}
+	if group := scimGroupFor(user.Privilege); group != nil {
+		u.Groups = []scim.MultiValue{{Value: group.ID, Display: group.DisplayName, Ref: group.Meta.Location}}
+	}
+	if user.UserDetails.Organization != "" {
+		u.Enterprise = &scim.EnterpriseUser{Organization: user.UserDetails.Organization}
+	}
+	return u
+}
+
+// Limits a query to users the identity provider provisioned. Local accounts, and anyone else the identity provider
+// does not know by an external ID, are out of reach of SCIM tokens.
+func scimManaged(tx *gorm.DB) *gorm.DB {
+	return tx.Where("users.external_id <> '' AND users.auth_provider NOT IN ?", []string{"", authn.ProviderLocal})
+}
+
+func findSCIMUser(tx *gorm.DB, id string) (*models.User, error) {
+	var user models.User
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return nil, errSCIMNotFound
+	}
+	if err := tx.Preload("UserDetails").Scopes(scimManaged).Where("users.id = ?", id).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errSCIMNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+/*
+ * GROUPS
+ */
+
+// List the privilege groups. Pass excludedAttributes=members to skip loading members.
+func SCIMGetGroups(c *fiber.Ctx) error {
+	startIndex, count := scimPage(c)
+
+	var filter scim.Filter
+	if expr := c.Query("filter"); expr != "" {
+		var err error
+		if filter, err = scim.ParseFilter(expr); err != nil {
+			return scimError(c, fiber.StatusBadRequest, scim.ErrInvalidFilter, err.Error())
+		}
+	}
+	withMembers := !strings.Contains(strings.ToLower(c.Query("excludedAttributes")), "members")
+
+	var matched []scim.Group
+	for _, g := range scimGroups {
+		group := scimGroupFor(g.Privilege)
+		if filter != nil {
+			members := func() []string {
+				if err := loadSCIMGroupMembers(group); err != nil {
+					return nil
+				}
+				values := make([]string, 0, len(group.Members))
+				for _, m := range group.Members {
+					values = append(values, m.Value)
+				}
+				return values
+			}
+			ok := filter.Match(func(path string) []string {
+				switch path {
+				case "id":
+					return []string{group.ID}
+				case "displayname":
+					return []string{group.DisplayName}
+				case "members", "members.value":
+					return members()
+				}
+				return nil
+			})
+			if !ok {
+				continue
+			}
+		}
+		matched = append(matched, *group)
+	}
+
+	resources := []scim.Group{}
+	if startIndex-1 < len(matched) {
+		resources = matched[startIndex-1:]
+	}
+	if len(resources) > count {
+		resources = resources[:count]
+	}
+	for i := range resources {
+		resources[i].Members = nil
+		if withMembers {
+			if err := loadSCIMGroupMembers(&resources[i]); err != nil {
+				return scimError(c, fiber.StatusInternalServerError, "", "Could not list group members.")
+			}
+		}
+	}
+
+	return scimJSON(c, fiber.StatusOK, scim.NewListResponse(resources, int64(len(matched)), startIndex, len(resources)))
+}
+
+func SCIMGetGroup(c *fiber.Ctx) error {
+	group := scimGroupByID(c.Params("id"))
+	if group == nil {
+		return scimLookupError(c, errSCIMNotFound)
+	}
+	if err := loadSCIMGroupMembers(group); err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "", "Could not load group members.")
+	}
+	return scimJSON(c, fiber.StatusOK, group)
+}
+
+// Groups are fixed, so they cannot be created or deleted.
+func SCIMGroupImmutable(c *fiber.Ctx) error {
+	return scimError(c, fiber.StatusForbidden, scim.ErrMutability, "Groups map onto fixed privilege levels and cannot be created or deleted.")
+}
+
+// Replace a group's members. Users dropped from the group become General users.
+func SCIMReplaceGroup(c *fiber.Ctx) error {
+	var in scim.Group
+	if err := json.Unmarshal(c.Body(), &in); err != nil {
+		return scimError(c, fiber.StatusBadRequest, scim.ErrInvalidSyntax, "Body is not a valid SCIM Group.")
+	}
+
+	ids := make([]string, 0, len(in.Members))
+	for _, m := range in.Members {
+		ids = append(ids, m.Value)
+	}
+	return updateSCIMGroup(c, func(group *scim.Group) (add []string, remove []string, err error) {
+		return ids, scimMembersNotIn(group, ids), nil
+	})
+}
+
+// Add or remove group members.
+func SCIMPatchGroup(c *fiber.Ctx) error {
+	var patch scim.PatchOp
+	if err := json.Unmarshal(c.Body(), &patch); err != nil || len(patch.Operations) == 0 {
+		return scimError(c, fiber.StatusBadRequest, scim.ErrInvalidSyntax, "Body is not a valid SCIM PatchOp.")
+	}
+
+	return updateSCIMGroup(c, func(group *scim.Group) (add []string, remove []string, err error) {
+		for _, op := range patch.Operations {
+			path := strings.ToLower(op.Path)
+			kind := strings.ToLower(op.Op)
+
+			// Renaming is not possible, but some IdPs send the display name along with member changes.
+			if path == "displayname" {
+				continue
+			}
+			if path != "" && path != "members" && !strings.HasPrefix(path, "members[") {
+				return nil, nil, invalidSCIMPath(op.Path)
+			}
+
+			var values []string
+			raw, _ := json.Marshal(op.Value)
+			if path == "" {
+				var body struct {
+					Members []scim.MultiValue `json:"members"`
+				}
+				json.Unmarshal(raw, &body)
+				for _, m := range body.Members {
+					values = append(values, m.Value)
+				}
+			} else {
+				var members []scim.MultiValue
+				json.Unmarshal(raw, &members)
+				for _, m := range members {
+					values = append(values, m.Value)
+				}
+			}
+
+			switch kind {
+			case "add":
+				add = append(add, values...)
+			case "replace":
+				add = append(add, values...)
+				remove = append(remove, scimMembersNotIn(group, values)...)
+			case "remove":
+				if strings.HasPrefix(path, "members[") {
+					filter, err := scim.ParseFilter(op.Path)
+					if err != nil {
+						return nil, nil, &scimInvalidError{scimType: scim.ErrInvalidFilter, detail: err.Error()}
+					}
+					for _, m := range group.Members {
+						value := m.Value
+						if filter.Match(func(string) []string { return []string{value} }) {
+							remove = append(remove, value)
+						}
+					}
+				} else if len(values) > 0 {
+					remove = append(remove, values...)
+				} else {
+					remove = append(remove, scimMembersNotIn(group, nil)...)
+				}
+			default:
+				return nil, nil, invalidSCIMValue("Unsupported patch op %q.", op.Op)
+			}
+		}
+		return add, remove, nil
+	})
+}
+
+// Work out which members to add and remove, then move them between privilege levels.
+func updateSCIMGroup(c *fiber.Ctx, changes func(group *scim.Group) (add []string, remove []string, err error)) error {
+	group := scimGroupByID(c.Params("id"))
+	if group == nil {
+		return scimLookupError(c, errSCIMNotFound)
+	}
+	level := int8(0)
+	fmt.Sscan(group.ID, &level)
+
+	minPrivilege := scimMinPrivilege()
+	if level < minPrivilege {
+		return scimError(c, fiber.StatusForbidden, scim.ErrMutability, "This group cannot be managed through SCIM.")
+	}
+	if err := loadSCIMGroupMembers(group); err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "", "Could not load group members.")
+	}
+
+	add, remove, err := changes(group)
+	if err != nil {
+		var invalid *scimInvalidError
+		if errors.As(err, &invalid) {
+			return scimError(c, fiber.StatusBadRequest, invalid.scimType, invalid.Error())
+		}
+		return scimError(c, fiber.StatusBadRequest, scim.ErrInvalidValue, err.Error())
+	}
+
+	type change struct {
+		user     models.User
+		from, to int8
+	}
+	var changed []change
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		move := func(id string, to int8, onlyFrom int8) error {
+			user, err := findSCIMUser(tx, id)
+			if errors.Is(err, errSCIMNotFound) {
+				return invalidSCIMValue("Member %q does not exist.", id)
+			}
+			if err != nil {
+				return err
+			}
+			if onlyFrom != 0 && user.Privilege != onlyFrom {
+				return nil
+			}
+			if user.Privilege == to {
+				return nil
+			}
+			if user.Privilege < minPrivilege {
+				return &scimInvalidError{scimType: scim.ErrMutability, detail: fmt.Sprintf("Member %q cannot be managed through SCIM.", id)}
+			}
+			if err := tx.Model(user).Update("privilege", to).Error; err != nil {
+				return err
+			}
+			changed = append(changed, change{user: *user, from: user.Privilege, to: to})
+			return nil
+		}
+
+		for _, id := range remove {
+			if err := move(id, 9, level); err != nil { // Back to General user.
+				return err
+			}
+		}
+		for _, id := range add {
+			if err := move(id, level, 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		var invalid *scimInvalidError
+		if errors.As(err, &invalid) {
+			return scimError(c, fiber.StatusBadRequest, invalid.scimType, invalid.Error())
+		}
+		return scimError(c, fiber.StatusInternalServerError, "", "Could not update group.")
+	}
+
+	for _, ch := range changed {
+		event := newSCIMAuditEvent(c, audit.PrivilegeChanged, &ch.user)
+		event.Details["from"] = strconv.Itoa(int(ch.from))
+		event.Details["to"] = strconv.Itoa(int(ch.to))
+		audit.Record(event)
+	}
+
+	group.Members = nil
+	if err := loadSCIMGroupMembers(group); err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "", "Could not load group members.")
+	}
+	return scimJSON(c, fiber.StatusOK, group)
+}
+
+// Current members whose IDs are not in keep.
+func scimMembersNotIn(group *scim.Group, keep []string) []string {
+	kept := map[string]bool{}
+	for _, id := range keep {
+		kept[id] = true
+	}
+	var out []string
+	for _, m := range group.Members {
+		if !kept[m.Value] {
+			out = append(out, m.Value)
+		}
+	}
+	return out
+}
+
+func scimGroupFor(privilege int8) *scim.Group {
+	for _, g := range scimGroups {
+		if g.Privilege == privilege {
+			id := strconv.Itoa(int(g.Privilege))
+			return &scim.Group{
+				Schemas:     []string{scim.GroupSchema},
+				ID:          id,
+				DisplayName: g.Name,
+				Members:     []scim.MultiValue{},
+				Meta:        &scim.Meta{ResourceType: "Group", Location: scimLocation("Groups", uint(g.Privilege))},
+			}
+		}
+	}
+	return nil
+}
+
+func scimGroupByID(id string) *scim.Group {
+	level, err := strconv.Atoi(id)
+	if err != nil || level < 1 || level > 9 {
+		return nil
+	}
+	return scimGroupFor(int8(level))
+}
+
+func loadSCIMGroupMembers(group *scim.Group) error {
+	if len(group.Members) > 0 {
+		return nil
+	}
+	var users []models.User
+	if err := database.DB.Select("id", "email").Scopes(scimManaged).Where("privilege = ?", group.ID).Order("id").Find(&users).Error; err != nil {
+		return err
+	}
+	group.Members = make([]scim.MultiValue, 0, len(users))
+	for _, u := range users {
+		group.Members = append(group.Members, scim.MultiValue{
+			Value:   strconv.FormatUint(uint64(u.ID), 10),
+			Display: u.Email,
+			Ref:     scimLocation("Users", u.ID),
+		})
+	}
+	return nil
+}
+
+/*
+ * DISCOVERY
+ */
+
+func SCIMServiceProviderConfig(c *fiber.Ctx) error {
+	supported := func(ok bool) fiber.Map { return fiber.Map{"supported": ok} }
+	return scimJSON(c, fiber.StatusOK, fiber.Map{
+		"schemas":        []string{scim.ServiceProviderConfigSchema},
+		"patch":          supported(true),
+		"bulk":           fiber.Map{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         fiber.Map{"supported": true, "maxResults": scim.MaxCount},
+		"changePassword": supported(false),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []fiber.Map{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer Token",
+			"description": "Authentication with a SCIM token issued by an administrator.",
+			"primary":     true,
+		}},
+	})
+}
+
+/*
+ * TOKENS
+ */
+
+// Create a SCIM bearer token for an identity provider. The token is only returned once.
+func CreateSCIMToken(c *fiber.Ctx) error {
+	var data map[string]string
+
+	if err := c.BodyParser(&data); err != nil || strings.TrimSpace(data["name"]) == "" {
+		rp := models.ResponsePacket{Error: true, Code: "empty_fields", Message: "A name for the token is required."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	token, tokenHash, err := generateSecureToken()
+	if err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not create token."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	claims := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	scimToken := models.SCIMToken{
+		Name:        strings.TrimSpace(data["name"]),
+		TokenHash:   tokenHash,
+		TokenHint:   token[:4],
+		CreatedByID: uint(claims["id"].(float64)),
+	}
+	if err := database.DB.Create(&scimToken).Error; err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not create token."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	event := newAuditEvent(c, audit.SCIMTokenCreated)
+	event.Details["scimTokenID"] = strconv.FormatUint(uint64(scimToken.ID), 10)
+	event.Details["name"] = scimToken.Name
+	audit.Record(event)
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"token": token, "scimToken": scimToken})
+}
+
+func GetSCIMTokens(c *fiber.Ctx) error {
+	var tokens []models.SCIMToken
+
+	if err := database.DB.Order("id desc").Find(&tokens).Error; err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&tokens)
+}
+
+func RevokeSCIMToken(c *fiber.Ctx) error {
+	result := database.DB.Model(&models.SCIMToken{}).Where("id = ? AND revoked_at IS NULL", c.Params("id")).Update("revoked_at", time.Now())
+	if result.Error != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not revoke token."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+	if result.RowsAffected == 0 {
+		rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "Token not found or already revoked."}
+		return c.Status(fiber.StatusNotFound).JSON(rp)
+	}
+
+	event := newAuditEvent(c, audit.SCIMTokenRevoked)
+	event.Details["scimTokenID"] = c.Params("id")
+	audit.Record(event)
+
+	rp := models.ResponsePacket{Error: false, Code: "token_revoked", Message: "SCIM token revoked."}
+	return c.Status(fiber.StatusOK).JSON(rp)
+}
+
+/*
+ * HELPERS
+ */
+
+// Read startIndex (1-based) and count, clamped to sensible values.
+func scimPage(c *fiber.Ctx) (int, int) {
+	startIndex, err := strconv.Atoi(c.Query("startIndex"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(c.Query("count"))
+	if err != nil {
+		count = scim.DefaultCount
+	}
+	if count < 0 {
+		count = 0
+	}
+	if count > scim.MaxCount {
+		count = scim.MaxCount
+	}
+	return startIndex, count
+}
+
+func scimLocation(resource string, id uint) string {
+	return fmt.Sprintf("%s/scim/v2/%s/%d", os.Getenv("API_URL"), resource, id)
+}
+
+// The actor of a SCIM change is the token, not a user.
+func newSCIMAuditEvent(c *fiber.Ctx, t audit.EventType, target *models.User) audit.Event {
+	event := newAuditEvent(c, t)
+	event.TargetID, event.TargetEmail = target.ID, target.Email
+	event.Details["via"] = "scim"
+	if token, ok := c.Locals("scimToken").(*models.SCIMToken); ok {
+		event.Details["scimTokenID"] = strconv.FormatUint(uint64(token.ID), 10)
+		event.Details["scimTokenName"] = token.Name
+	}
+	return event
+}
+
+func scimJSON(c *fiber.Ctx, status int, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, scim.ContentType)
+	return c.Status(status).Send(body)
+}
+
+func scimError(c *fiber.Ctx, status int, scimType string, detail string) error {
+	return scimJSON(c, status, scim.Error{
+		Schemas:  []string{scim.ErrorSchema},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	})
+}
+
+func scimLookupError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, errSCIMNotFound) {
+		return scimError(c, fiber.StatusNotFound, "", "Resource not found.")
+	}
+	if errors.Is(err, errSCIMProtected) {
+		return scimError(c, fiber.StatusForbidden, scim.ErrMutability, "This user cannot be managed through SCIM.")
+	}
+	return scimError(c, fiber.StatusInternalServerError, "", "Internal server error.")
+}
@@ -0,0 +1,153 @@
+package controller
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/Elimists/go-app/authn"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/scim"
+	"github.com/gofiber/fiber/v2"
+)
+
+type scimUsers struct {
+	local, idpAdmin, member models.User
+}
+
+func newSCIMTest(t *testing.T) (*fiber.App, *scimUsers) {
+	t.Helper()
+	useTestDB(t)
+
+	users := &scimUsers{
+		local:    models.User{Email: "root@example.org", Privilege: 1, Verified: true, AuthProvider: authn.ProviderLocal},
+		idpAdmin: models.User{Email: "boss@example.org", Privilege: 1, Verified: true, AuthProvider: authn.ProviderSAML, ExternalID: "ext-boss"},
+		member:   models.User{Email: "ada@example.org", Privilege: 9, Verified: true, AuthProvider: authn.ProviderSAML, ExternalID: "ext-ada"},
+	}
+	for _, u := range []*models.User{&users.local, &users.idpAdmin, &users.member} {
+		u.UserDetails.UserEmail = u.Email
+		if err := database.DB.Create(u).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := fiber.New()
+	app.Get("/Users", SCIMGetUsers)
+	app.Post("/Users", SCIMCreateUser)
+	app.Get("/Users/:id", SCIMGetUser)
+	app.Put("/Users/:id", SCIMReplaceUser)
+	app.Patch("/Users/:id", SCIMPatchUser)
+	app.Delete("/Users/:id", SCIMDeleteUser)
+	return app, users
+}
+
+func scimUserPath(u models.User) string {
+	return "/Users/" + uintString(u.ID)
+}
+
+func TestSCIMListsOnlyProvisionedUsers(t *testing.T) {
+	app, users := newSCIMTest(t)
+
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"", []string{users.idpAdmin.Email, users.member.Email}},
+		{`emails[type eq "work"]`, []string{users.idpAdmin.Email, users.member.Email}},
+		{`emails[type eq "work" and value eq "ada@example.org"]`, []string{users.member.Email}},
+		{`emails[type eq "home"]`, nil},
+		{`userName eq "root@example.org"`, nil},
+	}
+	for _, tt := range tests {
+		var list struct {
+			TotalResults int         `json:"totalResults"`
+			Resources    []scim.User `json:"Resources"`
+		}
+		status := sendRequest(t, app, fiber.MethodGet, "/Users?filter="+url.QueryEscape(tt.filter), "", &list)
+		if status != fiber.StatusOK {
+			t.Errorf("filter %s: status = %d", tt.filter, status)
+			continue
+		}
+		var got []string
+		for _, u := range list.Resources {
+			got = append(got, u.UserName)
+		}
+		if len(got) != len(tt.want) || list.TotalResults != len(tt.want) {
+			t.Errorf("filter %s: got %v (total %d), want %v", tt.filter, got, list.TotalResults, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("filter %s: got %v, want %v", tt.filter, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestSCIMCannotTouchLocalUsers(t *testing.T) {
+	app, users := newSCIMTest(t)
+	path := scimUserPath(users.local)
+
+	if status := sendRequest(t, app, fiber.MethodGet, path, "", nil); status != fiber.StatusNotFound {
+		t.Errorf("GET: status = %d, want 404", status)
+	}
+	patch := `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"replace","path":"active","value":false}]}`
+	if status := sendRequest(t, app, fiber.MethodPatch, path, patch, nil); status != fiber.StatusNotFound {
+		t.Errorf("PATCH: status = %d, want 404", status)
+	}
+	if status := sendRequest(t, app, fiber.MethodDelete, path, "", nil); status != fiber.StatusNotFound {
+		t.Errorf("DELETE: status = %d, want 404", status)
+	}
+
+	var user models.User
+	database.DB.First(&user, users.local.ID)
+	if user.DeactivatedAt != nil {
+		t.Error("local user was deactivated")
+	}
+}
+
+func TestSCIMCannotTouchPrivilegedUsers(t *testing.T) {
+	app, users := newSCIMTest(t)
+	path := scimUserPath(users.idpAdmin)
+
+	patch := `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"replace","path":"active","value":false}]}`
+	if status := sendRequest(t, app, fiber.MethodPatch, path, patch, nil); status != fiber.StatusForbidden {
+		t.Errorf("PATCH: status = %d, want 403", status)
+	}
+	put := `{"userName":"boss@example.org","externalId":"ext-boss","active":false}`
+	if status := sendRequest(t, app, fiber.MethodPut, path, put, nil); status != fiber.StatusForbidden {
+		t.Errorf("PUT: status = %d, want 403", status)
+	}
+	if status := sendRequest(t, app, fiber.MethodDelete, path, "", nil); status != fiber.StatusForbidden {
+		t.Errorf("DELETE: status = %d, want 403", status)
+	}
+
+	var user models.User
+	if err := database.DB.First(&user, users.idpAdmin.ID).Error; err != nil || user.DeactivatedAt != nil {
+		t.Errorf("privileged user was changed: %v %+v", err, user)
+	}
+}
+
+func TestSCIMManagesProvisionedUsers(t *testing.T) {
+	app, users := newSCIMTest(t)
+	path := scimUserPath(users.member)
+
+	patch := `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"replace","path":"active","value":false}]}`
+	var out scim.User
+	if status := sendRequest(t, app, fiber.MethodPatch, path, patch, &out); status != fiber.StatusOK || out.Active == nil || *out.Active {
+		t.Errorf("PATCH: status = %d, user = %+v", status, out)
+	}
+
+	// Clearing the external ID would put the user out of reach.
+	put := `{"userName":"ada@example.org","active":true}`
+	if status := sendRequest(t, app, fiber.MethodPut, path, put, nil); status != fiber.StatusBadRequest {
+		t.Errorf("PUT without externalId: status = %d, want 400", status)
+	}
+	if status := sendRequest(t, app, fiber.MethodPost, "/Users", `{"userName":"new@example.org"}`, nil); status != fiber.StatusBadRequest {
+		t.Errorf("POST without externalId: status = %d, want 400", status)
+	}
+
+	if status := sendRequest(t, app, fiber.MethodDelete, path, "", nil); status != fiber.StatusNoContent {
+		t.Errorf("DELETE: status = %d, want 204", status)
+	}
+}
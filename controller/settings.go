@@ -0,0 +1,24 @@
+package controller
+
+import (
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Read a runtime setting, falling back when it has never been set.
+func getSetting(key string, fallback string) string {
+	var setting models.Setting
+	if err := database.DB.Where("`key` = ?", key).Limit(1).Find(&setting).Error; err != nil || setting.Key == "" {
+		return fallback
+	}
+	return setting.Value
+}
+
+func setSetting(tx *gorm.DB, key string, value string) error {
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value", "updated_at"}),
+	}).Create(&models.Setting{Key: key, Value: value}).Error
+}
@@ -0,0 +1,214 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/authn"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/geoip"
+	"github.com/Elimists/go-app/middleware"
+	"github.com/Elimists/go-app/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// "This wasn't me" links in sign-in alerts work for this long.
+const notMeLinkLifetime = 7 * 24 * time.Hour
+
+// Remember where the user signed in from and send an alert when it is somewhere new.
+//
+// A sign-in is new when either the IP address or the user agent has not been seen on the account before.
+// The very first sign-in on an account is recorded without an alert.
+func recordSignIn(c *fiber.Ctx, user *models.User) {
+	ip := c.IP()
+	userAgent := c.Get(fiber.HeaderUserAgent)
+	fingerprint := hashToken(strings.ToLower(strings.TrimSpace(userAgent)))
+	now := time.Now()
+
+	var known []models.KnownDevice
+	if err := database.DB.Where("user_id = ?", user.ID).Find(&known).Error; err != nil {
+		log.Printf("Error loading known devices: %s", err.Error())
+		return
+	}
+
+	ipSeen, agentSeen := false, false
+	for i := range known {
+		if known[i].IPAddress == ip && known[i].Fingerprint == fingerprint {
+			database.DB.Model(&known[i]).Update("last_seen_at", now)
+			return
+		}
+		ipSeen = ipSeen || known[i].IPAddress == ip
+		agentSeen = agentSeen || known[i].Fingerprint == fingerprint
+	}
+
+	device := models.KnownDevice{
+		UserID:      user.ID,
+		IPAddress:   ip,
+		Fingerprint: fingerprint,
+		UserAgent:   userAgent,
+		Location:    geoip.Lookup(ip).String(),
+		LastSeenAt:  now,
+	}
+
+	alert := len(known) > 0 && (!ipSeen || !agentSeen)
+
+	var revokeToken string
+	if alert {
+		token, tokenHash, err := generateSecureToken()
+		if err != nil {
+			log.Printf("Error generating revoke token: %s", err.Error())
+			return
+		}
+		expires := now.Add(notMeLinkLifetime)
+		revokeToken, device.RevokeTokenHash, device.RevokeExpiresAt = token, tokenHash, &expires
+	}
+
+	if err := database.DB.Create(&device).Error; err != nil {
+		log.Printf("Error saving known device: %s", err.Error())
+		return
+	}
+
+	if alert {
+		revokeLink := fmt.Sprintf("%s/security/notme/%s", os.Getenv("API_URL"), revokeToken)
+		go func() {
+			if err := SendNewSignInEmail(user.Email, device, revokeLink); err != nil {
+				log.Printf("Error sending new sign-in email: %s", err.Error())
+			}
+		}()
+	}
+}
+
+// Shows the "this wasn't me" link from a new sign-in alert as a page with a button that confirms it. Mail scanners and
+// link prefetchers follow links in emails, so opening the link changes nothing.
+func SignInNotMePage(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Set("Referrer-Policy", "no-referrer")
+	c.Type("html", "utf-8")
+
+	var device models.KnownDevice
+	if err := database.DB.Where("revoke_token_hash = ? AND revoke_expires_at > ?", hashToken(c.Params("token")), time.Now()).First(&device).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).SendString(notMePage(`<p>This link is invalid, has expired or has already been used.</p>`))
+	}
+
+	location := device.Location
+	if location == "" {
+		location = "Unknown location"
+	}
+	return c.SendString(notMePage(fmt.Sprintf(`
+				<p>Someone signed in to your account from <b>%s</b> (%s) using %s.</p>
+				<p>If this wasn't you, sign out every session and reset your password.</p>
+				<form method="POST">
+					<button type="submit">This wasn't me, secure my account</button>
+				</form>`, html.EscapeString(location), html.EscapeString(device.IPAddress), html.EscapeString(device.UserAgent))))
+}
+
+// Confirms the "this wasn't me" link from a new sign-in alert.
+//
+// Revokes every session on the account, forgets the device and forces a password reset. Directory accounts have no
+// password here to reset, so they only lose their sessions.
+func SignInNotMe(c *fiber.Ctx) error {
+	var device models.KnownDevice
+	if err := database.DB.Where("revoke_token_hash = ? AND revoke_expires_at > ?", hashToken(c.Params("token")), time.Now()).First(&device).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			rp := models.ResponsePacket{Error: true, Code: "invalid_token", Message: "This link is invalid, has expired or has already been used."}
+			return notMeResult(c, fiber.StatusNotFound, rp)
+		}
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+		return notMeResult(c, fiber.StatusInternalServerError, rp)
+	}
+
+	var user models.User
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("id = ?", device.UserID).First(&user).Error; err != nil {
+			return err
+		}
+		updates := map[string]interface{}{"sessions_valid_after": time.Now().Unix()}
+		if isLocalAccount(&user) {
+			updates["password_reset_required"] = true
+		}
+		if err := tx.Model(&user).Updates(updates).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&device).Error
+	})
+	if err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not secure account."}
+		return notMeResult(c, fiber.StatusInternalServerError, rp)
+	}
+	middleware.InvalidateSession(user.ID)
+
+	event := newAuditEvent(c, audit.SessionsRevoked)
+	event.ActorID, event.ActorEmail = user.ID, user.Email
+	event.TargetID, event.TargetEmail = user.ID, user.Email
+	event.Details["reason"] = "not_me"
+	event.Details["deviceIP"] = device.IPAddress
+	audit.Record(event)
+
+	if !isLocalAccount(&user) {
+		rp := models.ResponsePacket{Error: false, Code: "account_secured", Message: "All sessions have been signed out. Change your password through your organization's directory."}
+		return notMeResult(c, fiber.StatusOK, rp)
+	}
+
+	if err := issuePasswordReset(&user); err != nil {
+		log.Printf("Error sending password reset email: %s", err.Error())
+	}
+
+	rp := models.ResponsePacket{Error: false, Code: "account_secured", Message: "All sessions have been signed out. Check your email to set a new password."}
+	return notMeResult(c, fiber.StatusOK, rp)
+}
+
+// Whether the user's password is kept here rather than in a directory.
+func isLocalAccount(user *models.User) bool {
+	return user.AuthProvider == "" || user.AuthProvider == authn.ProviderLocal
+}
+
+// The confirmation form is posted by a browser, which gets a page back. Other clients get JSON.
+func notMeResult(c *fiber.Ctx, status int, rp models.ResponsePacket) error {
+	if c.Accepts(fiber.MIMEApplicationJSON, fiber.MIMETextHTML) != fiber.MIMETextHTML {
+		return c.Status(status).JSON(rp)
+	}
+	c.Type("html", "utf-8")
+	return c.Status(status).SendString(notMePage("<p>" + html.EscapeString(rp.Message) + "</p>"))
+}
+
+func notMePage(content string) string {
+	return fmt.Sprintf(`
+		<html>
+			<div  style="font-size:20px; font-family: Arial, serif;">%s
+			</div>
+		</html>
+	`, content)
+}
+
+func SendNewSignInEmail(email string, device models.KnownDevice, revokeLink string) error {
+	location := device.Location
+	if location == "" {
+		location = "Unknown location"
+	}
+
+	body := fmt.Sprintf(`
+		<html>
+			<div  style="font-size:20px; font-family: Arial, serif;">
+				<p>Hi there,</p>
+				<p>Your account was just signed in to from a new device or location.</p>
+				<p>When: %s<br>Where: %s (%s)<br>Device: %s</p>
+				<p>If this was you, you can ignore this email.</p>
+				<p>If this wasn't you, <a href="%s">click here</a> to sign out everywhere and reset your password.</p>
+			</div>
+		</html>
+		`,
+		device.LastSeenAt.UTC().Format(time.RFC1123),
+		html.EscapeString(location), html.EscapeString(device.IPAddress),
+		html.EscapeString(device.UserAgent),
+		revokeLink,
+	)
+
+	return sendHTMLEmail(email, "New sign-in to your account", body)
+}
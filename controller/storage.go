@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/storage"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Serve a file from the local store through a presigned URL. Other stores hand out their own URLs.
+func GetStoredFile(c *fiber.Ctx) error {
+	local, ok := storage.Default.(*storage.Local)
+	key := strings.TrimPrefix(c.Params("*"), "/")
+	if !ok || !local.Verify(key, c.Query("expires"), c.Query("signature")) {
+		rp := models.ResponsePacket{Error: true, Code: "invalid_signature", Message: "Link is invalid or has expired."}
+		return c.Status(fiber.StatusForbidden).JSON(rp)
+	}
+
+	reader, info, err := local.Get(c.Context(), key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "File not found."}
+			return c.Status(fiber.StatusNotFound).JSON(rp)
+		}
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	c.Set(fiber.HeaderContentType, info.ContentType)
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	c.Set(fiber.HeaderCacheControl, "private, no-transform")
+	return c.SendStream(reader, int(info.Size))
+}
@@ -1,12 +1,18 @@
 package controller
 
 import (
+	"errors"
 	"strconv"
+	"time"
 
+	"github.com/Elimists/go-app/audit"
 	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/middleware"
 	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/pagination"
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
 )
 
 func GetUser(c *fiber.Ctx) error {
@@ -20,27 +26,78 @@ func GetUser(c *fiber.Ctx) error {
 		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error"}
 		return c.Status(fiber.StatusInternalServerError).JSON(rp)
 	}
+	user.ImpersonatedBy = impersonationFromClaims(claims)
 
 	return c.Status(fiber.StatusOK).JSON(&user)
 }
 
-func GetAllUsers(c *fiber.Ctx) error {
-
-	RETURN_LIMIT := 30
-	params := c.AllParams()
-	pagenum, _ := strconv.Atoi(params["pagenumber"])
-	if pagenum == 0 {
-		pagenum = 1
-	}
+var userSorts = map[string]pagination.Sort{
+	"id":     {Column: "id"},
+	"newest": {Column: "created_at", Desc: true, Time: true},
+	"email":  {Column: "email"},
+}
 
-	offset := (pagenum - 1) * RETURN_LIMIT
+// A user as staff see them, with the moderation status that is hidden from everyone else.
+type staffUser struct {
+	models.User
+	Status            string     `json:"status"`
+	SuspendedUntil    *time.Time `json:"suspendedUntil,omitempty"`
+	StatusReason      string     `json:"statusReason,omitempty"`
+	StatusChangedByID *uint      `json:"statusChangedByID,omitempty"`
+	StatusChangedAt   *time.Time `json:"statusChangedAt,omitempty"`
+}
 
-	var users []*models.User
+func newStaffUser(user models.User) staffUser {
+	return staffUser{
+		User:              user,
+		Status:            user.Status,
+		SuspendedUntil:    user.SuspendedUntil,
+		StatusReason:      user.StatusReason,
+		StatusChangedByID: user.StatusChangedByID,
+		StatusChangedAt:   user.StatusChangedAt,
+	}
+}
 
-	database.DB.Offset(offset).Limit(RETURN_LIMIT).Preload("UserDetails").Find(&users)
+// List users a page at a time, for staff.
+//
+// Query: sort (id, newest or email), limit and cursor.
+func GetAllUsers(c *fiber.Ctx) error {
+	p, err := pagination.Parse(c, pagination.Limits{Default: 30, Max: 100}, userSorts, "id")
+	if err != nil {
+		return paginationError(c, err)
+	}
 
-	return c.Status(fiber.StatusAccepted).JSON(&users)
+	base := database.DB.Model(&models.User{})
+	total, err := pagination.Count(base)
+	if err != nil {
+		return paginationError(c, err)
+	}
+	var users []models.User
+	if err := p.Query(base, "id").Preload("UserDetails").Find(&users).Error; err != nil {
+		return paginationError(c, err)
+	}
 
+	rows := make([]staffUser, len(users))
+	for i := range users {
+		rows[i] = newStaffUser(users[i])
+	}
+	page := pagination.NewPage(c, p, rows, func(u *staffUser) pagination.Key {
+		switch p.SortName {
+		case "newest":
+			return pagination.Key{Value: u.CreatedAt, ID: u.ID}
+		case "email":
+			return pagination.Key{Value: u.Email, ID: u.ID}
+		}
+		return pagination.Key{Value: u.ID, ID: u.ID}
+	}, total)
+
+	event := newAuditEvent(c, audit.UsersListed)
+	event.Details["sort"] = p.SortName
+	event.Details["cursor"] = c.Query("cursor")
+	event.Details["count"] = strconv.Itoa(len(page.Data))
+	audit.Record(event)
+
+	return c.Status(fiber.StatusAccepted).JSON(&page)
 }
 
 func UpdateUser(c *fiber.Ctx) error {
@@ -73,18 +130,62 @@ func UpdateUser(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusCreated).JSON(rp)
 }
 
-func GetAddress(c *fiber.Ctx) error {
-	return c.Status(fiber.StatusOK).JSON(&models.ResponsePacket{Error: false, Code: "success", Message: "Address added successfully"})
-}
+// Change the privilege level of a user.
+//
+// Admins and managers can only hand out privilege levels at or below their own.
+func UpdateUserPrivilege(c *fiber.Ctx) error {
+	var data map[string]int
 
-func AddAddress(c *fiber.Ctx) error {
-	return c.Status(fiber.StatusOK).JSON(&models.ResponsePacket{Error: false, Code: "success", Message: "Address added successfully"})
-}
+	if err := c.BodyParser(&data); err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
 
-func UpdateAddress(c *fiber.Ctx) error {
-	return c.Status(fiber.StatusOK).JSON(&models.ResponsePacket{Error: false, Code: "success", Message: "Address added successfully"})
-}
+	newPrivilege, ok := data["privilege"]
+	if !ok || newPrivilege < 1 || newPrivilege > 9 {
+		rp := models.ResponsePacket{Error: true, Code: "invalid_privilege", Message: "Privilege must be between 1 and 9."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	actorID, actorPrivilege := actorFromClaims(c)
+
+	var user models.User
+	if err := database.DB.Where("id = ?", c.Params("id")).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "User not found."}
+			return c.Status(fiber.StatusNotFound).JSON(rp)
+		}
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+
+	// Like account status, only users below the actor can be changed, and never the actor themselves.
+	if user.ID == actorID || user.Privilege <= actorPrivilege || int8(newPrivilege) < actorPrivilege {
+		rp := models.ResponsePacket{Error: true, Code: "forbidden", Message: "You cannot change privileges above your own."}
+		return c.Status(fiber.StatusForbidden).JSON(rp)
+	}
+
+	oldPrivilege := user.Privilege
+	updates := map[string]interface{}{"privilege": int8(newPrivilege)}
+	demoted := int8(newPrivilege) > oldPrivilege
+	if demoted {
+		// Tokens carry the privilege, so revoke them rather than let the old one linger until they expire.
+		updates["sessions_valid_after"] = time.Now().Unix()
+	}
+	if err := database.DB.Model(&user).Updates(updates).Error; err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error. Could not update privilege."}
+		return c.Status(fiber.StatusInternalServerError).JSON(rp)
+	}
+	if demoted {
+		middleware.InvalidateSession(user.ID)
+	}
+
+	event := newAuditEvent(c, audit.PrivilegeChanged)
+	event.TargetID, event.TargetEmail = user.ID, user.Email
+	event.Details["from"] = strconv.Itoa(int(oldPrivilege))
+	event.Details["to"] = strconv.Itoa(newPrivilege)
+	audit.Record(event)
 
-func DeleteAddress(c *fiber.Ctx) error {
-	return c.Status(fiber.StatusOK).JSON(&models.ResponsePacket{Error: false, Code: "success", Message: "Address added successfully"})
+	rp := models.ResponsePacket{Error: false, Code: "update_successfull", Message: "Privilege successfully updated."}
+	return c.Status(fiber.StatusOK).JSON(rp)
 }
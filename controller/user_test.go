@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestAccountStatusOnlyShownToStaff(t *testing.T) {
+	useTestDB(t)
+	admin := createTestUser(t, "admin@example.org", 1)
+	member := createTestUser(t, "member@example.org", 9)
+	database.DB.Model(&member).Updates(map[string]interface{}{"status": models.AccountBanned, "status_reason": "Spam."})
+
+	database.DB.First(&member, member.ID)
+	raw, err := json.Marshal(&member)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plain map[string]interface{}
+	json.Unmarshal(raw, &plain)
+	for _, field := range []string{"status", "statusReason", "suspendedUntil", "statusChangedByID", "statusChangedAt"} {
+		if _, ok := plain[field]; ok {
+			t.Errorf("user JSON has %s: %s", field, raw)
+		}
+	}
+
+	app := fiber.New()
+	app.Get("/users", signedInAs(admin), GetAllUsers)
+	var page struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	if status := sendRequest(t, app, fiber.MethodGet, "/users?sort=email", "", &page); status != fiber.StatusAccepted {
+		t.Fatalf("status = %d", status)
+	}
+	if len(page.Data) != 2 || page.Data[1]["email"] != member.Email || page.Data[1]["status"] != models.AccountBanned || page.Data[1]["statusReason"] != "Spam." {
+		t.Errorf("users = %v", page.Data)
+	}
+}
+
+func TestUpdateUserPrivilege(t *testing.T) {
+	useTestDB(t)
+	manager := createTestUser(t, "manager@example.org", 2)
+	peer := createTestUser(t, "peer@example.org", 2)
+	member := createTestUser(t, "member@example.org", 4)
+
+	app := fiber.New()
+	app.Patch("/users/:id/privilege", signedInAs(manager), UpdateUserPrivilege)
+	patch := func(user models.User, privilege string) int {
+		return sendRequest(t, app, fiber.MethodPatch, "/users/"+uintString(user.ID)+"/privilege", `{"privilege":`+privilege+`}`, nil)
+	}
+
+	for _, target := range []models.User{manager, peer} {
+		if status := patch(target, "9"); status != fiber.StatusForbidden {
+			t.Errorf("demoting %s = %d, want 403", target.Email, status)
+		}
+	}
+	if status := patch(member, "1"); status != fiber.StatusForbidden {
+		t.Errorf("promoting above the actor = %d, want 403", status)
+	}
+
+	if status := patch(member, "9"); status != fiber.StatusOK {
+		t.Fatalf("demotion = %d", status)
+	}
+	database.DB.First(&member, member.ID)
+	if member.Privilege != 9 || member.SessionsValidAfter == 0 {
+		t.Errorf("demoted member = privilege %d, sessions valid after %d", member.Privilege, member.SessionsValidAfter)
+	}
+
+	database.DB.Model(&member).Update("sessions_valid_after", 0)
+	if status := patch(member, "3"); status != fiber.StatusOK {
+		t.Fatalf("promotion = %d", status)
+	}
+	database.DB.First(&member, member.ID)
+	if member.Privilege != 3 || member.SessionsValidAfter != 0 {
+		t.Errorf("promoted member = privilege %d, sessions valid after %d", member.Privilege, member.SessionsValidAfter)
+	}
+}
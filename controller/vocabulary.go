@@ -0,0 +1,710 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	maxTermNameLength = 100
+	maxUnmappedNames  = 100
+)
+
+// The device children each vocabulary applies to.
+var vocabularyTables = map[string]interface{}{
+	models.VocabularyCapability: &models.DeviceCapability{},
+	models.VocabularyDisability: &models.DeviceDisability{},
+}
+
+var (
+	errUnknownVocabulary = errors.New("unknown vocabulary")
+	errTermNotFound      = errors.New("term not found")
+	errTermSlugTaken     = errors.New("name is already used in the vocabulary")
+	errTermCycle         = errors.New("term cannot be placed under itself")
+)
+
+// A loaded vocabulary. Every term and synonym slug points at its term.
+type vocabulary struct {
+	terms map[uint]*models.Term
+	slugs map[string]*models.Term
+}
+
+type termInput struct {
+	Name        *string   `json:"name"`
+	Description *string   `json:"description"`
+	ParentID    *uint     `json:"parentID"` // 0 makes the term top level.
+	Synonyms    *[]string `json:"synonyms"` // Replaces every synonym.
+}
+
+// List a vocabulary's terms with their synonyms. ParentID links each term to the broader term above it.
+func GetVocabulary(c *fiber.Ctx) error {
+	name, err := vocabularyParam(c)
+	if err != nil {
+		return vocabularyError(c, err)
+	}
+	terms := []models.Term{}
+	if err := database.DB.Preload("Synonyms").Where("vocabulary = ?", name).Order("name").Find(&terms).Error; err != nil {
+		return vocabularyError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(&terms)
+}
+
+// Add a term to a vocabulary. Devices already using its name or one of its synonyms are linked to it.
+func CreateTerm(c *fiber.Ctx) error {
+	name, err := vocabularyParam(c)
+	if err != nil {
+		return vocabularyError(c, err)
+	}
+	var data termInput
+	if err := c.BodyParser(&data); err != nil || data.Name == nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Terms need a name."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	term := models.Term{Vocabulary: name}
+	var invalid *models.ResponsePacket
+	var deviceIDs []uint
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if invalid = applyTermInput(&term, data); invalid != nil {
+			return gorm.ErrInvalidData
+		}
+		if err := checkTermPlacement(tx, &term); err != nil {
+			return err
+		}
+		if err := tx.Omit("Synonyms").Create(&term).Error; err != nil {
+			return err
+		}
+		if err := saveTermSynonyms(tx, &term); err != nil {
+			return err
+		}
+		userID, _ := actorFromClaims(c)
+		deviceIDs, err = relinkVocabulary(tx, name, nil, userID, fmt.Sprintf("Linked to the new vocabulary term %q.", term.Name))
+		return err
+	})
+	if invalid != nil {
+		return c.Status(fiber.StatusNotAcceptable).JSON(invalid)
+	}
+	if err != nil {
+		return vocabularyError(c, err)
+	}
+	reindexDevices(deviceIDs)
+
+	event := newAuditEvent(c, audit.VocabularyTermCreated)
+	event.Details["vocabulary"] = name
+	event.Details["termID"] = strconv.FormatUint(uint64(term.ID), 10)
+	event.Details["name"] = term.Name
+	audit.Record(event)
+
+	return c.Status(fiber.StatusCreated).JSON(&term)
+}
+
+// Rename a term, change its description, synonyms or parent. Fields left out keep their value. Devices linked to the
+// term take its new name.
+func UpdateTerm(c *fiber.Ctx) error {
+	name, err := vocabularyParam(c)
+	if err != nil {
+		return vocabularyError(c, err)
+	}
+	var data termInput
+	if err := c.BodyParser(&data); err != nil {
+		rp := models.ResponsePacket{Error: true, Code: "empty_body", Message: "Nothing in body"}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	var term models.Term
+	var invalid *models.ResponsePacket
+	var deviceIDs []uint
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := loadTerm(tx, name, c.Params("id"), &term); err != nil {
+			return err
+		}
+		if invalid = applyTermInput(&term, data); invalid != nil {
+			return gorm.ErrInvalidData
+		}
+		if err := checkTermPlacement(tx, &term); err != nil {
+			return err
+		}
+		if err := tx.Omit("Synonyms").Save(&term).Error; err != nil {
+			return err
+		}
+		if data.Synonyms != nil {
+			if err := tx.Where("term_id = ?", term.ID).Delete(&models.TermSynonym{}).Error; err != nil {
+				return err
+			}
+			if err := saveTermSynonyms(tx, &term); err != nil {
+				return err
+			}
+		}
+		userID, _ := actorFromClaims(c)
+		deviceIDs, err = relinkVocabulary(tx, name, []uint{term.ID}, userID, fmt.Sprintf("Vocabulary term %q updated.", term.Name))
+		return err
+	})
+	if invalid != nil {
+		return c.Status(fiber.StatusNotAcceptable).JSON(invalid)
+	}
+	if err != nil {
+		return vocabularyError(c, err)
+	}
+	reindexDevices(deviceIDs)
+
+	event := newAuditEvent(c, audit.VocabularyTermUpdated)
+	event.Details["vocabulary"] = name
+	event.Details["termID"] = strconv.FormatUint(uint64(term.ID), 10)
+	event.Details["name"] = term.Name
+	audit.Record(event)
+
+	return c.Status(fiber.StatusOK).JSON(&term)
+}
+
+// Remove a term. Narrower terms move up to its parent and devices keep the name as free text.
+func DeleteTerm(c *fiber.Ctx) error {
+	name, err := vocabularyParam(c)
+	if err != nil {
+		return vocabularyError(c, err)
+	}
+
+	var term models.Term
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := loadTerm(tx, name, c.Params("id"), &term); err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Term{}).Where("parent_id = ?", term.ID).Update("parent_id", term.ParentID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(vocabularyTables[name]).Where("term_id = ?", term.ID).Update("term_id", nil).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("term_id = ?", term.ID).Delete(&models.TermSynonym{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&term).Error
+	})
+	if err != nil {
+		return vocabularyError(c, err)
+	}
+
+	event := newAuditEvent(c, audit.VocabularyTermDeleted)
+	event.Details["vocabulary"] = name
+	event.Details["termID"] = strconv.FormatUint(uint64(term.ID), 10)
+	event.Details["name"] = term.Name
+	audit.Record(event)
+
+	rp := models.ResponsePacket{Error: false, Code: "delete_success", Message: "Term deleted successfully."}
+	return c.Status(fiber.StatusOK).JSON(rp)
+}
+
+// Merge near-duplicate terms into the term named by :id. The merged terms' names and synonyms become its synonyms,
+// their narrower terms move under it and their devices are linked to it, each with a revision crediting the admin.
+// Terms above it cannot be merged into it.
+//
+// Body: sourceIDs, the terms to merge away.
+func MergeTerms(c *fiber.Ctx) error {
+	name, err := vocabularyParam(c)
+	if err != nil {
+		return vocabularyError(c, err)
+	}
+	var data struct {
+		SourceIDs []uint `json:"sourceIDs"`
+	}
+	if err := c.BodyParser(&data); err != nil || len(data.SourceIDs) == 0 {
+		rp := models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Pick the terms to merge."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+
+	var target models.Term
+	var sources []models.Term
+	var deviceIDs []uint
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := loadTerm(tx, name, c.Params("id"), &target); err != nil {
+			return err
+		}
+		if err := tx.Where("vocabulary = ? AND id IN ? AND id <> ?", name, data.SourceIDs, target.ID).Find(&sources).Error; err != nil {
+			return err
+		}
+		if len(sources) == 0 {
+			return errTermNotFound
+		}
+		sourceIDs := make([]uint, len(sources))
+		for i, source := range sources {
+			sourceIDs[i] = source.ID
+		}
+
+		// Merging a broader term into one below it would leave the hierarchy with a loop.
+		v, err := loadVocabulary(tx, name)
+		if err != nil {
+			return err
+		}
+		for parent := target.ParentID; parent != nil && v.terms[*parent] != nil; parent = v.terms[*parent].ParentID {
+			if containsID(sourceIDs, *parent) {
+				return errTermCycle
+			}
+		}
+
+		if err := tx.Model(&models.Term{}).Where("parent_id IN ?", sourceIDs).Update("parent_id", target.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.TermSynonym{}).Where("term_id IN ?", sourceIDs).Update("term_id", target.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(vocabularyTables[name]).Where("term_id IN ?", sourceIDs).Update("term_id", target.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("id IN ?", sourceIDs).Delete(&models.Term{}).Error; err != nil {
+			return err
+		}
+		// The merged names keep working, now as synonyms. Slugs were unique before, so they cannot clash.
+		for _, source := range sources {
+			synonym := models.TermSynonym{TermID: target.ID, Vocabulary: name, Slug: source.Slug, Name: source.Name}
+			if err := tx.Create(&synonym).Error; err != nil {
+				return err
+			}
+		}
+		userID, _ := actorFromClaims(c)
+		deviceIDs, err = relinkVocabulary(tx, name, []uint{target.ID}, userID, fmt.Sprintf("Vocabulary terms merged into %q.", target.Name))
+		return err
+	})
+	if err != nil {
+		return vocabularyError(c, err)
+	}
+	reindexDevices(deviceIDs)
+
+	event := newAuditEvent(c, audit.VocabularyTermsMerged)
+	event.Details["vocabulary"] = name
+	event.Details["termID"] = strconv.FormatUint(uint64(target.ID), 10)
+	var merged []string
+	for _, source := range sources {
+		merged = append(merged, strconv.FormatUint(uint64(source.ID), 10))
+	}
+	event.Details["mergedIDs"] = strings.Join(merged, ",")
+	audit.Record(event)
+
+	database.DB.Preload("Synonyms").First(&target, target.ID)
+	return c.Status(fiber.StatusOK).JSON(&target)
+}
+
+// List the free text names devices use that match no term, most used first, so they can be added as terms or synonyms.
+func GetUnmappedTerms(c *fiber.Ctx) error {
+	name, err := vocabularyParam(c)
+	if err != nil {
+		return vocabularyError(c, err)
+	}
+	var rows []struct {
+		Name  string
+		Count int
+	}
+	err = database.DB.Model(vocabularyTables[name]).Select("name, COUNT(*) AS count").Where("term_id IS NULL").
+		Group("name").Scan(&rows).Error
+	if err != nil {
+		return vocabularyError(c, err)
+	}
+
+	type unmapped struct {
+		Name  string `json:"name"`
+		Slug  string `json:"slug"`
+		Count int    `json:"count"`
+	}
+	bySlug := map[string]*unmapped{}
+	names := []*unmapped{}
+	for _, row := range rows {
+		slug := urlSafeName(row.Name)
+		if slug == "" {
+			continue
+		}
+		if u, ok := bySlug[slug]; ok {
+			u.Count += row.Count
+			continue
+		}
+		bySlug[slug] = &unmapped{Name: strings.TrimSpace(row.Name), Slug: slug, Count: row.Count}
+		names = append(names, bySlug[slug])
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if names[i].Count != names[j].Count {
+			return names[i].Count > names[j].Count
+		}
+		return names[i].Slug < names[j].Slug
+	})
+	if len(names) > maxUnmappedNames {
+		names = names[:maxUnmappedNames]
+	}
+	return c.Status(fiber.StatusOK).JSON(&names)
+}
+
+// Map the capabilities and disabilities of a device being saved onto their terms. Matched entries take the term's
+// canonical name and entries that end up naming the same term are dropped. Unknown names are kept as free text.
+func mapDeviceTerms(tx *gorm.DB, device *models.Device) error {
+	if len(device.Capabilities) > 0 {
+		v, err := loadVocabulary(tx, models.VocabularyCapability)
+		if err != nil {
+			return err
+		}
+		mapped := device.Capabilities[:0]
+		seen := map[uint]bool{}
+		for _, capability := range device.Capabilities {
+			capability.Name, capability.TermID = v.canonical(capability.Name)
+			if capability.TermID != nil {
+				if seen[*capability.TermID] {
+					continue
+				}
+				seen[*capability.TermID] = true
+			}
+			mapped = append(mapped, capability)
+		}
+		device.Capabilities = mapped
+	}
+	if len(device.Disabilities) > 0 {
+		v, err := loadVocabulary(tx, models.VocabularyDisability)
+		if err != nil {
+			return err
+		}
+		mapped := device.Disabilities[:0]
+		seen := map[uint]bool{}
+		for _, disability := range device.Disabilities {
+			disability.Name, disability.TermID = v.canonical(disability.Name)
+			if disability.TermID != nil {
+				if seen[*disability.TermID] {
+					continue
+				}
+				seen[*disability.TermID] = true
+			}
+			mapped = append(mapped, disability)
+		}
+		device.Disabilities = mapped
+	}
+	return nil
+}
+
+// Turn search filter values into canonical names. A term also matches everything narrower than it, so "Upper limb"
+// finds devices tagged "Hand". Values that match no term are searched as they are.
+func canonicalFilter(name string, values []string) []string {
+	if len(values) == 0 {
+		return values
+	}
+	v, err := loadVocabulary(database.DB, name)
+	if err != nil {
+		log.Printf("Error loading %s vocabulary: %s", name, err.Error())
+		return values
+	}
+	var names []string
+	for _, value := range values {
+		term := v.slugs[urlSafeName(value)]
+		if term == nil {
+			names = append(names, value)
+			continue
+		}
+		names = append(names, v.narrower(term.ID)...)
+	}
+	return names
+}
+
+func loadVocabulary(tx *gorm.DB, name string) (vocabulary, error) {
+	var terms []models.Term
+	if err := tx.Preload("Synonyms").Where("vocabulary = ?", name).Find(&terms).Error; err != nil {
+		return vocabulary{}, err
+	}
+	v := vocabulary{terms: map[uint]*models.Term{}, slugs: map[string]*models.Term{}}
+	for i := range terms {
+		term := &terms[i]
+		v.terms[term.ID] = term
+		v.slugs[term.Slug] = term
+		for _, synonym := range term.Synonyms {
+			v.slugs[synonym.Slug] = term
+		}
+	}
+	return v, nil
+}
+
+// The canonical name and term ID for a name, or the trimmed name and nil when it is not in the vocabulary.
+func (v vocabulary) canonical(name string) (string, *uint) {
+	term := v.slugs[urlSafeName(name)]
+	if term == nil {
+		return strings.TrimSpace(name), nil
+	}
+	id := term.ID
+	return term.Name, &id
+}
+
+// The names of a term and every term below it.
+func (v vocabulary) narrower(id uint) []string {
+	var names []string
+	for _, term := range v.terms {
+		// Walk up from each term. The walk is capped in case a cycle slipped in.
+		current := term
+		for steps := 0; current != nil && steps <= len(v.terms); steps++ {
+			if current.ID == id {
+				names = append(names, term.Name)
+				break
+			}
+			if current.ParentID == nil {
+				break
+			}
+			current = v.terms[*current.ParentID]
+		}
+	}
+	return names
+}
+
+// Link device rows to the vocabulary after it changed: unlinked rows that now match a term, and rows linked to termIDs,
+// which may have been renamed. Returns the devices whose rows changed.
+//
+// Every changed device gets a revision crediting actorID with reason. Devices without revisions get their content
+// recorded first, so the change can be rolled back.
+func relinkVocabulary(tx *gorm.DB, name string, termIDs []uint, actorID uint, reason string) ([]uint, error) {
+	v, err := loadVocabulary(tx, name)
+	if err != nil {
+		return nil, err
+	}
+	changed := map[uint]bool{}
+	change := func(deviceID uint) error {
+		if changed[deviceID] {
+			return nil
+		}
+		changed[deviceID] = true
+		device, err := loadDeviceContent(tx, deviceID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = recordDeviceRevision(tx, &device, device.UserPostsID, baselineRevisionReason, nil)
+		return err
+	}
+
+	table := vocabularyTables[name]
+	var rows []struct {
+		ID       uint
+		Name     string
+		DeviceID uint
+		TermID   *uint
+	}
+	query := tx.Model(table).Select("id", "name", "device_id", "term_id")
+	if len(termIDs) > 0 {
+		query = query.Where("term_id IS NULL OR term_id IN ?", termIDs)
+	} else {
+		query = query.Where("term_id IS NULL")
+	}
+	if err := query.Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		var term *models.Term
+		if row.TermID != nil {
+			term = v.terms[*row.TermID]
+		} else {
+			term = v.slugs[urlSafeName(row.Name)]
+		}
+		if term == nil || (row.TermID != nil && row.Name == term.Name) {
+			continue
+		}
+		if err := change(row.DeviceID); err != nil {
+			return nil, err
+		}
+		if err := tx.Model(table).Where("id = ?", row.ID).Updates(map[string]interface{}{"name": term.Name, "term_id": term.ID}).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	// Two names on one device can now point at the same term. Keep the first.
+	var duplicates []struct {
+		DeviceID uint
+		TermID   uint
+		KeepID   uint
+	}
+	err = tx.Model(table).Select("device_id, term_id, MIN(id) AS keep_id").Where("term_id IS NOT NULL").
+		Group("device_id, term_id").Having("COUNT(*) > 1").Scan(&duplicates).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range duplicates {
+		if err := change(d.DeviceID); err != nil {
+			return nil, err
+		}
+		if err := tx.Unscoped().Where("device_id = ? AND term_id = ? AND id <> ?", d.DeviceID, d.TermID, d.KeepID).Delete(table).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	deviceIDs := make([]uint, 0, len(changed))
+	for id := range changed {
+		device, err := loadDeviceContent(tx, id)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := recordDeviceRevision(tx, &device, actorID, reason, nil); err != nil {
+			return nil, err
+		}
+		deviceIDs = append(deviceIDs, id)
+	}
+	return deviceIDs, nil
+}
+
+// Load a device with the children a revision records. Deleted devices are included, so their history stays complete.
+func loadDeviceContent(tx *gorm.DB, id uint) (models.Device, error) {
+	var device models.Device
+	err := tx.Unscoped().Preload("Capabilities").Preload("Disabilities").Preload("Usages").Where("id = ?", id).First(&device).Error
+	return device, err
+}
+
+func reindexDevices(ids []uint) {
+	if len(ids) == 0 {
+		return
+	}
+	go func() {
+		for _, id := range ids {
+			indexDevice(id)
+		}
+	}()
+}
+
+// Copy the fields that were sent onto the term and check them.
+func applyTermInput(term *models.Term, data termInput) *models.ResponsePacket {
+	if data.Name != nil {
+		term.Name = strings.TrimSpace(*data.Name)
+		term.Slug = urlSafeName(term.Name)
+	}
+	if data.Description != nil {
+		term.Description = strings.TrimSpace(*data.Description)
+	}
+	if data.ParentID != nil {
+		term.ParentID = data.ParentID
+		if *data.ParentID == 0 {
+			term.ParentID = nil
+		}
+	}
+	if data.Synonyms != nil {
+		term.Synonyms = []models.TermSynonym{}
+		seen := map[string]bool{}
+		for _, synonym := range *data.Synonyms {
+			synonym = strings.TrimSpace(synonym)
+			slug := urlSafeName(synonym)
+			if slug == "" || seen[slug] {
+				continue
+			}
+			if len(synonym) > maxTermNameLength {
+				return &models.ResponsePacket{Error: true, Code: "invalid_synonym", Message: fmt.Sprintf("Synonyms must be %d characters or fewer.", maxTermNameLength)}
+			}
+			seen[slug] = true
+			term.Synonyms = append(term.Synonyms, models.TermSynonym{Vocabulary: term.Vocabulary, Slug: slug, Name: synonym})
+		}
+	}
+
+	switch {
+	case term.Slug == "":
+		return &models.ResponsePacket{Error: true, Code: "empty_fields", Message: "Terms need a name."}
+	case len(term.Name) > maxTermNameLength:
+		return &models.ResponsePacket{Error: true, Code: "invalid_name", Message: fmt.Sprintf("Names must be %d characters or fewer.", maxTermNameLength)}
+	}
+	return nil
+}
+
+// The term's name and synonyms must be free in the vocabulary, and its parent must exist and not sit below it.
+func checkTermPlacement(tx *gorm.DB, term *models.Term) error {
+	slugs := []string{term.Slug}
+	for _, synonym := range term.Synonyms {
+		if synonym.Slug == term.Slug {
+			return errTermSlugTaken
+		}
+		slugs = append(slugs, synonym.Slug)
+	}
+	var taken int64
+	if err := tx.Model(&models.Term{}).Where("vocabulary = ? AND slug IN ? AND id <> ?", term.Vocabulary, slugs, term.ID).Count(&taken).Error; err != nil {
+		return err
+	}
+	if taken == 0 {
+		if err := tx.Model(&models.TermSynonym{}).Where("vocabulary = ? AND slug IN ? AND term_id <> ?", term.Vocabulary, slugs, term.ID).Count(&taken).Error; err != nil {
+			return err
+		}
+	}
+	if taken > 0 {
+		return errTermSlugTaken
+	}
+
+	if term.ParentID == nil {
+		return nil
+	}
+	v, err := loadVocabulary(tx, term.Vocabulary)
+	if err != nil {
+		return err
+	}
+	if v.terms[*term.ParentID] == nil {
+		return errTermNotFound
+	}
+	for parent := v.terms[*term.ParentID]; parent != nil; {
+		if parent.ID == term.ID {
+			return errTermCycle
+		}
+		if parent.ParentID == nil {
+			break
+		}
+		parent = v.terms[*parent.ParentID]
+	}
+	return nil
+}
+
+func saveTermSynonyms(tx *gorm.DB, term *models.Term) error {
+	for i := range term.Synonyms {
+		term.Synonyms[i].TermID = term.ID
+	}
+	if len(term.Synonyms) == 0 {
+		return nil
+	}
+	return tx.Create(&term.Synonyms).Error
+}
+
+func loadTerm(tx *gorm.DB, name string, id string, term *models.Term) error {
+	err := tx.Preload("Synonyms").Where("id = ? AND vocabulary = ?", id, name).First(term).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errTermNotFound
+	}
+	return err
+}
+
+func vocabularyParam(c *fiber.Ctx) (string, error) {
+	name := c.Params("vocabulary")
+	if _, ok := vocabularyTables[name]; !ok {
+		return "", errUnknownVocabulary
+	}
+	return name, nil
+}
+
+func containsID(ids []uint, id uint) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func vocabularyError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errUnknownVocabulary):
+		rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "Vocabulary not found."}
+		return c.Status(fiber.StatusNotFound).JSON(rp)
+	case errors.Is(err, errTermNotFound):
+		rp := models.ResponsePacket{Error: true, Code: "not_found", Message: "Term not found."}
+		return c.Status(fiber.StatusNotFound).JSON(rp)
+	case errors.Is(err, errTermSlugTaken):
+		rp := models.ResponsePacket{Error: true, Code: "term_taken", Message: "That name or synonym is already used in the vocabulary."}
+		return c.Status(fiber.StatusConflict).JSON(rp)
+	case errors.Is(err, errTermCycle):
+		rp := models.ResponsePacket{Error: true, Code: "invalid_parent", Message: "A term cannot be placed under itself or a narrower term."}
+		return c.Status(fiber.StatusNotAcceptable).JSON(rp)
+	}
+	rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Internal server error."}
+	return c.Status(fiber.StatusInternalServerError).JSON(rp)
+}
@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestMergeTermsRecordsRevisions(t *testing.T) {
+	useTestDB(t)
+	admin := createTestUser(t, "admin@example.org", 1)
+	author := createTestUser(t, "author@example.org", 9)
+	device := createTestDevice(t, "Switch mount", author, models.StageDraft)
+
+	grip := models.Term{Vocabulary: models.VocabularyCapability, Slug: "grip", Name: "Grip"}
+	grasp := models.Term{Vocabulary: models.VocabularyCapability, Slug: "grasp", Name: "Grasp"}
+	database.DB.Create(&grip)
+	database.DB.Create(&grasp)
+	database.DB.Create(&models.DeviceCapability{Name: "Grasp", DeviceID: device.ID, TermID: &grasp.ID})
+
+	app := fiber.New()
+	app.Post("/admin/vocabulary/:vocabulary/terms/:id/merge", signedInAs(admin), MergeTerms)
+	app.Patch("/devices/:id", signedInAs(author), UpdateDevice)
+
+	body := `{"sourceIDs":[` + uintString(grasp.ID) + `]}`
+	if status := sendRequest(t, app, fiber.MethodPost, "/admin/vocabulary/capability/terms/"+uintString(grip.ID)+"/merge", body, nil); status != fiber.StatusOK {
+		t.Fatalf("merge: status = %d", status)
+	}
+
+	var revisions []models.DeviceRevision
+	database.DB.Where("device_id = ?", device.ID).Order("number").Find(&revisions)
+	if len(revisions) != 2 {
+		t.Fatalf("revisions = %+v, want a baseline and the merge", revisions)
+	}
+	if revisions[0].ActorID != author.ID || revisions[0].Reason != baselineRevisionReason || revisions[0].Snapshot.Capabilities[0].Name != "Grasp" {
+		t.Errorf("baseline = %+v", revisions[0])
+	}
+	if revisions[1].ActorID != admin.ID || !strings.Contains(revisions[1].Reason, "merged") || revisions[1].Snapshot.Capabilities[0].Name != "Grip" {
+		t.Errorf("merge revision = %+v", revisions[1])
+	}
+
+	// The author's next edit follows on from the merge instead of recording it as their own.
+	if status := sendRequest(t, app, fiber.MethodPatch, "/devices/"+uintString(device.ID), `{"Difficulty":"hard"}`, nil); status != fiber.StatusOK {
+		t.Fatalf("update: status = %d", status)
+	}
+	revisions = nil
+	database.DB.Where("device_id = ?", device.ID).Order("number").Find(&revisions)
+	if len(revisions) != 3 || revisions[2].ActorID != author.ID || revisions[2].Reason == baselineRevisionReason || revisions[2].Snapshot.Difficulty != "hard" {
+		t.Errorf("revisions after the edit = %+v", revisions)
+	}
+}
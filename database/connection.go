@@ -28,12 +28,54 @@ func Connect() {
 	DB = db_conn
 
 	// Generate tables using the model if they don't exist.
-	db_conn.AutoMigrate(
+	Migrate(db_conn)
+
+	// Reviews used to be unique per device, which allowed one review in total. Uniqueness is now per user and device.
+	if db_conn.Migrator().HasIndex(&models.Review{}, "device_id") {
+		if err := db_conn.Migrator().DropIndex(&models.Review{}, "device_id"); err != nil {
+			panic("Could not drop the old unique index on reviews")
+		}
+	}
+}
+
+// Migrate creates or updates the tables for every model.
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(
 		&models.User{},
 		&models.UserVerification{},
 
 		&models.UserDetails{},
 		&models.UserAddress{},
 		&models.UserProfilePicture{},
+		&models.KnownDevice{},
+		&models.PasswordReset{},
+		&models.ImpersonationSession{},
+		&models.Invite{},
+		&models.Setting{},
+		&models.SAMLRequest{},
+		&models.SAMLAssertion{},
+		&models.SCIMToken{},
+		&models.DeviceAuthorization{},
+		&models.Appeal{},
+		&models.Term{},
+		&models.TermSynonym{},
+
+		&models.Device{},
+		&models.DeviceCapability{},
+		&models.DeviceDisability{},
+		&models.DeviceUsage{},
+		&models.DeviceFile{},
+		&models.DeviceImage{},
+		&models.DeviceStageHistory{},
+		&models.DeviceRevision{},
+		&models.Review{},
+		&models.ReviewVote{},
+		&models.Comment{},
+		&models.CommentMention{},
+		&models.Report{},
+		&models.ModerationCase{},
+		&models.ModerationAction{},
+
+		&models.AuditEntry{},
 	)
 }
@@ -0,0 +1,52 @@
+// Package geoip turns IP addresses into rough, human readable locations.
+package geoip
+
+import (
+	"net"
+	"strings"
+)
+
+type Location struct {
+	City    string `json:"city,omitempty"`
+	Region  string `json:"region,omitempty"`
+	Country string `json:"country,omitempty"`
+}
+
+// String joins the known parts of the location, e.g. "Toronto, ON, CA".
+func (l Location) String() string {
+	var parts []string
+	for _, p := range []string{l.City, l.Region, l.Country} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// A Locator resolves an IP address to a location.
+type Locator interface {
+	Lookup(ip net.IP) (Location, error)
+}
+
+// NoopLocator never knows where anything is. Used when no GeoIP database is configured.
+type NoopLocator struct{}
+
+func (NoopLocator) Lookup(ip net.IP) (Location, error) {
+	return Location{}, nil
+}
+
+// Default is the locator used by Lookup. Swap it out at startup.
+var Default Locator = NoopLocator{}
+
+// Lookup resolves the address with the Default locator. Unparseable addresses and lookup errors give an empty location.
+func Lookup(address string) Location {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return Location{}
+	}
+	loc, err := Default.Lookup(ip)
+	if err != nil {
+		return Location{}
+	}
+	return loc
+}
@@ -0,0 +1,53 @@
+package geoip
+
+import (
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// MaxMindLocator reads an offline MaxMind format database (GeoLite2/GeoIP2 City or Country, or compatible).
+type MaxMindLocator struct {
+	reader *maxminddb.Reader
+}
+
+type maxMindRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Subdivisions []struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// OpenMaxMind opens the .mmdb file at path.
+func OpenMaxMind(path string) (*MaxMindLocator, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &MaxMindLocator{reader: reader}, nil
+}
+
+func (m *MaxMindLocator) Lookup(ip net.IP) (Location, error) {
+	var record maxMindRecord
+	if err := m.reader.Lookup(ip, &record); err != nil {
+		return Location{}, err
+	}
+
+	loc := Location{
+		City:    record.City.Names["en"],
+		Country: record.Country.IsoCode,
+	}
+	if len(record.Subdivisions) > 0 {
+		loc.Region = record.Subdivisions[0].IsoCode
+	}
+	return loc, nil
+}
+
+func (m *MaxMindLocator) Close() error {
+	return m.reader.Close()
+}
@@ -3,20 +3,37 @@ module github.com/Elimists/go-app
 go 1.18
 
 require (
+	github.com/beevik/etree v1.1.0
+	github.com/crewjam/saml v0.4.13
+	github.com/go-asn1-ber/asn1-ber v1.5.4
+	github.com/go-ldap/ldap/v3 v3.4.4
 	github.com/gofiber/fiber/v2 v2.42.0
+	github.com/gofiber/jwt/v3 v3.3.6
+	github.com/joho/godotenv v1.5.1
+	github.com/microcosm-cc/bluemonday v1.0.21
+	github.com/oschwald/maxminddb-golang v1.10.0
+	github.com/russellhaering/goxmldsig v1.2.0
+	github.com/yuin/goldmark v1.5.4
 	golang.org/x/crypto v0.4.0
+	golang.org/x/image v0.5.0
 	gorm.io/driver/mysql v1.4.4
+	gorm.io/driver/sqlite v1.4.4
 	gorm.io/gorm v1.24.2
 )
 
 require (
+	github.com/Azure/go-ntlmssp v0.0.0-20220621081337-cb9428e4ac1e // indirect
+	github.com/aymerick/douceur v0.2.0 // indirect
 	github.com/eapache/queue v1.1.0 // indirect
-	github.com/gofiber/jwt/v3 v3.3.6 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
+	github.com/gorilla/css v1.0.0 // indirect
+	github.com/jonboulle/clockwork v0.2.2 // indirect
+	github.com/mattermost/xml-roundtrip-validator v0.1.0 // indirect
+	github.com/mattn/go-sqlite3 v1.14.15 // indirect
 	github.com/philhofer/fwd v1.1.2 // indirect
 	github.com/savsgio/dictpool v0.0.0-20221023140959-7bf2e61cea94 // indirect
 	github.com/savsgio/gotils v0.0.0-20230208104028-c358bd845dee // indirect
 	github.com/tinylib/msgp v1.1.8 // indirect
+	golang.org/x/net v0.3.0 // indirect
 )
 
 require (
@@ -24,7 +41,7 @@ require (
 	github.com/eapache/channels v1.1.0
 	github.com/go-sql-driver/mysql v1.7.0 // indirect
 	github.com/golang-jwt/jwt/v4 v4.5.0
-	github.com/google/uuid v1.3.0
+	github.com/google/uuid v1.3.0 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
 	github.com/klauspost/compress v1.16.0 // indirect
@@ -33,7 +50,7 @@ require (
 	github.com/mattn/go-runewidth v0.0.14 // indirect
 	github.com/rivo/uniseg v0.4.4 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
-	github.com/valyala/fasthttp v1.44.0 // indirect
+	github.com/valyala/fasthttp v1.44.0
 	github.com/valyala/tcplisten v1.0.0 // indirect
 	golang.org/x/sys v0.6.0 // indirect
 )
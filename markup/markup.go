@@ -0,0 +1,74 @@
+// Package markup renders user written markdown to safe HTML.
+package markup
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// MaxMentions caps how many users one piece of text can mention.
+const MaxMentions = 10
+
+var (
+	// Raw HTML in the source is dropped by goldmark. The policy is a second line of defence for anything that gets through.
+	markdown = goldmark.New(goldmark.WithExtensions(extension.Strikethrough, extension.Linkify))
+	policy   = newPolicy()
+
+	// Mentions are written <@123>, Slack style, and clients insert them from a user picker.
+	mentionPattern  = regexp.MustCompile(`<@(\d{1,10})>`)
+	markdownSpecial = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `_`, `\_`, "`", "\\`", `[`, `\[`, `]`, `\]`, `<`, `\<`, `>`, `\>`, `#`, `\#`, `~`, `\~`)
+)
+
+func newPolicy() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+	p.AllowElements("p", "br", "hr", "strong", "em", "del", "code", "pre", "blockquote", "ul", "ol", "li", "h1", "h2", "h3", "h4", "h5", "h6")
+	p.AllowAttrs("href").OnElements("a")
+	p.AllowStandardURLs()
+	p.RequireNoFollowOnLinks(true)
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+	return p
+}
+
+// Render turns markdown into sanitized HTML. Images and raw HTML are not allowed.
+func Render(source string) (string, error) {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(source), &buf); err != nil {
+		return "", err
+	}
+	return policy.Sanitize(buf.String()), nil
+}
+
+// Mentions returns the IDs of the users mentioned in the source, in order and without repeats.
+func Mentions(source string) []uint {
+	var ids []uint
+	seen := map[uint]bool{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(source, -1) {
+		id, err := strconv.ParseUint(match[1], 10, 32)
+		if err != nil || id == 0 || seen[uint(id)] {
+			continue
+		}
+		seen[uint(id)] = true
+		ids = append(ids, uint(id))
+		if len(ids) == MaxMentions {
+			break
+		}
+	}
+	return ids
+}
+
+// ReplaceMentions swaps each mention for the user's name in bold. Mentions of unknown users become plain text.
+func ReplaceMentions(source string, names map[uint]string) string {
+	return mentionPattern.ReplaceAllStringFunc(source, func(mention string) string {
+		id, _ := strconv.ParseUint(mentionPattern.FindStringSubmatch(mention)[1], 10, 32)
+		if name, ok := names[uint(id)]; ok {
+			return "**@" + markdownSpecial.Replace(name) + "**"
+		}
+		return "@unknown"
+	})
+}
@@ -0,0 +1,86 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// A JPEG with an EXIF block that holds only the given orientation.
+func exifJPEG(t *testing.T, width, height, orientation int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Big-endian TIFF header and one IFD entry: tag 0x0112 (Orientation), type SHORT, count 1.
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+	binary.BigEndian.PutUint16(tiff[18:], uint16(orientation))
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+
+	data := buf.Bytes()
+	out := append([]byte{}, data[:2]...)
+	out = append(out, 0xFF, 0xE1, 0, 0)
+	binary.BigEndian.PutUint16(out[4:], uint16(len(segment)+2))
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+func TestDecodeReadsOrientation(t *testing.T) {
+	for _, orientation := range []int{1, 3, 6, 8} {
+		_, contentType, got, err := Decode(exifJPEG(t, 40, 20, orientation))
+		if err != nil || contentType != "image/jpeg" || got != orientation {
+			t.Errorf("orientation %d: Decode() = %s, %d, %v", orientation, contentType, got, err)
+		}
+	}
+	if got := jpegOrientation([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00}); got != 1 {
+		t.Errorf("truncated EXIF = %d, want 1", got)
+	}
+}
+
+func TestDecodeRejectsOtherTypes(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"text": []byte("just some text, not a picture"),
+		"gif":  []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;"),
+		"pdf":  []byte("%PDF-1.4\n"),
+	} {
+		if _, _, _, err := Decode(data); !errors.Is(err, ErrUnsupportedType) {
+			t.Errorf("%s: Decode() = %v, want ErrUnsupportedType", name, err)
+		}
+	}
+}
+
+func TestOrientRotates(t *testing.T) {
+	img, _, orientation, err := Decode(exifJPEG(t, 40, 20, 6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 6 is a quarter turn clockwise, so width and height swap.
+	if b := Orient(img, orientation).Bounds(); b.Dx() != 20 || b.Dy() != 40 {
+		t.Errorf("oriented bounds = %v, want 20x40", b)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	opaque := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	for i := range opaque.Pix {
+		opaque.Pix[i] = 0xFF
+	}
+	if contentType, ext := Format(opaque); contentType != "image/jpeg" || ext != "jpg" {
+		t.Errorf("opaque = %s %s, want JPEG", contentType, ext)
+	}
+	if contentType, ext := Format(image.NewNRGBA(image.Rect(0, 0, 2, 2))); contentType != "image/png" || ext != "png" {
+		t.Errorf("transparent = %s %s, want PNG", contentType, ext)
+	}
+}
@@ -3,15 +3,49 @@ package middleware
 import (
 	"os"
 
+	"github.com/Elimists/go-app/models"
 	"github.com/gofiber/fiber/v2"
 	jwtware "github.com/gofiber/jwt/v3"
+	"github.com/golang-jwt/jwt/v4"
 )
 
 func Protected() func(*fiber.Ctx) error {
-	return jwtware.New(jwtware.Config{
+	return jwtware.New(protectedConfig())
+}
+
+// OptionalProtected checks the JWT when an Authorization header is sent and lets anonymous requests through.
+func OptionalProtected() func(*fiber.Ctx) error {
+	config := protectedConfig()
+	config.Filter = func(c *fiber.Ctx) bool {
+		return c.Get(fiber.HeaderAuthorization) == ""
+	}
+	return jwtware.New(config)
+}
+
+func protectedConfig() jwtware.Config {
+	return jwtware.Config{
 		SigningKey:   []byte(os.Getenv("SECRET_KEY")),
 		ErrorHandler: jwtError,
-	})
+		SuccessHandler: func(c *fiber.Ctx) error {
+			claims := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+			if !sessionIsValid(claims) {
+				c.Status(fiber.StatusUnauthorized)
+				return c.JSON(fiber.Map{"status": "error", "message": "Session has been revoked", "data": nil})
+			}
+			if status := accountStatus(claims); status != models.AccountActive {
+				c.Status(fiber.StatusForbidden)
+				return c.JSON(fiber.Map{"status": "error", "message": "Account is " + status, "data": nil})
+			}
+			if IsImpersonation(claims) && !impersonationIsActive(claims) {
+				c.Status(fiber.StatusUnauthorized)
+				return c.JSON(fiber.Map{"status": "error", "message": "Impersonation session has ended", "data": nil})
+			}
+			if IsImpersonation(claims) {
+				recordImpersonatedRequest(c, claims)
+			}
+			return c.Next()
+		},
+	}
 }
 
 func jwtError(c *fiber.Ctx, err error) error {
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// A token issued before a suspension keeps its signature, so Protected has to look the status up on every request.
+func TestProtectedRefusesSuspendedAccount(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-secret")
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ := db.DB()
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.AutoMigrate(&models.User{}); err != nil {
+		t.Fatal(err)
+	}
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() { database.DB = previous })
+
+	user := models.User{CustomModel: models.CustomModel{ID: 7}, Email: "member@example.org", Privilege: 9, Verified: true}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"id": float64(user.ID), "email": user.Email, "privilege": float64(9),
+		"iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("test-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Get("/me", Protected(), func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusOK) })
+	get := func() int {
+		req := httptest.NewRequest(fiber.MethodGet, "/me", nil)
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+signed)
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode
+	}
+
+	if status := get(); status != fiber.StatusOK {
+		t.Fatalf("active account = %d", status)
+	}
+	until := time.Now().Add(24 * time.Hour)
+	db.Model(&user).Updates(map[string]interface{}{"status": models.AccountSuspended, "suspended_until": until})
+	InvalidateSession(user.ID)
+	if status := get(); status != fiber.StatusForbidden {
+		t.Errorf("suspended account = %d, want 403", status)
+	}
+
+	// Suspensions lapse on their own.
+	db.Model(&user).Update("suspended_until", time.Now().Add(-time.Minute))
+	InvalidateSession(user.ID)
+	if status := get(); status != fiber.StatusOK {
+		t.Errorf("lapsed suspension = %d, want 200", status)
+	}
+}
@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"io"
+
+	"github.com/Elimists/go-app/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Caps request bodies at limit bytes when the app streams request bodies.
+//
+// With fiber.Config.StreamRequestBody set, bodies over the app's BodyLimit and chunked bodies reach handlers as a
+// stream instead of being refused. This buffers them back into memory up to limit, so handlers that call c.Body() or
+// c.BodyParser() stay bounded. Routes for which stream returns true get the stream untouched. stream may be nil when
+// the middleware is added to a single route.
+func BodyLimit(limit int, stream func(c *fiber.Ctx) bool) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		body := c.Context().RequestBodyStream()
+		if body == nil || (stream != nil && stream(c)) {
+			return c.Next()
+		}
+		if c.Request().Header.ContentLength() > limit {
+			rp := models.ResponsePacket{Error: true, Code: "body_too_large", Message: "Request body is too large."}
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(rp)
+		}
+
+		buffered, err := io.ReadAll(io.LimitReader(body, int64(limit)+1))
+		if err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		if len(buffered) > limit {
+			rp := models.ResponsePacket{Error: true, Code: "body_too_large", Message: "Request body is too large."}
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(rp)
+		}
+		c.Request().SetBody(buffered)
+		return c.Next()
+	}
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Elimists/go-app/challenge"
+	"github.com/Elimists/go-app/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Requires a solved challenge once an IP has failed too often.
+//
+// Takes the number of failed requests (status >= 400) an IP may make inside the tracker window before it has to send
+// a solved challenge in the X-{API_NAME}-Challenge header. Use 0 to always require one.
+func Challenge(allowedFailures int) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		ip := c.IP()
+
+		if challenge.DefaultTracker.Failures(ip) >= allowedFailures {
+			response := c.Get(fmt.Sprintf("X-%s-Challenge", os.Getenv("API_NAME")))
+			if err := challenge.Default.Verify(c.UserContext(), response, ip); err != nil {
+				issued, issueErr := challenge.Default.Issue()
+				if issueErr != nil {
+					rp := models.ResponsePacket{Error: true, Code: "internal_error", Message: "Could not issue challenge."}
+					return c.Status(fiber.StatusInternalServerError).JSON(rp)
+				}
+
+				code, status := "challenge_failed", fiber.StatusForbidden
+				if response == "" {
+					code, status = "challenge_required", fiber.StatusPreconditionRequired
+				}
+				return c.Status(status).JSON(fiber.Map{"error": true, "code": code, "message": "Please complete the challenge and try again.", "challenge": issued})
+			}
+		}
+
+		err := c.Next()
+
+		if err != nil || c.Response().StatusCode() >= fiber.StatusBadRequest {
+			challenge.DefaultTracker.RecordFailure(ip)
+		}
+
+		return err
+	}
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"math/bits"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Elimists/go-app/challenge"
+	"github.com/gofiber/fiber/v2"
+)
+
+func solveChallenge(token string, difficulty int) string {
+	for counter := 0; ; counter++ {
+		response := token + ":" + strconv.Itoa(counter)
+		sum := sha256.Sum256([]byte(response))
+		zeros := 0
+		for _, b := range sum {
+			zeros += bits.LeadingZeros8(b)
+			if b != 0 {
+				break
+			}
+		}
+		if zeros >= difficulty {
+			return response
+		}
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	t.Setenv("API_NAME", "Test")
+	previous, previousTracker := challenge.Default, challenge.DefaultTracker
+	challenge.Default = challenge.NewHashcash([]byte("secret"), 8, time.Minute)
+	challenge.DefaultTracker = challenge.NewRiskTracker(time.Minute)
+	t.Cleanup(func() { challenge.Default, challenge.DefaultTracker = previous, previousTracker })
+
+	app := fiber.New()
+	app.Post("/signin", Challenge(2), func(c *fiber.Ctx) error {
+		if c.Query("ok") == "" {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	send := func(target string, response string) *fiber.Map {
+		t.Helper()
+		req := httptest.NewRequest(fiber.MethodPost, target, nil)
+		if response != "" {
+			req.Header.Set("X-Test-Challenge", response)
+		}
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := fiber.Map{"status": res.StatusCode}
+		json.NewDecoder(res.Body).Decode(&body)
+		return &body
+	}
+
+	// The first two failures are free.
+	for i := 0; i < 2; i++ {
+		if got := (*send("/signin", ""))["status"]; got != fiber.StatusUnauthorized {
+			t.Fatalf("failure %d: status = %v, want 401", i+1, got)
+		}
+	}
+
+	required := *send("/signin?ok=1", "")
+	if required["status"] != fiber.StatusPreconditionRequired || required["code"] != "challenge_required" {
+		t.Fatalf("without challenge: %v", required)
+	}
+	issued := required["challenge"].(map[string]interface{})
+	token := issued["token"].(string)
+
+	if got := *send("/signin?ok=1", token+":0x"); got["status"] != fiber.StatusForbidden || got["code"] != "challenge_failed" {
+		t.Errorf("wrong answer: %v", got)
+	}
+
+	solved := solveChallenge(token, int(issued["difficulty"].(float64)))
+	if got := (*send("/signin?ok=1", solved))["status"]; got != fiber.StatusOK {
+		t.Errorf("solved challenge: status = %v, want 200", got)
+	}
+	if got := *send("/signin?ok=1", solved); got["code"] != "challenge_failed" {
+		t.Errorf("replayed challenge: %v", got)
+	}
+}
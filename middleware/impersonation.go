@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Elimists/go-app/audit"
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var (
+	impersonationMu    sync.Mutex
+	impersonationCache = map[uint]sessionEntry{} // validAfter holds the session expiry, 0 once ended.
+)
+
+// Reports whether the claims belong to an impersonation token (RFC 8693 "act" claim).
+func IsImpersonation(claims jwt.MapClaims) bool {
+	_, ok := claims["act"].(map[string]interface{})
+	return ok
+}
+
+// Reports whether the impersonation session behind the token is still running.
+func impersonationIsActive(claims jwt.MapClaims) bool {
+	id, err := strconv.ParseUint(claimString(claims, "jti"), 10, 64)
+	if err != nil {
+		return false
+	}
+	sessionID := uint(id)
+
+	impersonationMu.Lock()
+	entry, found := impersonationCache[sessionID]
+	impersonationMu.Unlock()
+
+	if !found || time.Since(entry.fetchedAt) > sessionCacheTTL {
+		var session models.ImpersonationSession
+		if err := database.DB.Where("id = ?", sessionID).First(&session).Error; err != nil {
+			return false
+		}
+		entry = sessionEntry{fetchedAt: time.Now()}
+		if session.EndedAt == nil {
+			entry.validAfter = session.ExpiresAt.Unix()
+		}
+
+		impersonationMu.Lock()
+		impersonationCache[sessionID] = entry
+		impersonationMu.Unlock()
+	}
+
+	return time.Now().Unix() < entry.validAfter
+}
+
+// Every request made while impersonating goes in the audit log.
+func recordImpersonatedRequest(c *fiber.Ctx, claims jwt.MapClaims) {
+	act := claims["act"].(map[string]interface{})
+	actorID, _ := strconv.ParseUint(fmt.Sprint(act["sub"]), 10, 64)
+	actorEmail, _ := act["email"].(string)
+	targetID, _ := claims["id"].(float64)
+
+	audit.Record(audit.Event{
+		Type:        audit.ImpersonatedRequest,
+		ActorID:     uint(actorID),
+		ActorEmail:  actorEmail,
+		TargetID:    uint(targetID),
+		TargetEmail: claimString(claims, "email"),
+		IP:          c.IP(),
+		UserAgent:   c.Get(fiber.HeaderUserAgent),
+		Details: map[string]string{
+			"method":                 c.Method(),
+			"path":                   c.Path(),
+			"impersonationSessionID": claimString(claims, "jti"),
+		},
+	})
+}
+
+// Drops the cached state of an impersonation session. Call after ending it.
+func InvalidateImpersonation(sessionID uint) {
+	impersonationMu.Lock()
+	delete(impersonationCache, sessionID)
+	impersonationMu.Unlock()
+}
+
+// Blocks impersonation tokens from a route.
+//
+// Use on anything that changes credentials: password, email and MFA settings.
+func DenyImpersonation() func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		if token, ok := c.Locals("user").(*jwt.Token); ok && IsImpersonation(token.Claims.(jwt.MapClaims)) {
+			rp := models.ResponsePacket{Error: true, Code: "impersonation_forbidden", Message: "This action is not allowed while impersonating a user."}
+			return c.Status(fiber.StatusForbidden).JSON(rp)
+		}
+		return c.Next()
+	}
+}
+
+func claimString(claims jwt.MapClaims, key string) string {
+	s, _ := claims[key].(string)
+	return s
+}
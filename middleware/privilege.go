@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"github.com/Elimists/go-app/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Only lets users with the given privilege level or higher through.
+//
+// Lower numbers carry more privilege (1: Admin ... 9: General user). Must be used after Protected().
+func RequirePrivilege(level int8) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		token, ok := c.Locals("user").(*jwt.Token)
+		if !ok {
+			rp := models.ResponsePacket{Error: true, Code: "unauthorized", Message: "Missing or malformed JWT"}
+			return c.Status(fiber.StatusUnauthorized).JSON(rp)
+		}
+
+		claims := token.Claims.(jwt.MapClaims)
+		privilege, ok := claims["privilege"].(float64)
+		if !ok || int8(privilege) > level {
+			rp := models.ResponsePacket{Error: true, Code: "forbidden", Message: "You do not have permission to do that."}
+			return c.Status(fiber.StatusForbidden).JSON(rp)
+		}
+
+		return c.Next()
+	}
+}
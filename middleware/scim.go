@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/Elimists/go-app/scim"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Only lets identity providers holding a valid SCIM bearer token through.
+//
+// SCIM tokens are opaque and stored hashed. They are never accepted as user JWTs, and user JWTs are never accepted here.
+func SCIMAuth() func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		header := c.Get(fiber.HeaderAuthorization)
+		if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+			return scimUnauthorized(c)
+		}
+
+		sum := sha256.Sum256([]byte(strings.TrimSpace(header[7:])))
+		var token models.SCIMToken
+		if err := database.DB.Where("token_hash = ? AND revoked_at IS NULL", hex.EncodeToString(sum[:])).First(&token).Error; err != nil {
+			return scimUnauthorized(c)
+		}
+
+		// Only bump the timestamp now and then so busy syncs don't write on every request.
+		if token.LastUsedAt == nil || time.Since(*token.LastUsedAt) > time.Minute {
+			database.DB.Model(&token).Update("last_used_at", time.Now())
+		}
+
+		c.Locals("scimToken", &token)
+		return c.Next()
+	}
+}
+
+func scimUnauthorized(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="scim"`)
+	body, _ := json.Marshal(scim.Error{
+		Schemas: []string{scim.ErrorSchema},
+		Status:  "401",
+		Detail:  "Missing or invalid SCIM bearer token.",
+	})
+	c.Set(fiber.HeaderContentType, scim.ContentType)
+	return c.Status(fiber.StatusUnauthorized).Send(body)
+}
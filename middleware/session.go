@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Elimists/go-app/database"
+	"github.com/Elimists/go-app/models"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const sessionCacheTTL = 30 * time.Second
+
+type sessionEntry struct {
+	validAfter int64
+	user       models.User // Only the columns that decide whether the account may be used.
+	fetchedAt  time.Time
+}
+
+var (
+	sessionMu    sync.Mutex
+	sessionCache = map[uint]sessionEntry{}
+)
+
+// Reports whether the token was issued after the user's sessions were last revoked.
+//
+// Lookups are cached for a short while so protected routes don't hit the database on every request.
+func sessionIsValid(claims jwt.MapClaims) bool {
+	entry, ok := sessionState(claims)
+	if !ok {
+		return false
+	}
+	if entry.validAfter == 0 {
+		return true
+	}
+	issuedAt, ok := claims["iat"].(float64)
+	return ok && int64(issuedAt) >= entry.validAfter
+}
+
+// Returns the account status of the token's user, or "deactivated" when the identity provider has deactivated them.
+// Shares the session cache, so a status change takes effect once InvalidateSession is called or the entry expires.
+func accountStatus(claims jwt.MapClaims) string {
+	entry, ok := sessionState(claims)
+	if !ok || entry.user.DeactivatedAt != nil {
+		return "deactivated"
+	}
+	return entry.user.AccountStatus()
+}
+
+func sessionState(claims jwt.MapClaims) (sessionEntry, bool) {
+	id, ok := claims["id"].(float64)
+	if !ok {
+		return sessionEntry{}, false
+	}
+	userID := uint(id)
+
+	sessionMu.Lock()
+	entry, found := sessionCache[userID]
+	sessionMu.Unlock()
+
+	if !found || time.Since(entry.fetchedAt) > sessionCacheTTL {
+		var user models.User
+		if err := database.DB.Select("id", "sessions_valid_after", "status", "suspended_until", "deactivated_at").Where("id = ?", userID).First(&user).Error; err != nil {
+			return sessionEntry{}, false
+		}
+		entry = sessionEntry{validAfter: user.SessionsValidAfter, user: user, fetchedAt: time.Now()}
+
+		sessionMu.Lock()
+		sessionCache[userID] = entry
+		sessionMu.Unlock()
+	}
+	return entry, true
+}
+
+// Drops the cached session state for a user. Call after revoking their sessions or changing their account status.
+func InvalidateSession(userID uint) {
+	sessionMu.Lock()
+	delete(sessionCache, userID)
+	sessionMu.Unlock()
+}
@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// Appeal outcomes.
+const (
+	AppealPending    = "pending"
+	AppealUpheld     = "upheld"     // The suspension or ban stands.
+	AppealOverturned = "overturned" // The account was made active again.
+)
+
+// Appeal asks staff to reconsider a suspension or ban. A user can have one pending appeal at a time.
+type Appeal struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	UserID        uint       `json:"userID" gorm:"index"`
+	AccountStatus string     `json:"accountStatus" gorm:"type:varchar(16)"` // The status being appealed.
+	StatusReason  string     `json:"statusReason" gorm:"type:text"`
+	Message       string     `json:"message" gorm:"type:text"`
+	Status        string     `json:"status" gorm:"type:varchar(16);index;not null"`
+	Response      string     `json:"response" gorm:"type:text"`
+	DecidedByID   *uint      `json:"decidedByID"`
+	DecidedAt     *time.Time `json:"decidedAt"`
+	CreatedAt     time.Time  `json:"createdAt"`
+}
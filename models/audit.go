@@ -0,0 +1,36 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrAuditImmutable = errors.New("audit entries are append-only")
+
+// AuditEntry is a single row of the security audit log.
+//
+// Every row carries the hash of the row before it, so removing or editing a row breaks the chain.
+type AuditEntry struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	Type        string    `json:"type" gorm:"index;type:varchar(64);not null"`
+	ActorID     uint      `json:"actorID" gorm:"index"`
+	ActorEmail  string    `json:"actorEmail" gorm:"index;type:varchar(255)"`
+	TargetID    uint      `json:"targetID" gorm:"index"`
+	TargetEmail string    `json:"targetEmail" gorm:"index;type:varchar(255)"`
+	IP          string    `json:"ip"`
+	UserAgent   string    `json:"userAgent"`
+	Details     string    `json:"details" gorm:"type:text"` // JSON encoded key/value pairs.
+	OccurredAt  time.Time `json:"occurredAt" gorm:"index;not null"`
+	PrevHash    string    `json:"prevHash" gorm:"type:char(64)"`
+	Hash        string    `json:"hash" gorm:"type:char(64);uniqueIndex;not null"`
+}
+
+func (AuditEntry) BeforeUpdate(tx *gorm.DB) error {
+	return ErrAuditImmutable
+}
+
+func (AuditEntry) BeforeDelete(tx *gorm.DB) error {
+	return ErrAuditImmutable
+}
@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// Comment is a message on a device's discussion. Replies point at their parent and every comment in a thread shares
+// the ID of the comment that started it.
+type Comment struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	DeviceID    uint       `json:"deviceID" gorm:"index;not null"`
+	ThreadID    uint       `json:"threadID" gorm:"index"` // Equal to ID for top level comments.
+	ParentID    *uint      `json:"parentID"`
+	Depth       uint8      `json:"depth"`
+	UserID      uint       `json:"userID" gorm:"index"`
+	Body        string     `json:"body" gorm:"type:text"`     // Markdown as written.
+	BodyHTML    string     `json:"bodyHTML" gorm:"type:text"` // Sanitized render of Body.
+	IsQuestion  bool       `json:"isQuestion"`
+	Answered    bool       `json:"answered" gorm:"index"`
+	AnswerID    *uint      `json:"answerID"` // The reply that answered the question, when one was picked.
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	EditedAt    *time.Time `json:"editedAt"`
+	DeletedAt   *time.Time `json:"deletedAt"` // Deleted comments stay as placeholders so their replies keep their place.
+	DeletedByID *uint      `json:"-"`
+	HiddenAt    *time.Time `json:"hiddenAt,omitempty"` // Set when a moderator hides the comment.
+	Replies     []Comment  `json:"replies,omitempty" gorm:"-"`
+	ReplyCount  int        `json:"replyCount,omitempty" gorm:"-"` // Set on threads. May be more than len(Replies).
+}
+
+// CommentMention records who a comment mentioned, so edits only notify people who were added.
+type CommentMention struct {
+	CommentID uint `gorm:"primaryKey;autoIncrement:false"`
+	UserID    uint `gorm:"primaryKey;autoIncrement:false"`
+}
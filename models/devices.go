@@ -1,6 +1,22 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Device stages. Devices move between them through the transitions in controller/devicestage.go.
+const (
+	StageDraft    = "draft"
+	StageReview   = "review"
+	StagePublic   = "public"
+	StageArchived = "archived"
+)
 
 type Device struct {
 	gorm.Model
@@ -10,13 +26,17 @@ type Device struct {
 	TimeToComplete string             `gorm:"not null"`
 	MaterialCost   string             `gorm:"not null"`
 	License        string             `gorm:"not null"`
-	Stage          string             `gorm:"not null"`
+	Stage          string             `gorm:"not null;index;default:draft"`
 	Capabilities   []DeviceCapability `gorm:"constraint:OnDelete:CASCADE;"` // If the device is deleted, delete the capabilities for this device.
 	Disabilities   []DeviceDisability `gorm:"constraint:OnDelete:CASCADE;"`
 	Usages         []DeviceUsage      `gorm:"constraint:OnDelete:CASCADE;"`
 	Images         []DeviceImage      `gorm:"constraint:OnDelete:CASCADE;"`
-	Reviews        []Review           `gorm:"constraint:OnDelete:SET NULL;"` // If the device is deleted, set the device ID for the reivew to null. The user is responsible for deleting the review.
+	Reviews        []Review           `gorm:"constraint:OnDelete:SET NULL;"`           // If the device is deleted, set the device ID for the reivew to null. The user is responsible for deleting the review.
+	RatingAverage  float64            `json:"ratingAverage" gorm:"not null;default:0"` // Kept in step with Reviews by the review controllers.
+	RatingCount    uint               `json:"ratingCount" gorm:"not null;default:0"`
 	UserPostsID    uint               `json:"userID"`
+	HiddenAt       *time.Time         `json:"hiddenAt,omitempty"`                // Set when a moderator hides the device.
+	CoverThumbnail string             `json:"coverThumbnail,omitempty" gorm:"-"` // Filled in on device lists.
 }
 
 type DeviceCapability struct {
@@ -24,6 +44,7 @@ type DeviceCapability struct {
 	Name        string `gorm:"not null"`
 	Description string
 	DeviceID    uint
+	TermID      *uint `gorm:"index"` // Set when Name matches the capability vocabulary. Name is then the term's canonical name.
 }
 
 type DeviceDisability struct {
@@ -31,6 +52,7 @@ type DeviceDisability struct {
 	Name        string `gorm:"not null"`
 	Description string
 	DeviceID    uint
+	TermID      *uint `gorm:"index"` // Set when Name matches the disability vocabulary.
 }
 
 type DeviceUsage struct {
@@ -40,18 +62,153 @@ type DeviceUsage struct {
 	DeviceID    uint // References the device in the Device table.
 }
 
+// DeviceFile is a downloadable bundle, such as a zip of build instructions and 3D models.
 type DeviceFile struct {
 	gorm.Model
-	Name             string `gorm:"not null"`
-	Description      string
-	DiscLocationName string
-	FileSize         uint
-	DeviceID         uint
+	Name             string `json:"name" gorm:"not null"` // The uploaded file name, with the extension matching its contents.
+	Description      string `json:"description"`
+	DiscLocationName string `json:"-"` // Storage key.
+	FileSize         uint   `json:"fileSize"`
+	ContentType      string `json:"contentType" gorm:"type:varchar(64)"`
+	Checksum         string `json:"sha256" gorm:"type:char(64);index"`
+	DownloadCount    uint   `json:"downloadCount" gorm:"not null;default:0"`
+	UploadedByID     uint   `json:"uploadedByID"`
+	DeviceID         uint   `json:"deviceID" gorm:"index"`
+	// Files stay in quarantine until the malware scanner passes them.
+	ScanStatus    string     `json:"scanStatus" gorm:"type:varchar(16);not null;default:pending;index"`
+	ScanSignature string     `json:"scanSignature,omitempty"`
+	ScannedAt     *time.Time `json:"scannedAt"`
 }
 
+const (
+	ScanPending  = "pending"
+	ScanClean    = "clean"
+	ScanInfected = "infected"
+	ScanFailed   = "failed" // The scanner could not read the file, e.g. it was too large.
+)
+
+// DeviceImage is one picture in a device's gallery, shown in Position order.
 type DeviceImage struct {
 	gorm.Model
-	Title       string `gorm:"not null"`
-	Description string
-	DeviceID    uint
+	Title       string            `json:"title"` // Caption shown with the image.
+	Description string            `json:"description"`
+	AltText     string            `json:"altText" gorm:"not null"`
+	Position    int               `json:"position" gorm:"not null;default:0"`
+	IsCover     bool              `json:"isCover" gorm:"not null;default:false"` // One image per device is its cover.
+	Hash        string            `json:"-" gorm:"type:char(64)"`                // SHA-256 of the upload. The sizes live in storage under devices/<DeviceID>/images/<Hash>/.
+	Extension   string            `json:"-" gorm:"type:varchar(8)"`
+	Width       int               `json:"width"` // Of the largest size.
+	Height      int               `json:"height"`
+	DeviceID    uint              `json:"deviceID" gorm:"index"`
+	URLs        map[string]string `json:"urls" gorm:"-"` // Keyed by the longest side in pixels.
+}
+
+// DeviceStageHistory records every stage change, who made it and why.
+type DeviceStageHistory struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	DeviceID  uint      `json:"deviceID" gorm:"index"`
+	FromStage string    `json:"fromStage"`
+	ToStage   string    `json:"toStage"`
+	ActorID   uint      `json:"actorID"`
+	Comment   string    `json:"comment" gorm:"type:text"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+var ErrRevisionImmutable = errors.New("device revisions cannot be changed")
+
+// DeviceRevision is an immutable snapshot of a device as it was saved.
+type DeviceRevision struct {
+	ID           uint           `json:"id" gorm:"primaryKey"`
+	DeviceID     uint           `json:"deviceID" gorm:"uniqueIndex:idx_device_revision"`
+	Number       uint           `json:"number" gorm:"uniqueIndex:idx_device_revision"` // Counts up from 1 per device.
+	ActorID      uint           `json:"actorID"`
+	Reason       string         `json:"reason"`
+	RestoredFrom *uint          `json:"restoredFrom,omitempty"` // Set when the revision was made by rolling back to an earlier one.
+	Snapshot     DeviceSnapshot `json:"snapshot" gorm:"type:text"`
+	CreatedAt    time.Time      `json:"createdAt"`
+}
+
+func (DeviceRevision) BeforeUpdate(tx *gorm.DB) error {
+	return ErrRevisionImmutable
+}
+
+func (DeviceRevision) BeforeDelete(tx *gorm.DB) error {
+	return ErrRevisionImmutable
+}
+
+// DeviceSnapshot holds the editable content of a device. The stage is left out because it has its own history.
+type DeviceSnapshot struct {
+	Name           string         `json:"name"`
+	Difficulty     string         `json:"difficulty"`
+	TimeToComplete string         `json:"timeToComplete"`
+	MaterialCost   string         `json:"materialCost"`
+	License        string         `json:"license"`
+	Capabilities   []SnapshotItem `json:"capabilities"`
+	Disabilities   []SnapshotItem `json:"disabilities"`
+	Usages         []SnapshotItem `json:"usages"`
+}
+
+type SnapshotItem struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+func NewDeviceSnapshot(device *Device) DeviceSnapshot {
+	snapshot := DeviceSnapshot{
+		Name:           device.Name,
+		Difficulty:     device.Difficulty,
+		TimeToComplete: device.TimeToComplete,
+		MaterialCost:   device.MaterialCost,
+		License:        device.License,
+		Capabilities:   []SnapshotItem{},
+		Disabilities:   []SnapshotItem{},
+		Usages:         []SnapshotItem{},
+	}
+	for _, capability := range device.Capabilities {
+		snapshot.Capabilities = append(snapshot.Capabilities, SnapshotItem{capability.Name, capability.Description})
+	}
+	for _, disability := range device.Disabilities {
+		snapshot.Disabilities = append(snapshot.Disabilities, SnapshotItem{disability.Name, disability.Description})
+	}
+	for _, usage := range device.Usages {
+		snapshot.Usages = append(snapshot.Usages, SnapshotItem{usage.Name, usage.Description})
+	}
+	return snapshot
+}
+
+// Apply copies the snapshot's content onto a device, replacing its child lists.
+func (s DeviceSnapshot) Apply(device *Device) {
+	device.Name = s.Name
+	device.Difficulty = s.Difficulty
+	device.TimeToComplete = s.TimeToComplete
+	device.MaterialCost = s.MaterialCost
+	device.License = s.License
+	device.Capabilities = []DeviceCapability{}
+	for _, item := range s.Capabilities {
+		device.Capabilities = append(device.Capabilities, DeviceCapability{Name: item.Name, Description: item.Description})
+	}
+	device.Disabilities = []DeviceDisability{}
+	for _, item := range s.Disabilities {
+		device.Disabilities = append(device.Disabilities, DeviceDisability{Name: item.Name, Description: item.Description})
+	}
+	device.Usages = []DeviceUsage{}
+	for _, item := range s.Usages {
+		device.Usages = append(device.Usages, DeviceUsage{Name: item.Name, Description: item.Description})
+	}
+}
+
+// Stored as JSON.
+func (s DeviceSnapshot) Value() (driver.Value, error) {
+	data, err := json.Marshal(s)
+	return string(data), err
+}
+
+func (s *DeviceSnapshot) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		return json.Unmarshal(v, s)
+	case string:
+		return json.Unmarshal([]byte(v), s)
+	}
+	return fmt.Errorf("cannot scan %T into DeviceSnapshot", value)
 }
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// Invite lets people register while registration is restricted, optionally with a preassigned privilege.
+type Invite struct {
+	CustomModel
+	CodeHash    string     `json:"-" gorm:"uniqueIndex;type:char(64);not null"` // SHA-256 of the invite code. The code itself is only shown once.
+	CodeHint    string     `json:"codeHint"`                                    // First few characters of the code so admins can tell invites apart.
+	Note        string     `json:"note"`
+	Privilege   int8       `json:"privilege"`
+	MaxUses     uint       `json:"maxUses"`
+	Uses        uint       `json:"uses"`
+	ExpiresAt   time.Time  `json:"expiresAt"`
+	RevokedAt   *time.Time `json:"revokedAt"`
+	CreatedByID uint       `json:"createdByID"`
+}
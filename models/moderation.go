@@ -0,0 +1,90 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Things that can be reported and moderated.
+const (
+	TargetDevice  = "device"
+	TargetReview  = "review"
+	TargetComment = "comment"
+	TargetUser    = "user"
+)
+
+// Moderation case states.
+const (
+	CaseOpen      = "open"
+	CaseClaimed   = "claimed"
+	CaseResolved  = "resolved"
+	CaseDismissed = "dismissed"
+)
+
+// Moderator actions, as stored in ModerationAction.Action.
+const (
+	ActionClaim    = "claim"
+	ActionResolve  = "resolve"
+	ActionDismiss  = "dismiss"
+	ActionHide     = "hide"
+	ActionUnhide   = "unhide"
+	ActionAutoHide = "auto_hide"
+	ActionWarn     = "warn"
+	ActionSuspend  = "suspend"
+)
+
+var ErrModerationActionImmutable = errors.New("moderation actions are append-only")
+
+// Report is one user's complaint about a piece of content or a profile. Each user can report a target once.
+type Report struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	TargetType string    `json:"targetType" gorm:"type:varchar(16);uniqueIndex:idx_report_target_reporter"`
+	TargetID   uint      `json:"targetID" gorm:"uniqueIndex:idx_report_target_reporter"`
+	ReporterID uint      `json:"reporterID" gorm:"uniqueIndex:idx_report_target_reporter"`
+	ReasonCode string    `json:"reasonCode" gorm:"type:varchar(32)"`
+	Details    string    `json:"details" gorm:"type:text"`
+	CaseID     uint      `json:"caseID" gorm:"index"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// ModerationCase groups the reports about one target until a moderator resolves or dismisses it.
+type ModerationCase struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	TargetType  string     `json:"targetType" gorm:"type:varchar(16);index:idx_case_target"`
+	TargetID    uint       `json:"targetID" gorm:"index:idx_case_target"`
+	OpenTarget  *string    `json:"-" gorm:"type:varchar(32);uniqueIndex"` // "type:id" while the case is open or claimed, so a target has one open case at a time.
+	Status      string     `json:"status" gorm:"type:varchar(16);index;not null"`
+	ReportCount uint       `json:"reportCount" gorm:"not null;default:0"`
+	AutoHidden  bool       `json:"autoHidden"` // The target was hidden because it crossed the report threshold.
+	ClaimedByID *uint      `json:"claimedByID"`
+	ClaimedAt   *time.Time `json:"claimedAt"`
+	ClosedByID  *uint      `json:"closedByID"`
+	ClosedAt    *time.Time `json:"closedAt"`
+	Resolution  string     `json:"resolution" gorm:"type:text"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	Reports     []Report   `json:"reports,omitempty" gorm:"foreignKey:CaseID"`
+}
+
+// ModerationAction is an append-only log of everything moderators, and the auto-hide rule, have done.
+type ModerationAction struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	CaseID      *uint     `json:"caseID" gorm:"index"`
+	ModeratorID uint      `json:"moderatorID" gorm:"index"` // Zero for automatic actions.
+	Action      string    `json:"action" gorm:"type:varchar(16)"`
+	TargetType  string    `json:"targetType" gorm:"type:varchar(16);index:idx_action_target"`
+	TargetID    uint      `json:"targetID" gorm:"index:idx_action_target"`
+	UserID      uint      `json:"userID" gorm:"index"` // The user who owns the target.
+	Note        string    `json:"note" gorm:"type:text"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+func (ModerationAction) BeforeUpdate(tx *gorm.DB) error {
+	return ErrModerationActionImmutable
+}
+
+func (ModerationAction) BeforeDelete(tx *gorm.DB) error {
+	return ErrModerationActionImmutable
+}
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// DeviceAuthorization is a pending RFC 8628 device authorization grant.
+type DeviceAuthorization struct {
+	CustomModel
+	DeviceCodeHash string     `json:"-" gorm:"uniqueIndex;type:char(64);not null"` // SHA-256 of the device code the client polls with.
+	UserCode       string     `json:"userCode" gorm:"uniqueIndex;type:varchar(16);not null"`
+	ClientID       string     `json:"clientID"`
+	Scope          string     `json:"scope"`
+	Interval       int        `json:"interval"` // Seconds the client must wait between polls. Grows on slow_down.
+	ExpiresAt      time.Time  `json:"expiresAt"`
+	LastPolledAt   *time.Time `json:"-"`
+	UserID         *uint      `json:"-"` // The user who approved or denied the request.
+	ApprovedAt     *time.Time `json:"approvedAt"`
+	DeniedAt       *time.Time `json:"deniedAt"`
+	ConsumedAt     *time.Time `json:"-"` // Set once a token has been issued, so the device code only works once.
+}
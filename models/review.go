@@ -1,12 +1,28 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"time"
 
+	"gorm.io/gorm"
+)
+
+// Review is one user's rating of a device. Each user can review a device once.
 type Review struct {
 	gorm.Model
-	Title         string `json:"title"`
-	Review        string `json:"review"`
-	Rating        uint8  `json:"rating"`
-	UserDetailsID uint   `json:"userID"`
-	DeviceID      uint   `json:"deviceID" gorm:"unique"`
+	Title         string     `json:"title"`
+	Review        string     `json:"review" gorm:"type:text"`
+	Rating        uint8      `json:"rating" gorm:"not null"`
+	UserDetailsID uint       `json:"userID" gorm:"uniqueIndex:idx_review_author_device"`
+	DeviceID      uint       `json:"deviceID" gorm:"uniqueIndex:idx_review_author_device;index"`
+	HelpfulCount  uint       `json:"helpfulCount" gorm:"not null;default:0"`
+	EditedAt      *time.Time `json:"editedAt"`
+	HiddenAt      *time.Time `json:"hiddenAt,omitempty"` // Set when a moderator hides the review.
+}
+
+// ReviewVote marks a review as helpful. One per user per review.
+type ReviewVote struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	ReviewID  uint      `json:"reviewID" gorm:"uniqueIndex:idx_review_vote"`
+	UserID    uint      `json:"userID" gorm:"uniqueIndex:idx_review_vote"`
+	CreatedAt time.Time `json:"createdAt"`
 }
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// SAMLRequest is an AuthnRequest we sent and are waiting to hear back about.
+type SAMLRequest struct {
+	ID         string    `gorm:"primaryKey;type:varchar(128)"` // The AuthnRequest ID, echoed back in InResponseTo.
+	RelayState string    `gorm:"uniqueIndex;type:char(64)"`
+	RedirectTo string    // Where to send the browser once the user is signed in.
+	ExpiresAt  time.Time `gorm:"index"`
+}
+
+// SAMLAssertion remembers assertions we have already accepted so they cannot be replayed.
+type SAMLAssertion struct {
+	ID        string    `gorm:"primaryKey;type:varchar(255)"`
+	ExpiresAt time.Time `gorm:"index"`
+}
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// SCIMToken lets an identity provider call the SCIM provisioning API. It is not tied to a user.
+type SCIMToken struct {
+	CustomModel
+	Name        string     `json:"name"`                                        // e.g. the name of the identity provider.
+	TokenHash   string     `json:"-" gorm:"uniqueIndex;type:char(64);not null"` // SHA-256 of the bearer token. The token itself is only shown once.
+	TokenHint   string     `json:"tokenHint"`
+	CreatedByID uint       `json:"createdByID"`
+	LastUsedAt  *time.Time `json:"lastUsedAt"`
+	RevokedAt   *time.Time `json:"revokedAt"`
+}
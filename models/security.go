@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// KnownDevice is an IP address and browser combination a user has signed in from before.
+type KnownDevice struct {
+	CustomModel
+	UserID          uint       `json:"-" gorm:"uniqueIndex:idx_user_device;not null"`
+	IPAddress       string     `json:"ipAddress" gorm:"uniqueIndex:idx_user_device;type:varchar(45)"`
+	Fingerprint     string     `json:"-" gorm:"uniqueIndex:idx_user_device;type:char(64)"` // SHA-256 of the user agent.
+	UserAgent       string     `json:"userAgent"`
+	Location        string     `json:"location"`
+	RevokeTokenHash string     `json:"-" gorm:"index;type:char(64)"` // SHA-256 of the "this wasn't me" token sent in the alert email.
+	RevokeExpiresAt *time.Time `json:"-"`                            // The token stops working after this.
+	LastSeenAt      time.Time  `json:"lastSeenAt"`
+}
+
+// PasswordReset is a single-use token that lets a user set a new password without logging in.
+type PasswordReset struct {
+	CustomModel
+	UserID    uint      `json:"-" gorm:"index;not null"`
+	TokenHash string    `json:"-" gorm:"uniqueIndex;type:char(64);not null"` // SHA-256 of the token sent by email.
+	ExpiresAt time.Time `json:"-"`
+}
+
+// ImpersonationSession is a support staff member viewing the app as another user.
+type ImpersonationSession struct {
+	CustomModel
+	ActorID   uint       `json:"actorID" gorm:"index;not null"`  // The staff member doing the impersonating.
+	TargetID  uint       `json:"targetID" gorm:"index;not null"` // The user being impersonated.
+	Reason    string     `json:"reason"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	EndedAt   *time.Time `json:"endedAt"`
+}
+
+// Impersonation is shown on a user's profile when it is being viewed through an impersonation token.
+type Impersonation struct {
+	SessionID  uint   `json:"sessionID"`
+	ActorID    uint   `json:"actorID"`
+	ActorEmail string `json:"actorEmail"`
+}
@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+// Setting is a runtime configurable value that admins can change without a redeploy.
+type Setting struct {
+	Key       string    `json:"key" gorm:"primaryKey;type:varchar(128)"`
+	Value     string    `json:"value" gorm:"type:text"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
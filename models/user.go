@@ -13,12 +13,44 @@ type CustomModel struct {
 
 type User struct {
 	CustomModel
-	Email            string           `json:"email" gorm:"unique;primary_key"` // The email address of the user. This is the primary key.
-	Password         []byte           `json:"-"`
-	Privilege        int8             `json:"privilege"` // 1: Admin, 2: Manager, 3: Coordinator, 4: Moderator, 9: General user
-	Verified         bool             `json:"-"`
-	UserVerification UserVerification `json:"userVerification" gorm:"constraint:OnDelete:CASCADE;foreignKey:UserID"`
-	UserDetails      UserDetails      `json:"userDetails" gorm:"constraint:OnDelete:CASCADE;foreignkey:UserID"` // One to one relationship with the user details. Delete the user details if the user is deleted.
+	Email                 string           `json:"email" gorm:"unique;primary_key"` // The email address of the user. This is the primary key.
+	Password              []byte           `json:"-"`
+	Privilege             int8             `json:"privilege"` // 1: Admin, 2: Manager, 3: Coordinator, 4: Moderator, 9: General user
+	Verified              bool             `json:"-"`
+	AuthProvider          string           `json:"authProvider" gorm:"type:varchar(32);default:local"`  // Where the user's credentials live: "local" or a directory such as "ldap".
+	SessionsValidAfter    int64            `json:"-"`                                                   // Unix time. Tokens issued before this are rejected.
+	PasswordResetRequired bool             `json:"-"`                                                   // Set when the account may be compromised. Login is refused until the password is reset.
+	ExternalID            string           `json:"externalId,omitempty" gorm:"type:varchar(255);index"` // The identity provider's ID for this user, set through SCIM.
+	DeactivatedAt         *time.Time       `json:"deactivatedAt,omitempty"`                             // Set when the identity provider deactivates the user. Login is refused while set.
+	Status                string           `json:"-" gorm:"type:varchar(16);not null;default:active"`   // Set by staff. See AccountStatus. Independent of DeactivatedAt, which belongs to the identity provider. Only shown through staff endpoints and the appeal link.
+	SuspendedUntil        *time.Time       `json:"-"`                                                   // When a suspension lifts.
+	StatusReason          string           `json:"-" gorm:"type:text"`                                  // Why the account was suspended or banned. Shown to the user.
+	StatusChangedByID     *uint            `json:"-"`
+	StatusChangedAt       *time.Time       `json:"-"`
+	AppealTokenHash       string           `json:"-" gorm:"type:varchar(64);index"` // Lets a suspended or banned user appeal without signing in.
+	UserVerification      UserVerification `json:"userVerification" gorm:"constraint:OnDelete:CASCADE;foreignKey:UserID"`
+	UserDetails           UserDetails      `json:"userDetails" gorm:"constraint:OnDelete:CASCADE;foreignkey:UserID"` // One to one relationship with the user details. Delete the user details if the user is deleted.
+	ImpersonatedBy        *Impersonation   `json:"impersonatedBy,omitempty" gorm:"-"`                                // Only set when the request was made with an impersonation token.
+}
+
+// Account statuses set by staff.
+const (
+	AccountActive    = "active"
+	AccountSuspended = "suspended"
+	AccountBanned    = "banned"
+)
+
+// AccountStatus is the status in effect now. Suspensions lift by themselves once SuspendedUntil has passed.
+func (u *User) AccountStatus() string {
+	switch u.Status {
+	case AccountBanned:
+		return AccountBanned
+	case AccountSuspended:
+		if u.SuspendedUntil != nil && time.Now().Before(*u.SuspendedUntil) {
+			return AccountSuspended
+		}
+	}
+	return AccountActive
 }
 
 type UserVerification struct {
@@ -55,8 +87,8 @@ type UserAddress struct {
 }
 type UserProfilePicture struct {
 	CustomModel
-	UserDetailsID uint   `json:"userDetailsID"` // References the user details id in the UserDetails table.
-	UrlSafeName   string `json:"urlSafeName"`
-	UserImage     []byte `json:"userImage"`
+	UserDetailsID uint   `json:"userDetailsID"`                       // References the user details id in the UserDetails table.
+	UrlSafeName   string `json:"urlSafeName" gorm:"type:varchar(64)"` // SHA-256 of the uploaded file. The variants live in storage under avatars/<UrlSafeName>/.
+	Extension     string `json:"extension" gorm:"type:varchar(8)"`    // File extension of the stored variants, "jpg" or "png".
 	ImageAltText  string `json:"imageAltText"`
 }
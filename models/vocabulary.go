@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// Vocabularies. Device capabilities and disabilities are mapped onto terms from these.
+const (
+	VocabularyCapability = "capability"
+	VocabularyDisability = "disability"
+)
+
+// Term is a curated entry in a vocabulary, such as "Hand" under "Upper limb". Devices that use the term or one of its
+// synonyms are stored with the term's canonical name.
+type Term struct {
+	ID          uint          `json:"id" gorm:"primaryKey"`
+	Vocabulary  string        `json:"vocabulary" gorm:"type:varchar(16);not null;uniqueIndex:idx_term_slug"`
+	Slug        string        `json:"slug" gorm:"type:varchar(100);not null;uniqueIndex:idx_term_slug"` // URL safe form of Name, e.g. "upper-limb".
+	Name        string        `json:"name" gorm:"type:varchar(100);not null"`
+	Description string        `json:"description" gorm:"type:text"`
+	ParentID    *uint         `json:"parentID" gorm:"index"` // The broader term, if any.
+	Synonyms    []TermSynonym `json:"synonyms" gorm:"constraint:OnDelete:CASCADE;"`
+	CreatedAt   time.Time     `json:"createdAt"`
+	UpdatedAt   time.Time     `json:"updatedAt"`
+}
+
+// TermSynonym is another name that maps to a term. Slugs are unique across the terms and synonyms of a vocabulary.
+type TermSynonym struct {
+	ID         uint   `json:"-" gorm:"primaryKey"`
+	TermID     uint   `json:"-" gorm:"index"`
+	Vocabulary string `json:"-" gorm:"type:varchar(16);not null;uniqueIndex:idx_synonym_slug"`
+	Slug       string `json:"slug" gorm:"type:varchar(100);not null;uniqueIndex:idx_synonym_slug"`
+	Name       string `json:"name" gorm:"type:varchar(100);not null"`
+}
@@ -0,0 +1,279 @@
+// Package pagination pages through list endpoints with keyset cursors.
+//
+// Rows are ordered by a sort column with the primary key as a tie breaker, so the order is stable and every page is an
+// index range scan instead of an OFFSET. Cursors are opaque to clients and only valid for the sort they were made for.
+package pagination
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidSort   = errors.New("invalid sort")
+)
+
+// CountCap bounds how many rows are counted for the total. Anything above it is reported as an estimate.
+const CountCap = 10000
+
+// Sort orders rows by Column and then by the table's id in the same direction.
+type Sort struct {
+	Column string // Qualified when the query joins, e.g. "devices.created_at".
+	Desc   bool
+	Time   bool // The column holds timestamps.
+	// Ranked rows come in an order only the caller knows, such as search relevance. Their cursors hold an offset.
+	Ranked bool
+}
+
+// Limits are the default and maximum page sizes for an endpoint.
+type Limits struct {
+	Default int
+	Max     int
+}
+
+// Key is where a row sits in the sort order.
+type Key struct {
+	Value interface{}
+	ID    uint
+}
+
+type cursor struct {
+	Sort   string          `json:"s"`
+	Value  json.RawMessage `json:"v"`
+	ID     uint            `json:"i"`
+	Prev   bool            `json:"p,omitempty"` // Page backwards from the key.
+	Offset int             `json:"o,omitempty"` // Where a ranked page starts.
+}
+
+// Params is a parsed page request.
+type Params struct {
+	Limit    int
+	SortName string
+	Sort     Sort
+	after    *Key
+	prev     bool
+	offset   int
+}
+
+// Parse reads ?limit=, ?sort= and ?cursor= from the request. Sort names must be keys of sorts, and an empty ?sort= picks
+// defaultSort. A cursor overrides ?sort= with the sort it was made for.
+func Parse(c *fiber.Ctx, limits Limits, sorts map[string]Sort, defaultSort string) (Params, error) {
+	p := Params{Limit: limits.Default, SortName: c.Query("sort", defaultSort)}
+	if limit, err := strconv.Atoi(c.Query("limit")); err == nil && limit > 0 {
+		p.Limit = limit
+	}
+	if p.Limit > limits.Max {
+		p.Limit = limits.Max
+	}
+
+	if encoded := c.Query("cursor"); encoded != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil {
+			return p, ErrInvalidCursor
+		}
+		var cur cursor
+		if err := json.Unmarshal(raw, &cur); err != nil {
+			return p, ErrInvalidCursor
+		}
+		p.SortName, p.prev = cur.Sort, cur.Prev
+		sort, ok := sorts[p.SortName]
+		if !ok {
+			return p, ErrInvalidCursor
+		}
+		if sort.Ranked {
+			if cur.Offset < 0 || cur.Prev {
+				return p, ErrInvalidCursor
+			}
+			p.offset = cur.Offset
+		} else {
+			if cur.ID == 0 {
+				return p, ErrInvalidCursor
+			}
+			value, err := decodeValue(cur.Value, sort)
+			if err != nil {
+				return p, ErrInvalidCursor
+			}
+			p.after = &Key{Value: value, ID: cur.ID}
+		}
+	}
+
+	sort, ok := sorts[p.SortName]
+	if !ok {
+		return p, ErrInvalidSort
+	}
+	p.Sort = sort
+	return p, nil
+}
+
+// Offset is how many ranked rows come before the page.
+func (p Params) Offset() int {
+	return p.offset
+}
+
+// Query adds the keyset condition, order and limit to db. One extra row is fetched to tell whether there are more.
+//
+// idColumn is the primary key, qualified when the query joins.
+func (p Params) Query(db *gorm.DB, idColumn string) *gorm.DB {
+	tx := db.Session(&gorm.Session{})
+	desc := p.Sort.Desc != p.prev // Paging backwards walks the order in reverse.
+
+	if p.after != nil {
+		op := ">"
+		if desc {
+			op = "<"
+		}
+		tx = tx.Where(fmt.Sprintf("(%s %s ? OR (%s = ? AND %s %s ?))", p.Sort.Column, op, p.Sort.Column, idColumn, op),
+			p.after.Value, p.after.Value, p.after.ID)
+	}
+
+	direction := "ASC"
+	if desc {
+		direction = "DESC"
+	}
+	return tx.Order(p.Sort.Column + " " + direction).Order(idColumn + " " + direction).Limit(p.Limit + 1)
+}
+
+// Total is a hint at how many rows the list has. Rows can change between pages.
+type Total struct {
+	Count int64 `json:"count"`
+	Exact bool  `json:"exact"` // False when there are more than CountCap rows.
+}
+
+// Count counts the rows db matches, up to CountCap.
+func Count(db *gorm.DB) (Total, error) {
+	var count int64
+	sub := db.Session(&gorm.Session{}).Select("1").Limit(CountCap + 1)
+	if err := db.Session(&gorm.Session{NewDB: true}).Table("(?) AS counted", sub).Count(&count).Error; err != nil {
+		return Total{}, err
+	}
+	if count > CountCap {
+		return Total{Count: CountCap, Exact: false}, nil
+	}
+	return Total{Count: count, Exact: true}, nil
+}
+
+// Links to the neighbouring pages. Null when there is no such page.
+type Links struct {
+	Next *string `json:"next"`
+	Prev *string `json:"prev"`
+}
+
+// Page is the envelope every list endpoint returns.
+type Page[T any] struct {
+	Data  []T    `json:"data"`
+	Links Links  `json:"links"`
+	Limit int    `json:"limit"`
+	Sort  string `json:"sort"`
+	Total Total  `json:"total"`
+}
+
+// NewPage trims the extra row Query fetched, restores the sort order and links the neighbouring pages.
+func NewPage[T any](c *fiber.Ctx, p Params, rows []T, key func(*T) Key, total Total) Page[T] {
+	more := len(rows) > p.Limit
+	if more {
+		rows = rows[:p.Limit]
+	}
+	if p.prev {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+	if rows == nil {
+		rows = []T{}
+	}
+
+	hasNext, hasPrev := more, p.after != nil
+	if p.prev {
+		hasNext, hasPrev = true, more
+	}
+
+	page := Page[T]{Data: rows, Limit: p.Limit, Sort: p.SortName, Total: total}
+	if len(rows) > 0 {
+		if hasNext {
+			page.Links.Next = link(c, p, key(&rows[len(rows)-1]), false)
+		}
+		if hasPrev {
+			page.Links.Prev = link(c, p, key(&rows[0]), true)
+		}
+	}
+	return page
+}
+
+// NewRankedPage links the neighbouring pages of a ranked list. rows is one page, fetched from Offset with Limit, and
+// total is exact.
+func NewRankedPage[T any](c *fiber.Ctx, p Params, rows []T, total int) Page[T] {
+	if rows == nil {
+		rows = []T{}
+	}
+	page := Page[T]{Data: rows, Limit: p.Limit, Sort: p.SortName, Total: Total{Count: int64(total), Exact: true}}
+	if next := p.offset + p.Limit; next < total {
+		page.Links.Next = rankedLink(c, p, next)
+	}
+	if p.offset > 0 {
+		prev := p.offset - p.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		page.Links.Prev = rankedLink(c, p, prev)
+	}
+	return page
+}
+
+// Build a link to the current URL with a new cursor, keeping the other query parameters.
+func link(c *fiber.Ctx, p Params, k Key, prev bool) *string {
+	value := k.Value
+	if t, ok := value.(time.Time); ok {
+		value = t.UTC().Format(time.RFC3339Nano)
+	}
+	encodedValue, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	return cursorLink(c, p, cursor{Sort: p.SortName, Value: encodedValue, ID: k.ID, Prev: prev})
+}
+
+func rankedLink(c *fiber.Ctx, p Params, offset int) *string {
+	return cursorLink(c, p, cursor{Sort: p.SortName, Value: json.RawMessage("null"), Offset: offset})
+}
+
+func cursorLink(c *fiber.Ctx, p Params, cur cursor) *string {
+	raw, err := json.Marshal(cur)
+	if err != nil {
+		return nil
+	}
+
+	query, _ := url.ParseQuery(string(c.Request().URI().QueryString()))
+	query.Set("cursor", base64.RawURLEncoding.EncodeToString(raw))
+	query.Set("limit", strconv.Itoa(p.Limit))
+	query.Del("sort") // The cursor carries it.
+	href := c.BaseURL() + c.Path() + "?" + query.Encode()
+	return &href
+}
+
+func decodeValue(raw json.RawMessage, sort Sort) (interface{}, error) {
+	if sort.Time {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, err
+		}
+		return time.Parse(time.RFC3339Nano, s)
+	}
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, err
+	}
+	switch value.(type) {
+	case string, float64:
+		return value, nil
+	}
+	return nil, ErrInvalidCursor
+}
@@ -0,0 +1,245 @@
+package pagination
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type item struct {
+	ID        uint
+	Score     int
+	CreatedAt time.Time
+}
+
+var testSorts = map[string]Sort{
+	"newest":     {Column: "created_at", Desc: true, Time: true},
+	"oldest":     {Column: "created_at", Time: true},
+	"score":      {Column: "score"},
+	"score_desc": {Column: "score", Desc: true},
+	"relevance":  {Ranked: true},
+}
+
+// Seven items with ties on both columns, so only the ID decides some of the order.
+func testItems(t *testing.T) *fiber.App {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ := db.DB()
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.AutoMigrate(&item{}); err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, score := range []int{3, 1, 3, 2, 1, 3, 2} {
+		created := base.Add(time.Duration(i/2) * time.Hour) // Pairs share a timestamp.
+		if err := db.Create(&item{Score: score, CreatedAt: created}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := fiber.New()
+	app.Get("/items", func(c *fiber.Ctx) error {
+		p, err := Parse(c, Limits{Default: 2, Max: 3}, testSorts, "newest")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		var items []item
+		if err := p.Query(db.Model(&item{}), "id").Find(&items).Error; err != nil {
+			return err
+		}
+		return c.JSON(NewPage(c, p, items, func(i *item) Key {
+			if p.Sort.Time {
+				return Key{Value: i.CreatedAt, ID: i.ID}
+			}
+			return Key{Value: i.Score, ID: i.ID}
+		}, Total{}))
+	})
+	return app
+}
+
+func getPage(t *testing.T, app *fiber.App, target string) (int, Page[item]) {
+	t.Helper()
+	res, err := app.Test(httptest.NewRequest(fiber.MethodGet, target, nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var page Page[item]
+	if res.StatusCode == fiber.StatusOK {
+		if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res.StatusCode, page
+}
+
+// Links are absolute, so strip them back to a path the test app can serve.
+func local(t *testing.T, link string) string {
+	t.Helper()
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.RequestURI()
+}
+
+func ids(items []item) []uint {
+	out := []uint{}
+	for _, i := range items {
+		out = append(out, i.ID)
+	}
+	return out
+}
+
+func TestWalkPages(t *testing.T) {
+	app := testItems(t)
+	for sort, want := range map[string][]uint{
+		"newest":     {7, 6, 5, 4, 3, 2, 1},
+		"oldest":     {1, 2, 3, 4, 5, 6, 7},
+		"score":      {2, 5, 4, 7, 1, 3, 6},
+		"score_desc": {6, 3, 1, 7, 4, 5, 2},
+	} {
+		// Forwards through every page.
+		var got []uint
+		var pages []Page[item]
+		target := "/items?sort=" + sort
+		for target != "" {
+			status, page := getPage(t, app, target)
+			if status != fiber.StatusOK {
+				t.Fatalf("%s: %s = %d", sort, target, status)
+			}
+			if page.Sort != sort || page.Limit != 2 {
+				t.Errorf("%s: page sort %s, limit %d", sort, page.Sort, page.Limit)
+			}
+			got = append(got, ids(page.Data)...)
+			pages = append(pages, page)
+			target = ""
+			if page.Links.Next != nil {
+				target = local(t, *page.Links.Next)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: forwards = %v, want %v", sort, got, want)
+		}
+		if pages[0].Links.Prev != nil {
+			t.Errorf("%s: first page links back", sort)
+		}
+
+		// And back again from the last page, each page matching the one seen on the way forwards.
+		for i := len(pages) - 1; i > 0; i-- {
+			status, page := getPage(t, app, local(t, *pages[i].Links.Prev))
+			if status != fiber.StatusOK || !reflect.DeepEqual(ids(page.Data), ids(pages[i-1].Data)) {
+				t.Errorf("%s: back from page %d = %d %v, want %v", sort, i, status, ids(page.Data), ids(pages[i-1].Data))
+			}
+			if page.Links.Next == nil {
+				t.Errorf("%s: page %d reached backwards has no next link", sort, i-1)
+			}
+		}
+	}
+}
+
+func TestLimit(t *testing.T) {
+	app := testItems(t)
+	for query, want := range map[string]int{"": 2, "limit=1": 1, "limit=3": 3, "limit=500": 3, "limit=0": 2, "limit=-4": 2, "limit=x": 2} {
+		if _, page := getPage(t, app, "/items?"+query); page.Limit != want || len(page.Data) != want {
+			t.Errorf("%q: limit %d with %d rows, want %d", query, page.Limit, len(page.Data), want)
+		}
+	}
+}
+
+func TestBadCursors(t *testing.T) {
+	app := testItems(t)
+	encode := func(cur string) string { return base64.RawURLEncoding.EncodeToString([]byte(cur)) }
+	for name, cursor := range map[string]string{
+		"garbage":            "!!not-base64!!",
+		"not json":           encode("hello"),
+		"unknown sort":       encode(`{"s":"name","v":"a","i":1}`),
+		"no id":              encode(`{"s":"score","v":1}`),
+		"number for a time":  encode(`{"s":"newest","v":5,"i":1}`),
+		"bad time":           encode(`{"s":"newest","v":"yesterday","i":1}`),
+		"object value":       encode(`{"s":"score","v":{"a":1},"i":1}`),
+		"negative offset":    encode(`{"s":"relevance","v":null,"o":-2}`),
+		"ranked prev cursor": encode(`{"s":"relevance","v":null,"o":2,"p":true}`),
+	} {
+		if status, _ := getPage(t, app, "/items?cursor="+cursor); status != fiber.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", name, status)
+		}
+	}
+	if status, _ := getPage(t, app, "/items?sort=name"); status != fiber.StatusBadRequest {
+		t.Errorf("unknown sort: status = %d, want 400", status)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	app := fiber.New()
+	var got error
+	app.Get("/", func(c *fiber.Ctx) error {
+		_, got = Parse(c, Limits{Default: 2, Max: 3}, testSorts, "newest")
+		return nil
+	})
+	for target, want := range map[string]error{
+		"/?sort=name":   ErrInvalidSort,
+		"/?cursor=%%%%": ErrInvalidCursor,
+		"/?sort=score":  nil,
+	} {
+		app.Test(httptest.NewRequest(fiber.MethodGet, target, nil), -1)
+		if !errors.Is(got, want) {
+			t.Errorf("%s: Parse() = %v, want %v", target, got, want)
+		}
+	}
+}
+
+func TestRankedPage(t *testing.T) {
+	app := fiber.New()
+	app.Get("/search", func(c *fiber.Ctx) error {
+		p, err := Parse(c, Limits{Default: 2, Max: 3}, testSorts, "relevance")
+		if err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		all := []int{10, 20, 30, 40, 50}
+		end := p.Offset() + p.Limit
+		if end > len(all) {
+			end = len(all)
+		}
+		return c.JSON(NewRankedPage(c, p, all[p.Offset():end], len(all)))
+	})
+
+	var got []int
+	target := "/search"
+	for target != "" {
+		res, err := app.Test(httptest.NewRequest(fiber.MethodGet, target, nil), -1)
+		if err != nil || res.StatusCode != fiber.StatusOK {
+			t.Fatalf("%s = %v, %v", target, res.StatusCode, err)
+		}
+		var page Page[int]
+		json.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if (len(got) == 0) != (page.Links.Prev == nil) || page.Total.Count != 5 || !page.Total.Exact {
+			t.Errorf("%s: links %+v, total %+v", target, page.Links, page.Total)
+		}
+		got = append(got, page.Data...)
+		target = ""
+		if page.Links.Next != nil {
+			target = local(t, *page.Links.Next)
+		}
+	}
+	if !reflect.DeepEqual(got, []int{10, 20, 30, 40, 50}) {
+		t.Errorf("ranked pages = %v", got)
+	}
+}
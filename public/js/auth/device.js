@@ -0,0 +1,80 @@
+// Signed in pages hand us the JWT in the URL fragment (#token=...), the same way SAML logins do.
+const fragment = new URLSearchParams(window.location.hash.substring(1));
+if (fragment.get('token')) {
+    sessionStorage.setItem('token', fragment.get('token'));
+    history.replaceState(null, '', window.location.pathname + window.location.search);
+}
+
+const query = new URLSearchParams(window.location.search);
+if (query.get('user_code')) {
+    document.getElementById('user_code').value = query.get('user_code');
+}
+
+document.getElementById('device-form').addEventListener('submit', function(event) {
+    event.preventDefault();
+
+    const userCode = document.getElementById('user_code').value;
+    request('GET', '/oauth/device?user_code=' + encodeURIComponent(userCode)).then(function(data) {
+        document.getElementById('device-client').textContent = data.clientID + ' wants to sign in as you.';
+        document.getElementById('device-form').style.display = 'none';
+        document.getElementById('device-confirm').style.display = 'block';
+    });
+});
+
+document.getElementById('approve').addEventListener('click', function() { decide(true); });
+document.getElementById('deny').addEventListener('click', function() { decide(false); });
+
+function decide(approve) {
+    const body = {user_code: document.getElementById('user_code').value, approve: approve};
+    request('POST', '/oauth/device', body).then(function(data) {
+        document.getElementById('device-confirm').style.display = 'none';
+        showMessage(data.message);
+    });
+}
+
+function request(method, url, body) {
+    const token = sessionStorage.getItem('token');
+    if (!token) {
+        showMessage("Please log in, then come back to this page.");
+        return Promise.reject();
+    }
+
+    return fetch(url, {
+        method: method,
+        headers: {
+            'Content-Type': 'application/json',
+            'Authorization': 'Bearer ' + token,
+            'X-CustomAPI-CSRF-Token': getCookie('CustomAPI_csrf') // Include the CSRF token in the request headers
+        },
+        body: body ? JSON.stringify(body) : undefined,
+        credentials: 'include'
+    }).then(function(response) {
+        if (response.status == 429) {
+            showMessage("Too many requests. Please try again later.");
+            return Promise.reject();
+        }
+        return response.json().then(function(data) {
+            if (!response.ok || data.error) {
+                showMessage(data.message || "Please log in and try again.");
+                return Promise.reject();
+            }
+            return data;
+        });
+    });
+}
+
+function showMessage(message) {
+    document.getElementById('error-msg').textContent = message;
+    document.getElementById('error-msg').style.display = 'block';
+}
+
+function getCookie(name) {
+    const cookies = document.cookie.split(';');
+    for (let i = 0; i < cookies.length; i++) {
+        const cookie = cookies[i].trim();
+        if (cookie.startsWith(name + '=')) {
+            return cookie.substring(name.length + 1);
+        }
+    }
+    return null;
+}
@@ -6,7 +6,8 @@ document.getElementById('registration-form').addEventListener('submit', function
         last_name: document.getElementById('last_name').value,
         email: btoa(document.getElementById('email').value), // encode email as base64
         password: document.getElementById('password').value, // encode password as base64
-        password2: document.getElementById('password2').value // encode password as base64
+        password2: document.getElementById('password2').value, // encode password as base64
+        invite: document.getElementById('invite').value
     };
 
     // Retrieve CSRF token from the cookie
@@ -14,34 +14,139 @@ func AllRoutes(app *fiber.App) {
 	/*AUTH Routes*/
 	app.Get("/verify/:email/:verificationCode", controller.VerifyEmail)
 	app.Get("/register", controller.ShowRegistrationForm)
-	app.Post("/register", middleware.Limiter(14, 60), controller.Register)
-	app.Post("/login", middleware.Limiter(6, 45), controller.Login)
+	app.Post("/register", middleware.Limiter(14, 60), middleware.Challenge(3), controller.Register)
+	app.Post("/login", middleware.Limiter(6, 45), middleware.Challenge(3), controller.Login)
 	app.Post("/logout", middleware.Limiter(6, 45), controller.Logout)
-	app.Post("/resetpassword", middleware.Limiter(6, 45), controller.ResetPassword)
+	app.Post("/resetpassword", middleware.Limiter(6, 45), middleware.Challenge(2), controller.ResetPassword)
+	app.Post("/resetpassword/:token", middleware.Limiter(6, 45), controller.ConfirmPasswordReset)
+	app.Get("/saml/metadata", controller.SAMLMetadata)
+	app.Get("/saml/login", middleware.Limiter(14, 60), controller.SAMLLogin)
+	app.Post("/saml/acs", middleware.Limiter(14, 60), controller.SAMLACS)
+	app.Get("/challenge", middleware.Limiter(30, 60), controller.GetChallenge)
+	app.Get("/security/notme/:token", middleware.Limiter(6, 45), controller.SignInNotMePage)
+	app.Post("/security/notme/:token", middleware.Limiter(6, 45), controller.SignInNotMe)
+	app.Get("/appeals/:token", middleware.Limiter(14, 60), controller.GetAppealStatus)
+	app.Post("/appeals/:token", middleware.Limiter(6, 45), controller.SubmitAppeal)
+
+	/*OAUTH Routes*/
+	app.Post("/oauth/device_authorization", middleware.Limiter(10, 60), controller.DeviceAuthorization)
+	app.Post("/oauth/token", middleware.Limiter(30, 60), controller.OAuthToken)
+	app.Get("/device", controller.ShowDeviceVerification)
+	app.Get("/oauth/device", middleware.Protected(), middleware.Limiter(10, 60), controller.GetDeviceAuthorization)
+	app.Post("/oauth/device", middleware.Protected(), middleware.DenyImpersonation(), middleware.Limiter(10, 60), controller.VerifyDeviceAuthorization)
 
 	/*USER Routes*/
-	app.Get("/getuser", controller.GetUser)
-	//app.Get("api//getprofilepic", controller.GetProfilePic)
+	app.Get("/getuser", middleware.Protected(), controller.GetUser)
 
 	/*DEVICE Routes*/
-	app.Get("/getdevices/:pagenumber", controller.GetDevices)
-	app.Get("/getdevice/:id", controller.GetDevice)
-	//temporary
-	//app.Post("api/v2/savefile", controller.SaveFile)
+	app.Get("/getdevices", controller.GetDevices)
+	app.Get("/getdevice/:id", middleware.OptionalProtected(), controller.GetDevice)
+	app.Get("/getdevice/:id/comments", middleware.OptionalProtected(), controller.GetDeviceComments)
+	app.Get("/getdevice/:id/comments/:thread/replies", middleware.OptionalProtected(), controller.GetCommentReplies)
+	app.Get("/getdevice/:id/reviews", controller.GetDeviceReviews)
+	app.Get("/devices/search", middleware.OptionalProtected(), middleware.Limiter(30, 60), controller.SearchDevices)
+	app.Get("/vocabulary/:vocabulary", controller.GetVocabulary)
+	app.Get("/devices/mine", middleware.Protected(), controller.GetMyDevices)
+	app.Get("/devices/review", middleware.Protected(), middleware.RequirePrivilege(4), controller.GetDevicesForReview)
+	app.Get("/devices/:id/history", middleware.Protected(), controller.GetDeviceStageHistory)
+	app.Post("/devices/:id/stage", middleware.Protected(), middleware.Limiter(20, 60), controller.SetDeviceStage)
+	app.Get("/devices/:id/revisions", middleware.Protected(), controller.GetDeviceRevisions)
+	app.Get("/devices/:id/revisions/diff", middleware.Protected(), controller.DiffDeviceRevisions)
+	app.Get("/devices/:id/revisions/:number", middleware.Protected(), controller.GetDeviceRevision)
+	app.Post("/devices/:id/revisions/:number/rollback", middleware.Protected(), middleware.Limiter(10, 60), controller.RollbackDevice)
+	app.Post("/devices/:id/reviews", middleware.Protected(), middleware.Limiter(10, 60), controller.AddReview)
+	app.Patch("/reviews/:id", middleware.Protected(), middleware.Limiter(10, 60), controller.UpdateReview)
+	app.Delete("/reviews/:id", middleware.Protected(), middleware.Limiter(10, 60), controller.DeleteReview)
+	app.Post("/reviews/:id/helpful", middleware.Protected(), middleware.Limiter(30, 60), controller.VoteReviewHelpful)
+	app.Delete("/reviews/:id/helpful", middleware.Protected(), middleware.Limiter(30, 60), controller.UnvoteReviewHelpful)
+	app.Post("/reviews/:id/report", middleware.Protected(), middleware.Limiter(10, 60), controller.ReportReview)
+	app.Post("/devices/:id/comments", middleware.Protected(), middleware.Limiter(10, 60), controller.AddComment)
+	app.Patch("/comments/:id", middleware.Protected(), middleware.Limiter(10, 60), controller.UpdateComment)
+	app.Delete("/comments/:id", middleware.Protected(), middleware.Limiter(10, 60), controller.DeleteComment)
+	app.Post("/comments/:id/answered", middleware.Protected(), middleware.Limiter(10, 60), controller.MarkCommentAnswered)
+	app.Post("/reports", middleware.Protected(), middleware.Limiter(10, 60), controller.CreateReport)
+	app.Post("/devices", middleware.Protected(), middleware.Limiter(10, 60), controller.AddDevice)
+	app.Patch("/devices/:id", middleware.Protected(), middleware.Limiter(20, 60), controller.UpdateDevice)
+	app.Delete("/devices/:id", middleware.Protected(), middleware.Limiter(10, 60), controller.DeleteDevice)
+	app.Get("/getdevice/:id/files", middleware.OptionalProtected(), controller.GetDeviceFiles)
+	app.Get("/getdevice/:id/files/:fileID", middleware.OptionalProtected(), middleware.Limiter(30, 60), controller.DownloadDeviceFile)
+	app.Get("/getdevice/:id/images", middleware.OptionalProtected(), controller.GetDeviceImages)
+	app.Get("/getdevice/:id/images/:name/:file", middleware.OptionalProtected(), controller.GetDeviceImageFile)
+	app.Post("/devices/:id/images", middleware.Protected(), middleware.Limiter(10, 60), middleware.BodyLimit(controller.MaxDeviceImageUpload, nil), controller.UploadDeviceImages)
+	app.Put("/devices/:id/images/order", middleware.Protected(), controller.ReorderDeviceImages)
+	app.Patch("/devices/:id/images/:imageID", middleware.Protected(), controller.UpdateDeviceImage)
+	app.Delete("/devices/:id/images/:imageID", middleware.Protected(), middleware.Limiter(10, 60), controller.DeleteDeviceImage)
+	app.Post("/devices/:id/files", middleware.Protected(), middleware.Limiter(10, 60), controller.UploadDeviceFile)
+	app.Delete("/devices/:id/files/:fileID", middleware.Protected(), middleware.Limiter(10, 60), controller.DeleteDeviceFile)
 
 	//app.Get("/getallusers", controller.GetAllUsers)
 
 	// PROTECTED ROUTES
-	app.Get("/users", middleware.Protected(), controller.GetAllUsers)
+	app.Get("/users", middleware.Protected(), middleware.RequirePrivilege(2), controller.GetAllUsers)
 	app.Get("/users/:id", middleware.Protected(), middleware.Limiter(6, 60), controller.GetUser)
-	app.Patch("/users/:id", middleware.Protected(), middleware.Limiter(6, 60), controller.UpdateUser)
+	app.Patch("/users/:id", middleware.Protected(), middleware.DenyImpersonation(), middleware.Limiter(6, 60), controller.UpdateUser)
 
 	app.Get("/users/:id/address", middleware.Protected(), controller.GetAddress)
 	app.Post("/users/:id/address", middleware.Protected(), controller.AddAddress)
-	app.Patch("/users/:id/address/:id", middleware.Protected(), controller.UpdateAddress)
-	app.Delete("/users/:id/address/:id", middleware.Protected(), controller.DeleteAddress)
+	app.Patch("/users/:id/address/:addressID", middleware.Protected(), controller.UpdateAddress)
+	app.Delete("/users/:id/address/:addressID", middleware.Protected(), controller.DeleteAddress)
+
+	app.Put("/users/me/avatar", middleware.Protected(), middleware.DenyImpersonation(), middleware.Limiter(6, 60), controller.UploadAvatar)
+	app.Get("/avatars/:name/:file", controller.GetAvatar)
+	app.Get("/files/*", controller.GetStoredFile)
+	app.Post("/updatepassword", middleware.Protected(), middleware.DenyImpersonation(), middleware.Limiter(6, 45), controller.UpdatePassword)
+	app.Post("/impersonation/stop", middleware.Protected(), controller.StopImpersonation)
+
+	/*MODERATION Routes*/
+	moderation := app.Group("/moderation", middleware.Protected(), middleware.RequirePrivilege(4))
+	moderation.Get("/cases", controller.GetModerationCases)
+	moderation.Get("/cases/:id", controller.GetModerationCase)
+	moderation.Post("/cases/:id/claim", controller.ClaimModerationCase)
+	moderation.Post("/cases/:id/resolve", controller.ResolveModerationCase)
+	moderation.Post("/cases/:id/dismiss", controller.DismissModerationCase)
+	moderation.Post("/content/:type/:id/hide", controller.HideContent)
+	moderation.Post("/content/:type/:id/unhide", controller.UnhideContent)
+	moderation.Post("/users/:id/warn", middleware.Limiter(20, 60), controller.WarnUser)
+	moderation.Post("/users/:id/suspend", middleware.DenyImpersonation(), middleware.Limiter(20, 60), controller.SuspendUser)
+
+	/*ADMIN Routes*/
+	app.Patch("/admin/users/:id/privilege", middleware.Protected(), middleware.RequirePrivilege(2), controller.UpdateUserPrivilege)
+	app.Put("/admin/users/:id/status", middleware.Protected(), middleware.DenyImpersonation(), middleware.RequirePrivilege(2), controller.UpdateUserStatus)
+	app.Get("/admin/appeals", middleware.Protected(), middleware.RequirePrivilege(2), controller.GetAppeals)
+	app.Post("/admin/appeals/:id/decide", middleware.Protected(), middleware.DenyImpersonation(), middleware.RequirePrivilege(2), controller.DecideAppeal)
+	app.Get("/admin/vocabulary/:vocabulary/unmapped", middleware.Protected(), middleware.RequirePrivilege(2), controller.GetUnmappedTerms)
+	app.Post("/admin/vocabulary/:vocabulary/terms", middleware.Protected(), middleware.RequirePrivilege(2), controller.CreateTerm)
+	app.Patch("/admin/vocabulary/:vocabulary/terms/:id", middleware.Protected(), middleware.RequirePrivilege(2), controller.UpdateTerm)
+	app.Delete("/admin/vocabulary/:vocabulary/terms/:id", middleware.Protected(), middleware.RequirePrivilege(2), controller.DeleteTerm)
+	app.Post("/admin/vocabulary/:vocabulary/terms/:id/merge", middleware.Protected(), middleware.RequirePrivilege(2), controller.MergeTerms)
+	app.Post("/admin/users/:id/impersonate", middleware.Protected(), middleware.DenyImpersonation(), middleware.RequirePrivilege(2), controller.StartImpersonation)
+	app.Get("/admin/registration", middleware.Protected(), middleware.RequirePrivilege(2), controller.GetRegistrationSettings)
+	app.Put("/admin/registration", middleware.Protected(), middleware.RequirePrivilege(1), controller.UpdateRegistrationSettings)
+	app.Get("/admin/moderation", middleware.Protected(), middleware.RequirePrivilege(2), controller.GetModerationSettings)
+	app.Put("/admin/moderation", middleware.Protected(), middleware.RequirePrivilege(1), controller.UpdateModerationSettings)
+	app.Get("/admin/invites", middleware.Protected(), middleware.RequirePrivilege(2), controller.GetInvites)
+	app.Post("/admin/invites", middleware.Protected(), middleware.RequirePrivilege(2), controller.CreateInvite)
+	app.Delete("/admin/invites/:id", middleware.Protected(), middleware.RequirePrivilege(2), controller.RevokeInvite)
+	app.Get("/admin/audit", middleware.Protected(), middleware.RequirePrivilege(2), controller.GetAuditLog)
+	app.Get("/admin/audit/verify", middleware.Protected(), middleware.RequirePrivilege(1), controller.VerifyAuditLog)
+	app.Get("/admin/scim/tokens", middleware.Protected(), middleware.RequirePrivilege(1), controller.GetSCIMTokens)
+	app.Post("/admin/scim/tokens", middleware.Protected(), middleware.DenyImpersonation(), middleware.RequirePrivilege(1), controller.CreateSCIMToken)
+	app.Delete("/admin/scim/tokens/:id", middleware.Protected(), middleware.RequirePrivilege(1), controller.RevokeSCIMToken)
 
-	//app.Patch("/uploadpic", middleware.Protected(), controller.UpdateProfilePic)
-	app.Post("/updatepassword", middleware.Protected(), middleware.Limiter(6, 45), controller.UpdatePassword)
+	/*SCIM Routes*/
+	scim := app.Group("/scim/v2", middleware.SCIMAuth())
+	scim.Get("/ServiceProviderConfig", controller.SCIMServiceProviderConfig)
+	scim.Get("/Users", controller.SCIMGetUsers)
+	scim.Post("/Users", controller.SCIMCreateUser)
+	scim.Get("/Users/:id", controller.SCIMGetUser)
+	scim.Put("/Users/:id", controller.SCIMReplaceUser)
+	scim.Patch("/Users/:id", controller.SCIMPatchUser)
+	scim.Delete("/Users/:id", controller.SCIMDeleteUser)
+	scim.Get("/Groups", controller.SCIMGetGroups)
+	scim.Post("/Groups", controller.SCIMGroupImmutable)
+	scim.Get("/Groups/:id", controller.SCIMGetGroup)
+	scim.Put("/Groups/:id", controller.SCIMReplaceGroup)
+	scim.Patch("/Groups/:id", controller.SCIMPatchGroup)
+	scim.Delete("/Groups/:id", controller.SCIMGroupImmutable)
 
 }
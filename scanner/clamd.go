@@ -0,0 +1,115 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Clamd streams files to a ClamAV daemon with the INSTREAM command.
+type Clamd struct {
+	Network   string // "tcp" or "unix".
+	Address   string
+	Timeout   time.Duration // For a whole scan, including sending the file.
+	ChunkSize int
+}
+
+// NewClamd connects to clamd at a host:port, or at a unix socket when the address is a path.
+func NewClamd(address string) *Clamd {
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+	return &Clamd{Network: network, Address: address, Timeout: 2 * time.Minute, ChunkSize: 64 * 1024}
+}
+
+// ClamdFromEnv reads CLAMD_ADDRESS and, optionally, CLAMD_TIMEOUT_SECONDS.
+func ClamdFromEnv() *Clamd {
+	clamd := NewClamd(os.Getenv("CLAMD_ADDRESS"))
+	if seconds, err := strconv.Atoi(os.Getenv("CLAMD_TIMEOUT_SECONDS")); err == nil && seconds > 0 {
+		clamd.Timeout = time.Duration(seconds) * time.Second
+	}
+	return clamd
+}
+
+func (c *Clamd) Scan(ctx context.Context, file io.Reader) (Result, error) {
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return Result{}, fmt.Errorf("%w: %s", ErrUnavailable, err.Error())
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(c.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	// clamd stops reading once a file goes over its StreamMaxLength and answers straight away, so a failed write
+	// still leaves a reply worth reading.
+	writeErr := c.send(conn, file)
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		if writeErr != nil {
+			return Result{}, fmt.Errorf("%w: %s", ErrUnavailable, writeErr.Error())
+		}
+		return Result{}, fmt.Errorf("%w: %s", ErrUnavailable, err.Error())
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00"))
+}
+
+// Send the command, the file as length-prefixed chunks and a zero-length chunk to end it.
+func (c *Clamd) send(conn net.Conn, file io.Reader) error {
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return err
+	}
+	chunkSize := c.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = 64 * 1024
+	}
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, err := io.ReadFull(file, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := conn.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// Replies look like "stream: OK", "stream: Eicar-Signature FOUND" or "INSTREAM size limit exceeded. ERROR".
+func parseClamdReply(reply string) (Result, error) {
+	reply = strings.TrimSpace(reply)
+	switch {
+	case strings.HasSuffix(reply, " FOUND"):
+		signature := strings.TrimSuffix(reply, " FOUND")
+		if i := strings.LastIndex(signature, ": "); i >= 0 {
+			signature = signature[i+2:]
+		}
+		return Result{Infected: true, Signature: signature}, nil
+	case strings.HasSuffix(reply, ": OK"):
+		return Result{}, nil
+	case strings.Contains(reply, "size limit exceeded"):
+		return Result{}, fmt.Errorf("%w: larger than clamd's StreamMaxLength", ErrUnscannable)
+	}
+	return Result{}, fmt.Errorf("unexpected clamd reply: %q", reply)
+}
@@ -0,0 +1,173 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A clamd that checks INSTREAM framing and answers with a fixed verdict.
+type fakeClamd struct {
+	listener  net.Listener
+	maxLength int // Like clamd's StreamMaxLength. Zero for no limit.
+	reply     string
+	received  chan []byte // The file as reassembled from its chunks.
+	chunks    chan []int  // The chunk sizes sent.
+	problems  chan string // Framing mistakes.
+}
+
+func newFakeClamd(t *testing.T, reply string, maxLength int) *fakeClamd {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeClamd{listener: listener, maxLength: maxLength, reply: reply,
+		received: make(chan []byte, 1), chunks: make(chan []int, 1), problems: make(chan string, 1)}
+	t.Cleanup(func() { listener.Close() })
+	go f.serve()
+	return f
+}
+
+func (f *fakeClamd) serve() {
+	conn, err := f.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	command, err := r.ReadString(0)
+	if err != nil || command != "zINSTREAM\x00" {
+		f.problems <- "command " + command
+		return
+	}
+
+	var file []byte
+	var sizes []int
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			f.problems <- "length: " + err.Error()
+			return
+		}
+		if size == 0 {
+			break
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			f.problems <- "chunk: " + err.Error()
+			return
+		}
+		sizes = append(sizes, int(size))
+		file = append(file, chunk...)
+		if f.maxLength > 0 && len(file) > f.maxLength {
+			// clamd answers as soon as the stream is too long. Keep reading so the client sees the reply, not a reset.
+			conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+			f.received <- file
+			f.chunks <- sizes
+			io.Copy(io.Discard, r)
+			return
+		}
+	}
+	f.received <- file
+	f.chunks <- sizes
+	conn.Write([]byte(f.reply + "\x00"))
+}
+
+func (f *fakeClamd) clamd(chunkSize int) *Clamd {
+	c := NewClamd(f.listener.Addr().String())
+	c.ChunkSize, c.Timeout = chunkSize, 5*time.Second
+	return c
+}
+
+func (f *fakeClamd) check(t *testing.T, file []byte, chunkSize int) {
+	t.Helper()
+	select {
+	case problem := <-f.problems:
+		t.Fatalf("framing: %s", problem)
+	case received := <-f.received:
+		if !bytes.HasPrefix(file, received) || (f.maxLength == 0 && len(received) != len(file)) {
+			t.Errorf("clamd received %d bytes of %d, not a prefix of the file", len(received), len(file))
+		}
+		for i, size := range <-f.chunks {
+			if size > chunkSize {
+				t.Errorf("chunk %d is %d bytes, over %d", i, size, chunkSize)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("clamd received nothing")
+	}
+}
+
+func TestClamdClean(t *testing.T) {
+	f := newFakeClamd(t, "stream: OK", 0)
+	file := bytes.Repeat([]byte("clean file "), 1000) // 11000 bytes: two full chunks and a short one.
+
+	result, err := f.clamd(4096).Scan(context.Background(), bytes.NewReader(file))
+	if err != nil || result.Infected {
+		t.Fatalf("Scan() = %+v, %v", result, err)
+	}
+	f.check(t, file, 4096)
+}
+
+func TestClamdFound(t *testing.T) {
+	f := newFakeClamd(t, "stream: Win.Test.EICAR_HDB-1 FOUND", 0)
+
+	result, err := f.clamd(16).Scan(context.Background(), bytes.NewReader(eicar))
+	if err != nil || !result.Infected || result.Signature != "Win.Test.EICAR_HDB-1" {
+		t.Fatalf("Scan() = %+v, %v", result, err)
+	}
+	f.check(t, eicar, 16)
+}
+
+func TestClamdEmptyFile(t *testing.T) {
+	f := newFakeClamd(t, "stream: OK", 0)
+
+	if _, err := f.clamd(4096).Scan(context.Background(), bytes.NewReader(nil)); err != nil {
+		t.Fatalf("Scan() = %v", err)
+	}
+	f.check(t, nil, 4096)
+}
+
+func TestClamdSizeLimit(t *testing.T) {
+	f := newFakeClamd(t, "stream: OK", 2048)
+	file := bytes.Repeat([]byte{'x'}, 8192)
+
+	_, err := f.clamd(1024).Scan(context.Background(), bytes.NewReader(file))
+	if !errors.Is(err, ErrUnscannable) {
+		t.Fatalf("Scan() = %v, want ErrUnscannable", err)
+	}
+	f.check(t, file, 1024)
+}
+
+func TestClamdUnavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	_, err = NewClamd(address).Scan(context.Background(), strings.NewReader("file"))
+	if !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("Scan() = %v, want ErrUnavailable", err)
+	}
+}
+
+func TestParseClamdReply(t *testing.T) {
+	if _, err := parseClamdReply("stream: something odd"); err == nil || errors.Is(err, ErrUnscannable) || errors.Is(err, ErrUnavailable) {
+		t.Errorf("unexpected reply: %v", err)
+	}
+	if c := NewClamd("/run/clamav/clamd.ctl"); c.Network != "unix" {
+		t.Errorf("socket path network = %s", c.Network)
+	}
+}
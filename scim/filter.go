@@ -0,0 +1,425 @@
+package scim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var ErrFilter = errors.New("invalid filter")
+
+// Filter is a parsed SCIM filter expression.
+type Filter interface {
+	// SQL compiles the filter into a WHERE clause using the given attribute to column mapping.
+	SQL(columns map[string]Column) (string, []interface{}, error)
+	// Match evaluates the filter in memory. get returns every value of a (lower case) attribute path.
+	Match(get func(path string) []string) bool
+}
+
+// ColumnKind tells the SQL compiler how to treat an attribute.
+type ColumnKind int
+
+const (
+	StringColumn ColumnKind = iota
+	NumberColumn
+	BoolColumn
+	TimeColumn
+)
+
+// Column maps a SCIM attribute path onto an SQL expression.
+type Column struct {
+	Expr string
+	Kind ColumnKind
+}
+
+type logicalFilter struct {
+	op          string // "and" or "or"
+	left, right Filter
+}
+
+type notFilter struct {
+	inner Filter
+}
+
+type compareFilter struct {
+	path  string // Lower case, e.g. "name.givenname".
+	op    string // eq, ne, co, sw, ew, pr, gt, ge, lt, le
+	value interface{}
+}
+
+// ParseFilter parses a filter such as `userName eq "bjensen" and (active eq true or emails[type eq "work"] pr)`.
+func ParseFilter(input string) (Filter, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	f, err := p.parseOr("")
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("%w: unexpected %q", ErrFilter, p.tokens[p.pos].text)
+	}
+	return f, nil
+}
+
+func (f *logicalFilter) SQL(columns map[string]Column) (string, []interface{}, error) {
+	left, leftArgs, err := f.left.SQL(columns)
+	if err != nil {
+		return "", nil, err
+	}
+	right, rightArgs, err := f.right.SQL(columns)
+	if err != nil {
+		return "", nil, err
+	}
+	return "(" + left + " " + strings.ToUpper(f.op) + " " + right + ")", append(leftArgs, rightArgs...), nil
+}
+
+func (f *logicalFilter) Match(get func(string) []string) bool {
+	if f.op == "and" {
+		return f.left.Match(get) && f.right.Match(get)
+	}
+	return f.left.Match(get) || f.right.Match(get)
+}
+
+func (f *notFilter) SQL(columns map[string]Column) (string, []interface{}, error) {
+	inner, args, err := f.inner.SQL(columns)
+	if err != nil {
+		return "", nil, err
+	}
+	return "NOT (" + inner + ")", args, nil
+}
+
+func (f *notFilter) Match(get func(string) []string) bool {
+	return !f.inner.Match(get)
+}
+
+func (f *compareFilter) SQL(columns map[string]Column) (string, []interface{}, error) {
+	col, ok := columns[f.path]
+	if !ok {
+		return "", nil, fmt.Errorf("%w: unsupported attribute %q", ErrFilter, f.path)
+	}
+
+	if f.op == "pr" {
+		if col.Kind == StringColumn {
+			return "(" + col.Expr + " IS NOT NULL AND " + col.Expr + " <> '')", nil, nil
+		}
+		return col.Expr + " IS NOT NULL", nil, nil
+	}
+
+	if f.value == nil {
+		switch f.op {
+		case "eq":
+			return col.Expr + " IS NULL", nil, nil
+		case "ne":
+			return col.Expr + " IS NOT NULL", nil, nil
+		}
+		return "", nil, fmt.Errorf("%w: %s cannot compare with null", ErrFilter, f.op)
+	}
+
+	value := f.value
+	if col.Kind == BoolColumn {
+		b, ok := value.(bool)
+		if !ok {
+			return "", nil, fmt.Errorf("%w: %s expects a boolean", ErrFilter, f.path)
+		}
+		value = b
+	}
+
+	switch f.op {
+	case "eq":
+		return col.Expr + " = ?", []interface{}{value}, nil
+	case "ne":
+		return col.Expr + " <> ?", []interface{}{value}, nil
+	case "co", "sw", "ew":
+		s, ok := value.(string)
+		if !ok || col.Kind != StringColumn {
+			return "", nil, fmt.Errorf("%w: %s only works on strings", ErrFilter, f.op)
+		}
+		s = escapeLike(s)
+		switch f.op {
+		case "co":
+			s = "%" + s + "%"
+		case "sw":
+			s = s + "%"
+		case "ew":
+			s = "%" + s
+		}
+		return col.Expr + " LIKE ?", []interface{}{s}, nil
+	case "gt":
+		return col.Expr + " > ?", []interface{}{value}, nil
+	case "ge":
+		return col.Expr + " >= ?", []interface{}{value}, nil
+	case "lt":
+		return col.Expr + " < ?", []interface{}{value}, nil
+	case "le":
+		return col.Expr + " <= ?", []interface{}{value}, nil
+	}
+	return "", nil, fmt.Errorf("%w: unknown operator %q", ErrFilter, f.op)
+}
+
+func (f *compareFilter) Match(get func(string) []string) bool {
+	values := get(f.path)
+	if f.op == "pr" {
+		for _, v := range values {
+			if v != "" {
+				return true
+			}
+		}
+		return false
+	}
+
+	want := strings.ToLower(fmt.Sprint(f.value))
+	for _, v := range values {
+		v = strings.ToLower(v)
+		var ok bool
+		switch f.op {
+		case "eq":
+			ok = v == want
+		case "ne":
+			ok = v != want
+		case "co":
+			ok = strings.Contains(v, want)
+		case "sw":
+			ok = strings.HasPrefix(v, want)
+		case "ew":
+			ok = strings.HasSuffix(v, want)
+		case "gt":
+			ok = v > want
+		case "ge":
+			ok = v >= want
+		case "lt":
+			ok = v < want
+		case "le":
+			ok = v <= want
+		}
+		if ok {
+			return true
+		}
+	}
+	return f.op == "ne" && len(values) == 0
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+/*
+ * PARSER
+ */
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenString
+	tokenOpen
+	tokenClose
+	tokenOpenBracket
+	tokenCloseBracket
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func tokenize(input string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(input); {
+		ch := input[i]
+		switch {
+		case unicode.IsSpace(rune(ch)):
+			i++
+		case ch == '(':
+			tokens = append(tokens, token{tokenOpen, "("})
+			i++
+		case ch == ')':
+			tokens = append(tokens, token{tokenClose, ")"})
+			i++
+		case ch == '[':
+			tokens = append(tokens, token{tokenOpenBracket, "["})
+			i++
+		case ch == ']':
+			tokens = append(tokens, token{tokenCloseBracket, "]"})
+			i++
+		case ch == '"':
+			j := i + 1
+			for ; j < len(input); j++ {
+				if input[j] == '\\' {
+					j++
+					continue
+				}
+				if input[j] == '"' {
+					break
+				}
+			}
+			if j >= len(input) {
+				return nil, fmt.Errorf("%w: unterminated string", ErrFilter)
+			}
+			var s string
+			if err := json.Unmarshal([]byte(input[i:j+1]), &s); err != nil {
+				return nil, fmt.Errorf("%w: bad string %s", ErrFilter, input[i:j+1])
+			}
+			tokens = append(tokens, token{tokenString, s})
+			i = j + 1
+		default:
+			j := i
+			for j < len(input) && !unicode.IsSpace(rune(input[j])) && !strings.ContainsRune("()[]\"", rune(input[j])) {
+				j++
+			}
+			tokens = append(tokens, token{tokenWord, input[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peekWord(word string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokenWord && strings.EqualFold(p.tokens[p.pos].text, word)
+}
+
+func (p *parser) expect(kind tokenKind) error {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != kind {
+		return fmt.Errorf("%w: unexpected end of filter", ErrFilter)
+	}
+	p.pos++
+	return nil
+}
+
+// prefix is set inside value paths, e.g. "emails." for emails[type eq "work"].
+func (p *parser) parseOr(prefix string) (Filter, error) {
+	left, err := p.parseAnd(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for p.peekWord("or") {
+		p.pos++
+		right, err := p.parseAnd(prefix)
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalFilter{op: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd(prefix string) (Filter, error) {
+	left, err := p.parseUnary(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for p.peekWord("and") {
+		p.pos++
+		right, err := p.parseUnary(prefix)
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalFilter{op: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary(prefix string) (Filter, error) {
+	if p.peekWord("not") {
+		p.pos++
+		if err := p.expect(tokenOpen); err != nil {
+			return nil, err
+		}
+		inner, err := p.parseOr(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenClose); err != nil {
+			return nil, err
+		}
+		return &notFilter{inner: inner}, nil
+	}
+
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokenOpen {
+		p.pos++
+		inner, err := p.parseOr(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenClose); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	}
+
+	return p.parseComparison(prefix)
+}
+
+func (p *parser) parseComparison(prefix string) (Filter, error) {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokenWord {
+		return nil, fmt.Errorf("%w: expected an attribute", ErrFilter)
+	}
+	path := prefix + strings.ToLower(p.tokens[p.pos].text)
+	p.pos++
+
+	// Value path: emails[type eq "work" and value co "@example.com"]
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokenOpenBracket {
+		p.pos++
+		inner, err := p.parseOr(path + ".")
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenCloseBracket); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	}
+
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokenWord {
+		return nil, fmt.Errorf("%w: expected an operator after %s", ErrFilter, path)
+	}
+	op := strings.ToLower(p.tokens[p.pos].text)
+	p.pos++
+
+	switch op {
+	case "pr":
+		return &compareFilter{path: path, op: op}, nil
+	case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+	default:
+		return nil, fmt.Errorf("%w: unknown operator %q", ErrFilter, op)
+	}
+
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("%w: expected a value after %s %s", ErrFilter, path, op)
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+
+	var value interface{}
+	switch {
+	case tok.kind == tokenString:
+		value = tok.text
+	case tok.kind == tokenWord && tok.text == "true":
+		value = true
+	case tok.kind == tokenWord && tok.text == "false":
+		value = false
+	case tok.kind == tokenWord && tok.text == "null":
+		value = nil
+	case tok.kind == tokenWord:
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad value %q", ErrFilter, tok.text)
+		}
+		value = n
+	default:
+		return nil, fmt.Errorf("%w: bad value %q", ErrFilter, tok.text)
+	}
+
+	return &compareFilter{path: path, op: op, value: value}, nil
+}
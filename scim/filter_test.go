@@ -0,0 +1,165 @@
+package scim
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var testColumns = map[string]Column{
+	"username":        {Expr: "users.email", Kind: StringColumn},
+	"emails.value":    {Expr: "users.email", Kind: StringColumn},
+	"emails.type":     {Expr: "'work'", Kind: StringColumn},
+	"active":          {Expr: "(users.deactivated_at IS NULL)", Kind: BoolColumn},
+	"name.givenname":  {Expr: "user_details.first_name", Kind: StringColumn},
+	"groups.value":    {Expr: "users.privilege", Kind: NumberColumn},
+	"meta.created":    {Expr: "users.created_at", Kind: TimeColumn},
+	"externalid":      {Expr: "users.external_id", Kind: StringColumn},
+	"name.familyname": {Expr: "user_details.last_name", Kind: StringColumn},
+}
+
+func TestFilterSQL(t *testing.T) {
+	tests := []struct {
+		filter string
+		where  string
+		args   []interface{}
+	}{
+		{`userName eq "bjensen"`, "users.email = ?", []interface{}{"bjensen"}},
+		{`USERNAME Eq "bjensen"`, "users.email = ?", []interface{}{"bjensen"}},
+		{`name.givenName co "an_%"`, "user_details.first_name LIKE ?", []interface{}{`%an\_\%%`}},
+		{`userName sw "b"`, "users.email LIKE ?", []interface{}{"b%"}},
+		{`userName ew "@example.com"`, "users.email LIKE ?", []interface{}{"%@example.com"}},
+		{`externalId pr`, "(users.external_id IS NOT NULL AND users.external_id <> '')", nil},
+		{`groups.value pr`, "users.privilege IS NOT NULL", nil},
+		{`externalId eq null`, "users.external_id IS NULL", nil},
+		{`groups.value le 4`, "users.privilege <= ?", []interface{}{float64(4)}},
+		{`meta.created gt "2011-05-13T04:42:34Z"`, "users.created_at > ?", []interface{}{"2011-05-13T04:42:34Z"}},
+		{`active eq false`, "(users.deactivated_at IS NULL) = ?", []interface{}{false}},
+		{
+			`userName eq "a" or userName eq "b" and active eq true`,
+			"(users.email = ? OR (users.email = ? AND (users.deactivated_at IS NULL) = ?))",
+			[]interface{}{"a", "b", true},
+		},
+		{
+			`(userName eq "a" or userName eq "b") and not (active eq true)`,
+			"((users.email = ? OR users.email = ?) AND NOT ((users.deactivated_at IS NULL) = ?))",
+			[]interface{}{"a", "b", true},
+		},
+		{`emails[type eq "work"]`, "'work' = ?", []interface{}{"work"}},
+		{
+			`emails[type eq "work" and value co "@example.com"]`,
+			"('work' = ? AND users.email LIKE ?)",
+			[]interface{}{"work", "%@example.com%"},
+		},
+		{`userName eq "quote \" and \\ backslash"`, "users.email = ?", []interface{}{`quote " and \ backslash`}},
+	}
+
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("ParseFilter(%s): %v", tt.filter, err)
+			continue
+		}
+		where, args, err := f.SQL(testColumns)
+		if err != nil {
+			t.Errorf("SQL(%s): %v", tt.filter, err)
+			continue
+		}
+		if where != tt.where || !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("SQL(%s) = %q %v, want %q %v", tt.filter, where, args, tt.where, tt.args)
+		}
+	}
+}
+
+func TestFilterSQLErrors(t *testing.T) {
+	tests := []string{
+		`nickName eq "b"`,        // Not in the column map.
+		`emails[display eq "b"]`, // Nor is this sub-attribute.
+		`active eq "yes"`,        // Booleans only.
+		`groups.value co "1"`,    // co, sw and ew only work on strings.
+		`userName gt null`,       // Only eq and ne compare with null.
+		`userName sw 4`,          // A number is not a string.
+	}
+	for _, filter := range tests {
+		f, err := ParseFilter(filter)
+		if err != nil {
+			t.Errorf("ParseFilter(%s): %v", filter, err)
+			continue
+		}
+		if _, _, err := f.SQL(testColumns); !errors.Is(err, ErrFilter) {
+			t.Errorf("SQL(%s): got %v, want ErrFilter", filter, err)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName is "b"`,
+		`userName eq "unterminated`,
+		`userName eq bjensen`,
+		`(userName eq "b"`,
+		`userName eq "b")`,
+		`emails[type eq "work"`,
+		`not userName eq "b"`,
+		`userName eq "b" and`,
+	}
+	for _, filter := range tests {
+		if _, err := ParseFilter(filter); !errors.Is(err, ErrFilter) {
+			t.Errorf("ParseFilter(%s): got %v, want ErrFilter", filter, err)
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	attributes := map[string][]string{
+		"displayname":   {"Managers"},
+		"members.value": {"12", "40"},
+		"emails.type":   {"work"},
+		"emails.value":  {"Ada@Example.org"},
+	}
+	get := func(path string) []string { return attributes[path] }
+
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{`displayName eq "managers"`, true}, // Case insensitive.
+		{`displayName eq "Admins"`, false},
+		{`displayName ne "Admins"`, true},
+		{`displayName sw "Man"`, true},
+		{`displayName ew "ers"`, true},
+		{`displayName co "nag"`, true},
+		{`members.value eq "40"`, true}, // Any value may match.
+		{`members[value eq "41"]`, false},
+		{`members pr`, false},
+		{`members.value pr`, true},
+		{`nickName ne "x"`, true}, // ne matches a missing attribute.
+		{`emails[type eq "work" and value ew "@example.org"]`, true},
+		{`emails[type eq "home"] or displayName eq "Managers"`, true},
+		{`not (displayName eq "Managers")`, false},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("ParseFilter(%s): %v", tt.filter, err)
+			continue
+		}
+		if got := f.Match(get); got != tt.want {
+			t.Errorf("Match(%s) = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestFilterValuePath(t *testing.T) {
+	f, err := ParseFilter(`emails[type eq "work"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compare, ok := f.(*compareFilter)
+	if !ok || compare.path != "emails.type" || compare.op != "eq" || compare.value != "work" {
+		t.Errorf("parsed = %#v", f)
+	}
+}
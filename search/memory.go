@@ -0,0 +1,219 @@
+package search
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Memory is an inverted index kept in process. It suits tests, SQLite and small deployments, and is rebuilt from the
+// database at startup.
+type Memory struct {
+	mu       sync.RWMutex
+	docs     map[uint]Document
+	postings map[string]map[uint]int // token -> document -> weight
+}
+
+func NewMemory() *Memory {
+	return &Memory{docs: map[uint]Document{}, postings: map[string]map[uint]int{}}
+}
+
+// Name words count more than words in capabilities, disabilities and usages.
+const nameWeight = 3
+
+func (m *Memory) Index(ctx context.Context, doc Document) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.remove(doc.ID)
+	m.docs[doc.ID] = doc
+
+	add := func(text string, weight int) {
+		for _, token := range Tokenize(text) {
+			if m.postings[token] == nil {
+				m.postings[token] = map[uint]int{}
+			}
+			m.postings[token][doc.ID] += weight
+		}
+	}
+	add(doc.Name, nameWeight)
+	for _, subs := range [][]SubDocument{doc.Capabilities, doc.Disabilities, doc.Usages} {
+		for _, sub := range subs {
+			add(sub.Name, 1)
+			add(sub.Description, 1)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Remove(ctx context.Context, id uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(id)
+	return nil
+}
+
+func (m *Memory) remove(id uint) {
+	if _, ok := m.docs[id]; !ok {
+		return
+	}
+	delete(m.docs, id)
+	for token, docs := range m.postings {
+		delete(docs, id)
+		if len(docs) == 0 {
+			delete(m.postings, token)
+		}
+	}
+}
+
+func (m *Memory) Search(ctx context.Context, query Query) (Result, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	tokens := Tokenize(query.Text)
+	if matchesNothing(query.Text, tokens) {
+		return emptyResult(), nil
+	}
+	scores := m.match(tokens)
+
+	result := Result{Facets: map[string][]FacetCount{}}
+	facetCounts := map[string]map[string]int{FacetDifficulty: {}, FacetLicense: {}, FacetStage: {}, FacetCapability: {}, FacetDisability: {}}
+	var matches []uint
+	for id := range scores {
+		doc := m.docs[id]
+		failed := failedFilters(doc, query)
+		if len(failed) == 0 {
+			matches = append(matches, id)
+		}
+		// A document counts towards a facet when it passes every other filter.
+		count := func(facet string, value string) {
+			if len(failed) == 0 || (len(failed) == 1 && failed[0] == facet) {
+				facetCounts[facet][value]++
+			}
+		}
+		count(FacetDifficulty, doc.Difficulty)
+		count(FacetLicense, doc.License)
+		count(FacetStage, doc.Stage)
+		for facet, subs := range map[string][]SubDocument{FacetCapability: doc.Capabilities, FacetDisability: doc.Disabilities} {
+			seen := map[string]bool{}
+			for _, sub := range subs {
+				if !seen[sub.Name] {
+					seen[sub.Name] = true
+					count(facet, sub.Name)
+				}
+			}
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if scores[matches[i]] != scores[matches[j]] {
+			return scores[matches[i]] > scores[matches[j]]
+		}
+		return matches[i] > matches[j] // Newest first.
+	})
+	result.Total = len(matches)
+	result.IDs = page(matches, query.Offset, query.Limit)
+
+	for facet, counts := range facetCounts {
+		result.Facets[facet] = sortFacet(counts, facet == FacetCapability || facet == FacetDisability)
+	}
+	return result, nil
+}
+
+// Score every document that contains all tokens. No tokens matches every document with a score of zero.
+func (m *Memory) match(tokens []string) map[uint]int {
+	scores := map[uint]int{}
+	if len(tokens) == 0 {
+		for id := range m.docs {
+			scores[id] = 0
+		}
+		return scores
+	}
+
+	for i, token := range tokens {
+		tokenScores := map[uint]int{}
+		for indexed, docs := range m.postings {
+			if !strings.HasPrefix(indexed, token) {
+				continue
+			}
+			for id, weight := range docs {
+				tokenScores[id] += weight
+			}
+		}
+
+		if i == 0 {
+			scores = tokenScores
+			continue
+		}
+		for id := range scores {
+			if weight, ok := tokenScores[id]; ok {
+				scores[id] += weight
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+	return scores
+}
+
+// The names of the filters a document does not pass.
+func failedFilters(doc Document, query Query) []string {
+	var failed []string
+	if len(query.Difficulty) > 0 && !containsFold(query.Difficulty, doc.Difficulty) {
+		failed = append(failed, FacetDifficulty)
+	}
+	if len(query.License) > 0 && !containsFold(query.License, doc.License) {
+		failed = append(failed, FacetLicense)
+	}
+	if len(query.Stage) > 0 && !containsFold(query.Stage, doc.Stage) {
+		failed = append(failed, FacetStage)
+	}
+	if len(query.Capabilities) > 0 && !anyNamed(doc.Capabilities, query.Capabilities) {
+		failed = append(failed, FacetCapability)
+	}
+	if len(query.Disabilities) > 0 && !anyNamed(doc.Disabilities, query.Disabilities) {
+		failed = append(failed, FacetDisability)
+	}
+	return failed
+}
+
+func anyNamed(subs []SubDocument, names []string) bool {
+	for _, sub := range subs {
+		if containsFold(names, sub.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func page(ids []uint, offset int, limit int) []uint {
+	if offset >= len(ids) {
+		return []uint{}
+	}
+	ids = ids[offset:]
+	if limit > 0 && limit < len(ids) {
+		ids = ids[:limit]
+	}
+	return ids
+}
+
+// Most common first. Capped facets keep only the most common values.
+func sortFacet(counts map[string]int, capped bool) []FacetCount {
+	facet := make([]FacetCount, 0, len(counts))
+	for value, count := range counts {
+		if value != "" {
+			facet = append(facet, FacetCount{Value: value, Count: count})
+		}
+	}
+	sort.Slice(facet, func(i, j int) bool {
+		if facet[i].Count != facet[j].Count {
+			return facet[i].Count > facet[j].Count
+		}
+		return facet[i].Value < facet[j].Value
+	})
+	if capped && len(facet) > MaxFacetValues {
+		facet = facet[:MaxFacetValues]
+	}
+	return facet
+}
@@ -0,0 +1,166 @@
+package search
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func testIndex(t *testing.T) *Memory {
+	t.Helper()
+	m := NewMemory()
+	docs := []Document{
+		{ID: 1, Name: "Switch mount", Difficulty: "easy", License: "MIT", Stage: "public",
+			Capabilities: []SubDocument{{Name: "Grip"}}, Disabilities: []SubDocument{{Name: "Low vision"}}},
+		{ID: 2, Name: "3D printed switch", Difficulty: "easy", License: "CC-BY", Stage: "public",
+			Capabilities: []SubDocument{{Name: "Grip"}, {Name: "Reach"}}},
+		{ID: 3, Name: "Joystick switch", Difficulty: "hard", License: "MIT", Stage: "public",
+			Capabilities: []SubDocument{{Name: "Reach"}}, Disabilities: []SubDocument{{Name: "Low vision"}}},
+		{ID: 4, Name: "Page turner", Difficulty: "hard", License: "MIT", Stage: "draft",
+			Usages: []SubDocument{{Name: "Reading", Description: "Turns pages of a book"}}},
+	}
+	for _, doc := range docs {
+		if err := m.Index(context.Background(), doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+func search(t *testing.T, m *Memory, query Query) Result {
+	t.Helper()
+	result, err := m.Search(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func facet(result Result, name string) map[string]int {
+	counts := map[string]int{}
+	for _, count := range result.Facets[name] {
+		counts[count.Value] = count.Count
+	}
+	return counts
+}
+
+func TestMemoryText(t *testing.T) {
+	m := testIndex(t)
+	for _, tc := range []struct {
+		text string
+		ids  []uint
+	}{
+		{"", []uint{4, 3, 2, 1}},
+		{"switch", []uint{3, 2, 1}},
+		{"swi", []uint{3, 2, 1}},
+		{"SWITCH joy", []uint{3}},
+		{"3d", []uint{2}},
+		{"3d switch", []uint{2}},
+		{"book", []uint{4}},
+		{"switch book", []uint{}},
+		{"x", []uint{}},
+		{"a b c", []uint{}},
+		{"!!", []uint{}},
+	} {
+		result := search(t, m, Query{Text: tc.text})
+		if !reflect.DeepEqual(result.IDs, tc.ids) || result.Total != len(tc.ids) {
+			t.Errorf("%q: ids = %v (total %d), want %v", tc.text, result.IDs, result.Total, tc.ids)
+		}
+	}
+}
+
+func TestMemoryNameRanksFirst(t *testing.T) {
+	m := NewMemory()
+	m.Index(context.Background(), Document{ID: 1, Name: "Switch"})
+	m.Index(context.Background(), Document{ID: 2, Name: "Mount", Usages: []SubDocument{{Name: "Switch"}}})
+
+	if ids := search(t, m, Query{Text: "switch"}).IDs; !reflect.DeepEqual(ids, []uint{1, 2}) {
+		t.Errorf("ids = %v, want the name match first", ids)
+	}
+}
+
+func TestMemoryNothingMatchedHasEveryFacet(t *testing.T) {
+	result := search(t, testIndex(t), Query{Text: "x"})
+	for _, name := range []string{FacetDifficulty, FacetLicense, FacetStage, FacetCapability, FacetDisability} {
+		if counts, ok := result.Facets[name]; !ok || counts == nil || len(counts) != 0 {
+			t.Errorf("facet %s = %v, want empty", name, counts)
+		}
+	}
+}
+
+// Each facet is counted with every filter except its own.
+func TestMemoryFacetsIgnoreOwnFilter(t *testing.T) {
+	m := testIndex(t)
+
+	result := search(t, m, Query{Difficulty: []string{"easy"}, License: []string{"MIT"}})
+	if !reflect.DeepEqual(result.IDs, []uint{1}) {
+		t.Fatalf("ids = %v, want [1]", result.IDs)
+	}
+	// Difficulty counts only apply the license filter: 1, 3 and 4 are MIT.
+	if got, want := facet(result, FacetDifficulty), map[string]int{"easy": 1, "hard": 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("difficulty = %v, want %v", got, want)
+	}
+	// License counts only apply the difficulty filter: 1 and 2 are easy.
+	if got, want := facet(result, FacetLicense), map[string]int{"MIT": 1, "CC-BY": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("license = %v, want %v", got, want)
+	}
+	// Other facets apply both filters.
+	if got, want := facet(result, FacetCapability), map[string]int{"Grip": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("capability = %v, want %v", got, want)
+	}
+	if got, want := facet(result, FacetStage), map[string]int{"public": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stage = %v, want %v", got, want)
+	}
+}
+
+func TestMemoryFacetsWithTextAndSubFilters(t *testing.T) {
+	m := testIndex(t)
+
+	result := search(t, m, Query{Text: "switch", Capabilities: []string{"reach"}})
+	if !reflect.DeepEqual(result.IDs, []uint{3, 2}) {
+		t.Fatalf("ids = %v, want [3 2]", result.IDs)
+	}
+	// The capability facet ignores its own filter but keeps the text, so the page turner is not counted.
+	if got, want := facet(result, FacetCapability), map[string]int{"Grip": 2, "Reach": 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("capability = %v, want %v", got, want)
+	}
+	if got, want := facet(result, FacetDisability), map[string]int{"Low vision": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("disability = %v, want %v", got, want)
+	}
+	if got, want := facet(result, FacetDifficulty), map[string]int{"easy": 1, "hard": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("difficulty = %v, want %v", got, want)
+	}
+
+	// A second filter on another facet narrows the capability counts but not its own.
+	result = search(t, m, Query{Text: "switch", Capabilities: []string{"Reach"}, Disabilities: []string{"Low vision"}})
+	if !reflect.DeepEqual(result.IDs, []uint{3}) {
+		t.Fatalf("ids = %v, want [3]", result.IDs)
+	}
+	if got, want := facet(result, FacetCapability), map[string]int{"Grip": 1, "Reach": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("capability = %v, want %v", got, want)
+	}
+	if got, want := facet(result, FacetDisability), map[string]int{"Low vision": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("disability = %v, want %v", got, want)
+	}
+}
+
+func TestMemoryPaging(t *testing.T) {
+	m := testIndex(t)
+	result := search(t, m, Query{Offset: 1, Limit: 2})
+	if !reflect.DeepEqual(result.IDs, []uint{3, 2}) || result.Total != 4 {
+		t.Errorf("ids = %v (total %d), want [3 2] of 4", result.IDs, result.Total)
+	}
+	if ids := search(t, m, Query{Offset: 10}).IDs; len(ids) != 0 || ids == nil {
+		t.Errorf("past the end = %v, want []", ids)
+	}
+}
+
+func TestMySQLShortWords(t *testing.T) {
+	tokens := Tokenize("3D-printed a switch")
+	if got := booleanExpression(tokens); got != "+printed* +switch*" {
+		t.Errorf("booleanExpression = %q", got)
+	}
+	if got := indexedWords("3D switch", []string{"Grip", "Holds a pen"}); got != " 3d switch grip holds pen" {
+		t.Errorf("indexedWords = %q", got)
+	}
+}
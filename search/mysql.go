@@ -0,0 +1,251 @@
+package search
+
+import (
+	"context"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MySQL keeps one row per device in a table with a FULLTEXT index and answers queries in boolean mode.
+type MySQL struct {
+	db *gorm.DB
+}
+
+type mysqlDocument struct {
+	DeviceID uint   `gorm:"primaryKey;autoIncrement:false"`
+	Name     string `gorm:"type:varchar(255);index:idx_device_search_text,class:FULLTEXT"`
+	Content  string `gorm:"type:mediumtext;index:idx_device_search_text,class:FULLTEXT"` // Capabilities, disabilities and usages.
+	// Every token of the name and content, each preceded by a space, for words too short for the FULLTEXT index.
+	// Rows indexed before this column existed need SEARCH_REINDEX.
+	Words      string `gorm:"type:mediumtext"`
+	Difficulty string `gorm:"type:varchar(64);index"`
+	License    string `gorm:"type:varchar(128);index"`
+	Stage      string `gorm:"type:varchar(16);index"`
+}
+
+func (mysqlDocument) TableName() string { return "device_search_documents" }
+
+type mysqlCapability struct {
+	DeviceID uint   `gorm:"primaryKey;autoIncrement:false"`
+	Name     string `gorm:"primaryKey;type:varchar(191);index"`
+}
+
+func (mysqlCapability) TableName() string { return "device_search_capabilities" }
+
+type mysqlDisability struct {
+	DeviceID uint   `gorm:"primaryKey;autoIncrement:false"`
+	Name     string `gorm:"primaryKey;type:varchar(191);index"`
+}
+
+func (mysqlDisability) TableName() string { return "device_search_disabilities" }
+
+// InnoDB ignores words shorter than innodb_ft_min_token_size, which defaults to 3.
+const mysqlMinToken = 3
+
+func NewMySQL(db *gorm.DB) *MySQL {
+	return &MySQL{db: db}
+}
+
+// Migrate creates the search tables and the FULLTEXT index.
+func (m *MySQL) Migrate() error {
+	return m.db.AutoMigrate(&mysqlDocument{}, &mysqlCapability{}, &mysqlDisability{})
+}
+
+func (m *MySQL) Index(ctx context.Context, doc Document) error {
+	var content []string
+	for _, subs := range [][]SubDocument{doc.Capabilities, doc.Disabilities, doc.Usages} {
+		for _, sub := range subs {
+			content = append(content, sub.Name, sub.Description)
+		}
+	}
+	row := mysqlDocument{
+		DeviceID:   doc.ID,
+		Name:       doc.Name,
+		Content:    strings.Join(content, "\n"),
+		Words:      indexedWords(doc.Name, content),
+		Difficulty: doc.Difficulty,
+		License:    doc.License,
+		Stage:      doc.Stage,
+	}
+
+	return m.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&row).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("device_id = ?", doc.ID).Delete(&mysqlCapability{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("device_id = ?", doc.ID).Delete(&mysqlDisability{}).Error; err != nil {
+			return err
+		}
+
+		var capabilities []mysqlCapability
+		for _, name := range distinctNames(doc.Capabilities) {
+			capabilities = append(capabilities, mysqlCapability{DeviceID: doc.ID, Name: name})
+		}
+		if len(capabilities) > 0 {
+			if err := tx.Create(&capabilities).Error; err != nil {
+				return err
+			}
+		}
+		var disabilities []mysqlDisability
+		for _, name := range distinctNames(doc.Disabilities) {
+			disabilities = append(disabilities, mysqlDisability{DeviceID: doc.ID, Name: name})
+		}
+		if len(disabilities) == 0 {
+			return nil
+		}
+		return tx.Create(&disabilities).Error
+	})
+}
+
+// Non-empty names, keeping the first spelling of names that only differ in case.
+func distinctNames(subs []SubDocument) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, sub := range subs {
+		key := strings.ToLower(sub.Name)
+		if sub.Name == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		names = append(names, sub.Name)
+	}
+	return names
+}
+
+func (m *MySQL) Remove(ctx context.Context, id uint) error {
+	return m.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("device_id = ?", id).Delete(&mysqlCapability{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("device_id = ?", id).Delete(&mysqlDisability{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("device_id = ?", id).Delete(&mysqlDocument{}).Error
+	})
+}
+
+func (m *MySQL) Search(ctx context.Context, query Query) (Result, error) {
+	db := m.db.WithContext(ctx)
+	tokens := Tokenize(query.Text)
+	if matchesNothing(query.Text, tokens) {
+		return emptyResult(), nil
+	}
+	expression := booleanExpression(tokens)
+
+	result := Result{Facets: map[string][]FacetCount{}}
+	var total int64
+	if err := m.filtered(db, query, tokens, "").Count(&total).Error; err != nil {
+		return result, err
+	}
+	result.Total = int(total)
+
+	ids := m.filtered(db, query, tokens, "").Select("d.device_id")
+	if expression != "" {
+		ids = ids.Clauses(clause.OrderBy{Expression: clause.Expr{
+			SQL:  "MATCH(d.name, d.content) AGAINST (? IN BOOLEAN MODE) DESC, d.device_id DESC",
+			Vars: []interface{}{expression},
+		}})
+	} else {
+		ids = ids.Order("d.device_id DESC")
+	}
+	if query.Limit > 0 {
+		ids = ids.Limit(query.Limit)
+	}
+	if err := ids.Offset(query.Offset).Pluck("d.device_id", &result.IDs).Error; err != nil {
+		return result, err
+	}
+	if result.IDs == nil {
+		result.IDs = []uint{}
+	}
+
+	for facet, column := range map[string]string{FacetDifficulty: "d.difficulty", FacetLicense: "d.license", FacetStage: "d.stage"} {
+		var counts []FacetCount
+		err := m.filtered(db, query, tokens, facet).
+			Select(column + " AS value, COUNT(*) AS count").Where(column + " <> ''").
+			Group(column).Order("count DESC, value").Scan(&counts).Error
+		if err != nil {
+			return result, err
+		}
+		result.Facets[facet] = nonNil(counts)
+	}
+
+	for facet, table := range map[string]string{FacetCapability: "device_search_capabilities", FacetDisability: "device_search_disabilities"} {
+		var counts []FacetCount
+		err := m.filtered(db, query, tokens, facet).
+			Joins("JOIN " + table + " n ON n.device_id = d.device_id").
+			Select("n.name AS value, COUNT(*) AS count").
+			Group("n.name").Order("count DESC, value").Limit(MaxFacetValues).Scan(&counts).Error
+		if err != nil {
+			return result, err
+		}
+		result.Facets[facet] = nonNil(counts)
+	}
+
+	return result, nil
+}
+
+// Build the matching rows with every filter except skip applied.
+func (m *MySQL) filtered(db *gorm.DB, query Query, tokens []string, skip string) *gorm.DB {
+	tx := db.Table("device_search_documents AS d")
+	if expression := booleanExpression(tokens); expression != "" {
+		tx = tx.Where("MATCH(d.name, d.content) AGAINST (? IN BOOLEAN MODE)", expression)
+	}
+	// Tokens only hold letters and digits, so they never contain LIKE wildcards.
+	for _, token := range tokens {
+		if len([]rune(token)) < mysqlMinToken {
+			tx = tx.Where("d.words LIKE ?", "% "+token+"%")
+		}
+	}
+	if len(query.Difficulty) > 0 && skip != FacetDifficulty {
+		tx = tx.Where("d.difficulty IN ?", query.Difficulty)
+	}
+	if len(query.License) > 0 && skip != FacetLicense {
+		tx = tx.Where("d.license IN ?", query.License)
+	}
+	if len(query.Stage) > 0 && skip != FacetStage {
+		tx = tx.Where("d.stage IN ?", query.Stage)
+	}
+	if len(query.Capabilities) > 0 && skip != FacetCapability {
+		tx = tx.Where("d.device_id IN (SELECT device_id FROM device_search_capabilities WHERE name IN ?)", query.Capabilities)
+	}
+	if len(query.Disabilities) > 0 && skip != FacetDisability {
+		tx = tx.Where("d.device_id IN (SELECT device_id FROM device_search_disabilities WHERE name IN ?)", query.Disabilities)
+	}
+	return tx
+}
+
+// Require every word as a prefix. Tokenize leaves only letters and digits, so no boolean operators get through.
+//
+// Words shorter than mysqlMinToken are left out and matched against d.words instead.
+func booleanExpression(tokens []string) string {
+	var terms []string
+	for _, token := range tokens {
+		if len([]rune(token)) >= mysqlMinToken {
+			terms = append(terms, "+"+token+"*")
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// The tokens of the name and content, each preceded by a space so "% word%" matches word prefixes only.
+func indexedWords(name string, content []string) string {
+	var words strings.Builder
+	for _, text := range append([]string{name}, content...) {
+		for _, token := range Tokenize(text) {
+			words.WriteString(" ")
+			words.WriteString(token)
+		}
+	}
+	return words.String()
+}
+
+func nonNil(counts []FacetCount) []FacetCount {
+	if counts == nil {
+		return []FacetCount{}
+	}
+	return counts
+}
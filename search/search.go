@@ -0,0 +1,114 @@
+// Package search finds devices by text and counts facets over the results.
+package search
+
+import (
+	"context"
+	"strings"
+	"unicode"
+)
+
+// Facet names, used as keys in Result.Facets.
+const (
+	FacetDifficulty = "difficulty"
+	FacetLicense    = "license"
+	FacetStage      = "stage"
+	FacetCapability = "capability"
+	FacetDisability = "disability"
+)
+
+// Document is the searchable form of a device.
+type Document struct {
+	ID           uint
+	Name         string
+	Difficulty   string
+	License      string
+	Stage        string
+	Capabilities []SubDocument
+	Disabilities []SubDocument
+	Usages       []SubDocument
+}
+
+// SubDocument is a capability, disability or usage. Names are matched and faceted, descriptions are only matched.
+type SubDocument struct {
+	Name        string
+	Description string
+}
+
+// Query selects documents. Every word in Text must match, as a prefix, somewhere in the document. Text without any
+// words, such as a lone letter, matches nothing. Empty text matches every document.
+//
+// Values within one filter are alternatives, different filters must all match.
+type Query struct {
+	Text         string
+	Difficulty   []string
+	License      []string
+	Stage        []string
+	Capabilities []string
+	Disabilities []string
+	Offset       int
+	Limit        int
+}
+
+// Result holds one page of matching IDs, best match first, and facet counts over all matches.
+//
+// Each facet is counted with every filter applied except its own, so the counts show what picking another value would give.
+type Result struct {
+	IDs    []uint
+	Total  int
+	Facets map[string][]FacetCount
+}
+
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// An Index stores documents and answers queries.
+type Index interface {
+	Index(ctx context.Context, doc Document) error
+	Remove(ctx context.Context, id uint) error
+	Search(ctx context.Context, query Query) (Result, error)
+}
+
+// Default is the index used by the device controllers. Swap it out at startup.
+var Default Index = NewMemory()
+
+// MaxFacetValues caps how many capability and disability names are counted.
+const MaxFacetValues = 50
+
+// Tokenize lowercases text and splits it into words of letters and digits. Single characters are dropped.
+func Tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	tokens := words[:0]
+	for _, word := range words {
+		if len([]rune(word)) > 1 {
+			tokens = append(tokens, word)
+		}
+	}
+	return tokens
+}
+
+// Whether the query text was given but has no words to match, which would otherwise match every document.
+func matchesNothing(text string, tokens []string) bool {
+	return len(tokens) == 0 && strings.TrimSpace(text) != ""
+}
+
+// A result without matches, with every facet present.
+func emptyResult() Result {
+	result := Result{IDs: []uint{}, Facets: map[string][]FacetCount{}}
+	for _, facet := range []string{FacetDifficulty, FacetLicense, FacetStage, FacetCapability, FacetDisability} {
+		result.Facets[facet] = []FacetCount{}
+	}
+	return result
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,249 @@
+// Package sso lets users sign in through an external identity provider.
+package sso
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+var ErrNoEmail = errors.New("assertion does not contain an email address")
+
+// SAMLConfig describes this service provider and the identity provider it trusts.
+type SAMLConfig struct {
+	RootURL           string // e.g. https://api.example.com. Metadata and ACS endpoints hang off this.
+	EntityID          string // Defaults to the metadata URL.
+	Key               *rsa.PrivateKey
+	Certificate       *x509.Certificate
+	IDPMetadata       *saml.EntityDescriptor
+	AllowIDPInitiated bool
+
+	// SAML attribute names to look in for each field, in order. Defaults cover common IdPs.
+	EmailAttributes        []string
+	FirstNameAttributes    []string
+	LastNameAttributes     []string
+	OrganizationAttributes []string
+}
+
+// Identity is what we learned about the user from a validated assertion.
+type Identity struct {
+	AssertionID  string
+	InResponseTo string
+	NotOnOrAfter time.Time
+	NameID       string
+	Email        string
+	FirstName    string
+	LastName     string
+	Organization string
+}
+
+// SAML is a service provider that signs its AuthnRequests and validates assertions.
+type SAML struct {
+	config SAMLConfig
+	sp     *saml.ServiceProvider
+}
+
+// Default is nil unless SAML has been configured.
+var Default *SAML
+
+func NewSAML(config SAMLConfig) (*SAML, error) {
+	root, err := url.Parse(strings.TrimSuffix(config.RootURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	metadataURL := *root
+	metadataURL.Path += "/saml/metadata"
+	acsURL := *root
+	acsURL.Path += "/saml/acs"
+
+	if len(config.EmailAttributes) == 0 {
+		config.EmailAttributes = []string{"email", "mail", "urn:oid:0.9.2342.19200300.100.1.3", "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress"}
+	}
+	if len(config.FirstNameAttributes) == 0 {
+		config.FirstNameAttributes = []string{"firstName", "givenName", "urn:oid:2.5.4.42", "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/givenname"}
+	}
+	if len(config.LastNameAttributes) == 0 {
+		config.LastNameAttributes = []string{"lastName", "sn", "surname", "urn:oid:2.5.4.4", "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/surname"}
+	}
+	if len(config.OrganizationAttributes) == 0 {
+		config.OrganizationAttributes = []string{"organization", "o", "urn:oid:2.5.4.10"}
+	}
+
+	sp := &saml.ServiceProvider{
+		EntityID:          config.EntityID,
+		Key:               config.Key,
+		Certificate:       config.Certificate,
+		MetadataURL:       metadataURL,
+		AcsURL:            acsURL,
+		IDPMetadata:       config.IDPMetadata,
+		AuthnNameIDFormat: saml.EmailAddressNameIDFormat,
+		SignatureMethod:   dsig.RSASHA256SignatureMethod,
+		// InResponseTo is checked by the caller against the requests we sent, so IdP-initiated logins can be turned off separately.
+		AllowIDPInitiated: true,
+	}
+
+	return &SAML{config: config, sp: sp}, nil
+}
+
+// Metadata returns this service provider's metadata document.
+func (s *SAML) Metadata() ([]byte, error) {
+	return xml.MarshalIndent(s.sp.Metadata(), "", "  ")
+}
+
+func (s *SAML) AllowIDPInitiated() bool {
+	return s.config.AllowIDPInitiated
+}
+
+// AuthnRequestURL builds a signed AuthnRequest using the HTTP-Redirect binding.
+//
+// Returns the URL to send the browser to and the request ID to expect back in InResponseTo.
+// relayState must already be URL safe.
+func (s *SAML) AuthnRequestURL(relayState string) (string, string, error) {
+	req, err := s.sp.MakeAuthenticationRequest(s.sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return "", "", err
+	}
+
+	redirect, err := req.Redirect(relayState, s.sp)
+	if err != nil {
+		return "", "", err
+	}
+	return redirect.String(), req.ID, nil
+}
+
+// ParseResponse validates a base64 encoded SAMLResponse (HTTP-POST binding).
+//
+// Checks the signature, issuer, audience, recipient and NotBefore/NotOnOrAfter. Replay and InResponseTo checks are left to the caller.
+func (s *SAML) ParseResponse(encodedResponse string) (*Identity, error) {
+	raw, err := base64.StdEncoding.DecodeString(encodedResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	assertion, err := s.sp.ParseXMLResponse(raw, nil)
+	if err != nil {
+		var invalid *saml.InvalidResponseError
+		if errors.As(err, &invalid) {
+			return nil, fmt.Errorf("invalid SAML response: %w", invalid.PrivateErr)
+		}
+		return nil, err
+	}
+
+	identity := &Identity{
+		AssertionID:  assertion.ID,
+		NotOnOrAfter: assertion.Conditions.NotOnOrAfter,
+	}
+	if assertion.Subject != nil {
+		if assertion.Subject.NameID != nil {
+			identity.NameID = assertion.Subject.NameID.Value
+		}
+		for _, confirmation := range assertion.Subject.SubjectConfirmations {
+			if confirmation.SubjectConfirmationData != nil && confirmation.SubjectConfirmationData.InResponseTo != "" {
+				identity.InResponseTo = confirmation.SubjectConfirmationData.InResponseTo
+			}
+		}
+	}
+
+	attributes := map[string]string{}
+	for _, statement := range assertion.AttributeStatements {
+		for _, attr := range statement.Attributes {
+			if len(attr.Values) == 0 {
+				continue
+			}
+			attributes[attr.Name] = attr.Values[0].Value
+			if attr.FriendlyName != "" {
+				attributes[attr.FriendlyName] = attr.Values[0].Value
+			}
+		}
+	}
+
+	identity.Email = firstAttribute(attributes, s.config.EmailAttributes)
+	if identity.Email == "" && strings.Contains(identity.NameID, "@") {
+		identity.Email = identity.NameID
+	}
+	identity.Email = strings.ToLower(strings.TrimSpace(identity.Email))
+	if identity.Email == "" {
+		return nil, ErrNoEmail
+	}
+
+	identity.FirstName = firstAttribute(attributes, s.config.FirstNameAttributes)
+	identity.LastName = firstAttribute(attributes, s.config.LastNameAttributes)
+	identity.Organization = firstAttribute(attributes, s.config.OrganizationAttributes)
+
+	return identity, nil
+}
+
+// SAMLConfigFromEnv reads the SAML_* environment variables.
+//
+// SAML_IDP_METADATA may be a file path or an http(s) URL.
+func SAMLConfigFromEnv() (SAMLConfig, error) {
+	config := SAMLConfig{
+		RootURL:           os.Getenv("API_URL"),
+		EntityID:          os.Getenv("SAML_ENTITY_ID"),
+		AllowIDPInitiated: os.Getenv("SAML_ALLOW_IDP_INITIATED") == "true",
+	}
+
+	keyPair, err := tls.LoadX509KeyPair(os.Getenv("SAML_SP_CERT_FILE"), os.Getenv("SAML_SP_KEY_FILE"))
+	if err != nil {
+		return config, fmt.Errorf("loading SP key pair: %w", err)
+	}
+	key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return config, errors.New("SP key must be an RSA key")
+	}
+	config.Key = key
+	if config.Certificate, err = x509.ParseCertificate(keyPair.Certificate[0]); err != nil {
+		return config, err
+	}
+
+	metadata, err := readMetadata(os.Getenv("SAML_IDP_METADATA"))
+	if err != nil {
+		return config, fmt.Errorf("loading IdP metadata: %w", err)
+	}
+	config.IDPMetadata = &saml.EntityDescriptor{}
+	if err := xml.Unmarshal(metadata, config.IDPMetadata); err != nil {
+		return config, fmt.Errorf("parsing IdP metadata: %w", err)
+	}
+
+	return config, nil
+}
+
+func readMetadata(location string) ([]byte, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		return os.ReadFile(location)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s returned %d", location, res.StatusCode)
+	}
+	return io.ReadAll(res.Body)
+}
+
+func firstAttribute(attributes map[string]string, names []string) string {
+	for _, name := range names {
+		if v := strings.TrimSpace(attributes[name]); v != "" {
+			return v
+		}
+	}
+	return ""
+}
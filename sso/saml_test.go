@@ -0,0 +1,90 @@
+package sso
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"regexp"
+	"testing"
+
+	"github.com/Elimists/go-app/sso/samltest"
+	"github.com/crewjam/saml"
+)
+
+func newTestSAML(t *testing.T, idp *samltest.IdP) (*SAML, *saml.EntityDescriptor) {
+	t.Helper()
+	key, cert := samltest.NewKeyPair(t, "api.example.org")
+	s, err := NewSAML(SAMLConfig{
+		RootURL:     "https://api.example.org",
+		Key:         key,
+		Certificate: cert,
+		IDPMetadata: idp.Metadata(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := s.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata saml.EntityDescriptor
+	if err := xml.Unmarshal(raw, &metadata); err != nil {
+		t.Fatal(err)
+	}
+	return s, &metadata
+}
+
+func TestParseResponse(t *testing.T) {
+	idp := samltest.NewIdP(t)
+	s, metadata := newTestSAML(t, idp)
+
+	identity, err := s.ParseResponse(idp.Response(t, metadata, samltest.Login{
+		InResponseTo: "id-request",
+		Email:        "Ada@Example.org",
+		FirstName:    "Ada",
+		LastName:     "Lovelace",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if identity.Email != "ada@example.org" || identity.FirstName != "Ada" || identity.LastName != "Lovelace" {
+		t.Errorf("identity = %+v", identity)
+	}
+	if identity.InResponseTo != "id-request" {
+		t.Errorf("InResponseTo = %q, want id-request", identity.InResponseTo)
+	}
+	if identity.AssertionID == "" || identity.NotOnOrAfter.IsZero() {
+		t.Errorf("assertion ID and expiry must be set: %+v", identity)
+	}
+}
+
+func TestParseResponseBadSignature(t *testing.T) {
+	idp := samltest.NewIdP(t)
+	s, metadata := newTestSAML(t, idp)
+
+	// Same entity ID, different key.
+	impostor := samltest.NewIdP(t)
+	if _, err := s.ParseResponse(impostor.Response(t, metadata, samltest.Login{Email: "ada@example.org"})); err == nil {
+		t.Error("response signed by an untrusted key was accepted")
+	}
+
+	raw := idp.ResponseXML(t, metadata, samltest.Login{Email: "ada@example.org"})
+	value := regexp.MustCompile(`<ds:SignatureValue>([A-Za-z0-9+/])`).FindSubmatchIndex(raw)
+	if value == nil {
+		t.Fatal("response is not signed")
+	}
+	tampered := append([]byte(nil), raw...)
+	if tampered[value[2]] == 'A' {
+		tampered[value[2]] = 'B'
+	} else {
+		tampered[value[2]] = 'A'
+	}
+	if _, err := s.ParseResponse(base64.StdEncoding.EncodeToString(tampered)); err == nil {
+		t.Error("response with a tampered signature was accepted")
+	}
+
+	if _, err := s.ParseResponse("not base64!"); err == nil {
+		t.Error("garbage was accepted")
+	}
+}
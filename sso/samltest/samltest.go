@@ -0,0 +1,133 @@
+// Package samltest provides a throwaway identity provider for testing SAML service providers.
+package samltest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// IdP signs assertions with a key pair generated for the test.
+type IdP struct {
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+	idp         *saml.IdentityProvider
+}
+
+// Login describes the user an assertion is about.
+type Login struct {
+	InResponseTo string // Empty for an IdP-initiated login.
+	Email        string
+	FirstName    string
+	LastName     string
+}
+
+// NewIdP creates an identity provider with the entity ID https://idp.example.org/metadata.
+func NewIdP(t *testing.T) *IdP {
+	t.Helper()
+	key, cert := NewKeyPair(t, "idp.example.org")
+
+	metadataURL, _ := url.Parse("https://idp.example.org/metadata")
+	ssoURL, _ := url.Parse("https://idp.example.org/sso")
+	return &IdP{
+		Key:         key,
+		Certificate: cert,
+		idp: &saml.IdentityProvider{
+			Key:             key,
+			Certificate:     cert,
+			MetadataURL:     *metadataURL,
+			SSOURL:          *ssoURL,
+			SignatureMethod: dsig.RSASHA256SignatureMethod,
+		},
+	}
+}
+
+// NewKeyPair generates an RSA key and a self-signed certificate for it.
+func NewKeyPair(t *testing.T, commonName string) (*rsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+// Metadata is what the service provider should be configured to trust.
+func (p *IdP) Metadata() *saml.EntityDescriptor {
+	return p.idp.Metadata()
+}
+
+// Response builds a signed, base64 encoded SAMLResponse for the service provider, as posted to its ACS.
+func (p *IdP) Response(t *testing.T, sp *saml.EntityDescriptor, login Login) string {
+	t.Helper()
+	return base64.StdEncoding.EncodeToString(p.ResponseXML(t, sp, login))
+}
+
+// ResponseXML is Response without the encoding, for tests that want to tamper with it.
+func (p *IdP) ResponseXML(t *testing.T, sp *saml.EntityDescriptor, login Login) []byte {
+	t.Helper()
+	if len(sp.SPSSODescriptors) == 0 || len(sp.SPSSODescriptors[0].AssertionConsumerServices) == 0 {
+		t.Fatal("service provider metadata has no assertion consumer service")
+	}
+
+	req := &saml.IdpAuthnRequest{
+		IDP:                     p.idp,
+		HTTPRequest:             &http.Request{RemoteAddr: "203.0.113.7:443"},
+		Request:                 saml.AuthnRequest{ID: login.InResponseTo},
+		ServiceProviderMetadata: sp,
+		SPSSODescriptor:         &sp.SPSSODescriptors[0],
+		ACSEndpoint:             &sp.SPSSODescriptors[0].AssertionConsumerServices[0],
+		Now:                     saml.TimeNow(),
+	}
+	session := &saml.Session{
+		ID:            "session",
+		CreateTime:    req.Now,
+		ExpireTime:    req.Now.Add(time.Hour),
+		NameID:        login.Email,
+		NameIDFormat:  string(saml.EmailAddressNameIDFormat),
+		UserEmail:     login.Email,
+		UserGivenName: login.FirstName,
+		UserSurname:   login.LastName,
+	}
+	if err := (saml.DefaultAssertionMaker{}).MakeAssertion(req, session); err != nil {
+		t.Fatal(err)
+	}
+	if err := req.MakeResponse(); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := etree.NewDocument()
+	doc.SetRoot(req.ResponseEl)
+	raw, err := doc.WriteToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
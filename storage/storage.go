@@ -0,0 +1,61 @@
+// Package storage keeps uploaded files outside the database.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound   = errors.New("object not found")
+	ErrInvalidKey = errors.New("invalid object key")
+	// ErrPresignUnsupported is returned by stores that cannot hand out direct download links.
+	ErrPresignUnsupported = errors.New("store cannot presign URLs")
+)
+
+// Info describes a stored object.
+type Info struct {
+	Size        int64
+	ContentType string
+}
+
+// A Store saves objects under slash separated keys such as "avatars/ab12.../256.jpg".
+type Store interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get returns ErrNotFound when there is no object under key. The caller closes the reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, Info, error)
+	// GetRange reads length bytes starting at offset. Info.Size is the size of the whole object.
+	GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, Info, error)
+	// Delete does not fail when the object is already gone.
+	Delete(ctx context.Context, key string) error
+	// PresignedURL returns a link that lets anyone holding it download the object until it expires.
+	PresignedURL(ctx context.Context, key string, expires time.Duration) (string, error)
+}
+
+// Default is the store used by the controllers. Swap it out at startup.
+var Default Store = NewLocal("./uploads", "", nil)
+
+// Reject keys that could escape the store's root or confuse an object store.
+func validKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") || strings.Contains(key, "//") {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+func contentTypeFor(key string) string {
+	if t := mime.TypeByExtension(path.Ext(key)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}